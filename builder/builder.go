@@ -1,6 +1,7 @@
 package builder
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
@@ -18,8 +19,11 @@ import (
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/gobwas/glob"
 )
@@ -27,22 +31,71 @@ import (
 type DeviceInfo struct {
 	Name string `json:"name"`
 	ID   string `json:"id"`
+	// Tags are free-form key/value labels used to organize devices
+	Tags map[string]string `json:"tags,omitempty"`
 }
 
 type FirmwareLib struct {
+	// Name is the library name set in library.json, or its path
+	Name         string
 	BasePath     string
 	Files        map[string]*FileEntry
 	Modules      []ModuleDef `json:"modules"`
 	Dependencies []*FirmwareLib
+	ModulesOnly  bool
+	// DevicePatterns are the include patterns that reference the device id
+	DevicePatterns []string
+	// DeviceFiles are the files matched by DevicePatterns for any device id
+	DeviceFiles map[string]*FileEntry
+	// IncludePatterns are the include patterns set in library.json, empty
+	// when the library includes everything by default
+	IncludePatterns []string
 }
 
+// DeviceIDPlaceholder is replaced by the id of the device being built in
+// library include patterns, such as "config-${ID}.lua"
+const DeviceIDPlaceholder = "${ID}"
+
 type FileEntry struct {
-	Base         string   `json:"base"`
-	Path         string   `json:"path"`
+	Base string `json:"base"`
+	Path string `json:"path"`
+	// Source is the file location relative to Base when it differs from
+	// Path, as happens in prefixed libraries
+	Source       string   `json:"source,omitempty"`
 	Hash         string   `json:"hash"`
+	Size         int64    `json:"size,omitempty"`
 	Dependencies []string `json:"-"`
-	Datafiles    []string `json:"datafiles,omitempty"`
-	Content      []byte   `json:"-"`
+	// DependencyLines maps each dependency to the line where it is required
+	DependencyLines map[string]int `json:"-"`
+	Datafiles       []string       `json:"datafiles,omitempty"`
+	// DatafileLines maps each datafile to the line where it is declared
+	DatafileLines map[string]int `json:"-"`
+	// Includes are the files loaded with dofile() or loadfile()
+	Includes []string `json:"-"`
+	// IncludeLines maps each included file to the line where it is loaded
+	IncludeLines map[string]int `json:"-"`
+	// OptionalDependencies may be missing without failing the build
+	OptionalDependencies map[string]bool `json:"-"`
+	// Sources lists the paths of the files packed in a generated file, such
+	// as the LFS image
+	Sources []string `json:"sources,omitempty"`
+	Content []byte   `json:"-"`
+}
+
+// SourcePath returns the location of the file on disk
+func (fe *FileEntry) SourcePath() string {
+	if fe.Source != "" {
+		return filepath.Join(fe.Base, fe.Source)
+	}
+	return filepath.Join(fe.Base, fe.Path)
+}
+
+func fileSize(path string) (int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
 }
 
 type LibDef struct {
@@ -51,17 +104,35 @@ type LibDef struct {
 	Exclude      []string    `json:"exclude`
 	Name         string      `json:"name"`
 	Modules      []ModuleDef `json:"modules"`
+	// Version of the library. Changing it discards the cached scans of the
+	// library files, even if they look unchanged on disk.
+	Version string `json:"version"`
+	// ModulesOnly restricts the library to contribute only the Lua files
+	// reachable from the device modules, skipping its other files
+	ModulesOnly bool `json:"modulesOnly"`
+	// Prefix mounts the library files under <prefix>/ and its modules as
+	// <prefix>.<module>, so they don't clash with modules of the same name.
+	// Requires between the library's own modules are resolved within the
+	// prefix.
+	Prefix string `json:"prefix"`
 }
 
 type ModuleDef struct {
 	Name      string          `json:"name"`
 	Autostart bool            `json:"autostart"`
 	Config    json.RawMessage `json:"config,omitempty"`
+	// After lists modules that must start before this one even though it
+	// does not require them
+	After []string `json:"after,omitempty"`
 }
 
 type FirmwareLFSConfig struct {
 	Include []string `json:"include"`
 	Exclude []string `json:"exclude`
+	// Libs packs the Lua files of the named libraries in LFS
+	Libs []string `json:"libs"`
+	// Modules packs the files of the named modules in LFS
+	Modules []string `json:"modules"`
 }
 
 type FirmwareDef struct {
@@ -69,20 +140,278 @@ type FirmwareDef struct {
 	NodeMCUFirmware string            `json:"nodemcu-firmware"`
 	Libs            []string          `json:"libs"`
 	LFS             FirmwareLFSConfig `json:"lfs"`
+	Files           []string          `json:"files"`
+	// FormatCommand is the Lua code that erases the device filesystem
+	FormatCommand string `json:"formatCommand"`
+	// ConfigSetCommand and ConfigGetCommand are the Lua code templates that
+	// write and print a value of the device config store. ${KEY} and ${VALUE}
+	// are replaced by the key and value as Lua string literals.
+	ConfigSetCommand string `json:"configSetCommand"`
+	ConfigGetCommand string `json:"configGetCommand"`
+	// RenameCommand is the Lua code template that changes the identity
+	// stored on the device. ${ID} and ${NAME} are replaced by the new id and
+	// name as Lua string literals. ${NAME} is nil when the name is kept.
+	// espore reads the device id from the id field of config.json, falling
+	// back to the chip id, so the command must store the new id there.
+	RenameCommand string `json:"renameCommand"`
+	// BootLoopPattern is a regular expression matching the line the device
+	// prints on every boot, which /recover watches for to detect a boot loop
+	BootLoopPattern string `json:"bootLoopPattern"`
+	// RecoverCommand is the Lua code /recover sends to break a boot loop,
+	// such as one that stops autostart
+	RecoverCommand string `json:"recoverCommand"`
+	// Modules are started in addition to those declared by the device
+	// library
+	Modules []ModuleDef `json:"modules"`
+	// SearchOrder sets which libraries are searched first when resolving
+	// required modules and files loaded with dofile(). Entries are library
+	// names, or DeviceLibraryName for the device folder. Libraries not
+	// listed are searched afterwards in the default order, dependencies
+	// before the libraries depending on them. The first library containing
+	// a module shadows it in all the others: its version is shipped and its
+	// requires are followed. Listing the device first lets it override any
+	// library module. Other files are not affected by the order.
+	SearchOrder []string `json:"searchOrder"`
+	// Variants are alternative builds of the device, such as for A/B
+	// testing, mapping each variant name to the modules it starts on top of
+	// Modules. Each variant is written as <id>-<variant>.img and .json, with
+	// its name in FirmwareManifest.Variant.
+	Variants map[string][]ModuleDef `json:"variants"`
+}
+
+// deviceVariant is an alternative build of a device
+type deviceVariant struct {
+	name  string
+	fwDef FirmwareDef
+}
+
+// deviceVariants returns the variants of a device, sorted by variant name
+func deviceVariants(fwDef FirmwareDef) ([]deviceVariant, error) {
+	names := make([]string, 0, len(fwDef.Variants))
+	for name := range fwDef.Variants {
+		if name == "" || strings.ContainsAny(name, `/\`) {
+			return nil, fmt.Errorf("Invalid variant name %q in device %s", name, fwDef.Name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	variants := make([]deviceVariant, len(names))
+	for i, name := range names {
+		variant := fwDef
+		variant.Modules = append(append([]ModuleDef(nil), fwDef.Modules...), fwDef.Variants[name]...)
+		variant.Variants = nil
+		variants[i] = deviceVariant{name: name, fwDef: variant}
+	}
+	return variants, nil
+}
+
+// artifactName returns the base name of the files written for a manifest, the
+// device id followed by the variant name for device variants
+func artifactName(manifest *FirmwareManifest) string {
+	if manifest.Variant != "" {
+		return manifest.ID + "-" + manifest.Variant
+	}
+	return manifest.ID
+}
+
+// DeviceLibraryName refers to the device folder in FirmwareDef.SearchOrder
+const DeviceLibraryName = "@device"
+
+// DefaultFormatCommand erases the filesystem of NodeMCU devices
+const DefaultFormatCommand = "file.format()"
+
+// GetFormatCommand returns the configured format command or the default one
+func (fd *FirmwareDef) GetFormatCommand() string {
+	if fd.FormatCommand == "" {
+		return DefaultFormatCommand
+	}
+	return fd.FormatCommand
+}
+
+// DefaultConfigSetCommand stores config values as JSON in config.json
+const DefaultConfigSetCommand = `local cfg = file.exists("config.json") and sjson.decode(file.getcontents("config.json")) or {}
+cfg[${KEY}] = ${VALUE}
+file.putcontents("config.json", sjson.encode(cfg))
+print(${KEY} .. " = " .. cfg[${KEY}])`
+
+// DefaultConfigGetCommand prints a value stored by DefaultConfigSetCommand
+const DefaultConfigGetCommand = `local cfg = file.exists("config.json") and sjson.decode(file.getcontents("config.json")) or {}
+print(${KEY} .. " = " .. tostring(cfg[${KEY}]))`
+
+// GetConfigSetCommand returns the Lua code that sets key to value in the device
+// config store
+func (fd *FirmwareDef) GetConfigSetCommand(key, value string) string {
+	command := fd.ConfigSetCommand
+	if command == "" {
+		command = DefaultConfigSetCommand
+	}
+	return configCommand(command, key, value)
+}
+
+// GetConfigGetCommand returns the Lua code that prints the value of key in
+// the device config store
+func (fd *FirmwareDef) GetConfigGetCommand(key string) string {
+	command := fd.ConfigGetCommand
+	if command == "" {
+		command = DefaultConfigGetCommand
+	}
+	return configCommand(command, key, "")
+}
+
+// DefaultRenameCommand stores the device id and name in config.json, next to
+// the values written by DefaultConfigSetCommand. The stored id replaces the
+// chip id as the device id, see session.DeviceIDLua.
+const DefaultRenameCommand = `local cfg = file.exists("config.json") and sjson.decode(file.getcontents("config.json")) or {}
+cfg.id = ${ID}
+cfg.name = ${NAME} or cfg.name
+file.putcontents("config.json", sjson.encode(cfg))
+print("Device renamed to " .. cfg.id)`
+
+// GetRenameCommand returns the Lua code that sets the id and name stored on
+// the device. The stored name is kept if name is empty.
+func (fd *FirmwareDef) GetRenameCommand(id, name string) string {
+	command := fd.RenameCommand
+	if command == "" {
+		command = DefaultRenameCommand
+	}
+	luaName := "nil"
+	if name != "" {
+		luaName = luaString(name)
+	}
+	return strings.NewReplacer("${ID}", luaString(id), "${NAME}", luaName).Replace(command)
+}
+
+// DefaultBootLoopPattern matches the banner of the espore bootloader
+const DefaultBootLoopPattern = `^Espore bootloader will launch`
+
+// DefaultRecoverCommand stops the espore bootloader before it launches main
+const DefaultRecoverCommand = "boot = nil"
+
+// GetBootLoopPattern returns the configured boot loop pattern or the default
+// one
+func (fd *FirmwareDef) GetBootLoopPattern() string {
+	if fd.BootLoopPattern == "" {
+		return DefaultBootLoopPattern
+	}
+	return fd.BootLoopPattern
+}
+
+// GetRecoverCommand returns the configured recover command or the default one
+func (fd *FirmwareDef) GetRecoverCommand() string {
+	if fd.RecoverCommand == "" {
+		return DefaultRecoverCommand
+	}
+	return fd.RecoverCommand
+}
+
+func configCommand(command, key, value string) string {
+	return strings.NewReplacer("${KEY}", luaString(key), "${VALUE}", luaString(value)).Replace(command)
+}
+
+// luaString quotes s as a Lua string literal, escaping control characters
+// as decimal escapes, which all Lua versions understand
+func luaString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
 }
 
 type FirmwareManifest struct {
 	DeviceInfo
+	// Variant is the name of the device variant the manifest was built for,
+	// empty for the device itself
+	Variant         string `json:"variant,omitempty"`
+	ManifestVersion int    `json:"manifestVersion"`
 	NodeMCUFirmware string
-	Files           []*FileEntry `json:"files"`
+	// BuiltAt is the RFC3339 time the manifest was built at
+	BuiltAt string `json:"builtAt,omitempty"`
+	// Revision is the source revision the manifest was built from
+	Revision string       `json:"revision,omitempty"`
+	Files    []*FileEntry `json:"files"`
+	// Resolved maps the path of every file resolved for the device, before
+	// LFS packing, to its hash
+	Resolved map[string]string `json:"-"`
+}
+
+// buildTime returns the current time. Replaced in tests.
+var buildTime = time.Now
+
+// gitRevision returns the git revision of the working directory, or an empty
+// string if it cannot be determined. Replaced in tests.
+var gitRevision = func() string {
+	out, err := exec.Command("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// buildStamp returns the build time and source revision to record in the
+// manifests, honoring the overrides in the build configuration
+func buildStamp(config *config.BuildConfig) (builtAt, revision string) {
+	builtAt, revision = config.BuiltAt, config.Revision
+	if config.Reproducible {
+		return builtAt, revision
+	}
+	if builtAt == "" {
+		builtAt = buildTime().UTC().Format(time.RFC3339)
+	}
+	if revision == "" {
+		revision = gitRevision()
+	}
+	return builtAt, revision
+}
+
+// stampConfig returns a copy of config with the build time and revision
+// resolved, so the devices built with it are stamped alike and git runs once.
+// The copy is marked reproducible to keep them as resolved, even if empty.
+func stampConfig(config *config.BuildConfig) *config.BuildConfig {
+	stamped := *config
+	stamped.BuiltAt, stamped.Revision = buildStamp(config)
+	stamped.Reproducible = true
+	return &stamped
 }
 
 var parseDepRegex = []*regexp.Regexp{
 	regexp.MustCompile(`(?m)pcall\s*\(\s*require\s*,\s*"([^"]*)"\s*\)`),
 	regexp.MustCompile(`(?m)(?:^require|\s+require|pkg\.require)\s*\(\s*"([^"]*)"\s*(,.*)?\)`),
 }
+
+// optionalRequireRegex matches the hint marking a require as optional when
+// it follows it on the same line, as in require("x") -- optional
+var optionalRequireRegex = regexp.MustCompile(`^[^\n]*--\s*optional\b`)
+
+// importRegex builds the regexes matching explicit import directives with any
+// of the given keywords, either one per line (-- import: a, b) or as a block
+// comment (--[[ import: a, b, c ]])
+func importRegex(keywords []string) []*regexp.Regexp {
+	quoted := make([]string, len(keywords))
+	for i, keyword := range keywords {
+		quoted[i] = regexp.QuoteMeta(keyword)
+	}
+	alternatives := strings.Join(quoted, "|")
+	return []*regexp.Regexp{
+		regexp.MustCompile(`(?m)^--\s*(?:` + alternatives + `):([^\n]*)$`),
+		regexp.MustCompile(`(?s)--\[\[\s*(?:` + alternatives + `):(.*?)\]\]`),
+	}
+}
+
 var parseDFRegex = regexp.MustCompile(`(?m)^--\s*datafile:\s*(.*)$`)
 
+var parseIncludeRegex = regexp.MustCompile(`(?:^|[^\w.:])(?:dofile|loadfile)\s*\(\s*"([^"]*)"\s*\)`)
+
 var LFSEmbeddedFiles = map[string]string{
 	"__lfsinit.lua": lfsInitLua,
 }
@@ -103,17 +432,26 @@ func Luac(sourceEntries []*FileEntry, dstFile string) (err error) {
 	if err != nil {
 		return err
 	}
+	defer os.RemoveAll(tmpDir)
 	var sources []string
+	sourceNames := make(map[string]string)
 	for _, f := range sourceEntries {
 		dst := strings.ReplaceAll(strings.ReplaceAll(f.Path, "/", ","), "\\", ",")
 		dst = filepath.Join(tmpDir, dst)
-		utils.CopyFile(filepath.Join(f.Base, f.Path), dst, false)
+		utils.CopyFile(f.SourcePath(), dst, false)
 		sources = append(sources, dst)
+		sourceNames[dst] = f.SourcePath()
 	}
 
 	cmd := exec.Command("luac.cross", append([]string{"-o", dstFile, "-f"}, sources...)...)
 	outputBytes, err := cmd.CombinedOutput()
 	if err != nil {
+		if match := luacErrorRegex.FindStringSubmatch(string(outputBytes)); match != nil {
+			if source, ok := sourceNames[match[1]]; ok {
+				line, _ := strconv.Atoi(match[2])
+				return &BuildError{File: source, Line: line, Message: match[3]}
+			}
+		}
 		exitErr := err.(*exec.ExitError)
 		var code int
 		if exitErr != nil {
@@ -126,41 +464,178 @@ func Luac(sourceEntries []*FileEntry, dstFile string) (err error) {
 	return nil
 }
 
-func ReadDependenciesAndDatafiles(luaFile string) (deps, datafiles []string, err error) {
-	code, err := ioutil.ReadFile(luaFile)
+// luacErrorRegex extracts the file, line and message of a luac syntax error
+var luacErrorRegex = regexp.MustCompile(`(?m)^(?:\S*luac\.cross: )?([^:]+):(\d+): (.*)$`)
+
+// luac is the compiler function invoked by luacWithRetry. Replaced in tests.
+var luac = Luac
+
+// luacRetryDelay is the wait after the first failed LFS compilation. It
+// doubles after each further failure.
+const luacRetryDelay = 500 * time.Millisecond
+
+// retrySleep waits between compilation attempts. Replaced in tests.
+var retrySleep = time.Sleep
+
+// luacWithRetry compiles the LFS image, retrying with a growing delay since
+// luac.cross fails under load. Syntax errors are not retried.
+func luacWithRetry(config *config.BuildConfig, sourceEntries []*FileEntry, dstFile string, bl *buildLog) (err error) {
+	retries := config.GetLuacRetries()
+	delay := luacRetryDelay
+	for attempt := 1; attempt <= retries; attempt++ {
+		if err = luac(sourceEntries, dstFile); err == nil {
+			return nil
+		}
+		if _, ok := err.(*BuildError); ok {
+			return err
+		}
+		bl.Infof("luac attempt %d/%d failed: %s", attempt, retries, err)
+		if attempt < retries {
+			retrySleep(delay)
+			delay *= 2
+		}
+	}
+	return err
+}
+
+// SourceInfo holds the dependencies and datafiles declared in a Lua source,
+// along with the line where each one is first declared
+type SourceInfo struct {
+	Dependencies    []string
+	Datafiles       []string
+	Includes        []string
+	DependencyLines map[string]int
+	DatafileLines   map[string]int
+	IncludeLines    map[string]int
+	// OptionalDependencies are the dependencies only required through
+	// pcall(require, ...) or with an optional hint, which may be missing
+	OptionalDependencies map[string]bool
+}
+
+func ReadDependenciesAndDatafiles(luaFile string, parseImportRegex []*regexp.Regexp) (*SourceInfo, error) {
+	code, err := readFile(luaFile)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	return parseDependenciesAndDatafiles(string(code), parseImportRegex), nil
+}
+
+func parseDependenciesAndDatafiles(code string, parseImportRegex []*regexp.Regexp) *SourceInfo {
+	info := &SourceInfo{
+		DependencyLines:      make(map[string]int),
+		DatafileLines:        make(map[string]int),
+		IncludeLines:         make(map[string]int),
+		OptionalDependencies: make(map[string]bool),
 	}
-	depMap := make(map[string]bool)
-	for _, regex := range parseDepRegex {
-		matches := regex.FindAllStringSubmatch(string(code), -1)
-		if matches != nil {
-			for _, match := range matches {
-				depMap[match[1]] = true
+	// a dependency is only optional if every require of it is
+	addDep := func(dep string, offset int, optional bool) {
+		if _, ok := info.DependencyLines[dep]; !ok {
+			info.DependencyLines[dep] = lineAt(code, offset)
+			info.Dependencies = append(info.Dependencies, dep)
+			if optional {
+				info.OptionalDependencies[dep] = true
 			}
+		} else if !optional {
+			delete(info.OptionalDependencies, dep)
+		}
+	}
+	for i, regex := range parseDepRegex {
+		matches := regex.FindAllStringSubmatchIndex(code, -1)
+		for _, match := range matches {
+			optional := i == 0 || optionalRequireRegex.MatchString(code[match[1]:])
+			addDep(code[match[2]:match[3]], match[2], optional)
 		}
 	}
 
-	dfMap := make(map[string]bool)
-	matches := parseDFRegex.FindAllStringSubmatch(string(code), -1)
-	if matches != nil {
+	for _, regex := range parseImportRegex {
+		matches := regex.FindAllStringSubmatchIndex(code, -1)
 		for _, match := range matches {
-			dfMap[match[1]] = true
+			offset := match[2]
+			for _, imp := range strings.Split(code[match[2]:match[3]], ",") {
+				if name := strings.TrimSpace(imp); name != "" {
+					addDep(name, offset+strings.Index(imp, name), false)
+				}
+				offset += len(imp) + 1
+			}
+		}
+	}
+
+	// list dependencies in declaration order
+	sort.SliceStable(info.Dependencies, func(i, j int) bool {
+		return info.DependencyLines[info.Dependencies[i]] < info.DependencyLines[info.Dependencies[j]]
+	})
+
+	matches := parseDFRegex.FindAllStringSubmatchIndex(code, -1)
+	for _, match := range matches {
+		df := code[match[2]:match[3]]
+		if _, ok := info.DatafileLines[df]; !ok {
+			info.DatafileLines[df] = lineAt(code, match[2])
+			info.Datafiles = append(info.Datafiles, df)
 		}
 	}
 
-	for dep := range depMap {
-		deps = append(deps, dep)
+	matches = parseIncludeRegex.FindAllStringSubmatchIndex(code, -1)
+	for _, match := range matches {
+		inc := code[match[2]:match[3]]
+		if _, ok := info.IncludeLines[inc]; !ok {
+			info.IncludeLines[inc] = lineAt(code, match[2])
+			info.Includes = append(info.Includes, inc)
+		}
 	}
 
-	for df := range dfMap {
-		datafiles = append(datafiles, df)
+	return info
+}
+
+// lineAt returns the 1-based line number of the given offset in code
+func lineAt(code string, offset int) int {
+	return strings.Count(code[:offset], "\n") + 1
+}
+
+// hashFile and readFile are replaced in tests to track file reads
+var hashFile = utils.HashFile
+var readFile = ioutil.ReadFile
+
+// scanFile returns the hash of a library file and, for Lua sources, the
+// dependencies it declares, reusing the cached results if neither the file
+// nor libVersion, the version of its library, changed
+func scanFile(fpath string, parseImportRegex []*regexp.Regexp, fc *fileCache, libVersion string) (string, *SourceInfo, error) {
+	var fi os.FileInfo
+	var key string
+	if fc != nil {
+		var err error
+		if fi, err = os.Stat(fpath); err != nil {
+			return "", nil, err
+		}
+		if key, err = filepath.Abs(fpath); err != nil {
+			return "", nil, err
+		}
+		if cached := fc.get(key, fi, libVersion); cached != nil && (cached.Info != nil || !isLua(fpath)) {
+			fc.log.Debugf("%s: unchanged, using the cached scan", fpath)
+			return cached.Hash, cached.Info, nil
+		}
+		fc.log.Debugf("%s: scanning", fpath)
 	}
+	hash, err := hashFile(fpath)
+	if err != nil {
+		return "", nil, err
+	}
+	var info *SourceInfo
+	if isLua(fpath) {
+		if info, err = ReadDependenciesAndDatafiles(fpath, parseImportRegex); err != nil {
+			return "", nil, err
+		}
+	}
+	fc.put(key, fi, libVersion, hash, info)
+	return hash, info, nil
+}
 
-	return deps, datafiles, nil
+func LoadLibrary(config *config.BuildConfig, path string, allLibs map[string]*FirmwareLib, level int) (*FirmwareLib, error) {
+	fc := openFileCache(config.CacheDir, config.GetDirectiveKeywords(), newBuildLog(config))
+	defer fc.save()
+	return loadLibrary(config, path, allLibs, level, fc)
 }
 
-func LoadLibrary(path string, allLibs map[string]*FirmwareLib, level int) (*FirmwareLib, error) {
+func loadLibrary(config *config.BuildConfig, path string, allLibs map[string]*FirmwareLib, level int, fc *fileCache) (*FirmwareLib, error) {
 	lib := allLibs[path]
 	if lib != nil {
 		return lib, nil
@@ -169,60 +644,101 @@ func LoadLibrary(path string, allLibs map[string]*FirmwareLib, level int) (*Firm
 		return nil, fmt.Errorf("Circular dependency in %q", path)
 	}
 
-	list, err := utils.EnumerateDir(path)
-	if err != nil {
-		return nil, err
+	if isRemote(path) {
+		localPath, err := FetchRemoteLibrary(path, config.CacheDir)
+		if err != nil {
+			return nil, err
+		}
+		lib, err := loadLibrary(config, localPath, allLibs, level, fc)
+		if err != nil {
+			return nil, err
+		}
+		allLibs[path] = lib
+		return lib, nil
 	}
 
 	var libDef LibDef
 	libDefPath := filepath.Join(path, "library.json")
 	utils.ReadJSON(libDefPath, &libDef)
+	includePatterns := libDef.Include
 	if len(libDef.Include) == 0 {
 		libDef.Include = []string{"*"}
 	}
 	if libDef.Name == "" {
 		libDef.Name = path
 	}
-	var includes []glob.Glob
-	var excludes []glob.Glob
 
-	for _, i := range libDef.Include {
-		g, err := glob.Compile(i, '/')
-		if err != nil {
-			return nil, fmt.Errorf("Error parsing include glob in %s", libDefPath)
+	// compile the globs before scanning any file, so bad patterns are
+	// reported right away
+	// patterns referencing the device id match any id when loading, and are
+	// narrowed down to each device's id when it is built
+	var devicePatterns []string
+	isDevicePattern := make([]bool, len(libDef.Include))
+	anyIDPatterns := make([]string, len(libDef.Include))
+	for i, pattern := range libDef.Include {
+		anyIDPatterns[i] = pattern
+		if strings.Contains(pattern, DeviceIDPlaceholder) {
+			isDevicePattern[i] = true
+			devicePatterns = append(devicePatterns, pattern)
+			anyIDPatterns[i] = strings.ReplaceAll(pattern, DeviceIDPlaceholder, "*")
 		}
-		includes = append(includes, g)
 	}
-	for _, e := range libDef.Exclude {
-		g, err := glob.Compile(e, '/')
-		if err != nil {
-			return nil, fmt.Errorf("Error parsing exclude glob in %s", libDefPath)
-		}
-		excludes = append(excludes, g)
+	includes, err := compileGlobs(anyIDPatterns)
+	if err != nil {
+		return nil, &BuildError{File: libDefPath, Message: fmt.Sprintf("Error parsing include glob in library %q: %s", libDef.Name, err)}
+	}
+	excludes, err := compileGlobs(libDef.Exclude)
+	if err != nil {
+		return nil, &BuildError{File: libDefPath, Message: fmt.Sprintf("Error parsing exclude glob in library %q: %s", libDef.Name, err)}
+	}
+	parseImportRegex := importRegex(config.GetDirectiveKeywords())
+
+	// test files are skipped altogether so their requires are never parsed
+	list, err := utils.EnumerateDir(path, config.GetTestPatterns()...)
+	if err != nil {
+		return nil, err
 	}
 
 	entries := make(map[string]*FileEntry)
+	deviceEntries := make(map[string]*FileEntry)
+	includeMatched := make([]bool, len(includes))
 	for _, f := range list {
 		if f == "library.json" {
 			continue
 		}
+		var deviceFile bool
+		for i, ig := range includes {
+			if ig.Match(f) {
+				includeMatched[i] = true
+				deviceFile = deviceFile || isDevicePattern[i]
+			}
+		}
+		if !config.IsExtensionAllowed(filepath.Ext(f)) {
+			newBuildLog(config).Infof("Skipping %s: extension not in the allowed list", filepath.Join(path, f))
+			continue
+		}
 		var entry FileEntry
 		fpath := filepath.Join(path, f)
 		entry.Path = f
 		entry.Base = path
-		entry.Hash, err = utils.HashFile(fpath)
+		hash, info, err := scanFile(fpath, parseImportRegex, fc, libDef.Version)
 		if err != nil {
 			return nil, err
 		}
+		entry.Hash = hash
+		if entry.Size, err = fileSize(fpath); err != nil {
+			return nil, err
+		}
 		var add bool
 		if isLua(f) {
 			add = true
-			deps, datafiles, err := ReadDependenciesAndDatafiles(fpath)
-			if err != nil {
-				return nil, err
-			}
-			entry.Dependencies = deps
-			entry.Datafiles = datafiles
+			entry.Dependencies = info.Dependencies
+			entry.DependencyLines = info.DependencyLines
+			entry.OptionalDependencies = info.OptionalDependencies
+			entry.Datafiles = info.Datafiles
+			entry.DatafileLines = info.DatafileLines
+			entry.Includes = info.Includes
+			entry.IncludeLines = info.IncludeLines
 		} else {
 			for _, ig := range includes {
 				if ig.Match(f) {
@@ -237,14 +753,36 @@ func LoadLibrary(path string, allLibs map[string]*FirmwareLib, level int) (*Firm
 				}
 			}
 		}
-		if add {
+		for _, eg := range excludes {
+			if eg.Match(f) {
+				deviceFile = false
+				break
+			}
+		}
+		if deviceFile {
+			deviceEntries[entry.Path] = &entry
+		} else if add {
 			entries[entry.Path] = &entry
 		}
 	}
 
+	modules := libDef.Modules
+	if libDef.Prefix != "" {
+		entries, modules = prefixLibrary(libDef.Prefix, entries, modules)
+		deviceEntries, _ = prefixLibrary(libDef.Prefix, deviceEntries, nil)
+	}
+
+	if config.StrictIncludes {
+		for i, matched := range includeMatched {
+			if !matched {
+				return nil, &BuildError{File: libDefPath, Message: fmt.Sprintf("include pattern %q in library %q matches no files", libDef.Include[i], libDef.Name)}
+			}
+		}
+	}
+
 	var dependencies []*FirmwareLib
 	for _, depLibName := range libDef.Dependencies {
-		dep, err := LoadLibrary(depLibName, allLibs, level+1)
+		dep, err := loadLibrary(config, depLibName, allLibs, level+1, fc)
 		if err != nil {
 			return nil, fmt.Errorf("Error resolving dependency %q of library %q", depLibName, path)
 		}
@@ -252,15 +790,92 @@ func LoadLibrary(path string, allLibs map[string]*FirmwareLib, level int) (*Firm
 	}
 
 	lib = &FirmwareLib{
-		BasePath:     path,
-		Files:        entries,
-		Modules:      libDef.Modules,
-		Dependencies: dependencies,
+		Name:            libDef.Name,
+		BasePath:        path,
+		Files:           entries,
+		Modules:         modules,
+		Dependencies:    dependencies,
+		ModulesOnly:     libDef.ModulesOnly,
+		DevicePatterns:  devicePatterns,
+		DeviceFiles:     deviceEntries,
+		IncludePatterns: includePatterns,
 	}
 	allLibs[path] = lib
 	return lib, nil
 }
 
+// prefixLibrary mounts the library entries and modules under prefix, pointing
+// requires and loaded files that refer to the library itself to their prefixed
+// names
+func prefixLibrary(prefix string, entries map[string]*FileEntry, modules []ModuleDef) (map[string]*FileEntry, []ModuleDef) {
+	prefix = strings.Trim(prefix, "/.")
+	modPrefix := strings.ReplaceAll(prefix, "/", ".") + "."
+	prefixed := make(map[string]*FileEntry, len(entries))
+	for path, entry := range entries {
+		entry.Source = entry.Path
+		entry.Path = prefix + "/" + path
+		// the parsed source info may be shared with the file cache, so build
+		// new slices and maps rather than modifying them
+		deps := make([]string, len(entry.Dependencies))
+		depLines := make(map[string]int, len(entry.Dependencies))
+		optional := make(map[string]bool, len(entry.OptionalDependencies))
+		for i, dep := range entry.Dependencies {
+			deps[i] = dep
+			if _, ok := entries[Mod2File(dep)]; ok {
+				deps[i] = modPrefix + dep
+			}
+			depLines[deps[i]] = entry.DependencyLines[dep]
+			if entry.OptionalDependencies[dep] {
+				optional[deps[i]] = true
+			}
+		}
+		entry.Dependencies, entry.DependencyLines, entry.OptionalDependencies = deps, depLines, optional
+		incs := make([]string, len(entry.Includes))
+		incLines := make(map[string]int, len(entry.Includes))
+		for i, inc := range entry.Includes {
+			incs[i] = inc
+			if _, ok := entries[inc]; ok {
+				incs[i] = prefix + "/" + inc
+			}
+			incLines[incs[i]] = entry.IncludeLines[inc]
+		}
+		entry.Includes, entry.IncludeLines = incs, incLines
+		prefixed[entry.Path] = entry
+	}
+	libModules := make(map[string]bool, len(modules))
+	for _, mod := range modules {
+		libModules[mod.Name] = true
+	}
+	prefixedModules := make([]ModuleDef, len(modules))
+	for i, mod := range modules {
+		mod.Name = modPrefix + mod.Name
+		after := make([]string, len(mod.After))
+		for j, name := range mod.After {
+			after[j] = name
+			if libModules[name] {
+				after[j] = modPrefix + name
+			}
+		}
+		mod.After = after
+		prefixedModules[i] = mod
+	}
+	return prefixed, prefixedModules
+}
+
+// compileGlobs compiles the given path patterns, naming the offending pattern
+// if any is invalid
+func compileGlobs(patterns []string) ([]glob.Glob, error) {
+	globs := make([]glob.Glob, 0, len(patterns))
+	for _, pattern := range patterns {
+		g, err := glob.Compile(pattern, '/')
+		if err != nil {
+			return nil, fmt.Errorf("%q: %s", pattern, err)
+		}
+		globs = append(globs, g)
+	}
+	return globs, nil
+}
+
 func getLibraryList(lib *FirmwareLib, added map[*FirmwareLib]bool) []*FirmwareLib {
 	if added == nil {
 		added = make(map[*FirmwareLib]bool)
@@ -277,10 +892,101 @@ func getLibraryList(lib *FirmwareLib, added map[*FirmwareLib]bool) []*FirmwareLi
 
 }
 
+// orderLibraries returns libs with the libraries named in searchOrder moved
+// to the front, in that order
+func orderLibraries(libs []*FirmwareLib, deviceRootLib *FirmwareLib, searchOrder []string) ([]*FirmwareLib, error) {
+	if len(searchOrder) == 0 {
+		return libs, nil
+	}
+	ordered := make([]*FirmwareLib, 0, len(libs))
+	placed := make(map[*FirmwareLib]bool)
+	for _, name := range searchOrder {
+		var found *FirmwareLib
+		for _, lib := range libs {
+			if (name == DeviceLibraryName && lib == deviceRootLib) || (name != DeviceLibraryName && lib.Name == name) {
+				found = lib
+				break
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("Library %q in the search order is not used by the device", name)
+		}
+		if !placed[found] {
+			placed[found] = true
+			ordered = append(ordered, found)
+		}
+	}
+	for _, lib := range libs {
+		if !placed[lib] {
+			ordered = append(ordered, lib)
+		}
+	}
+	return ordered, nil
+}
+
+// Mod2File returns the file a module is loaded from with the default search
+// path
 func Mod2File(moduleName string) string {
 	return strings.ReplaceAll(moduleName, ".", "/") + ".lua"
 }
 
+// file2Mod returns the module name a Lua file is required as, the reverse of
+// Mod2File
+func file2Mod(fileName string) string {
+	return strings.ReplaceAll(strings.TrimSuffix(fileName, ".lua"), "/", ".")
+}
+
+// suggestModule returns the available module whose name is closest to
+// moduleName, or "" if none is close enough to be a likely typo
+func suggestModule(moduleName string, searchPath []string, libs []*FirmwareLib) string {
+	best := ""
+	bestDistance := len(moduleName)/3 + 1
+	for _, lib := range libs {
+		for fileName := range lib.Files {
+			candidate, ok := fileModule(fileName, searchPath)
+			if !ok {
+				continue
+			}
+			d := editDistance(moduleName, candidate)
+			if d < bestDistance || (d == bestDistance && best != "" && candidate < best) {
+				best, bestDistance = candidate, d
+			}
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
 var ErrFileEntryNotFound = errors.New("Cannot find file in firmware libraries")
 
 func FindInLibraries(fileName string, libs []*FirmwareLib) (*FileEntry, error) {
@@ -293,51 +999,275 @@ func FindInLibraries(fileName string, libs []*FirmwareLib) (*FileEntry, error) {
 	return nil, ErrFileEntryNotFound
 }
 
+// AddFilesFromModule adds the module file and its dependencies to fileMap,
+// resolving modules with the default search path
 func AddFilesFromModule(moduleName string, libs []*FirmwareLib, fileMap map[string]*FileEntry) error {
-	moduleFileName := Mod2File(moduleName)
+	return addFilesFromModule(moduleName, nil, libs, fileMap, nil, nil)
+}
+
+// addFilesFromModule adds the module file and its dependencies, keeping track
+// of the resolution chain so errors point at the exact path to a missing module
+func addFilesFromModule(moduleName string, searchPath []string, libs []*FirmwareLib, fileMap map[string]*FileEntry, parent *FileEntry, chain []string) error {
+	chain = append(chain, moduleName)
+	moduleFileName, entry := findModule(moduleName, searchPath, libs, fileMap)
 	if _, ok := fileMap[moduleFileName]; ok {
 		return nil
 	}
-	entry, err := FindInLibraries(moduleFileName, libs)
-	if err != nil {
-		return fmt.Errorf("Error finding %s: %s", moduleFileName, err)
+	if entry == nil {
+		buildErr := &BuildError{
+			Message: fmt.Sprintf("module %s: file %s not found in libraries", strings.Join(chain, " -> "), strings.Join(moduleFiles(moduleName, searchPath), " or ")),
+		}
+		if suggestion := suggestModule(moduleName, searchPath, libs); suggestion != "" {
+			buildErr.Message += fmt.Sprintf(". Did you mean %s?", suggestion)
+		}
+		if parent != nil {
+			buildErr.File = parent.SourcePath()
+			buildErr.Line = parent.DependencyLines[moduleName]
+		}
+		return buildErr
 	}
 	fileMap[moduleFileName] = entry
+	return addReferencedFiles(entry, searchPath, libs, fileMap, chain)
+}
+
+// addReferencedFiles adds the modules required by entry and the files it loads
+// with dofile() or loadfile()
+func addReferencedFiles(entry *FileEntry, searchPath []string, libs []*FirmwareLib, fileMap map[string]*FileEntry, chain []string) error {
 	for _, dep := range entry.Dependencies {
-		if err := AddFilesFromModule(dep, libs, fileMap); err != nil {
-			return fmt.Errorf("Cannot resolve dependency %q of %s: %s", dep, entry.Path, err)
+		if entry.OptionalDependencies[dep] {
+			if _, depEntry := findModule(dep, searchPath, libs, fileMap); depEntry == nil {
+				continue
+			}
+		}
+		if err := addFilesFromModule(dep, searchPath, libs, fileMap, entry, chain[:len(chain):len(chain)]); err != nil {
+			return err
+		}
+	}
+	for _, inc := range entry.Includes {
+		if _, ok := fileMap[inc]; ok {
+			continue
+		}
+		incEntry, err := FindInLibraries(inc, libs)
+		if err != nil {
+			return &BuildError{
+				File:    entry.SourcePath(),
+				Line:    entry.IncludeLines[inc],
+				Message: fmt.Sprintf("module %s: loaded file %s not found in libraries", strings.Join(chain, " -> "), inc),
+			}
+		}
+		fileMap[inc] = incEntry
+		if err := addReferencedFiles(incEntry, searchPath, libs, fileMap, chain[:len(chain):len(chain)]); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func AddOtherFiles(libs []*FirmwareLib, fileMap map[string]*FileEntry) error {
+// AddOtherFiles adds the non-Lua files of the libraries, along with the files
+// matched by include patterns that reference the given device id
+func AddOtherFiles(libs []*FirmwareLib, fileMap map[string]*FileEntry, controlFiles []string, deviceID string) error {
 	for _, lib := range libs {
+		if lib.ModulesOnly {
+			continue
+		}
 		for path, entry := range lib.Files {
-			if !isLua(path) {
+			if !isLua(path) && !isControlFile(path, controlFiles) {
 				fileMap[path] = entry
 			}
 		}
+		if len(lib.DeviceFiles) == 0 {
+			continue
+		}
+		var patterns []string
+		for _, pattern := range lib.DevicePatterns {
+			patterns = append(patterns, strings.ReplaceAll(pattern, DeviceIDPlaceholder, glob.QuoteMeta(deviceID)))
+		}
+		globs, err := compileGlobs(patterns)
+		if err != nil {
+			return err
+		}
+		for path, entry := range lib.DeviceFiles {
+			// patterns are relative to the library, before any prefix
+			libPath := entry.Path
+			if entry.Source != "" {
+				libPath = entry.Source
+			}
+			for _, g := range globs {
+				if g.Match(libPath) {
+					fileMap[path] = entry
+					break
+				}
+			}
+		}
 	}
 	return nil
 }
 
-func AddDeviceSpecificFiles(deviceRootLib *FirmwareLib, fileMap map[string]*FileEntry) {
+// deviceEntrypoints are the device files run by the firmware without being
+// required by any module
+var deviceEntrypoints = []string{"init.lua", "main.lua"}
+
+// auditDeviceFiles returns a warning for each file in the device folder that
+// is not reachable from the modules already in fileMap, declared as a
+// datafile, matched by an explicit include pattern or a known entrypoint.
+// Such files are still shipped, but are often leftovers.
+func auditDeviceFiles(deviceRootLib *FirmwareLib, fileMap map[string]*FileEntry, controlFiles []string) ([]string, error) {
+	includes, err := compileGlobs(deviceRootLib.IncludePatterns)
+	if err != nil {
+		return nil, err
+	}
+	referenced := make(map[string]bool)
+	for path, fe := range fileMap {
+		referenced[path] = true
+		for _, datafile := range fe.Datafiles {
+			referenced[datafile] = true
+		}
+	}
+	for _, entrypoint := range deviceEntrypoints {
+		referenced[entrypoint] = true
+	}
+
+	var warnings []string
+	for path, fe := range deviceRootLib.Files {
+		if referenced[path] || isControlFile(path, controlFiles) {
+			continue
+		}
+		var matched bool
+		for _, g := range includes {
+			if g.Match(path) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			warnings = append(warnings, fmt.Sprintf("%s: device file is not required, loaded or explicitly included", fe.SourcePath()))
+		}
+	}
+	sort.Strings(warnings)
+	return warnings, nil
+}
+
+func AddDeviceSpecificFiles(deviceRootLib *FirmwareLib, fileMap map[string]*FileEntry, controlFiles []string) {
 	for _, fe := range deviceRootLib.Files {
-		fileMap[fe.Path] = fe
+		if !isControlFile(fe.Path, controlFiles) {
+			fileMap[fe.Path] = fe
+		}
 	}
 }
 
-func removeDuplicateModules(mods []ModuleDef) []ModuleDef {
-	modmap := make(map[string]ModuleDef)
-	for _, mod := range mods {
-		if _, ok := modmap[mod.Name]; !ok {
-			modmap[mod.Name] = mod
+// isControlFile returns whether path is a build-control file at the root of a
+// library or device folder, which must never be shipped to the device
+func isControlFile(path string, controlFiles []string) bool {
+	for _, cf := range controlFiles {
+		if path == cf {
+			return true
 		}
 	}
-	mods = make([]ModuleDef, 0, len(modmap))
-	for _, mod := range modmap {
-		mods = append(mods, mod)
+	return false
+}
+
+// deviceDatafiles returns datafiles with DeviceIDPlaceholder replaced by the
+// device id, so one directive can name a different datafile per device
+func deviceDatafiles(datafiles []string, deviceID string) []string {
+	expanded := make([]string, len(datafiles))
+	for i, datafile := range datafiles {
+		expanded[i] = strings.ReplaceAll(datafile, DeviceIDPlaceholder, deviceID)
+	}
+	return expanded
+}
+
+// hasDeviceDatafiles returns whether any datafile refers to the device id
+func hasDeviceDatafiles(datafiles []string) bool {
+	for _, datafile := range datafiles {
+		if strings.Contains(datafile, DeviceIDPlaceholder) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandDatafiles replaces the entries of fileMap whose datafiles refer to the
+// device id with copies naming the datafiles of this device. Library entries
+// are shared by all devices, so they are never modified.
+func expandDatafiles(fileMap map[string]*FileEntry, deviceID string) {
+	for path, fe := range fileMap {
+		if !hasDeviceDatafiles(fe.Datafiles) {
+			continue
+		}
+		expanded := *fe
+		expanded.Datafiles = deviceDatafiles(fe.Datafiles, deviceID)
+		fileMap[path] = &expanded
+	}
+}
+
+// applyOverrides replaces the files of fileMap listed in overrides with the
+// local files providing their content. The original entry is kept otherwise,
+// so an overridden Lua file keeps the dependencies of the file it replaces.
+func applyOverrides(fileMap map[string]*FileEntry, overrides map[string]string, deviceID string, bl *buildLog) error {
+	for path, local := range overrides {
+		fe, ok := fileMap[path]
+		if !ok {
+			bl.Debugf("Device %s: override for %s skipped, the device does not ship it", deviceID, path)
+			continue
+		}
+		overridden := *fe
+		overridden.Base, overridden.Source = filepath.Dir(local), filepath.Base(local)
+		overridden.Content = nil
+		var err error
+		if overridden.Hash, err = utils.HashFile(local); err != nil {
+			return fmt.Errorf("Cannot read override for %s: %s", path, err)
+		}
+		if overridden.Size, err = fileSize(local); err != nil {
+			return fmt.Errorf("Cannot read override for %s: %s", path, err)
+		}
+		bl.Debugf("Device %s: overriding %s with %s", deviceID, path, local)
+		fileMap[path] = &overridden
+	}
+	return nil
+}
+
+// AddPassthroughFiles adds the given files verbatim to the file map. Relative
+// paths are resolved against the device folder and keep their relative path in
+// the image, while absolute paths are shipped under their base name. Two files
+// shipped under the same path are an error.
+func AddPassthroughFiles(devicePath string, files []string, fileMap map[string]*FileEntry) error {
+	added := make(map[string]string)
+	for _, file := range files {
+		var entry FileEntry
+		if filepath.IsAbs(file) {
+			entry.Base = filepath.Dir(file)
+			entry.Path = filepath.Base(file)
+		} else {
+			entry.Base = devicePath
+			entry.Path = filepath.ToSlash(filepath.Clean(file))
+		}
+		if other, ok := added[entry.Path]; ok {
+			return fmt.Errorf("Cannot add file %q: %q is already shipped as %s", file, other, entry.Path)
+		}
+		added[entry.Path] = file
+		hash, err := utils.HashFile(entry.SourcePath())
+		if err != nil {
+			return fmt.Errorf("Cannot add file %q: %s", file, err)
+		}
+		entry.Hash = hash
+		if entry.Size, err = fileSize(entry.SourcePath()); err != nil {
+			return fmt.Errorf("Cannot add file %q: %s", file, err)
+		}
+		fileMap[entry.Path] = &entry
+	}
+	return nil
+}
+
+func removeDuplicateModules(mods []ModuleDef) []ModuleDef {
+	modmap := make(map[string]ModuleDef)
+	for _, mod := range mods {
+		if _, ok := modmap[mod.Name]; !ok {
+			modmap[mod.Name] = mod
+		}
+	}
+	mods = make([]ModuleDef, 0, len(modmap))
+	for _, mod := range modmap {
+		mods = append(mods, mod)
 	}
 	sort.SliceStable(mods, func(i, j int) bool {
 		return strings.Compare(mods[i].Name, mods[j].Name) < 0
@@ -349,6 +1279,7 @@ func NewVirtualFileEntry(data []byte, path string) *FileEntry {
 	var fe FileEntry
 	fe.Path = path
 	fe.Content = data
+	fe.Size = int64(len(data))
 	hasher := sha1.New()
 	hasher.Write(data)
 	fe.Hash = hex.EncodeToString(hasher.Sum(nil))
@@ -359,7 +1290,7 @@ var MainModule = ModuleDef{
 	Name: "main",
 }
 
-func packLFS(manifest *FirmwareManifest, LFSConfig FirmwareLFSConfig) error {
+func packLFS(config *config.BuildConfig, manifest *FirmwareManifest, LFSConfig FirmwareLFSConfig, libs []*FirmwareLib, searchPath []string, cache *lfsCache, bl *buildLog) error {
 	var lfsFiles []*FileEntry
 	var lfsHash string
 	var lfsDatafiles []string
@@ -367,32 +1298,45 @@ func packLFS(manifest *FirmwareManifest, LFSConfig FirmwareLFSConfig) error {
 
 	hasher := sha1.New()
 
-	if len(LFSConfig.Include) == 0 {
+	if len(LFSConfig.Include) == 0 && len(LFSConfig.Libs) == 0 && len(LFSConfig.Modules) == 0 {
 		LFSConfig.Include = []string{"**/*", "*"}
 	}
 
-	LFSConfig.Exclude = append(LFSConfig.Exclude, "init.lua") // always exclude init.lua from LFS
+	lfsBases, err := lfsLibBases(LFSConfig.Libs, libs)
+	if err != nil {
+		return fmt.Errorf("Error in %s LFS config: %s", manifest.Name, err)
+	}
+	shipped := make(map[string]*FileEntry, len(manifest.Files))
+	for _, file := range manifest.Files {
+		shipped[file.Path] = file
+	}
+	lfsModules := make(map[string]bool)
+	for _, module := range LFSConfig.Modules {
+		fileName, _ := findModule(module, searchPath, nil, shipped)
+		lfsModules[fileName] = true
+	}
 
-	var includes []glob.Glob
-	var excludes []glob.Glob
+	LFSConfig.Exclude = append(LFSConfig.Exclude, "init.lua") // always exclude init.lua from LFS
 
-	for _, i := range LFSConfig.Include {
-		g, err := glob.Compile(i, '/')
-		if err != nil {
-			return fmt.Errorf("Error parsing LFS include glob in %s firmware manifest file", manifest.Name)
-		}
-		includes = append(includes, g)
+	includes, err := compileGlobs(LFSConfig.Include)
+	if err != nil {
+		return fmt.Errorf("Error parsing LFS include glob in %s firmware manifest file: %s", manifest.Name, err)
 	}
-	for _, e := range LFSConfig.Exclude {
-		g, err := glob.Compile(e, '/')
-		if err != nil {
-			return fmt.Errorf("Error parsing LFS exclude glob in %s firmware manifest file", manifest.Name)
+	excludes, err := compileGlobs(LFSConfig.Exclude)
+	if err != nil {
+		return fmt.Errorf("Error parsing LFS exclude glob in %s firmware manifest file: %s", manifest.Name, err)
+	}
+
+	// files loaded with dofile() or loadfile() must stay in the filesystem
+	loaded := make(map[string]bool)
+	for _, file := range manifest.Files {
+		for _, inc := range file.Includes {
+			loaded[inc] = true
 		}
-		excludes = append(excludes, g)
 	}
 
 	for _, file := range manifest.Files {
-		var add bool
+		add := lfsBases[file.Base] || lfsModules[file.Path]
 		for _, ig := range includes {
 			if ig.Match(file.Path) {
 				add = true
@@ -406,11 +1350,10 @@ func packLFS(manifest *FirmwareManifest, LFSConfig FirmwareLFSConfig) error {
 			}
 
 		}
-		add = add && isLua(file.Path)
+		add = add && isLua(file.Path) && !loaded[file.Path]
 		if add {
 			lfsFiles = append(lfsFiles, file)
 			lfsDatafiles = append(lfsDatafiles, file.Datafiles...)
-			hasher.Write([]byte(file.Hash))
 		} else {
 			files = append(files, file)
 		}
@@ -419,39 +1362,30 @@ func packLFS(manifest *FirmwareManifest, LFSConfig FirmwareLFSConfig) error {
 	manifest.Files = files
 
 	if len(lfsFiles) > 0 {
-		lfsHash = hex.EncodeToString(hasher.Sum(nil))
-		tmpDir, err := ioutil.TempDir("", "espore-luac")
-		if err != nil {
-			return err
+		// hash the sorted LFS file set so devices sharing the same content
+		// share the same compiled image
+		sort.Slice(lfsFiles, func(i, j int) bool {
+			return strings.Compare(lfsFiles[i].Path, lfsFiles[j].Path) < 0
+		})
+		for _, file := range lfsFiles {
+			hasher.Write([]byte(file.Path))
+			hasher.Write([]byte(file.Hash))
 		}
-		defer os.RemoveAll(tmpDir)
+		lfsHash = hex.EncodeToString(hasher.Sum(nil))
 
-		for file, content := range LFSEmbeddedFiles {
-			if err := extractFile(file, content, tmpDir); err != nil {
+		lfsData, err := cache.getOrCompile(lfsHash, bl, func() ([]byte, error) {
+			return compileLFS(config, lfsFiles, lfsHash, bl)
+		})
+		if err != nil {
+			if _, ok := err.(*BuildError); ok {
 				return err
 			}
-		}
-
-		for file := range LFSEmbeddedFiles {
-			lfsFiles = append(lfsFiles, &FileEntry{
-				Base: tmpDir,
-				Path: file,
-			})
-		}
-
-		lfsFile := filepath.Join(tmpDir, fmt.Sprintf("%s.lfs", lfsHash))
-		if err := Luac(lfsFiles, lfsFile); err != nil {
 			return fmt.Errorf("Error compiling lua firmware for %s: %s", manifest.DeviceInfo.Name, err)
 		}
-		lfsData, err := ioutil.ReadFile(lfsFile)
-		if err != nil {
-			return fmt.Errorf("Error reading lfs file %s for %s: %s", lfsFile, manifest.DeviceInfo.Name, err)
-		}
 		lfsFileEntry := NewVirtualFileEntry(lfsData, "lfs.img")
-		lfsFileEntry.Hash, err = utils.HashFile(lfsFile)
 		lfsFileEntry.Datafiles = lfsDatafiles
-		if err != nil {
-			return fmt.Errorf("Error hasing lfs file %s for %s: %s", lfsFile, manifest.DeviceInfo.Name, err)
+		for _, file := range lfsFiles {
+			lfsFileEntry.Sources = append(lfsFileEntry.Sources, file.Path)
 		}
 		manifest.Files = append(manifest.Files, lfsFileEntry)
 	}
@@ -459,29 +1393,121 @@ func packLFS(manifest *FirmwareManifest, LFSConfig FirmwareLFSConfig) error {
 	return nil
 }
 
-func buildDeviceFirmwareManifest(deviceRootLib *FirmwareLib, fwDef FirmwareDef) (*FirmwareManifest, error) {
-	usedLibs := getLibraryList(deviceRootLib, nil)
+func compileLFS(config *config.BuildConfig, lfsFiles []*FileEntry, lfsHash string, bl *buildLog) ([]byte, error) {
+	tmpDir, err := ioutil.TempDir("", "espore-luac")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
 
+	for file, content := range LFSEmbeddedFiles {
+		if err := extractFile(file, content, tmpDir); err != nil {
+			return nil, err
+		}
+	}
+
+	for file := range LFSEmbeddedFiles {
+		lfsFiles = append(lfsFiles, &FileEntry{
+			Base: tmpDir,
+			Path: file,
+		})
+	}
+
+	lfsFile := filepath.Join(tmpDir, fmt.Sprintf("%s.lfs", lfsHash))
+	if err := luacWithRetry(config, lfsFiles, lfsFile, bl); err != nil {
+		return nil, err
+	}
+	lfsData, err := ioutil.ReadFile(lfsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading lfs file %s: %s", lfsFile, err)
+	}
+	return lfsData, nil
+}
+
+// deviceModules returns the modules a device starts, in start order and
+// ending with main, and the libraries its modules are resolved from
+func deviceModules(deviceRootLib *FirmwareLib, usedLibs []*FirmwareLib, fwDef FirmwareDef, searchPath []string) ([]ModuleDef, []*FirmwareLib, error) {
 	var modules []ModuleDef
+	modules = append(modules, fwDef.Modules...)
 	modules = append(modules, deviceRootLib.Modules...)
 	for _, lib := range usedLibs {
 		modules = append(modules, lib.Modules...)
 	}
-	modules = removeDuplicateModules(modules)
-	modules = append(modules, MainModule)
+	searchLibs, err := orderLibraries(usedLibs, deviceRootLib, fwDef.SearchOrder)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error in device %s: %s", fwDef.Name, err)
+	}
+	modules, err = orderModules(removeDuplicateModules(modules), searchPath, searchLibs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error in device %s: %s", fwDef.Name, err)
+	}
+	return append(modules, MainModule), searchLibs, nil
+}
+
+func buildDeviceFirmwareManifest(config *config.BuildConfig, deviceRootLib *FirmwareLib, fwDef FirmwareDef, cache *lfsCache) (*FirmwareManifest, error) {
+	controlFiles := config.GetControlFiles()
+	bl := newBuildLog(config)
+
+	usedLibs := getLibraryList(deviceRootLib, nil)
+	searchPath := config.GetSearchPath()
+	modules, searchLibs, err := deviceModules(deviceRootLib, usedLibs, fwDef, searchPath)
+	if err != nil {
+		return nil, err
+	}
 
 	fileMap := make(map[string]*FileEntry)
+	if config.VersionModule {
+		// reserve the module so requires resolve, it is generated once all
+		// the other files are known
+		fileMap[VersionFileName] = NewVirtualFileEntry(nil, VersionFileName)
+	}
 	for _, modDef := range modules {
-		if err := AddFilesFromModule(modDef.Name, usedLibs, fileMap); err != nil {
+		if err := addFilesFromModule(modDef.Name, searchPath, searchLibs, fileMap, nil, nil); err != nil {
+			if buildErr, ok := err.(*BuildError); ok && buildErr.File != "" {
+				return nil, buildErr
+			}
 			return nil, fmt.Errorf("Cannot add files from module %s: %s. Are you including the library where %s is defined?", modDef.Name, err, modDef.Name)
 		}
 	}
+	delete(fileMap, VersionFileName)
 
-	if err := AddOtherFiles(usedLibs, fileMap); err != nil {
+	if err := AddOtherFiles(usedLibs, fileMap, controlFiles, fwDef.ID); err != nil {
 		return nil, fmt.Errorf("Error adding other files in device %s: %s", fwDef.Name, err)
 	}
 
-	AddDeviceSpecificFiles(deviceRootLib, fileMap)
+	if config.AuditDeviceFiles {
+		warnings, err := auditDeviceFiles(deviceRootLib, fileMap, controlFiles)
+		if err != nil {
+			return nil, err
+		}
+		for _, warning := range warnings {
+			bl.Infof("Warning: %s", warning)
+		}
+	}
+	AddDeviceSpecificFiles(deviceRootLib, fileMap, controlFiles)
+
+	if err := AddPassthroughFiles(deviceRootLib.BasePath, fwDef.Files, fileMap); err != nil {
+		return nil, fmt.Errorf("Error adding files in device %s: %s", fwDef.Name, err)
+	}
+
+	expandDatafiles(fileMap, fwDef.ID)
+
+	if config.CaseInsensitivePaths {
+		if err := checkCaseCollisions(fileMap); err != nil {
+			return nil, fmt.Errorf("Error adding files in device %s: %s", fwDef.Name, err)
+		}
+	}
+
+	warnings, err := lintFiles(fileMap, config.MaxLineLength, config.MaxFileSize)
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range warnings {
+		bl.Infof("Warning: %s", warning)
+	}
+	for _, warning := range largeFileWarnings(fileMap, config.LargeFileWarning) {
+		bl.Infof("Warning: %s", warning)
+	}
 
 	modbytes, err := json.MarshalIndent(modules, "", "\t")
 	if err != nil {
@@ -491,31 +1517,217 @@ func buildDeviceFirmwareManifest(deviceRootLib *FirmwareLib, fwDef FirmwareDef)
 	fileMap["init.lua"] = NewVirtualFileEntry([]byte(initializer.InitLua), "init.lua")
 	fileMap["__espore.lua"] = NewVirtualFileEntry([]byte(session.EsporeLua), "__espore.lua")
 
+	if err := applyOverrides(fileMap, config.Overrides, fwDef.ID, bl); err != nil {
+		return nil, err
+	}
+
 	var manifest FirmwareManifest
 	manifest.DeviceInfo = fwDef.DeviceInfo
+	manifest.ManifestVersion = ManifestVersion
 	manifest.Name = fwDef.Name
 	manifest.Files = make([]*FileEntry, 0, len(fileMap))
 	for _, file := range fileMap {
 		manifest.Files = append(manifest.Files, file)
 	}
 	manifest.NodeMCUFirmware = fwDef.NodeMCUFirmware
+	manifest.BuiltAt, manifest.Revision = buildStamp(config)
+	manifest.Resolved = make(map[string]string, len(manifest.Files))
+	for _, fe := range manifest.Files {
+		manifest.Resolved[fe.Path] = fe.Hash
+	}
+
+	if config.ChecksumOnly {
+		// the LFS image and generated files derive from the sources, so
+		// their hashes are enough to tell whether the device changed
+		return &manifest, nil
+	}
 
-	err = packLFS(&manifest, fwDef.LFS)
+	err = packLFS(config, &manifest, fwDef.LFS, searchLibs, searchPath, cache, bl)
 	if err != nil {
 		return nil, err
 	}
 
+	if config.VersionModule {
+		manifest.Files = append(manifest.Files, versionModule(&manifest))
+	}
+
+	if config.EmbedManifest {
+		embedded, err := embeddedManifest(&manifest)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, embedded)
+	}
+
+	for _, path := range manifestPaths(&manifest) {
+		bl.Debugf("Device %s: including %s", fwDef.ID, path)
+	}
 	return &manifest, nil
 }
 
-func writeFileToImage(imageFile io.Writer, path string, size int64, sourceFile io.Reader) error {
-	fmt.Fprintln(imageFile, path)
-	fmt.Fprintln(imageFile, size)
-	_, err := io.Copy(imageFile, sourceFile)
-	return err
+// manifestPaths returns the sorted paths of the manifest files, along with
+// where each one comes from
+func manifestPaths(manifest *FirmwareManifest) []string {
+	paths := make([]string, 0, len(manifest.Files))
+	for _, fe := range manifest.Files {
+		switch {
+		case len(fe.Sources) > 0:
+			paths = append(paths, fmt.Sprintf("%s (packing %s)", fe.Path, strings.Join(fe.Sources, ", ")))
+		case fe.Content != nil:
+			paths = append(paths, fmt.Sprintf("%s (generated)", fe.Path))
+		default:
+			paths = append(paths, fmt.Sprintf("%s (from %s)", fe.Path, fe.SourcePath()))
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// EmbeddedManifestName is the file shipped to the device listing the hash of
+// every other file in the image, when BuildConfig.EmbedManifest is set
+const EmbeddedManifestName = "files.json"
+
+// embeddedManifest returns a virtual file mapping each manifest file path to
+// its hash, so the device can check the integrity of its files
+func embeddedManifest(manifest *FirmwareManifest) (*FileEntry, error) {
+	hashes := make(map[string]string, len(manifest.Files))
+	for _, fe := range manifest.Files {
+		hashes[fe.Path] = fe.Hash
+	}
+	data, err := json.Marshal(hashes)
+	if err != nil {
+		return nil, err
+	}
+	return NewVirtualFileEntry(data, EmbeddedManifestName), nil
+}
+
+// VersionFileName is the module generated when BuildConfig.VersionModule is
+// set
+const VersionFileName = "version.lua"
+
+// versionModule returns a virtual Lua module returning a table with the
+// checksum of the manifest files, the build time and the source revision
+func versionModule(manifest *FirmwareManifest) *FileEntry {
+	var b strings.Builder
+	b.WriteString("-- generated by espore\nreturn {\n")
+	fmt.Fprintf(&b, "\tid = %s,\n", luaString(manifest.ID))
+	fmt.Fprintf(&b, "\tname = %s,\n", luaString(manifest.Name))
+	fmt.Fprintf(&b, "\tchecksum = %s,\n", luaString(manifestChecksum(manifest.Files)))
+	fmt.Fprintf(&b, "\tbuiltAt = %s,\n", luaString(manifest.BuiltAt))
+	fmt.Fprintf(&b, "\trevision = %s,\n", luaString(manifest.Revision))
+	b.WriteString("}\n")
+	return NewVirtualFileEntry([]byte(b.String()), VersionFileName)
+}
+
+// FirmwareChecksum returns the checksum the generated version module of a
+// manifest reports, which leaves out the version module and the embedded
+// manifest
+func FirmwareChecksum(manifest *FirmwareManifest) string {
+	files := make([]*FileEntry, 0, len(manifest.Files))
+	for _, fe := range manifest.Files {
+		if fe.Path != VersionFileName && fe.Path != EmbeddedManifestName {
+			files = append(files, fe)
+		}
+	}
+	return manifestChecksum(files)
 }
 
-func writeFirmwareImage(manifest *FirmwareManifest, outputDir string) error {
+// manifestChecksum returns a hash of the paths and hashes of the given files,
+// which changes whenever any file is added, removed or modified
+func manifestChecksum(files []*FileEntry) string {
+	lines := make([]string, 0, len(files))
+	for _, fe := range files {
+		lines = append(lines, fe.Path+" "+fe.Hash+"\n")
+	}
+	sort.Strings(lines)
+	hasher := sha1.New()
+	for _, line := range lines {
+		hasher.Write([]byte(line))
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// lfsLibBases returns the base paths of the named libraries, so their files
+// can be told apart in the manifest
+func lfsLibBases(names []string, libs []*FirmwareLib) (map[string]bool, error) {
+	bases := make(map[string]bool)
+	for _, name := range names {
+		var found bool
+		for _, lib := range libs {
+			if lib.Name == name {
+				bases[lib.BasePath] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("LFS library %q is not used by the device", name)
+		}
+	}
+	return bases, nil
+}
+
+// SumExtension is the extension of the files holding the manifest checksum
+// of each device when BuildConfig.ChecksumOnly is set
+const SumExtension = ".sum"
+
+// writeManifestSum writes the manifest checksum to <id>.sum in outputDir
+func writeManifestSum(manifest *FirmwareManifest, outputDir string) error {
+	sum := manifestChecksum(manifest.Files) + "\n"
+	return ioutil.WriteFile(filepath.Join(outputDir, artifactName(manifest)+SumExtension), []byte(sum), 0644)
+}
+
+// checkCaseCollisions returns an error if any two files differ only in the case
+// of their paths, since they would overwrite each other on a case-insensitive
+// filesystem
+func checkCaseCollisions(fileMap map[string]*FileEntry) error {
+	paths := make([]string, 0, len(fileMap))
+	for path := range fileMap {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	seen := make(map[string]string)
+	for _, path := range paths {
+		lower := strings.ToLower(path)
+		if other, ok := seen[lower]; ok {
+			return fmt.Errorf("files %q and %q differ only in case", other, path)
+		}
+		seen[lower] = path
+	}
+	return nil
+}
+
+// writeImageFile appends the contents of a file entry to an image
+func writeImageFile(w io.Writer, fe *FileEntry, imageWriter ImageWriter) error {
+	if fe.Content != nil {
+		return imageWriter.WriteFile(w, fe.Path, int64(len(fe.Content)), bytes.NewReader(fe.Content))
+	}
+	f, err := os.Open(fe.SourcePath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return imageWriter.WriteFile(w, fe.Path, fi.Size(), f)
+}
+
+// writeDatafiles appends datafiles.json to an image, listing the datafiles
+// declared by the manifest files
+func writeDatafiles(w io.Writer, manifest *FirmwareManifest, imageWriter ImageWriter) error {
+	var datafiles = []string{} // init like this so when converting to JSON we get an empty array
+	for _, fe := range manifest.Files {
+		datafiles = append(datafiles, fe.Datafiles...)
+	}
+	datafilesJSON, err := json.Marshal(datafiles)
+	if err != nil {
+		return err
+	}
+	return imageWriter.WriteFile(w, "datafiles.json", int64(len(datafilesJSON)), bytes.NewReader(datafilesJSON))
+}
+
+func writeFirmwareImage(manifest *FirmwareManifest, outputDir string, imageWriter ImageWriter) error {
 
 	// sort the files alphabetically to avoid variations in order that would affect
 	// the checksum
@@ -523,141 +1735,369 @@ func writeFirmwareImage(manifest *FirmwareManifest, outputDir string) error {
 		return strings.Compare(manifest.Files[i].Path, manifest.Files[j].Path) < 0
 	})
 
-	var datafiles = []string{} // init like this so when converting to JSON we get an empty array
-
-	for _, fe := range manifest.Files {
-		datafiles = append(datafiles, fe.Datafiles...)
+	imgFilename := filepath.Join(outputDir, fmt.Sprintf("%s.img", artifactName(manifest)))
+	// the image is renamed into place once complete, so the firmware server
+	// never serves a partial image
+	imgFile, err := utils.CreateAtomic(imgFilename)
+	if err != nil {
+		return err
 	}
+	defer imgFile.Abort()
 
-	imgFilename := filepath.Join(outputDir, fmt.Sprintf("%s.img", manifest.ID))
-	imgFile, err := os.Create(imgFilename)
-	if err != nil {
+	// files are streamed to disk as they are hashed, so large datafiles are
+	// never held in memory
+	hasher := sha1.New()
+	imgBuf := bufio.NewWriter(io.MultiWriter(imgFile, hasher))
+	if err := imageWriter.WriteHeader(imgBuf, manifest, len(manifest.Files)+1); err != nil {
 		return err
 	}
-	defer imgFile.Close()
-	var imgBuf = &bytes.Buffer{}
-	fmt.Fprintf(imgBuf, "Version: 1 -- ESPore Device Image File\n")
-	fmt.Fprintf(imgBuf, "Device Id: %s\n", manifest.ID)
-	fmt.Fprintf(imgBuf, "Device Name: %s\n", manifest.Name)
-	fmt.Fprintf(imgBuf, "Total files: %d\n", len(manifest.Files)+1)
-	fmt.Fprintln(imgBuf)
 
 	for _, fe := range manifest.Files {
-		err := func() error {
-			var r io.Reader
-			var size int64
-			if fe.Content != nil {
-				r = bytes.NewReader(fe.Content)
-				size = int64(len(fe.Content))
-			} else {
-				path := filepath.Join(fe.Base, fe.Path)
-				f, err := os.Open(path)
-				if err != nil {
-					return err
-				}
-				defer f.Close()
-				fi, err := f.Stat()
-				if err != nil {
-					return err
-				}
-				r = f
-				size = fi.Size()
-			}
-			if err := writeFileToImage(imgBuf, fe.Path, size, r); err != nil {
-				return err
-			}
-			return nil
-		}()
-		if err != nil {
+		if err := writeImageFile(imgBuf, fe, imageWriter); err != nil {
 			return err
 		}
 	}
-	datafilesJSON, err := json.Marshal(datafiles)
-	if err := writeFileToImage(imgBuf, "datafiles.json", int64(len(datafilesJSON)), bytes.NewReader(datafilesJSON)); err != nil {
+	if err := writeDatafiles(imgBuf, manifest, imageWriter); err != nil {
 		return err
 	}
-
-	var hash string
-	hasher := sha1.New()
-	_, err = io.Copy(imgFile, io.TeeReader(imgBuf, hasher))
-	if err != nil {
+	if err := imgBuf.Flush(); err != nil {
+		return err
+	}
+	if err := imgFile.Commit(); err != nil {
 		return err
 	}
 
-	hash = hex.EncodeToString(hasher.Sum(nil))
-	if err = ioutil.WriteFile(imgFilename+".hash", []byte(hash), 0666); err != nil {
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	if err = utils.WriteFileAtomic(imgFilename+".hash", []byte(hash)); err != nil {
 		return err
 	}
 
-	if manifest.NodeMCUFirmware != "" {
+	// variants share the NodeMCU firmware of the device
+	if manifest.NodeMCUFirmware != "" && manifest.Variant == "" {
 		binFilename := filepath.Join(outputDir, fmt.Sprintf("%s.bin", manifest.ID))
 		hash, err = utils.CopyFile(manifest.NodeMCUFirmware, binFilename, true)
 		if err != nil {
 			return fmt.Errorf("Cannot copy NodeMCU firmware image %s to %s: %s", manifest.NodeMCUFirmware, outputDir, err)
 		}
-		err = ioutil.WriteFile(binFilename+".hash", []byte(hash), 0666)
+		err = utils.WriteFileAtomic(binFilename+".hash", []byte(hash))
 	}
 
 	return err
 }
 
-func Build(config *config.BuildConfig) error {
-	if err := utils.RemoveDirContents(config.Output); err != nil {
-		return fmt.Errorf("cannot remove output dir (%s) contents: %s", config.Output, err)
+// LoadLibraries scans all the library folders matched by the configured lib
+// globs, returning them indexed by path
+func LoadLibraries(config *config.BuildConfig) (map[string]*FirmwareLib, error) {
+	fc := buildFileCache(config)
+	defer fc.save()
+	return loadLibraries(config, fc)
+}
+
+// buildFileCache opens the persisted file cache, or an in-memory one if no
+// cache dir is configured, so libraries can be loaded from prescanned files
+func buildFileCache(config *config.BuildConfig) *fileCache {
+	fc := openFileCache(config.CacheDir, config.GetDirectiveKeywords(), newBuildLog(config))
+	if fc == nil {
+		fc = newFileCache("", config.GetDirectiveKeywords(), newBuildLog(config))
 	}
+	return fc
+}
 
+func loadLibraries(config *config.BuildConfig, fc *fileCache) (map[string]*FirmwareLib, error) {
 	allLibs := make(map[string]*FirmwareLib)
-
+	var libPaths []string
 	for _, libGlob := range config.Libs {
+		if isRemote(libGlob) {
+			libPaths = append(libPaths, libGlob)
+			continue
+		}
 		libNames, _ := filepath.Glob(libGlob)
 		for _, libName := range libNames {
 			fi, err := os.Stat(libName)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			if fi.IsDir() {
-				_, err = LoadLibrary(libName, allLibs, 0)
+				libPaths = append(libPaths, libName)
+			}
+		}
+	}
+
+	if err := prescanLibraries(config, libPaths, fc); err != nil {
+		return nil, err
+	}
+	for _, libPath := range libPaths {
+		if _, err := loadLibrary(config, libPath, allLibs, 0, fc); err != nil {
+			return nil, err
+		}
+	}
+	return allLibs, nil
+}
+
+// prescanLibraries hashes and parses the files of all the local libraries
+// through a single pool of config.GetParallelism() workers, storing the
+// results in fc so loading the libraries afterwards finds them all scanned.
+// Scan errors are left for loadLibrary to report.
+func prescanLibraries(config *config.BuildConfig, libPaths []string, fc *fileCache) error {
+	parseImportRegex := importRegex(config.GetDirectiveKeywords())
+	type scanJob struct {
+		path       string
+		libVersion string
+	}
+	var files []scanJob
+	for _, libPath := range libPaths {
+		if isRemote(libPath) {
+			continue
+		}
+		var libDef LibDef
+		utils.ReadJSON(filepath.Join(libPath, "library.json"), &libDef)
+		list, err := utils.EnumerateDir(libPath, config.GetTestPatterns()...)
+		if err != nil {
+			return err
+		}
+		for _, f := range list {
+			if f != "library.json" && config.IsExtensionAllowed(filepath.Ext(f)) {
+				files = append(files, scanJob{filepath.Join(libPath, f), libDef.Version})
+			}
+		}
+	}
+
+	jobs := make(chan scanJob)
+	wg := sync.WaitGroup{}
+	for i := 0; i < config.GetParallelism(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				scanFile(job.path, parseImportRegex, fc, job.libVersion)
+			}
+		}()
+	}
+	for _, job := range files {
+		jobs <- job
+	}
+	close(jobs)
+	wg.Wait()
+	return nil
+}
+
+// Build builds all the devices, emptying the output directory first unless
+// config.NoClean is set
+func Build(config *config.BuildConfig) error {
+	if !config.NoClean {
+		if err := utils.RemoveDirContents(config.Output); err != nil {
+			return fmt.Errorf("cannot remove output dir (%s) contents: %s", config.Output, err)
+		}
+	}
+	return buildDevices(config, nil)
+}
+
+// BuildDevices builds only the devices with the given ids, leaving the images
+// of other devices in the output directory untouched
+func BuildDevices(config *config.BuildConfig, deviceIDs []string) error {
+	selected := make(map[string]bool)
+	for _, id := range deviceIDs {
+		selected[id] = true
+	}
+	return buildDevices(config, selected)
+}
+
+// buildDevices builds the devices whose id is in selected, or all of them if
+// selected is nil
+func buildDevices(config *config.BuildConfig, selected map[string]bool) error {
+	config = stampConfig(config)
+	imageWriter, err := GetImageWriter(config.ImageVersion)
+	if err != nil {
+		return err
+	}
+
+	// one file cache serves the libraries and all the devices, saved once
+	fc := buildFileCache(config)
+	defer fc.save()
+	allLibs, err := loadLibraries(config, fc)
+	if err != nil {
+		return err
+	}
+
+	devicePaths, err := DevicePaths(config)
+	if err != nil {
+		return err
+	}
+
+	cache := newLFSCache(config.CacheDir)
+
+	// libraries are loaded serially since they share allLibs, then the
+	// devices are built concurrently, so distinct LFS images compile in parallel
+	type deviceJob struct {
+		devicePath string
+		fwDef      FirmwareDef
+		rootLib    *FirmwareLib
+		manifest   *FirmwareManifest
+		variants   []*FirmwareManifest
+		err        error
+	}
+	var jobs []*deviceJob
+	for _, devicePath := range devicePaths {
+		deviceName := filepath.Base(devicePath)
+		fwDef, err := ReadFirmwareDef(config, devicePath)
+		if err != nil {
+			return fmt.Errorf("Cannot read firmware file for %s in %s: %s", deviceName, devicePath, err)
+		}
+		if selected != nil && !selected[fwDef.ID] {
+			continue
+		}
+		deviceRootLib, err := loadLibrary(config, devicePath, allLibs, 0, fc)
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, &deviceJob{devicePath: devicePath, fwDef: fwDef, rootLib: deviceRootLib})
+	}
+	if selected != nil {
+		found := make(map[string]bool, len(jobs))
+		for _, job := range jobs {
+			found[job.fwDef.ID] = true
+		}
+		var unknown []string
+		for id := range selected {
+			if !found[id] {
+				unknown = append(unknown, id)
+			}
+		}
+		if len(unknown) > 0 {
+			sort.Strings(unknown)
+			return fmt.Errorf("No device found with id %s", strings.Join(unknown, ", "))
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	sem := make(chan struct{}, config.GetParallelism())
+	for _, job := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(job *deviceJob) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			job.manifest, job.err = buildDeviceManifest(config, job.devicePath, job.rootLib, job.fwDef, cache)
+			if job.err != nil {
+				return
+			}
+			variants, err := deviceVariants(job.fwDef)
+			if err != nil {
+				job.err = err
+				return
+			}
+			for _, variant := range variants {
+				manifest, err := buildDeviceManifest(config, job.devicePath, job.rootLib, variant.fwDef, cache)
 				if err != nil {
-					return err
+					job.err = err
+					return
 				}
+				manifest.Variant = variant.name
+				job.variants = append(job.variants, manifest)
 			}
+		}(job)
+	}
+	wg.Wait()
+
+	manifests := make([]*FirmwareManifest, 0, len(jobs))
+	for _, job := range jobs {
+		if job.err != nil {
+			return job.err
+		}
+		manifests = append(manifests, job.manifest)
+	}
+	if config.Lockfile != "" {
+		if err := checkLockfile(config, manifests, selected == nil); err != nil {
+			return err
 		}
 	}
 
+	for _, job := range jobs {
+		for _, manifest := range append([]*FirmwareManifest{job.manifest}, job.variants...) {
+			if config.ChecksumOnly {
+				if err := writeManifestSum(manifest, config.Output); err != nil {
+					return fmt.Errorf("Error writing checksum for %s: %s", job.devicePath, err)
+				}
+				continue
+			}
+			if err := utils.WriteJSON(filepath.Join(config.Output, artifactName(manifest)+".json"), manifest); err != nil {
+				return err
+			}
+			if err = writeFirmwareImage(manifest, config.Output, imageWriter); err != nil {
+				return fmt.Errorf("Error writing firmware image for %s: %s", job.devicePath, err)
+			}
+		}
+	}
+	return nil
+}
+
+// DevicePaths returns the device folders matched by the configured device globs
+func DevicePaths(config *config.BuildConfig) ([]string, error) {
+	var devicePaths []string
 	for _, deviceDef := range config.Devices {
 		devices, _ := filepath.Glob(deviceDef)
 		for _, devicePath := range devices {
 			fi, err := os.Stat(devicePath)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			if fi.IsDir() {
-				deviceRootLib, err := LoadLibrary(devicePath, allLibs, 0)
-				if err != nil {
-					return err
-				}
+				devicePaths = append(devicePaths, devicePath)
+			}
+		}
+	}
+	return devicePaths, nil
+}
 
-				var fwDef FirmwareDef
-				deviceName := filepath.Base(devicePath)
-				if err := utils.ReadJSON(filepath.Join(devicePath, "firmware.json"), &fwDef); err != nil {
-					return fmt.Errorf("Cannot read firmware file for %s in %s: %s", deviceName, devicePath, err)
-				}
+func buildDevice(config *config.BuildConfig, devicePath string, fwDef FirmwareDef, allLibs map[string]*FirmwareLib, cache *lfsCache) (*FirmwareManifest, error) {
+	deviceRootLib, err := LoadLibrary(config, devicePath, allLibs, 0)
+	if err != nil {
+		return nil, err
+	}
+	return buildDeviceManifest(config, devicePath, deviceRootLib, fwDef, cache)
+}
 
-				manifest, err := buildDeviceFirmwareManifest(deviceRootLib, fwDef)
-				if err != nil {
-					return fmt.Errorf("Error building device firmware for device with name %q: %s", fi.Name(), err)
-				}
-				if err := utils.WriteJSON(filepath.Join(config.Output, manifest.ID+".json"), manifest); err != nil {
-					return err
-				}
-				if err = writeFirmwareImage(manifest, config.Output); err != nil {
-					return fmt.Errorf("Error writing firmware image for %s: %s", devicePath, err)
-				}
+func buildDeviceManifest(config *config.BuildConfig, devicePath string, deviceRootLib *FirmwareLib, fwDef FirmwareDef, cache *lfsCache) (*FirmwareManifest, error) {
+	manifest, err := buildDeviceFirmwareManifest(config, deviceRootLib, fwDef, cache)
+	if err != nil {
+		if _, ok := err.(*BuildError); ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Error building device firmware for device with name %q: %s", filepath.Base(devicePath), err)
+	}
+	return manifest, nil
+}
 
-			}
+// BuildManifest builds the firmware manifest of a single device in memory,
+// without writing anything to the output directory
+func BuildManifest(config *config.BuildConfig, deviceID string) (*FirmwareManifest, error) {
+	devicePath, fwDef, err := FindDevice(config, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	allLibs, err := LoadLibraries(config)
+	if err != nil {
+		return nil, err
+	}
+	return buildDevice(config, devicePath, fwDef, allLibs, newLFSCache(config.CacheDir))
+}
+
+// FindDevice returns the folder and firmware definition of the device with
+// the given id
+func FindDevice(config *config.BuildConfig, deviceID string) (string, FirmwareDef, error) {
+	devicePaths, err := DevicePaths(config)
+	if err != nil {
+		return "", FirmwareDef{}, err
+	}
+
+	for _, devicePath := range devicePaths {
+		fwDef, err := ReadFirmwareDef(config, devicePath)
+		if err != nil || fwDef.ID != deviceID {
+			continue
 		}
+		return devicePath, fwDef, nil
 	}
-	return nil
+	return "", FirmwareDef{}, fmt.Errorf("Cannot find device with id %q", deviceID)
 }
 
 func isLua(path string) bool {
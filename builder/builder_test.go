@@ -0,0 +1,1412 @@
+package builder
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"espore/config"
+	"espore/utils"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestLuacRetry(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	defer func(f func([]*FileEntry, string) error) { luac = f }(luac)
+	defer func(f func(time.Duration)) { retrySleep = f }(retrySleep)
+	var delays []time.Duration
+	retrySleep = func(d time.Duration) { delays = append(delays, d) }
+
+	var calls int
+	luac = func(sourceEntries []*FileEntry, dstFile string) error {
+		calls++
+		if calls == 1 {
+			return errors.New("transient failure")
+		}
+		return nil
+	}
+
+	// first attempt fails, second succeeds after waiting
+	cfg := &config.BuildConfig{}
+	t.Ok(luacWithRetry(cfg, nil, "out.lfs", nil))
+	t.Equals(2, calls)
+	t.Equals([]time.Duration{luacRetryDelay}, delays)
+
+	// exhausting all retries returns the last error, waiting longer each time
+	calls, delays = 0, nil
+	luac = func(sourceEntries []*FileEntry, dstFile string) error {
+		calls++
+		return errors.New("permanent failure")
+	}
+	cfg.LuacRetries = 4
+	err := luacWithRetry(cfg, nil, "out.lfs", nil)
+	t.Assert(err != nil, "Expected an error after exhausting retries")
+	t.Equals(4, calls)
+	t.Equals([]time.Duration{luacRetryDelay, 2 * luacRetryDelay, 4 * luacRetryDelay}, delays)
+
+	// syntax errors are not retried
+	calls, delays = 0, nil
+	luac = func(sourceEntries []*FileEntry, dstFile string) error {
+		calls++
+		return &BuildError{File: "main.lua", Line: 1, Message: "syntax error"}
+	}
+	err = luacWithRetry(cfg, nil, "out.lfs", nil)
+	t.Assert(err != nil, "Expected the syntax error")
+	t.Equals(1, calls)
+	t.Equals(0, len(delays))
+}
+
+func TestParseImportDirectives(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	code := `-- import: net.wifi, net.mqtt
+--import:util
+--[[ import: a, b, c ]]
+--[[import:
+	d ,
+	e,f
+]]
+local x = require("g")
+`
+	info := parseDependenciesAndDatafiles(code, importRegex([]string{"import"}))
+	deps, depLines := info.Dependencies, info.DependencyLines
+	sort.Strings(deps)
+	t.Equals([]string{"a", "b", "c", "d", "e", "f", "g", "net.mqtt", "net.wifi", "util"}, deps)
+	t.Equals(1, depLines["net.mqtt"])
+	t.Equals(3, depLines["c"])
+	t.Equals(5, depLines["d"])
+	t.Equals(6, depLines["f"])
+	t.Equals(8, depLines["g"])
+}
+
+func TestAddPassthroughFiles(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	devicePath, err := ioutil.TempDir("", "espore-device")
+	t.Ok(err)
+	defer os.RemoveAll(devicePath)
+
+	cert := []byte("-----BEGIN CERTIFICATE-----\n")
+	t.Ok(os.MkdirAll(filepath.Join(devicePath, "certs"), 0755))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "certs", "ca.pem"), cert, 0644))
+
+	fileMap := make(map[string]*FileEntry)
+	t.Ok(AddPassthroughFiles(devicePath, []string{"certs/ca.pem"}, fileMap))
+	entry := fileMap["certs/ca.pem"]
+	t.Assert(entry != nil, "Expected certs/ca.pem in file map")
+	t.Equals(devicePath, entry.Base)
+	t.Equals(NewVirtualFileEntry(cert, "").Hash, entry.Hash)
+
+	// absolute paths are shipped under their base name
+	fileMap = make(map[string]*FileEntry)
+	t.Ok(AddPassthroughFiles("", []string{filepath.Join(devicePath, "certs", "ca.pem")}, fileMap))
+	t.Assert(fileMap["ca.pem"] != nil, "Expected ca.pem in file map")
+
+	// absolute paths with the same base name would overwrite each other
+	t.Ok(os.MkdirAll(filepath.Join(devicePath, "other"), 0755))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "other", "ca.pem"), cert, 0644))
+	err = AddPassthroughFiles("", []string{
+		filepath.Join(devicePath, "certs", "ca.pem"),
+		filepath.Join(devicePath, "other", "ca.pem"),
+	}, make(map[string]*FileEntry))
+	t.Assert(err != nil && strings.Contains(err.Error(), "ca.pem"), "Expected a collision error, got %v", err)
+
+	err = AddPassthroughFiles(devicePath, []string{"certs/missing.pem"}, fileMap)
+	t.Assert(err != nil && strings.Contains(err.Error(), "certs/missing.pem"), "Expected error naming the missing file, got %v", err)
+}
+
+func TestAddFilesFromModuleChain(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	libs := []*FirmwareLib{
+		{
+			Files: map[string]*FileEntry{
+				"app.lua":      {Path: "app.lua", Dependencies: []string{"net.wifi"}},
+				"net/wifi.lua": {Path: "net/wifi.lua", Dependencies: []string{"net.dhcp"}},
+			},
+		},
+	}
+
+	err := AddFilesFromModule("app", libs, make(map[string]*FileEntry))
+	t.Assert(err != nil, "Expected missing leaf module to fail")
+	buildErr, ok := err.(*BuildError)
+	t.Assert(ok, "Expected a BuildError")
+	t.Equals("module app -> net.wifi -> net.dhcp: file net/dhcp.lua not found in libraries", buildErr.Message)
+}
+
+func TestDofileIncludes(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	code := `local M = {}
+dofile("setup.lua")
+local f = loadfile( "handlers/http.lua" )
+local x = mylib.dofile("ignored.lua")
+return M
+`
+	info := parseDependenciesAndDatafiles(code, importRegex([]string{"import"}))
+	t.Equals([]string{"setup.lua", "handlers/http.lua"}, info.Includes)
+	t.Equals(map[string]int{"setup.lua": 2, "handlers/http.lua": 3}, info.IncludeLines)
+
+	libs := []*FirmwareLib{
+		{
+			Files: map[string]*FileEntry{
+				"app.lua":           {Path: "app.lua", Includes: info.Includes},
+				"setup.lua":         {Path: "setup.lua", Dependencies: []string{"util"}},
+				"util.lua":          {Path: "util.lua"},
+				"handlers/http.lua": {Path: "handlers/http.lua"},
+			},
+		},
+	}
+	fileMap := make(map[string]*FileEntry)
+	t.Ok(AddFilesFromModule("app", libs, fileMap))
+	t.Equals(4, len(fileMap))
+	t.Assert(fileMap["handlers/http.lua"] != nil, "Expected loaded file to be included")
+	t.Assert(fileMap["util.lua"] != nil, "Expected dependencies of loaded file to be included")
+
+	libs[0].Files["app.lua"].Includes = []string{"missing.lua"}
+	err := AddFilesFromModule("app", libs, make(map[string]*FileEntry))
+	buildErr, ok := err.(*BuildError)
+	t.Assert(ok, "Expected a BuildError")
+	t.Equals("module app: loaded file missing.lua not found in libraries", buildErr.Message)
+}
+
+func TestDeclarationLines(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	code := `-- datafile: settings.json
+local M = {}
+local wifi = require("net.wifi")
+
+-- datafile: calibration.dat
+local ok, mqtt = pcall(require, "net.mqtt")
+local again = require("net.wifi")
+-- datafile: settings.json
+return M
+`
+	info := parseDependenciesAndDatafiles(code, importRegex([]string{"import"}))
+	t.Equals([]string{"net.wifi", "net.mqtt"}, info.Dependencies)
+	t.Equals(map[string]int{"net.wifi": 3, "net.mqtt": 6}, info.DependencyLines)
+	t.Equals([]string{"settings.json", "calibration.dat"}, info.Datafiles)
+	t.Equals(map[string]int{"settings.json": 1, "calibration.dat": 5}, info.DatafileLines)
+}
+
+func TestCustomDirectiveKeywords(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	code := `-- requires: net.wifi
+--[[ needs: util, log ]]
+-- import: ignored
+`
+	deps := parseDependenciesAndDatafiles(code, importRegex([]string{"requires", "needs"})).Dependencies
+	sort.Strings(deps)
+	t.Equals([]string{"log", "net.wifi", "util"}, deps)
+}
+
+func TestModulesOnlyLibrary(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	libs := []*FirmwareLib{
+		{
+			ModulesOnly: true,
+			Files: map[string]*FileEntry{
+				"sensor.lua": {Path: "sensor.lua"},
+				"unused.lua": {Path: "unused.lua"},
+				"style.css":  {Path: "style.css"},
+			},
+		},
+	}
+
+	fileMap := make(map[string]*FileEntry)
+	t.Ok(AddFilesFromModule("sensor", libs, fileMap))
+	t.Ok(AddOtherFiles(libs, fileMap, nil, ""))
+
+	t.Equals(1, len(fileMap))
+	t.Assert(fileMap["sensor.lua"] != nil, "Expected sensor.lua to be included")
+}
+
+func TestMissingRequireBuildError(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	libPath, err := ioutil.TempDir("", "espore-lib")
+	t.Ok(err)
+	defer os.RemoveAll(libPath)
+
+	code := "local M = {}\n\nlocal missing = require(\"missing\")\nreturn M\n"
+	t.Ok(ioutil.WriteFile(filepath.Join(libPath, "app.lua"), []byte(code), 0644))
+
+	lib, err := LoadLibrary(&config.BuildConfig{}, libPath, make(map[string]*FirmwareLib), 0)
+	t.Ok(err)
+
+	err = AddFilesFromModule("app", []*FirmwareLib{lib}, make(map[string]*FileEntry))
+	buildErr, ok := err.(*BuildError)
+	t.Assert(ok, "Expected a BuildError, got %v", err)
+	t.Equals(filepath.Join(libPath, "app.lua"), buildErr.File)
+	t.Equals(3, buildErr.Line)
+
+	data, err := ErrorJSON(err)
+	t.Ok(err)
+	var record map[string]interface{}
+	t.Ok(json.Unmarshal(data, &record))
+	t.Equals(filepath.Join(libPath, "app.lua"), record["file"])
+	t.Equals(float64(3), record["line"])
+}
+
+func TestControlFilesExcluded(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	defer func(f func([]*FileEntry, string) error) { luac = f }(luac)
+	luac = func(sourceEntries []*FileEntry, dstFile string) error {
+		return ioutil.WriteFile(dstFile, []byte("lfs"), 0644)
+	}
+
+	devicePath, err := ioutil.TempDir("", "espore-device")
+	t.Ok(err)
+	defer os.RemoveAll(devicePath)
+
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "firmware.json"), []byte(`{"name": "kitchen", "id": "1234"}`), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "main.lua"), []byte("return 1\n"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "index.html"), []byte("<html></html>"), 0644))
+
+	manifest, err := BuildManifest(&config.BuildConfig{Devices: []string{devicePath}}, "1234")
+	t.Ok(err)
+
+	paths := make(map[string]bool)
+	for _, fe := range manifest.Files {
+		paths[fe.Path] = true
+	}
+	t.Assert(!paths["firmware.json"], "Expected firmware.json to be excluded from the manifest")
+	t.Assert(paths["index.html"], "Expected index.html in the manifest")
+	t.Assert(paths["lfs.img"], "Expected lfs.img in the manifest")
+}
+
+func TestLFSLibsAndModules(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	var packed []string
+	defer func(f func([]*FileEntry, string) error) { luac = f }(luac)
+	luac = func(sourceEntries []*FileEntry, dstFile string) error {
+		packed = nil
+		for _, fe := range sourceEntries {
+			packed = append(packed, fe.Path)
+		}
+		sort.Strings(packed)
+		return ioutil.WriteFile(dstFile, []byte("lfs"), 0644)
+	}
+
+	root, err := ioutil.TempDir("", "espore-lfs")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+
+	sensors := filepath.Join(root, "sensors")
+	t.Ok(os.MkdirAll(sensors, 0755))
+	t.Ok(ioutil.WriteFile(filepath.Join(sensors, "library.json"), []byte(`{"name": "sensors"}`), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(sensors, "dht.lua"), []byte("return 1\n"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(sensors, "bmp.lua"), []byte("return 2\n"), 0644))
+	util := filepath.Join(root, "util")
+	t.Ok(os.MkdirAll(util, 0755))
+	t.Ok(ioutil.WriteFile(filepath.Join(util, "library.json"), []byte(`{"name": "util"}`), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(util, "strings.lua"), []byte("return 3\n"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(util, "tables.lua"), []byte("return 4\n"), 0644))
+
+	devicePath := filepath.Join(root, "device")
+	t.Ok(os.MkdirAll(devicePath, 0755))
+	libJSON := `{"dependencies": [` + strconv.Quote(sensors) + `, ` + strconv.Quote(util) + `]}`
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "library.json"), []byte(libJSON), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "firmware.json"), []byte(`{"name": "kitchen", "id": "1234", "lfs": {"libs": ["sensors"], "modules": ["strings"]}}`), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "main.lua"), []byte("require(\"dht\")\nrequire(\"bmp\")\nrequire(\"strings\")\nrequire(\"tables\")\n"), 0644))
+
+	manifest, err := BuildManifest(&config.BuildConfig{Devices: []string{devicePath}, Reproducible: true}, "1234")
+	t.Ok(err)
+	t.Equals([]string{"__lfsinit.lua", "bmp.lua", "dht.lua", "strings.lua"}, packed)
+
+	loose := make(map[string]bool)
+	for _, fe := range manifest.Files {
+		loose[fe.Path] = true
+	}
+	t.Assert(loose["lfs.img"], "Expected lfs.img in the manifest")
+	t.Assert(loose["main.lua"] && loose["tables.lua"], "Expected files outside the LFS set to stay loose, got %v", loose)
+	t.Assert(!loose["dht.lua"] && !loose["bmp.lua"] && !loose["strings.lua"], "Expected LFS sources to be left out, got %v", loose)
+
+	// an unknown library is reported instead of silently packing nothing
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "firmware.json"), []byte(`{"name": "kitchen", "id": "1234", "lfs": {"libs": ["nope"]}}`), 0644))
+	_, err = BuildManifest(&config.BuildConfig{Devices: []string{devicePath}, Reproducible: true}, "1234")
+	t.Assert(err != nil && strings.Contains(err.Error(), `"nope"`), "Expected an unknown LFS library error, got %v", err)
+}
+
+func TestAllowedExtensions(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	libPath, err := ioutil.TempDir("", "espore-lib")
+	t.Ok(err)
+	defer os.RemoveAll(libPath)
+
+	for _, name := range []string{"main.lua", "index.html", "mockup.png"} {
+		t.Ok(ioutil.WriteFile(filepath.Join(libPath, name), []byte("x"), 0644))
+	}
+
+	lib, err := LoadLibrary(&config.BuildConfig{AllowedExtensions: []string{".html"}}, libPath, make(map[string]*FirmwareLib), 0)
+	t.Ok(err)
+	t.Assert(lib.Files["main.lua"] != nil, "Expected main.lua to be always allowed")
+	t.Assert(lib.Files["index.html"] != nil, "Expected index.html to be allowed")
+	t.Assert(lib.Files["mockup.png"] == nil, "Expected mockup.png to be excluded")
+
+	lib, err = LoadLibrary(&config.BuildConfig{}, libPath, make(map[string]*FirmwareLib), 0)
+	t.Ok(err)
+	t.Assert(lib.Files["mockup.png"] != nil, "Expected mockup.png with an empty allow-list")
+}
+
+func TestBuildDeviceGroup(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	defer func(f func([]*FileEntry, string) error) { luac = f }(luac)
+	luac = func(sourceEntries []*FileEntry, dstFile string) error {
+		return ioutil.WriteFile(dstFile, []byte("lfs"), 0644)
+	}
+
+	root, err := ioutil.TempDir("", "espore-build")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+
+	for _, id := range []string{"1111", "2222", "3333"} {
+		devicePath := filepath.Join(root, "devices", id)
+		t.Ok(os.MkdirAll(devicePath, 0755))
+		t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "firmware.json"), []byte(`{"name": "dev`+id+`", "id": "`+id+`"}`), 0644))
+		t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "main.lua"), []byte("return 1\n"), 0644))
+	}
+	output := filepath.Join(root, "dist")
+	t.Ok(os.MkdirAll(output, 0755))
+
+	ec := &config.EsporeConfig{
+		Build: config.BuildConfig{
+			Devices: []string{filepath.Join(root, "devices", "*")},
+			Output:  output,
+		},
+		Groups: map[string][]string{"sensors": {"1111", "3333"}},
+	}
+	ids, err := ec.ExpandDevices([]string{"@sensors"})
+	t.Ok(err)
+	t.Ok(BuildDevices(&ec.Build, ids))
+
+	built, err := filepath.Glob(filepath.Join(output, "*.json"))
+	t.Ok(err)
+	t.Equals([]string{filepath.Join(output, "1111.json"), filepath.Join(output, "3333.json")}, built)
+
+	err = BuildDevices(&ec.Build, []string{"1111", "9999", "8888"})
+	t.Assert(err != nil && strings.Contains(err.Error(), "8888, 9999"), "Expected unknown ids to be reported, got %v", err)
+}
+
+func TestBuildNoClean(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	defer func(f func([]*FileEntry, string) error) { luac = f }(luac)
+	luac = func(sourceEntries []*FileEntry, dstFile string) error {
+		return ioutil.WriteFile(dstFile, []byte("lfs"), 0644)
+	}
+
+	root, err := ioutil.TempDir("", "espore-build")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+
+	for _, id := range []string{"1111", "2222"} {
+		devicePath := filepath.Join(root, "devices", id)
+		t.Ok(os.MkdirAll(devicePath, 0755))
+		t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "firmware.json"), []byte(`{"name": "dev`+id+`", "id": "`+id+`"}`), 0644))
+		t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "main.lua"), []byte("return 1\n"), 0644))
+	}
+	output := filepath.Join(root, "dist")
+	t.Ok(os.MkdirAll(output, 0755))
+
+	cfg := &config.BuildConfig{
+		Devices: []string{filepath.Join(root, "devices", "*")},
+		Output:  output,
+	}
+	t.Ok(Build(cfg))
+	artifacts := func() []string {
+		files, err := filepath.Glob(filepath.Join(output, "2222.*"))
+		t.Ok(err)
+		return files
+	}
+	built := artifacts()
+	t.Assert(len(built) > 0, "Expected artifacts for device 2222")
+
+	// rebuild only the first device, updating its artifacts in place
+	t.Ok(ioutil.WriteFile(filepath.Join(root, "devices", "1111", "data.txt"), []byte("updated"), 0644))
+	cfg.Devices = []string{filepath.Join(root, "devices", "1111")}
+	cfg.NoClean = true
+	t.Ok(Build(cfg))
+	t.Equals(built, artifacts())
+	manifest, err := ReadManifest(filepath.Join(output, "1111.json"))
+	t.Ok(err)
+	t.Ok(CheckDevice(output, "1111"))
+	var found bool
+	for _, fe := range manifest.Files {
+		if fe.Path == "data.txt" {
+			t.Equals(NewVirtualFileEntry([]byte("updated"), "data.txt").Hash, fe.Hash)
+			found = true
+		}
+	}
+	t.Assert(found, "Expected the rebuilt manifest to include data.txt")
+
+	// a clean build removes the artifacts of devices not built
+	cfg.NoClean = false
+	t.Ok(Build(cfg))
+	t.Equals(0, len(artifacts()))
+}
+
+func TestBuildChecksumOnly(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	defer func(f func([]*FileEntry, string) error) { luac = f }(luac)
+	luac = func(sourceEntries []*FileEntry, dstFile string) error {
+		return errors.New("LFS must not be compiled in checksum-only mode")
+	}
+
+	root, err := ioutil.TempDir("", "espore-sum")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+
+	for _, id := range []string{"1111", "2222"} {
+		devicePath := filepath.Join(root, "devices", id)
+		t.Ok(os.MkdirAll(devicePath, 0755))
+		t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "firmware.json"), []byte(`{"name": "dev`+id+`", "id": "`+id+`"}`), 0644))
+		t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "main.lua"), []byte("return 1\n"), 0644))
+	}
+	output := filepath.Join(root, "dist")
+	t.Ok(os.MkdirAll(output, 0755))
+
+	cfg := &config.BuildConfig{
+		Devices:      []string{filepath.Join(root, "devices", "*")},
+		Output:       output,
+		ChecksumOnly: true,
+	}
+	sums := func() map[string]string {
+		t.Ok(Build(cfg))
+		files, err := filepath.Glob(filepath.Join(output, "*"))
+		t.Ok(err)
+		t.Equals(2, len(files))
+		sums := make(map[string]string)
+		for _, id := range []string{"1111", "2222"} {
+			data, err := ioutil.ReadFile(filepath.Join(output, id+SumExtension))
+			t.Ok(err)
+			sums[id] = string(data)
+		}
+		return sums
+	}
+
+	first := sums()
+	t.Equals(first, sums())
+
+	t.Ok(ioutil.WriteFile(filepath.Join(root, "devices", "1111", "main.lua"), []byte("return 2\n"), 0644))
+	changed := sums()
+	t.Assert(first["1111"] != changed["1111"], "Expected the sum of the changed device to change")
+	t.Equals(first["2222"], changed["2222"])
+}
+
+func TestBuildStamp(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	defer func(f func() time.Time) { buildTime = f }(buildTime)
+	defer func(f func() string) { gitRevision = f }(gitRevision)
+	buildTime = func() time.Time { return time.Date(2020, 5, 17, 10, 30, 0, 0, time.UTC) }
+	gitRevision = func() string { return "abc123" }
+
+	builtAt, revision := buildStamp(&config.BuildConfig{})
+	t.Equals("2020-05-17T10:30:00Z", builtAt)
+	t.Equals("abc123", revision)
+
+	builtAt, revision = buildStamp(&config.BuildConfig{Revision: "v1.0"})
+	t.Equals("2020-05-17T10:30:00Z", builtAt)
+	t.Equals("v1.0", revision)
+
+	builtAt, revision = buildStamp(&config.BuildConfig{Reproducible: true})
+	t.Equals("", builtAt)
+	t.Equals("", revision)
+
+	builtAt, revision = buildStamp(&config.BuildConfig{Reproducible: true, BuiltAt: "2000-01-01T00:00:00Z"})
+	t.Equals("2000-01-01T00:00:00Z", builtAt)
+	t.Equals("", revision)
+
+	// a stamped config resolves the revision once, even when there is none
+	var calls int
+	gitRevision = func() string {
+		calls++
+		return ""
+	}
+	stamped := stampConfig(&config.BuildConfig{})
+	for i := 0; i < 3; i++ {
+		builtAt, revision = buildStamp(stamped)
+		t.Equals("2020-05-17T10:30:00Z", builtAt)
+		t.Equals("", revision)
+	}
+	t.Equals(1, calls)
+}
+
+func TestStrictIncludes(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	libPath, err := ioutil.TempDir("", "espore-lib")
+	t.Ok(err)
+	defer os.RemoveAll(libPath)
+
+	t.Ok(ioutil.WriteFile(filepath.Join(libPath, "index.html"), []byte("x"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(libPath, "library.json"), []byte(`{"name": "web", "include": ["*.html"]}`), 0644))
+
+	strict := &config.BuildConfig{StrictIncludes: true}
+	lib, err := LoadLibrary(strict, libPath, make(map[string]*FirmwareLib), 0)
+	t.Ok(err)
+	t.Assert(lib.Files["index.html"] != nil, "Expected index.html to be included")
+
+	t.Ok(ioutil.WriteFile(filepath.Join(libPath, "library.json"), []byte(`{"name": "web", "include": ["*.html", "*.htm"]}`), 0644))
+	_, err = LoadLibrary(strict, libPath, make(map[string]*FirmwareLib), 0)
+	buildErr, ok := err.(*BuildError)
+	t.Assert(ok, "Expected a BuildError, got %v", err)
+	t.Equals(`include pattern "*.htm" in library "web" matches no files`, buildErr.Message)
+
+	_, err = LoadLibrary(&config.BuildConfig{}, libPath, make(map[string]*FirmwareLib), 0)
+	t.Ok(err)
+}
+
+func TestDeviceIncludes(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	libPath, err := ioutil.TempDir("", "espore-lib")
+	t.Ok(err)
+	defer os.RemoveAll(libPath)
+
+	t.Ok(ioutil.WriteFile(filepath.Join(libPath, "index.html"), []byte("x"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(libPath, "config-1111.lua"), []byte("return 1"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(libPath, "config-2222.lua"), []byte("return 2"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(libPath, "library.json"), []byte(`{"name": "app", "include": ["*.html", "config-${ID}.lua"]}`), 0644))
+
+	lib, err := LoadLibrary(&config.BuildConfig{}, libPath, make(map[string]*FirmwareLib), 0)
+	t.Ok(err)
+	t.Assert(lib.Files["config-1111.lua"] == nil, "Expected device files to be kept out of the library files")
+	t.Equals(2, len(lib.DeviceFiles))
+
+	for _, id := range []string{"1111", "2222"} {
+		fileMap := make(map[string]*FileEntry)
+		t.Ok(AddOtherFiles([]*FirmwareLib{lib}, fileMap, nil, id))
+		t.Assert(fileMap["index.html"] != nil, "Expected index.html for device %s", id)
+		t.Assert(fileMap["config-"+id+".lua"] != nil, "Expected config-%s.lua for device %s", id, id)
+		t.Equals(2, len(fileMap))
+	}
+}
+
+func TestDeviceDatafiles(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	root, err := ioutil.TempDir("", "espore-datafiles")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+
+	libPath := filepath.Join(root, "sensors")
+	t.Ok(os.MkdirAll(libPath, 0755))
+	t.Ok(ioutil.WriteFile(filepath.Join(libPath, "library.json"), []byte(`{"name": "sensors", "include": ["*.lua", "calib-${ID}.json"]}`), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(libPath, "sensor.lua"), []byte("-- datafile: calib-${ID}.json\nreturn 1\n"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(libPath, "calib-1111.json"), []byte(`{"offset": 1}`), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(libPath, "calib-2222.json"), []byte(`{"offset": 2}`), 0644))
+
+	for _, id := range []string{"1111", "2222"} {
+		devicePath := filepath.Join(root, "devices", id)
+		t.Ok(os.MkdirAll(devicePath, 0755))
+		t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "library.json"), []byte(`{"dependencies": [`+strconv.Quote(libPath)+`]}`), 0644))
+		t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "firmware.json"), []byte(testFirmwareJSON(id, "dev"+id)), 0644))
+		t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "main.lua"), []byte("require(\"sensor\")\n"), 0644))
+	}
+	output := filepath.Join(root, "dist")
+	t.Ok(os.MkdirAll(output, 0755))
+	t.Ok(Build(&config.BuildConfig{
+		Devices:      []string{filepath.Join(root, "devices", "*")},
+		Output:       output,
+		Reproducible: true,
+	}))
+
+	for _, id := range []string{"1111", "2222"} {
+		f, err := os.Open(filepath.Join(output, id+".img"))
+		t.Ok(err)
+		var datafiles []string
+		files := make(map[string]bool)
+		_, err = ParseImage(f, func(path string, size int64, r io.Reader) error {
+			files[path] = true
+			data, err := ioutil.ReadAll(r)
+			if err != nil || path != "datafiles.json" {
+				return err
+			}
+			return json.Unmarshal(data, &datafiles)
+		})
+		f.Close()
+		t.Ok(err)
+		t.Equals([]string{"calib-" + id + ".json"}, datafiles)
+		t.Assert(files["calib-"+id+".json"], "Expected device %s to bundle its own datafile, got %v", id, files)
+	}
+}
+
+func TestCaseCollisions(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	fileMap := map[string]*FileEntry{
+		"a.lua":    {Path: "a.lua"},
+		"b/c.json": {Path: "b/c.json"},
+	}
+	t.Ok(checkCaseCollisions(fileMap))
+
+	fileMap["A.lua"] = &FileEntry{Path: "A.lua"}
+	err := checkCaseCollisions(fileMap)
+	t.Assert(err != nil, "Expected a.lua and A.lua to collide")
+	t.Equals(`files "A.lua" and "a.lua" differ only in case`, err.Error())
+}
+
+func TestPrefixedLibrary(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	root, err := ioutil.TempDir("", "espore-lib")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+
+	vendorPath := filepath.Join(root, "vendor")
+	ownPath := filepath.Join(root, "own")
+	t.Ok(os.MkdirAll(vendorPath, 0755))
+	t.Ok(os.MkdirAll(ownPath, 0755))
+	t.Ok(ioutil.WriteFile(filepath.Join(vendorPath, "library.json"), []byte(`{"prefix": "ext", "modules": [{"name": "client"}]}`), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(vendorPath, "client.lua"), []byte(`local util = require("util")`), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(vendorPath, "util.lua"), []byte("return {}"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(ownPath, "util.lua"), []byte("return {}"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(ownPath, "app.lua"), []byte(`require("util")
+require("ext.client")`), 0644))
+
+	allLibs := make(map[string]*FirmwareLib)
+	vendor, err := LoadLibrary(&config.BuildConfig{}, vendorPath, allLibs, 0)
+	t.Ok(err)
+	own, err := LoadLibrary(&config.BuildConfig{}, ownPath, allLibs, 0)
+	t.Ok(err)
+	t.Equals("ext.client", vendor.Modules[0].Name)
+	t.Equals([]string{"ext.util"}, vendor.Files["ext/client.lua"].Dependencies)
+	t.Equals(filepath.Join(vendorPath, "util.lua"), vendor.Files["ext/util.lua"].SourcePath())
+
+	fileMap := make(map[string]*FileEntry)
+	t.Ok(AddFilesFromModule("app", []*FirmwareLib{own, vendor}, fileMap))
+	t.Equals(4, len(fileMap))
+	t.Equals(ownPath, fileMap["util.lua"].Base)
+	t.Equals(vendorPath, fileMap["ext/util.lua"].Base)
+}
+
+func BenchmarkBuildLFSDevices(b *testing.B) {
+	defer func(f func([]*FileEntry, string) error) { luac = f }(luac)
+	luac = func(sourceEntries []*FileEntry, dstFile string) error {
+		// simulate the cost of luac.cross
+		time.Sleep(20 * time.Millisecond)
+		return ioutil.WriteFile(dstFile, []byte("lfs"), 0644)
+	}
+
+	root, err := ioutil.TempDir("", "espore-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// each device has different sources, so each needs its own LFS image
+	for i := 0; i < 8; i++ {
+		id := fmt.Sprintf("%04d", i)
+		devicePath := filepath.Join(root, "devices", id)
+		if err := os.MkdirAll(devicePath, 0755); err != nil {
+			b.Fatal(err)
+		}
+		ioutil.WriteFile(filepath.Join(devicePath, "firmware.json"), []byte(`{"name": "dev`+id+`", "id": "`+id+`"}`), 0644)
+		ioutil.WriteFile(filepath.Join(devicePath, "main.lua"), []byte("return "+id+"\n"), 0644)
+	}
+	output := filepath.Join(root, "dist")
+	os.MkdirAll(output, 0755)
+
+	cfg := &config.BuildConfig{
+		Devices: []string{filepath.Join(root, "devices", "*")},
+		Output:  output,
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := Build(cfg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestInvalidIncludeGlob(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	libPath, err := ioutil.TempDir("", "espore-lib")
+	t.Ok(err)
+	defer os.RemoveAll(libPath)
+
+	t.Ok(ioutil.WriteFile(filepath.Join(libPath, "library.json"), []byte(`{"name": "web", "include": ["*.html", "[a-"]}`), 0644))
+
+	var hashed int
+	defer func(f func(string) (string, error)) { hashFile = f }(hashFile)
+	hashFile = func(path string) (string, error) {
+		hashed++
+		return utils.HashFile(path)
+	}
+
+	_, err = LoadLibrary(&config.BuildConfig{}, libPath, make(map[string]*FirmwareLib), 0)
+	buildErr, ok := err.(*BuildError)
+	t.Assert(ok, "Expected a BuildError, got %v", err)
+	t.Assert(strings.HasPrefix(buildErr.Message, `Error parsing include glob in library "web": "[a-"`), "Unexpected message %q", buildErr.Message)
+	t.Equals(0, hashed)
+}
+
+func BenchmarkLoadLibraryGlobs(b *testing.B) {
+	libPath, err := ioutil.TempDir("", "espore-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(libPath)
+
+	ioutil.WriteFile(filepath.Join(libPath, "library.json"), []byte(`{"include": ["**/*.html", "**/*.css", "**/*.js", "img/*.{png,jpg}"]}`), 0644)
+	for i := 0; i < 200; i++ {
+		ioutil.WriteFile(filepath.Join(libPath, fmt.Sprintf("page%d.html", i)), []byte("x"), 0644)
+	}
+
+	cfg := &config.BuildConfig{}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := LoadLibrary(cfg, libPath, make(map[string]*FirmwareLib), 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLoadLibraries(b *testing.B) {
+	root, err := ioutil.TempDir("", "espore-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// many small libraries, so scanning them one at a time cannot keep all
+	// the CPUs busy
+	for i := 0; i < 40; i++ {
+		libPath := filepath.Join(root, "libs", fmt.Sprintf("lib%d", i))
+		os.MkdirAll(libPath, 0755)
+		for j := 0; j < 5; j++ {
+			code := fmt.Sprintf("local m = require(\"lib%dmod%d\")\n-- %s\n", i, j+1, strings.Repeat("x", 2000))
+			ioutil.WriteFile(filepath.Join(libPath, fmt.Sprintf("lib%dmod%d.lua", i, j)), []byte(code), 0644)
+		}
+	}
+
+	for _, bench := range []struct {
+		name        string
+		parallelism int
+	}{{"sequential", 1}, {"pooled", 0}} {
+		b.Run(bench.name, func(b *testing.B) {
+			cfg := &config.BuildConfig{
+				Libs:        []string{filepath.Join(root, "libs", "*")},
+				Parallelism: bench.parallelism,
+			}
+			for n := 0; n < b.N; n++ {
+				if _, err := LoadLibraries(cfg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestAuditDeviceFiles(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	devicePath, err := ioutil.TempDir("", "espore-device")
+	t.Ok(err)
+	defer os.RemoveAll(devicePath)
+
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "main.lua"), []byte(`local util = require("util")`), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "util.lua"), []byte("return {}"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "scratch.lua"), []byte("print(1)"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "firmware.json"), []byte(`{"id": "1111"}`), 0644))
+
+	cfg := &config.BuildConfig{}
+	lib, err := LoadLibrary(cfg, devicePath, make(map[string]*FirmwareLib), 0)
+	t.Ok(err)
+	fileMap := make(map[string]*FileEntry)
+	t.Ok(AddFilesFromModule("main", []*FirmwareLib{lib}, fileMap))
+
+	warnings, err := auditDeviceFiles(lib, fileMap, cfg.GetControlFiles())
+	t.Ok(err)
+	t.Equals([]string{filepath.Join(devicePath, "scratch.lua") + ": device file is not required, loaded or explicitly included"}, warnings)
+
+	// explicitly including the file silences the warning
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "library.json"), []byte(`{"include": ["scratch.lua"]}`), 0644))
+	lib, err = LoadLibrary(cfg, devicePath, make(map[string]*FirmwareLib), 0)
+	t.Ok(err)
+	warnings, err = auditDeviceFiles(lib, fileMap, cfg.GetControlFiles())
+	t.Ok(err)
+	t.Equals(0, len(warnings))
+}
+
+func TestEmbedManifest(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	devicePath, err := ioutil.TempDir("", "espore-device")
+	t.Ok(err)
+	defer os.RemoveAll(devicePath)
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "main.lua"), []byte("print('hello')"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "index.html"), []byte("<html></html>"), 0644))
+
+	cfg := &config.BuildConfig{Reproducible: true}
+	fwDef := testFirmwareDef("1111", "kitchen")
+	manifest, _ := buildTestManifest(tx, cfg, devicePath, fwDef)
+	for _, fe := range manifest.Files {
+		t.Assert(fe.Path != EmbeddedManifestName, "Expected no embedded manifest unless enabled")
+	}
+
+	cfg.EmbedManifest = true
+	manifest, _ = buildTestManifest(tx, cfg, devicePath, fwDef)
+	var embedded *FileEntry
+	expected := make(map[string]string)
+	for _, fe := range manifest.Files {
+		if fe.Path == EmbeddedManifestName {
+			embedded = fe
+			continue
+		}
+		expected[fe.Path] = fe.Hash
+	}
+	t.Assert(embedded != nil, "Expected %s in the manifest", EmbeddedManifestName)
+
+	var hashes map[string]string
+	t.Ok(json.Unmarshal(embedded.Content, &hashes))
+	t.Equals(expected, hashes)
+	t.Assert(hashes["main.lua"] != "" && hashes["index.html"] != "", "Expected device files in %v", hashes)
+}
+
+func TestVersionModule(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	devicePath, err := ioutil.TempDir("", "espore-device")
+	t.Ok(err)
+	defer os.RemoveAll(devicePath)
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "main.lua"), []byte(`local version = require("version")
+print(version.revision)`), 0644))
+
+	cfg := &config.BuildConfig{
+		BuiltAt:       "2020-06-01T10:00:00Z",
+		Revision:      "abc123",
+		VersionModule: true,
+		EmbedManifest: true,
+	}
+	manifest, _ := buildTestManifest(tx, cfg, devicePath, testFirmwareDef("1111", "kitchen"))
+	var version *FileEntry
+	var others []*FileEntry
+	for _, fe := range manifest.Files {
+		switch fe.Path {
+		case VersionFileName:
+			version = fe
+		case EmbeddedManifestName:
+		default:
+			others = append(others, fe)
+		}
+	}
+	t.Assert(version != nil, "Expected %s in the manifest", VersionFileName)
+	t.Equals(manifestChecksum(others), FirmwareChecksum(manifest))
+
+	// the module returns a table of string fields, one per line
+	lines := strings.Split(strings.TrimSpace(string(version.Content)), "\n")
+	t.Equals("return {", lines[1])
+	t.Equals("}", lines[len(lines)-1])
+	fieldRegex := regexp.MustCompile(`^\t([a-zA-Z]+) = (".*"),$`)
+	fields := make(map[string]string)
+	for _, line := range lines[2 : len(lines)-1] {
+		match := fieldRegex.FindStringSubmatch(line)
+		t.Assert(match != nil, "Expected a table field, got %q", line)
+		value, err := strconv.Unquote(match[2])
+		t.Ok(err)
+		fields[match[1]] = value
+	}
+	t.Equals(map[string]string{
+		"id":       "1111",
+		"name":     "kitchen",
+		"checksum": manifestChecksum(others),
+		"builtAt":  "2020-06-01T10:00:00Z",
+		"revision": "abc123",
+	}, fields)
+
+	// the embedded manifest covers the version module
+	var hashes map[string]string
+	for _, fe := range manifest.Files {
+		if fe.Path == EmbeddedManifestName {
+			t.Ok(json.Unmarshal(fe.Content, &hashes))
+		}
+	}
+	t.Equals(version.Hash, hashes[VersionFileName])
+}
+
+func TestSearchOrder(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	root, err := ioutil.TempDir("", "espore-order")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+
+	corePath := filepath.Join(root, "core")
+	devicePath := filepath.Join(root, "device")
+	t.Ok(os.MkdirAll(corePath, 0755))
+	t.Ok(os.MkdirAll(devicePath, 0755))
+	t.Ok(ioutil.WriteFile(filepath.Join(corePath, "library.json"), []byte(`{"name": "core"}`), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(corePath, "main.lua"), []byte(`local wifi = require("wifi")`), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(corePath, "wifi.lua"), []byte("return {}"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(corePath, "eap.lua"), []byte("return {}"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "library.json"), []byte(`{"dependencies": ["`+filepath.ToSlash(corePath)+`"]}`), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "wifi.lua"), []byte(`local eap = require("eap")`), 0644))
+
+	cfg := &config.BuildConfig{Reproducible: true}
+	lib, err := LoadLibrary(cfg, devicePath, make(map[string]*FirmwareLib), 0)
+	t.Ok(err)
+	fwDef := testFirmwareDef("1111", "kitchen")
+	files := func(manifest *FirmwareManifest) map[string]*FileEntry {
+		m := make(map[string]*FileEntry)
+		for _, fe := range manifest.Files {
+			m[fe.Path] = fe
+		}
+		return m
+	}
+
+	// by default the core wifi module is resolved, so its requires are followed
+	manifest, err := buildDeviceFirmwareManifest(cfg, lib, fwDef, newLFSCache(""))
+	t.Ok(err)
+	t.Assert(files(manifest)["eap.lua"] == nil, "Expected eap.lua not to be required by the core wifi module")
+
+	// searching the device first, its wifi module shadows the core one
+	fwDef.SearchOrder = []string{DeviceLibraryName, "core"}
+	manifest, err = buildDeviceFirmwareManifest(cfg, lib, fwDef, newLFSCache(""))
+	t.Ok(err)
+	shipped := files(manifest)
+	t.Equals(devicePath, shipped["wifi.lua"].Base)
+	t.Assert(shipped["eap.lua"] != nil, "Expected eap.lua required by the device wifi module")
+
+	fwDef.SearchOrder = []string{"missing"}
+	_, err = buildDeviceFirmwareManifest(cfg, lib, fwDef, newLFSCache(""))
+	t.Assert(err != nil, "Expected an error for an unknown library in the search order")
+}
+
+func TestLuaString(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	t.Equals(`"plain"`, luaString("plain"))
+	t.Equals(`"say \"hi\" \\ bye"`, luaString(`say "hi" \ bye`))
+	t.Equals(`"a\010b"`, luaString("a\nb"))
+	t.Equals(`"café"`, luaString("café"))
+}
+
+func TestSuggestModule(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	libs := []*FirmwareLib{{
+		Files: map[string]*FileEntry{
+			"app.lua":          {Path: "app.lua", Dependencies: []string{"senors.temp"}},
+			"sensors/temp.lua": {Path: "sensors/temp.lua"},
+			"sensors/hum.lua":  {Path: "sensors/hum.lua"},
+			"index.html":       {Path: "index.html"},
+		},
+	}}
+	err := AddFilesFromModule("app", libs, make(map[string]*FileEntry))
+	buildErr, ok := err.(*BuildError)
+	t.Assert(ok, "Expected a BuildError, got %v", err)
+	t.Equals("module app -> senors.temp: file senors/temp.lua not found in libraries. Did you mean sensors.temp?", buildErr.Message)
+
+	t.Equals("", suggestModule("network", nil, libs))
+	t.Equals(3, editDistance("kitten", "sitting"))
+}
+
+func TestBuildOverrides(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	root, err := ioutil.TempDir("", "espore-overrides")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+	devicePath := filepath.Join(root, "devices", "1111")
+	t.Ok(os.MkdirAll(devicePath, 0755))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "firmware.json"), []byte(testFirmwareJSON("1111", "kitchen")), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "main.lua"), []byte("return 1\n"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "wifi.json"), []byte(`{"password": "changeme"}`), 0644))
+	secrets := filepath.Join(root, "ci", "wifi.json")
+	t.Ok(os.MkdirAll(filepath.Dir(secrets), 0755))
+	t.Ok(ioutil.WriteFile(secrets, []byte(`{"password": "s3cret"}`), 0644))
+
+	output := filepath.Join(root, "dist")
+	t.Ok(os.MkdirAll(output, 0755))
+	cfg := &config.BuildConfig{
+		Devices:      []string{filepath.Join(root, "devices", "*")},
+		Output:       output,
+		Reproducible: true,
+		Overrides: map[string]string{
+			"wifi.json":    secrets,
+			"missing.json": secrets,
+		},
+	}
+	t.Ok(Build(cfg))
+
+	manifest, err := ReadManifest(filepath.Join(output, "1111.json"))
+	t.Ok(err)
+	overridden := NewVirtualFileEntry([]byte(`{"password": "s3cret"}`), "wifi.json")
+	var found bool
+	for _, fe := range manifest.Files {
+		t.Assert(fe.Path != "missing.json", "Expected overrides of files not shipped to be ignored")
+		if fe.Path == "wifi.json" {
+			t.Equals(overridden.Hash, fe.Hash)
+			t.Equals(overridden.Size, fe.Size)
+			found = true
+		}
+	}
+	t.Assert(found, "Expected wifi.json in the manifest")
+
+	f, err := os.Open(filepath.Join(output, "1111.img"))
+	t.Ok(err)
+	defer f.Close()
+	var shipped string
+	_, err = ParseImage(f, func(path string, size int64, r io.Reader) error {
+		data, err := ioutil.ReadAll(r)
+		if path == "wifi.json" {
+			shipped = string(data)
+		}
+		return err
+	})
+	t.Ok(err)
+	t.Equals(`{"password": "s3cret"}`, shipped)
+
+	// the source file is left untouched
+	data, err := ioutil.ReadFile(filepath.Join(devicePath, "wifi.json"))
+	t.Ok(err)
+	t.Equals(`{"password": "changeme"}`, string(data))
+}
+
+func TestStreamLargeDatafile(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	devicePath, err := ioutil.TempDir("", "espore-device")
+	t.Ok(err)
+	defer os.RemoveAll(devicePath)
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "main.lua"), []byte("return 1\n"), 0644))
+	const size = 16 << 20
+	f, err := os.Create(filepath.Join(devicePath, "font.bin"))
+	t.Ok(err)
+	chunk := bytes.Repeat([]byte{0x5a}, 1<<20)
+	for i := 0; i < size/len(chunk); i++ {
+		_, err = f.Write(chunk)
+		t.Ok(err)
+	}
+	t.Ok(f.Close())
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := &config.BuildConfig{Reproducible: true, LargeFileWarning: 1 << 20}
+	manifest, _ := buildTestManifest(tx, cfg, devicePath, testFirmwareDef("1111", "kitchen"))
+	t.Assert(strings.Contains(output.String(), fmt.Sprintf("Warning: font.bin: file size %d exceeds %d bytes", size, 1<<20)), "Expected a large file warning, got %q", output.String())
+
+	// the datafile is streamed to disk instead of being buffered
+	outDir, err := ioutil.TempDir("", "espore-dist")
+	t.Ok(err)
+	defer os.RemoveAll(outDir)
+	imageWriter, err := GetImageWriter(DefaultImageVersion)
+	t.Ok(err)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	t.Ok(writeFirmwareImage(manifest, outDir, imageWriter))
+	runtime.ReadMemStats(&after)
+	allocated := after.TotalAlloc - before.TotalAlloc
+	t.Assert(allocated < size/8, "Expected bounded memory use writing the image, allocated %d bytes", allocated)
+
+	img, err := ioutil.ReadFile(filepath.Join(outDir, "1111.img"))
+	t.Ok(err)
+	hash, err := ioutil.ReadFile(filepath.Join(outDir, "1111.img.hash"))
+	t.Ok(err)
+	sum := sha1.Sum(img)
+	t.Equals(hex.EncodeToString(sum[:]), string(hash))
+	var shipped int64
+	_, err = ParseImage(bytes.NewReader(img), func(path string, size int64, r io.Reader) error {
+		n, err := io.Copy(ioutil.Discard, r)
+		if path == "font.bin" {
+			shipped = n
+		}
+		return err
+	})
+	t.Ok(err)
+	t.Equals(int64(size), shipped)
+}
+
+// checkingImageWriter runs check before each file is written
+type checkingImageWriter struct {
+	ImageWriter
+	check func()
+}
+
+func (w *checkingImageWriter) WriteFile(dst io.Writer, path string, size int64, r io.Reader) error {
+	w.check()
+	return w.ImageWriter.WriteFile(dst, path, size, r)
+}
+
+func TestAtomicImageWrite(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	output, err := ioutil.TempDir("", "espore-atomic")
+	t.Ok(err)
+	defer os.RemoveAll(output)
+
+	imageWriter, err := GetImageWriter(1)
+	t.Ok(err)
+	manifest := &FirmwareManifest{
+		DeviceInfo: DeviceInfo{ID: "1111", Name: "kitchen"},
+		Files: []*FileEntry{
+			NewVirtualFileEntry([]byte("print(1)"), "main.lua"),
+		},
+	}
+	t.Ok(writeFirmwareImage(manifest, output, imageWriter))
+	imgPath := filepath.Join(output, "1111.img")
+	previous, err := ioutil.ReadFile(imgPath)
+	t.Ok(err)
+
+	manifest.Files = append(manifest.Files, NewVirtualFileEntry([]byte("<html>"), "index.html"))
+	var checks int
+	writer := &checkingImageWriter{ImageWriter: imageWriter, check: func() {
+		checks++
+		current, err := ioutil.ReadFile(imgPath)
+		t.Ok(err)
+		t.Equals(string(previous), string(current))
+	}}
+	t.Ok(writeFirmwareImage(manifest, output, writer))
+	t.Equals(3, checks)
+
+	current, err := ioutil.ReadFile(imgPath)
+	t.Ok(err)
+	t.Assert(strings.Contains(string(current), "<html>"), "Expected the new image in place")
+	hash, err := ioutil.ReadFile(imgPath + ".hash")
+	t.Ok(err)
+	sum := sha1.Sum(current)
+	t.Equals(hex.EncodeToString(sum[:]), string(hash))
+
+	// an image that fails to build leaves the previous one in place
+	manifest.Files = append(manifest.Files, &FileEntry{Path: "missing.lua", Base: output})
+	t.Assert(writeFirmwareImage(manifest, output, imageWriter) != nil, "Expected an error writing a missing file")
+	failed, err := ioutil.ReadFile(imgPath)
+	t.Ok(err)
+	t.Equals(string(current), string(failed))
+	files, err := ioutil.ReadDir(output)
+	t.Ok(err)
+	t.Equals(2, len(files))
+}
+
+func TestExcludeTestFiles(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	root, err := ioutil.TempDir("", "espore-tests")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+
+	libPath := filepath.Join(root, "lib")
+	t.Ok(os.MkdirAll(libPath, 0755))
+	libFiles := map[string]string{
+		"util.lua":      "return {}\n",
+		"util_spec.lua": "require(\"busted\")\nrequire(\"util\")\n",
+		"busted.lua":    "return {}\n",
+	}
+	for name, content := range libFiles {
+		t.Ok(ioutil.WriteFile(filepath.Join(libPath, name), []byte(content), 0644))
+	}
+	devicePath := filepath.Join(root, "devices", "1111")
+	t.Ok(os.MkdirAll(devicePath, 0755))
+	deviceFiles := map[string]string{
+		"library.json":    `{"dependencies": [` + strconv.Quote(libPath) + `]}`,
+		"firmware.json":   testFirmwareJSON("1111", "kitchen"),
+		"main.lua":        "require(\"util\")\n",
+		"main_test.lua":   "require(\"mock\")\n",
+		"sub/io_test.lua": "return {}\n",
+	}
+	for name, content := range deviceFiles {
+		t.Ok(os.MkdirAll(filepath.Dir(filepath.Join(devicePath, name)), 0755))
+		t.Ok(ioutil.WriteFile(filepath.Join(devicePath, name), []byte(content), 0644))
+	}
+
+	cfg := &config.BuildConfig{Devices: []string{filepath.Join(root, "devices", "*")}}
+	paths := func() []string {
+		manifest, err := BuildManifest(cfg, "1111")
+		t.Ok(err)
+		var paths []string
+		for _, fe := range manifest.Files {
+			if isLua(fe.Path) && fe.Content == nil {
+				paths = append(paths, fe.Path)
+			}
+		}
+		sort.Strings(paths)
+		return paths
+	}
+
+	// test files in the device folder are not shipped
+	t.Equals([]string{"main.lua", "util.lua"}, paths())
+	allLibs, err := LoadLibraries(&config.BuildConfig{Libs: []string{libPath}})
+	t.Ok(err)
+	t.Assert(allLibs[libPath].Files["util_spec.lua"] == nil, "Expected the spec file to be left out of the library")
+	t.Assert(allLibs[libPath].Files["busted.lua"] != nil, "Expected other files to stay in the library")
+
+	// an empty list keeps test files
+	cfg.TestPatterns = []string{}
+	t.Equals([]string{"main.lua", "main_test.lua", "sub/io_test.lua", "util.lua"}, paths())
+}
+
+func TestOptionalRequires(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	code := `local ok, tls = pcall(require, "tls")
+local metrics = require("metrics") -- optional
+local util = require("util")
+local log = require("log") -- optional
+local logger = require("log")
+`
+	info := parseDependenciesAndDatafiles(code, importRegex([]string{"import"}))
+	t.Equals([]string{"tls", "metrics", "util", "log"}, info.Dependencies)
+	// log is also required unconditionally, so it is not optional
+	t.Equals(map[string]bool{"tls": true, "metrics": true}, info.OptionalDependencies)
+
+	app := &FileEntry{Path: "app.lua", Dependencies: info.Dependencies, DependencyLines: info.DependencyLines, OptionalDependencies: info.OptionalDependencies}
+	libs := []*FirmwareLib{
+		{
+			Files: map[string]*FileEntry{
+				"app.lua":  app,
+				"util.lua": {Path: "util.lua"},
+				"log.lua":  {Path: "log.lua"},
+				"tls.lua":  {Path: "tls.lua"},
+			},
+		},
+	}
+	// metrics is optional, so it may be missing; tls is shipped when present
+	fileMap := make(map[string]*FileEntry)
+	t.Ok(AddFilesFromModule("app", libs, fileMap))
+	t.Equals(4, len(fileMap))
+	t.Assert(fileMap["tls.lua"] != nil, "Expected an optional module that exists to be shipped")
+
+	// a missing module that is not optional fails the build
+	delete(libs[0].Files, "log.lua")
+	err := AddFilesFromModule("app", libs, make(map[string]*FileEntry))
+	buildErr, ok := err.(*BuildError)
+	t.Assert(ok, "Expected a BuildError, got %v", err)
+	t.Equals("module app -> log: file log.lua not found in libraries", buildErr.Message)
+	t.Equals(4, buildErr.Line)
+}
+
+func TestDeviceVariants(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	root, err := ioutil.TempDir("", "espore-variants")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+
+	// device files are always shipped, so the variant module lives in a library
+	libPath := filepath.Join(root, "lib")
+	files := map[string]string{
+		"lib/fastpath.lua":          "require(\"util\")\n",
+		"devices/1111/library.json": `{"dependencies": [` + strconv.Quote(libPath) + `]}`,
+		"devices/1111/firmware.json": `{"name": "kitchen", "id": "1111", "lfs": {"exclude": ["**/*", "*"]},
+			"tags": {"variant": "beta"},
+			"variants": {"A": [], "B": [{"name": "fastpath", "autostart": true}]}}`,
+		"devices/1111/main.lua": "require(\"util\")\n",
+		"devices/1111/util.lua": "return {}\n",
+	}
+	for name, content := range files {
+		t.Ok(os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755))
+		t.Ok(ioutil.WriteFile(filepath.Join(root, name), []byte(content), 0644))
+	}
+	cfg := &config.BuildConfig{
+		Devices: []string{filepath.Join(root, "devices", "*")},
+		Output:  filepath.Join(root, "dist"),
+	}
+	t.Ok(os.MkdirAll(cfg.Output, 0755))
+	t.Ok(Build(cfg))
+
+	for _, name := range []string{"1111", "1111-A", "1111-B"} {
+		for _, ext := range []string{".img", ".json"} {
+			_, err := os.Stat(filepath.Join(cfg.Output, name+ext))
+			t.Ok(err)
+		}
+	}
+	a, err := ReadManifest(filepath.Join(cfg.Output, "1111-A.json"))
+	t.Ok(err)
+	b, err := ReadManifest(filepath.Join(cfg.Output, "1111-B.json"))
+	t.Ok(err)
+	t.Equals("1111", b.ID)
+	t.Equals("A", a.Variant)
+	t.Equals("B", b.Variant)
+	// user tags do not make a variant
+	base, err := ReadManifest(filepath.Join(cfg.Output, "1111.json"))
+	t.Ok(err)
+	t.Equals("", base.Variant)
+	t.Equals("beta", base.Tags["variant"])
+	t.Equals("beta", b.Tags["variant"])
+	_, err = os.Stat(filepath.Join(cfg.Output, "1111-beta.json"))
+	t.Assert(os.IsNotExist(err), "Expected no artifact named after a user tag")
+	diff := CompareManifests(a, b)
+	t.Equals([]string{"fastpath.lua"}, diff.OnlyB)
+	t.Equals(0, len(diff.OnlyA))
+	t.Ok(CheckDist(cfg.Output))
+
+	devices, err := DevicesIncluding(cfg.Output, "util.lua")
+	t.Ok(err)
+	t.Equals(1, len(devices))
+
+	rows, err := Inventory(cfg.Output)
+	t.Ok(err)
+	var ids []string
+	for _, row := range rows {
+		ids = append(ids, row.ID)
+	}
+	t.Equals([]string{"1111", "1111-A", "1111-B"}, ids)
+
+	_, err = deviceVariants(FirmwareDef{Variants: map[string][]ModuleDef{"a/b": nil}})
+	t.Assert(err != nil, "Expected an error for a variant name with a path separator")
+}
@@ -0,0 +1,133 @@
+package builder
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DistCheckError lists every discrepancy found while checking a dist directory
+type DistCheckError struct {
+	Problems []string
+}
+
+func (dce *DistCheckError) Error() string {
+	return fmt.Sprintf("%d problems found:\n%s", len(dce.Problems), strings.Join(dce.Problems, "\n"))
+}
+
+// CheckDist verifies that the images in distDir match their checksums and
+// contain every file listed in their manifest with the recorded hash. It
+// returns a *DistCheckError listing all the discrepancies found.
+func CheckDist(distDir string) error {
+	manifests, err := readManifests(distDir)
+	if err != nil {
+		return err
+	}
+	var problems []string
+	for _, mf := range manifests {
+		if mf.err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", mf.path, mf.err))
+			continue
+		}
+		problems = append(problems, checkManifest(mf.path, mf.manifest)...)
+	}
+	if len(problems) > 0 {
+		return &DistCheckError{Problems: problems}
+	}
+	return nil
+}
+
+// CheckDevice performs the same verification as CheckDist, for a single device
+func CheckDevice(distDir, deviceID string) error {
+	manifestFile := filepath.Join(distDir, deviceID+".json")
+	if _, err := os.Stat(manifestFile); err != nil {
+		return fmt.Errorf("Cannot find manifest for device %s: %s", deviceID, err)
+	}
+	manifest, err := ReadManifest(manifestFile)
+	if err != nil {
+		return &DistCheckError{Problems: []string{fmt.Sprintf("%s: %s", manifestFile, err)}}
+	}
+	if problems := checkManifest(manifestFile, manifest); len(problems) > 0 {
+		return &DistCheckError{Problems: problems}
+	}
+	return nil
+}
+
+// checkManifest returns the discrepancies between a manifest and the image
+// files written next to it
+func checkManifest(manifestFile string, manifest *FirmwareManifest) []string {
+	distDir := filepath.Dir(manifestFile)
+	imgFilename := filepath.Join(distDir, artifactName(manifest)+".img")
+
+	var problems []string
+	if problem := checkHashFile(imgFilename); problem != "" {
+		problems = append(problems, problem)
+	}
+	binFilename := filepath.Join(distDir, manifest.ID+".bin")
+	if manifest.NodeMCUFirmware != "" && manifest.Variant == "" {
+		if problem := checkHashFile(binFilename); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	f, err := os.Open(imgFilename)
+	if err != nil {
+		return append(problems, fmt.Sprintf("%s: %s", imgFilename, err))
+	}
+	defer f.Close()
+	imageHashes, err := readImageHashes(f)
+	if err != nil {
+		return append(problems, fmt.Sprintf("%s: %s", imgFilename, err))
+	}
+	for _, fe := range manifest.Files {
+		hash, ok := imageHashes[fe.Path]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: missing file %s", imgFilename, fe.Path))
+			continue
+		}
+		if hash != fe.Hash {
+			problems = append(problems, fmt.Sprintf("%s: file %s has hash %s, manifest records %s", imgFilename, fe.Path, hash, fe.Hash))
+		}
+	}
+	return problems
+}
+
+// checkHashFile verifies the file at path against the checksum stored in
+// path.hash, returning a description of the problem if there is one
+func checkHashFile(path string) string {
+	expected, err := ioutil.ReadFile(path + ".hash")
+	if err != nil {
+		return fmt.Sprintf("%s: cannot read checksum: %s", path, err)
+	}
+	hash, err := hashFile(path)
+	if err != nil {
+		return fmt.Sprintf("%s: %s", path, err)
+	}
+	if hash != strings.TrimSpace(string(expected)) {
+		return fmt.Sprintf("%s: checksum mismatch, got %s, expected %s", path, hash, strings.TrimSpace(string(expected)))
+	}
+	return ""
+}
+
+// readImageHashes parses a version 1 image, returning the hash of each file
+// it contains indexed by path
+func readImageHashes(r io.Reader) (map[string]string, error) {
+	hashes := make(map[string]string)
+	_, err := ParseImage(r, func(path string, size int64, r io.Reader) error {
+		hasher := sha1.New()
+		if _, err := io.Copy(hasher, r); err != nil {
+			return err
+		}
+		hashes[path] = hex.EncodeToString(hasher.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
@@ -0,0 +1,61 @@
+package builder
+
+import (
+	"espore/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestCheckDist(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	output, err := ioutil.TempDir("", "espore-dist")
+	t.Ok(err)
+	defer os.RemoveAll(output)
+
+	imageWriter, err := GetImageWriter(0)
+	t.Ok(err)
+	manifest := &FirmwareManifest{
+		DeviceInfo:      DeviceInfo{ID: "1111", Name: "kitchen"},
+		ManifestVersion: ManifestVersion,
+		Files: []*FileEntry{
+			NewVirtualFileEntry([]byte("print('hello')"), "main.lua"),
+			NewVirtualFileEntry([]byte("<html></html>"), "index.html"),
+		},
+	}
+	t.Ok(utils.WriteJSON(filepath.Join(output, "1111.json"), manifest))
+	t.Ok(writeFirmwareImage(manifest, output, imageWriter))
+	t.Ok(CheckDist(output))
+	t.Ok(CheckDevice(output, "1111"))
+	t.Ok(ioutil.WriteFile(filepath.Join(output, "inventory.json"), []byte(`[{"id": "1111"}]`), 0644))
+	t.Ok(CheckDist(output))
+
+	// replace the contents of main.lua in the image, keeping the manifest and
+	// the image checksum of the original build
+	imgHash, err := ioutil.ReadFile(filepath.Join(output, "1111.img.hash"))
+	t.Ok(err)
+	tampered := &FirmwareManifest{
+		DeviceInfo: manifest.DeviceInfo,
+		Files: []*FileEntry{
+			NewVirtualFileEntry([]byte("<html></html>"), "index.html"),
+			NewVirtualFileEntry([]byte("print('bye')"), "main.lua"),
+		},
+	}
+	t.Ok(writeFirmwareImage(tampered, output, imageWriter))
+	t.Ok(ioutil.WriteFile(filepath.Join(output, "1111.img.hash"), imgHash, 0666))
+
+	err = CheckDist(output)
+	checkErr, ok := err.(*DistCheckError)
+	t.Assert(ok, "Expected a DistCheckError, got %v", err)
+	t.Equals(2, len(checkErr.Problems))
+	t.Assert(strings.Contains(checkErr.Problems[0], "checksum mismatch"), "Expected an image checksum mismatch, got %s", checkErr.Problems[0])
+	t.Assert(strings.Contains(checkErr.Problems[1], "file main.lua has hash"), "Expected a main.lua hash mismatch, got %s", checkErr.Problems[1])
+
+	t.Assert(CheckDevice(output, "2222") != nil, "Expected an error for an unknown device")
+}
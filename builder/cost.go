@@ -0,0 +1,71 @@
+package builder
+
+import (
+	"espore/config"
+	"sort"
+)
+
+// ModuleCost is what adding a module to a device costs in flash
+type ModuleCost struct {
+	Module string
+	// Files are the files the module pulls in that the other modules of the
+	// device don't, sorted by path
+	Files []*FileEntry
+	// Size is the total size of Files, in bytes
+	Size int64
+}
+
+// DeviceModuleCost returns the files, and their total size, that module adds
+// to a device on top of those already required by the device's other modules
+func DeviceModuleCost(config *config.BuildConfig, deviceID, module string) (*ModuleCost, error) {
+	deviceRootLib, fwDef, err := loadDevice(config, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	modules, searchLibs, err := deviceModules(deviceRootLib, getLibraryList(deviceRootLib, nil), fwDef, config.GetSearchPath())
+	if err != nil {
+		return nil, err
+	}
+	var others []string
+	for _, modDef := range modules {
+		if modDef.Name != module {
+			others = append(others, modDef.Name)
+		}
+	}
+	included, err := resolveModuleFiles(config, others, searchLibs)
+	if err != nil {
+		return nil, err
+	}
+	pulled, err := resolveModuleFiles(config, []string{module}, searchLibs)
+	if err != nil {
+		return nil, err
+	}
+
+	cost := &ModuleCost{Module: module}
+	for path, fe := range pulled {
+		if included[path] == nil {
+			cost.Files = append(cost.Files, fe)
+			cost.Size += fe.Size
+		}
+	}
+	sort.Slice(cost.Files, func(i, j int) bool {
+		return cost.Files[i].Path < cost.Files[j].Path
+	})
+	return cost, nil
+}
+
+// resolveModuleFiles returns the files the given modules pull in, resolved
+// the same way the build does
+func resolveModuleFiles(config *config.BuildConfig, modules []string, libs []*FirmwareLib) (map[string]*FileEntry, error) {
+	fileMap := make(map[string]*FileEntry)
+	if config.VersionModule {
+		fileMap[VersionFileName] = NewVirtualFileEntry(nil, VersionFileName)
+	}
+	for _, module := range modules {
+		if err := addFilesFromModule(module, config.GetSearchPath(), libs, fileMap, nil, nil); err != nil {
+			return nil, err
+		}
+	}
+	delete(fileMap, VersionFileName)
+	return fileMap, nil
+}
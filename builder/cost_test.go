@@ -0,0 +1,52 @@
+package builder
+
+import (
+	"espore/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestDeviceModuleCost(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	root, err := ioutil.TempDir("", "espore-cost")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+	devicePath := filepath.Join(root, "devices", "1111")
+	t.Ok(os.MkdirAll(devicePath, 0755))
+	files := map[string]string{
+		"firmware.json": `{"name": "kitchen", "id": "1111"}`,
+		"main.lua":      "require(\"util\")\n",
+		"util.lua":      "return {}\n",
+		"sensor.lua":    "require(\"util\")\nrequire(\"dht\")\n-- read the sensor\n",
+		"dht.lua":       "require(\"bits\")\nreturn {pin = 4}\n",
+		"bits.lua":      "return {band = bit.band}\n",
+	}
+	for name, content := range files {
+		t.Ok(ioutil.WriteFile(filepath.Join(devicePath, name), []byte(content), 0644))
+	}
+	cfg := &config.BuildConfig{Devices: []string{filepath.Join(root, "devices", "*")}}
+
+	cost, err := DeviceModuleCost(cfg, "1111", "sensor")
+	t.Ok(err)
+	var paths []string
+	for _, fe := range cost.Files {
+		paths = append(paths, fe.Path)
+	}
+	t.Equals([]string{"bits.lua", "dht.lua", "sensor.lua"}, paths)
+	t.Equals(int64(len(files["sensor.lua"])+len(files["dht.lua"])+len(files["bits.lua"])), cost.Size)
+
+	// util is already pulled in by main, so it costs nothing
+	cost, err = DeviceModuleCost(cfg, "1111", "util")
+	t.Ok(err)
+	t.Equals(0, len(cost.Files))
+	t.Equals(int64(0), cost.Size)
+
+	_, err = DeviceModuleCost(cfg, "1111", "nope")
+	t.Assert(err != nil, "Expected an error for a module that cannot be found")
+}
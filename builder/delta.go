@@ -0,0 +1,70 @@
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// DeltaImage holds the changes needed to upgrade a device from one manifest
+// to another
+type DeltaImage struct {
+	// Manifest is the target manifest
+	Manifest *FirmwareManifest
+	// Added are the files not present in the old manifest
+	Added []*FileEntry
+	// Updated are the files whose hash changed
+	Updated []*FileEntry
+	// Deleted are the paths present in the old manifest only
+	Deleted []string
+}
+
+// BuildDelta compares the manifest installed in a device with a new one,
+// returning the files to add, update and delete, each sorted by path
+func BuildDelta(old, new *FirmwareManifest) (*DeltaImage, error) {
+	if old == nil || new == nil {
+		return nil, errors.New("Cannot compute a delta without both manifests")
+	}
+	if old.ID != new.ID {
+		return nil, fmt.Errorf("Cannot compute a delta between devices %q and %q", old.ID, new.ID)
+	}
+
+	delta := &DeltaImage{Manifest: new}
+	delta.Added, delta.Updated, delta.Deleted = diffFiles(old.Files, new.Files)
+	return delta, nil
+}
+
+func sortFileEntries(files []*FileEntry) {
+	sort.Slice(files, func(i, j int) bool {
+		return strings.Compare(files[i].Path, files[j].Path) < 0
+	})
+}
+
+// Files returns the files the delta image carries, sorted by path
+func (d *DeltaImage) Files() []*FileEntry {
+	files := append(append([]*FileEntry{}, d.Added...), d.Updated...)
+	sortFileEntries(files)
+	return files
+}
+
+// Write writes the delta image with the given image writer, which must
+// support delta images. datafiles.json is always included, so the device keeps
+// an up to date list of its datafiles.
+func (d *DeltaImage) Write(w io.Writer, imageWriter ImageWriter) error {
+	deltaWriter, ok := imageWriter.(DeltaImageWriter)
+	if !ok {
+		return errors.New("Image format does not support delta images")
+	}
+	files := d.Files()
+	if err := deltaWriter.WriteDeltaHeader(w, d.Manifest, len(files)+1, d.Deleted); err != nil {
+		return err
+	}
+	for _, fe := range files {
+		if err := writeImageFile(w, fe, imageWriter); err != nil {
+			return err
+		}
+	}
+	return writeDatafiles(w, d.Manifest, imageWriter)
+}
@@ -0,0 +1,53 @@
+package builder
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestBuildDelta(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	old := &FirmwareManifest{
+		DeviceInfo: DeviceInfo{ID: "1111", Name: "sensor"},
+		Files: []*FileEntry{
+			NewVirtualFileEntry([]byte("main v1"), "main.lua"),
+			NewVirtualFileEntry([]byte("util"), "util.lua"),
+			NewVirtualFileEntry([]byte("legacy"), "legacy.lua"),
+		},
+	}
+	new := &FirmwareManifest{
+		DeviceInfo: DeviceInfo{ID: "1111", Name: "sensor"},
+		Files: []*FileEntry{
+			NewVirtualFileEntry([]byte("main v2"), "main.lua"),
+			NewVirtualFileEntry([]byte("util"), "util.lua"),
+			NewVirtualFileEntry([]byte("<html>"), "index.html"),
+		},
+	}
+
+	delta, err := BuildDelta(old, new)
+	t.Ok(err)
+	paths := func(files []*FileEntry) []string {
+		var list []string
+		for _, fe := range files {
+			list = append(list, fe.Path)
+		}
+		return list
+	}
+	t.Equals([]string{"index.html"}, paths(delta.Added))
+	t.Equals([]string{"main.lua"}, paths(delta.Updated))
+	t.Equals([]string{"legacy.lua"}, delta.Deleted)
+
+	var img bytes.Buffer
+	imageWriter, err := GetImageWriter(1)
+	t.Ok(err)
+	t.Ok(delta.Write(&img, imageWriter))
+	t.Equals("Version: 1 -- ESPore Device Delta Image File\nDevice Id: 1111\nDevice Name: sensor\nTotal files: 3\nDelete: legacy.lua\n\n"+
+		"index.html\n6\n<html>main.lua\n7\nmain v2datafiles.json\n2\n[]", img.String())
+
+	_, err = BuildDelta(old, &FirmwareManifest{DeviceInfo: DeviceInfo{ID: "2222"}})
+	t.Assert(err != nil, "Expected a delta between different devices to fail")
+}
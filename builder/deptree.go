@@ -0,0 +1,54 @@
+package builder
+
+import "sort"
+
+// DependencyNode is a module in a dependency tree
+type DependencyNode struct {
+	Module string
+	// Entry is the file the module resolves to, or nil if it cannot be found
+	Entry *FileEntry
+	// Seen indicates the module was already expanded elsewhere in the tree
+	Seen         bool
+	Dependencies []*DependencyNode
+}
+
+// DependencyTree resolves the transitive dependencies of a module the same
+// way AddFilesFromModule does, returning them as a tree. Each module is only
+// expanded the first time it is found.
+func DependencyTree(moduleName string, searchPath []string, libs []*FirmwareLib) *DependencyNode {
+	return dependencyTree(moduleName, searchPath, libs, make(map[string]bool))
+}
+
+func dependencyTree(moduleName string, searchPath []string, libs []*FirmwareLib, seen map[string]bool) *DependencyNode {
+	node := &DependencyNode{
+		Module: moduleName,
+	}
+	if seen[moduleName] {
+		node.Seen = true
+		return node
+	}
+	seen[moduleName] = true
+	_, entry := findModule(moduleName, searchPath, libs, nil)
+	if entry == nil {
+		return node
+	}
+	node.Entry = entry
+	deps := append([]string(nil), entry.Dependencies...)
+	sort.Strings(deps)
+	for _, dep := range deps {
+		node.Dependencies = append(node.Dependencies, dependencyTree(dep, searchPath, libs, seen))
+	}
+	return node
+}
+
+// LibraryList returns the libraries in the map sorted by path
+func LibraryList(allLibs map[string]*FirmwareLib) []*FirmwareLib {
+	libs := make([]*FirmwareLib, 0, len(allLibs))
+	for _, lib := range allLibs {
+		libs = append(libs, lib)
+	}
+	sort.Slice(libs, func(i, j int) bool {
+		return libs[i].BasePath < libs[j].BasePath
+	})
+	return libs
+}
@@ -0,0 +1,34 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// BuildError is a build failure that can be traced back to a source file,
+// and optionally to a line within it
+type BuildError struct {
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+func (be *BuildError) Error() string {
+	if be.File == "" {
+		return be.Message
+	}
+	if be.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", be.File, be.Line, be.Message)
+	}
+	return fmt.Sprintf("%s: %s", be.File, be.Message)
+}
+
+// ErrorJSON encodes a build error as a JSON record suitable for editor
+// integration. Errors without source information only carry a message.
+func ErrorJSON(err error) ([]byte, error) {
+	buildErr, ok := err.(*BuildError)
+	if !ok {
+		buildErr = &BuildError{Message: err.Error()}
+	}
+	return json.Marshal(buildErr)
+}
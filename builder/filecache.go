@@ -0,0 +1,142 @@
+package builder
+
+import (
+	"encoding/json"
+	"espore/config"
+	"espore/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FileCacheName is the name of the file, under the cache dir, where file
+// hashes and parsed sources are persisted across builds
+const FileCacheName = "files.json"
+
+// fileCacheEntry holds what is known about a file as of its last scan
+type fileCacheEntry struct {
+	ModTime int64       `json:"modTime"`
+	Size    int64       `json:"size"`
+	Version string      `json:"version,omitempty"`
+	Hash    string      `json:"hash"`
+	Info    *SourceInfo `json:"info,omitempty"`
+}
+
+// fileCache remembers the hash and parsed dependencies of source files,
+// indexed by path, so unchanged files need not be read again. Entries are
+// only valid while the file modification time and size, and the version of
+// the library the file belongs to, stay the same.
+type fileCache struct {
+	path     string
+	Format   int                        `json:"format"`
+	Keywords string                     `json:"keywords"`
+	Entries  map[string]*fileCacheEntry `json:"entries"`
+	dirty    bool
+	lock     sync.Mutex
+	log      *buildLog
+}
+
+// fileCacheFormat changes whenever SourceInfo gains information, so entries
+// parsed by older builders are discarded
+const fileCacheFormat = 1
+
+// openFileCache loads the file cache in cacheDir. Entries parsed with
+// different directive keywords or by an older format are discarded. It
+// returns nil, which disables caching, if cacheDir is empty.
+func openFileCache(cacheDir string, keywords []string, bl *buildLog) *fileCache {
+	if cacheDir == "" {
+		return nil
+	}
+	fc := newFileCache(filepath.Join(cacheDir, FileCacheName), keywords, bl)
+	if data, err := ioutil.ReadFile(fc.path); err == nil {
+		var stored fileCache
+		if err := json.Unmarshal(data, &stored); err == nil && stored.Format == fc.Format && stored.Keywords == fc.Keywords && stored.Entries != nil {
+			fc.Entries = stored.Entries
+		}
+	}
+	return fc
+}
+
+// ReloadLibraries discards the persisted file cache and scans the configured
+// libraries again, so the next build picks up edits the cache cannot tell
+// apart, such as those keeping the modification time and size of a file
+func ReloadLibraries(config *config.BuildConfig) (map[string]*FirmwareLib, error) {
+	if config.CacheDir != "" {
+		if err := os.Remove(filepath.Join(config.CacheDir, FileCacheName)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return LoadLibraries(config)
+}
+
+// newFileCache returns an empty cache persisted to path. An empty path keeps
+// the cache in memory only.
+func newFileCache(path string, keywords []string, bl *buildLog) *fileCache {
+	return &fileCache{
+		log:      bl,
+		path:     path,
+		Format:   fileCacheFormat,
+		Keywords: strings.Join(keywords, ","),
+		Entries:  make(map[string]*fileCacheEntry),
+	}
+}
+
+// get returns the cached entry for path if neither the file nor the version
+// of its library changed
+func (fc *fileCache) get(path string, fi os.FileInfo, version string) *fileCacheEntry {
+	if fc == nil {
+		return nil
+	}
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	entry := fc.Entries[path]
+	if entry == nil || entry.ModTime != fi.ModTime().UnixNano() || entry.Size != fi.Size() || entry.Version != version {
+		return nil
+	}
+	return entry
+}
+
+func (fc *fileCache) put(path string, fi os.FileInfo, version, hash string, info *SourceInfo) {
+	if fc == nil {
+		return
+	}
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	fc.Entries[path] = &fileCacheEntry{
+		ModTime: fi.ModTime().UnixNano(),
+		Size:    fi.Size(),
+		Version: version,
+		Hash:    hash,
+		Info:    info,
+	}
+	fc.dirty = true
+}
+
+// save persists the cache if it changed. Failures are only logged, since the
+// cache is just an optimization.
+func (fc *fileCache) save() {
+	if fc == nil || fc.path == "" {
+		return
+	}
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	if !fc.dirty {
+		return
+	}
+	data, err := json.Marshal(fc)
+	if err != nil {
+		fc.log.Infof("Cannot encode file cache: %s", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(fc.path), 0755); err != nil {
+		fc.log.Infof("Cannot create cache dir %s: %s", filepath.Dir(fc.path), err)
+		return
+	}
+	if err := utils.WriteFileAtomic(fc.path, data); err != nil {
+		fc.log.Infof("Cannot write file cache %s: %s", fc.path, err)
+		return
+	}
+	fc.dirty = false
+}
@@ -0,0 +1,234 @@
+package builder
+
+import (
+	"espore/config"
+	"espore/utils"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestLoadLibrariesReflectsChanges(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	libPath, err := ioutil.TempDir("", "espore-lib")
+	t.Ok(err)
+	defer os.RemoveAll(libPath)
+
+	luaFile := filepath.Join(libPath, "app.lua")
+	t.Ok(ioutil.WriteFile(luaFile, []byte("return 1\n"), 0644))
+
+	cfg := &config.BuildConfig{Libs: []string{libPath}}
+	libs, err := LoadLibraries(cfg)
+	t.Ok(err)
+	t.Equals(1, len(libs))
+	hash := libs[libPath].Files["app.lua"].Hash
+
+	t.Ok(ioutil.WriteFile(luaFile, []byte("return 2\n"), 0644))
+	libs, err = LoadLibraries(cfg)
+	t.Ok(err)
+	t.Assert(libs[libPath].Files["app.lua"].Hash != hash, "Expected changed file to be rescanned")
+}
+
+func TestReloadLibraries(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	root, err := ioutil.TempDir("", "espore-reload")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+
+	libPath := filepath.Join(root, "lib")
+	devicePath := filepath.Join(root, "devices", "1111")
+	t.Ok(os.MkdirAll(libPath, 0755))
+	t.Ok(os.MkdirAll(devicePath, 0755))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "firmware.json"), []byte(testFirmwareJSON("1111", "kitchen")), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "library.json"), []byte(`{"dependencies": [`+strconv.Quote(libPath)+`]}`), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "main.lua"), []byte("require(\"app\")\n"), 0644))
+	luaFile := filepath.Join(libPath, "app.lua")
+	t.Ok(ioutil.WriteFile(luaFile, []byte("return 1\n"), 0644))
+
+	cfg := &config.BuildConfig{
+		Libs:     []string{libPath},
+		Devices:  []string{filepath.Join(root, "devices", "*")},
+		Output:   filepath.Join(root, "dist"),
+		CacheDir: filepath.Join(root, "cache"),
+	}
+	t.Ok(os.MkdirAll(cfg.Output, 0755))
+	appHash := func() string {
+		t.Ok(Build(cfg))
+		manifest, err := ReadManifest(filepath.Join(cfg.Output, "1111.json"))
+		t.Ok(err)
+		for _, fe := range manifest.Files {
+			if fe.Path == "app.lua" {
+				return fe.Hash
+			}
+		}
+		t.Fatal("Expected app.lua to be shipped")
+		return ""
+	}
+	hash := appHash()
+
+	// an edit keeping the size and modification time goes unnoticed
+	fi, err := os.Stat(luaFile)
+	t.Ok(err)
+	t.Ok(ioutil.WriteFile(luaFile, []byte("return 2\n"), 0644))
+	t.Ok(os.Chtimes(luaFile, fi.ModTime(), fi.ModTime()))
+	t.Equals(hash, appHash())
+
+	_, err = ReloadLibraries(cfg)
+	t.Ok(err)
+	t.Assert(appHash() != hash, "Expected the edited file to be built after reloading")
+}
+
+func TestBuildFileCache(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	root, err := ioutil.TempDir("", "espore-filecache")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+
+	libPath := filepath.Join(root, "lib")
+	devicePath := filepath.Join(root, "devices", "1111")
+	t.Ok(os.MkdirAll(libPath, 0755))
+	t.Ok(os.MkdirAll(devicePath, 0755))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "firmware.json"), []byte(testFirmwareJSON("1111", "kitchen")), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "library.json"), []byte(`{"dependencies": [`+strconv.Quote(libPath)+`]}`), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "main.lua"), []byte("require(\"app\")\n"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(libPath, "app.lua"), []byte("return 1\n"), 0644))
+
+	cfg := &config.BuildConfig{
+		Libs:     []string{libPath},
+		Devices:  []string{filepath.Join(root, "devices", "*")},
+		Output:   filepath.Join(root, "dist"),
+		CacheDir: filepath.Join(root, "cache"),
+	}
+	t.Ok(os.MkdirAll(cfg.Output, 0755))
+	t.Ok(Build(cfg))
+
+	// library and device files share the cache saved at the end of the build
+	fc := openFileCache(cfg.CacheDir, cfg.GetDirectiveKeywords(), newBuildLog(cfg))
+	t.Assert(fc.Entries[filepath.Join(libPath, "app.lua")] != nil, "Expected the library file to be cached")
+	t.Assert(fc.Entries[filepath.Join(devicePath, "main.lua")] != nil, "Expected the device file to be cached")
+	leftovers, err := filepath.Glob(filepath.Join(cfg.CacheDir, ".*.tmp*"))
+	t.Ok(err)
+	t.Equals(0, len(leftovers))
+}
+
+func TestFileCacheWarmBuild(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	root, err := ioutil.TempDir("", "espore-filecache")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+
+	libPath := filepath.Join(root, "lib")
+	t.Ok(os.MkdirAll(libPath, 0755))
+	for i := 0; i < 20; i++ {
+		code := fmt.Sprintf("local m = require(\"mod%d\")\n-- %s\n", i+1, strings.Repeat("x", 1000))
+		t.Ok(ioutil.WriteFile(filepath.Join(libPath, fmt.Sprintf("mod%d.lua", i)), []byte(code), 0644))
+	}
+	t.Ok(ioutil.WriteFile(filepath.Join(libPath, "index.html"), []byte(strings.Repeat("y", 1000)), 0644))
+
+	var bytesRead int64
+	defer func(f func(string) (string, error)) { hashFile = f }(hashFile)
+	defer func(f func(string) ([]byte, error)) { readFile = f }(readFile)
+	// files are scanned concurrently
+	hashFile = func(path string) (string, error) {
+		size, _ := fileSize(path)
+		atomic.AddInt64(&bytesRead, size)
+		return utils.HashFile(path)
+	}
+	readFile = func(path string) ([]byte, error) {
+		data, err := ioutil.ReadFile(path)
+		atomic.AddInt64(&bytesRead, int64(len(data)))
+		return data, err
+	}
+
+	cfg := &config.BuildConfig{Libs: []string{libPath}, CacheDir: filepath.Join(root, "cache")}
+	cold, err := LoadLibraries(cfg)
+	t.Ok(err)
+	coldBytes := bytesRead
+
+	bytesRead = 0
+	warm, err := LoadLibraries(cfg)
+	t.Ok(err)
+	t.Assert(bytesRead*10 < coldBytes, "Expected warm build to read far fewer bytes: %d vs %d", bytesRead, coldBytes)
+	t.Equals(cold[libPath].Files["mod3.lua"].Hash, warm[libPath].Files["mod3.lua"].Hash)
+	t.Equals([]string{"mod4"}, warm[libPath].Files["mod3.lua"].Dependencies)
+
+	// changed files are scanned again
+	modified := filepath.Join(libPath, "mod3.lua")
+	t.Ok(ioutil.WriteFile(modified, []byte(`require("other")`), 0644))
+	t.Ok(os.Chtimes(modified, time.Now(), time.Now().Add(time.Minute)))
+	bytesRead = 0
+	warm, err = LoadLibraries(cfg)
+	t.Ok(err)
+	t.Equals(int64(2*len(`require("other")`)), bytesRead)
+	t.Equals([]string{"other"}, warm[libPath].Files["mod3.lua"].Dependencies)
+}
+
+func TestFileCacheLibraryVersion(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	root, err := ioutil.TempDir("", "espore-cache")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+
+	sensorsPath := filepath.Join(root, "sensors")
+	utilPath := filepath.Join(root, "util")
+	for _, libPath := range []string{sensorsPath, utilPath} {
+		t.Ok(os.MkdirAll(libPath, 0755))
+		t.Ok(ioutil.WriteFile(filepath.Join(libPath, "library.json"), []byte(`{"version": "1.0"}`), 0644))
+	}
+	dht := filepath.Join(sensorsPath, "dht.lua")
+	t.Ok(ioutil.WriteFile(dht, []byte("return 1\n"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(utilPath, "str.lua"), []byte("return 2\n"), 0644))
+	fi, err := os.Stat(dht)
+	t.Ok(err)
+
+	var lock sync.Mutex
+	hashed := make(map[string]int)
+	defer func(f func(string) (string, error)) { hashFile = f }(hashFile)
+	hashFile = func(path string) (string, error) {
+		lock.Lock()
+		hashed[filepath.Base(path)]++
+		lock.Unlock()
+		return utils.HashFile(path)
+	}
+
+	cfg := &config.BuildConfig{Libs: []string{sensorsPath, utilPath}, CacheDir: filepath.Join(root, "cache")}
+	_, err = LoadLibraries(cfg)
+	t.Ok(err)
+	t.Equals(map[string]int{"dht.lua": 1, "str.lua": 1}, hashed)
+
+	// a checkout that keeps the modification time and size goes unnoticed
+	// by the cache...
+	t.Ok(ioutil.WriteFile(dht, []byte("return 9\n"), 0644))
+	t.Ok(os.Chtimes(dht, fi.ModTime(), fi.ModTime()))
+	hashed = make(map[string]int)
+	libs, err := LoadLibraries(cfg)
+	t.Ok(err)
+	t.Equals(0, len(hashed))
+	t.Equals(NewVirtualFileEntry([]byte("return 1\n"), "dht.lua").Hash, libs[sensorsPath].Files["dht.lua"].Hash)
+
+	// ...until the library version changes, which rescans only that library
+	t.Ok(ioutil.WriteFile(filepath.Join(sensorsPath, "library.json"), []byte(`{"version": "1.1"}`), 0644))
+	libs, err = LoadLibraries(cfg)
+	t.Ok(err)
+	t.Equals(map[string]int{"dht.lua": 1}, hashed)
+	t.Equals(NewVirtualFileEntry([]byte("return 9\n"), "dht.lua").Hash, libs[sensorsPath].Files["dht.lua"].Hash)
+}
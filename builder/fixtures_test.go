@@ -0,0 +1,66 @@
+package builder
+
+import (
+	"espore/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// noLFS keeps every file out of LFS, so tests need no Lua compiler
+var noLFS = FirmwareLFSConfig{Exclude: []string{"**/*", "*"}}
+
+// testFirmwareDef returns the definition of a device kept out of LFS
+func testFirmwareDef(id, name string) FirmwareDef {
+	return FirmwareDef{DeviceInfo: DeviceInfo{ID: id, Name: name}, LFS: noLFS}
+}
+
+// testFirmwareJSON returns the firmware.json of a device kept out of LFS
+func testFirmwareJSON(id, name string) string {
+	return `{"name": ` + strconv.Quote(name) + `, "id": ` + strconv.Quote(id) + `, "lfs": {"exclude": ["**/*", "*"]}}`
+}
+
+// writeFiles writes files, keyed by their slash separated path relative to
+// root, creating the folders they are in
+func writeFiles(tb testing.TB, root string, files map[string]string) {
+	tb.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			tb.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// buildTestManifest loads the device folder at devicePath and builds the
+// manifest of fwDef from it, returning the libraries it was built from too
+func buildTestManifest(tb testing.TB, cfg *config.BuildConfig, devicePath string, fwDef FirmwareDef) (*FirmwareManifest, []*FirmwareLib) {
+	tb.Helper()
+	lib, err := LoadLibrary(cfg, devicePath, make(map[string]*FirmwareLib), 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	manifest, err := buildDeviceFirmwareManifest(cfg, lib, fwDef, newLFSCache(""))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	libs, err := orderLibraries(getLibraryList(lib, nil), lib, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return manifest, libs
+}
+
+// fileHashes maps the path of every file in manifest to its hash
+func fileHashes(manifest *FirmwareManifest) map[string]string {
+	hashes := make(map[string]string, len(manifest.Files))
+	for _, fe := range manifest.Files {
+		hashes[fe.Path] = fe.Hash
+	}
+	return hashes
+}
@@ -0,0 +1,80 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"espore/config"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// FirmwareTemplateName is the device definition rendered with text/template
+// before being parsed. It takes precedence over firmware.json.
+const FirmwareTemplateName = "firmware.json.tmpl"
+
+// FirmwareTemplateContext is the data available to firmware templates
+type FirmwareTemplateContext struct {
+	// Env holds the environment variables
+	Env map[string]string
+	// Device is the name of the device folder
+	Device string
+	// Site holds the site-wide values from the build configuration
+	Site map[string]interface{}
+}
+
+// ReadFirmwareDef reads the device definition in devicePath, rendering
+// firmware.json.tmpl if present, or reading firmware.json otherwise
+func ReadFirmwareDef(config *config.BuildConfig, devicePath string) (FirmwareDef, error) {
+	var fwDef FirmwareDef
+	jsonPath := filepath.Join(devicePath, "firmware.json")
+	tmplPath := filepath.Join(devicePath, FirmwareTemplateName)
+	tmplData, err := ioutil.ReadFile(tmplPath)
+	if os.IsNotExist(err) {
+		data, err := ioutil.ReadFile(jsonPath)
+		if err != nil {
+			return fwDef, err
+		}
+		return fwDef, json.Unmarshal(data, &fwDef)
+	}
+	if err != nil {
+		return fwDef, err
+	}
+	if _, err := os.Stat(jsonPath); err == nil {
+		newBuildLog(config).Infof("Warning: %s: both %s and firmware.json exist, using the template", devicePath, FirmwareTemplateName)
+	}
+
+	tmpl, err := template.New(FirmwareTemplateName).Parse(string(tmplData))
+	if err != nil {
+		return fwDef, fmt.Errorf("Error parsing %s: %s", tmplPath, err)
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, firmwareTemplateContext(config, devicePath)); err != nil {
+		return fwDef, fmt.Errorf("Error rendering %s: %s", tmplPath, err)
+	}
+	if err := json.Unmarshal(rendered.Bytes(), &fwDef); err != nil {
+		return fwDef, fmt.Errorf("Error decoding rendered %s: %s", tmplPath, err)
+	}
+	return fwDef, nil
+}
+
+func firmwareTemplateContext(config *config.BuildConfig, devicePath string) *FirmwareTemplateContext {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	site := config.Site
+	if site == nil {
+		site = make(map[string]interface{})
+	}
+	return &FirmwareTemplateContext{
+		Env:    env,
+		Device: filepath.Base(devicePath),
+		Site:   site,
+	}
+}
@@ -0,0 +1,47 @@
+package builder
+
+import (
+	"espore/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestFirmwareTemplate(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	devicePath, err := ioutil.TempDir("", "espore-device")
+	t.Ok(err)
+	defer os.RemoveAll(devicePath)
+
+	tmpl := `{
+	"id": "1111",
+	"name": "{{.Device}}",
+	"modules": [
+		{"name": "sensor"}{{if .Site.debug}},
+		{"name": "telnet", "autostart": true}{{end}}
+	]
+}`
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, FirmwareTemplateName), []byte(tmpl), 0644))
+	// the template takes precedence over firmware.json
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "firmware.json"), []byte(`{"id": "9999"}`), 0644))
+
+	fwDef, err := ReadFirmwareDef(&config.BuildConfig{}, devicePath)
+	t.Ok(err)
+	t.Equals("1111", fwDef.ID)
+	t.Equals(filepath.Base(devicePath), fwDef.Name)
+	t.Equals([]ModuleDef{{Name: "sensor"}}, fwDef.Modules)
+
+	fwDef, err = ReadFirmwareDef(&config.BuildConfig{Site: map[string]interface{}{"debug": true}}, devicePath)
+	t.Ok(err)
+	t.Equals([]ModuleDef{{Name: "sensor"}, {Name: "telnet", Autostart: true}}, fwDef.Modules)
+
+	t.Ok(os.Remove(filepath.Join(devicePath, FirmwareTemplateName)))
+	fwDef, err = ReadFirmwareDef(&config.BuildConfig{}, devicePath)
+	t.Ok(err)
+	t.Equals("9999", fwDef.ID)
+}
@@ -0,0 +1,94 @@
+package builder
+
+import (
+	"espore/config"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DeviceGraphDOT returns the module dependency graph of a device in Graphviz
+// DOT format. Modules are resolved the same way the build does, starting from
+// the modules the device starts. Modules that cannot be found are drawn as
+// dashed red nodes.
+func DeviceGraphDOT(config *config.BuildConfig, deviceID string) (string, error) {
+	deviceRootLib, fwDef, err := loadDevice(config, deviceID)
+	if err != nil {
+		return "", err
+	}
+	modules, searchLibs, err := deviceModules(deviceRootLib, getLibraryList(deviceRootLib, nil), fwDef, config.GetSearchPath())
+	if err != nil {
+		return "", err
+	}
+	var roots []string
+	for _, module := range modules {
+		roots = append(roots, module.Name)
+	}
+	generated := make(map[string]bool)
+	if config.VersionModule {
+		generated[file2Mod(VersionFileName)] = true
+	}
+	return dependencyGraphDOT(fwDef.ID, roots, config.GetSearchPath(), searchLibs, generated), nil
+}
+
+// dependencyGraphDOT renders the dependencies of the root modules as a DOT
+// digraph named name. Modules in generated are produced by the build, so
+// they are not reported as missing.
+func dependencyGraphDOT(name string, roots []string, searchPath []string, libs []*FirmwareLib, generated map[string]bool) string {
+	seen := make(map[string]bool)
+	nodes := make(map[string]*DependencyNode)
+	var edges []string
+	var walk func(node *DependencyNode)
+	walk = func(node *DependencyNode) {
+		if node.Seen {
+			return
+		}
+		nodes[node.Module] = node
+		for _, dep := range node.Dependencies {
+			edges = append(edges, fmt.Sprintf("\t%s -> %s;\n", dotQuote(node.Module), dotQuote(dep.Module)))
+			walk(dep)
+		}
+	}
+	isRoot := make(map[string]bool)
+	for _, root := range roots {
+		isRoot[root] = true
+		walk(dependencyTree(root, searchPath, libs, seen))
+	}
+
+	names := make([]string, 0, len(nodes))
+	for module := range nodes {
+		names = append(names, module)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "digraph %s {\n", dotQuote(name))
+	sb.WriteString("\tnode [shape=box];\n")
+	for _, module := range names {
+		var attrs []string
+		switch {
+		case generated[module]:
+			attrs = append(attrs, "style=dotted")
+		case nodes[module].Entry == nil:
+			attrs = append(attrs, "style=dashed", "color=red", "fontcolor=red", "label="+dotQuote(module+" (not found)"))
+		}
+		if isRoot[module] {
+			attrs = append(attrs, "peripheries=2")
+		}
+		if len(attrs) == 0 {
+			fmt.Fprintf(&sb, "\t%s;\n", dotQuote(module))
+		} else {
+			fmt.Fprintf(&sb, "\t%s [%s];\n", dotQuote(module), strings.Join(attrs, ", "))
+		}
+	}
+	for _, edge := range edges {
+		sb.WriteString(edge)
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// dotQuote returns s as a quoted DOT identifier
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
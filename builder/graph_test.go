@@ -0,0 +1,44 @@
+package builder
+
+import (
+	"espore/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestDeviceGraphDOT(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	root, err := ioutil.TempDir("", "espore-graph")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+	devicePath := filepath.Join(root, "devices", "1111")
+	t.Ok(os.MkdirAll(devicePath, 0755))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "firmware.json"), []byte(`{"name": "kitchen", "id": "1111"}`), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "library.json"), []byte(`{"modules": [{"name": "sensor", "autostart": true}]}`), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "main.lua"), []byte("require(\"util\")\n"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "sensor.lua"), []byte("require(\"util\")\nrequire(\"gps\")\n"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "util.lua"), []byte("return {}\n"), 0644))
+
+	dot, err := DeviceGraphDOT(&config.BuildConfig{Devices: []string{filepath.Join(root, "devices", "*")}}, "1111")
+	t.Ok(err)
+	t.Equals(`digraph "1111" {
+	node [shape=box];
+	"gps" [style=dashed, color=red, fontcolor=red, label="gps (not found)"];
+	"main" [peripheries=2];
+	"sensor" [peripheries=2];
+	"util";
+	"sensor" -> "gps";
+	"sensor" -> "util";
+	"main" -> "util";
+}
+`, dot)
+
+	_, err = DeviceGraphDOT(&config.BuildConfig{Devices: []string{filepath.Join(root, "devices", "*")}}, "9999")
+	t.Assert(err != nil, "Expected an error for an unknown device")
+}
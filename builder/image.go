@@ -0,0 +1,76 @@
+package builder
+
+import (
+	"fmt"
+	"io"
+)
+
+// ImageWriter serializes a device firmware image in a given format version
+type ImageWriter interface {
+	// WriteHeader writes the image preamble, before any file is written
+	WriteHeader(w io.Writer, manifest *FirmwareManifest, totalFiles int) error
+	// WriteFile appends a file to the image
+	WriteFile(w io.Writer, path string, size int64, r io.Reader) error
+}
+
+// DeltaImageWriter is implemented by image formats that support delta images
+type DeltaImageWriter interface {
+	ImageWriter
+	// WriteDeltaHeader writes the preamble of a delta image, listing the
+	// files the device must delete
+	WriteDeltaHeader(w io.Writer, manifest *FirmwareManifest, totalFiles int, deleted []string) error
+}
+
+// DefaultImageVersion is the image format used when none is configured
+const DefaultImageVersion = 1
+
+var imageWriters = map[int]ImageWriter{
+	1: &imageWriterV1{},
+}
+
+// GetImageWriter returns the ImageWriter for the given image format version.
+// Version 0 selects DefaultImageVersion.
+func GetImageWriter(version int) (ImageWriter, error) {
+	if version == 0 {
+		version = DefaultImageVersion
+	}
+	imageWriter, ok := imageWriters[version]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported image version %d", version)
+	}
+	return imageWriter, nil
+}
+
+// imageWriterV1 writes a plain text header followed by each file as its path
+// and size on separate lines, then the raw contents
+type imageWriterV1 struct{}
+
+func (iw *imageWriterV1) WriteHeader(w io.Writer, manifest *FirmwareManifest, totalFiles int) error {
+	_, err := fmt.Fprintf(w, "Version: 1 -- ESPore Device Image File\nDevice Id: %s\nDevice Name: %s\nTotal files: %d\n\n",
+		manifest.ID, manifest.Name, totalFiles)
+	return err
+}
+
+// WriteDeltaHeader writes the version 1 header with an extra Delete line for
+// each file to remove
+func (iw *imageWriterV1) WriteDeltaHeader(w io.Writer, manifest *FirmwareManifest, totalFiles int, deleted []string) error {
+	if _, err := fmt.Fprintf(w, "Version: 1 -- ESPore Device Delta Image File\nDevice Id: %s\nDevice Name: %s\nTotal files: %d\n",
+		manifest.ID, manifest.Name, totalFiles); err != nil {
+		return err
+	}
+	for _, path := range deleted {
+		if _, err := fmt.Fprintf(w, "Delete: %s\n", path); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprint(w, "\n")
+	return err
+}
+
+func (iw *imageWriterV1) WriteFile(w io.Writer, path string, size int64, r io.Reader) error {
+	if _, err := fmt.Fprintf(w, "%s\n%d\n", path, size); err != nil {
+		return err
+	}
+	_, err := io.Copy(w, r)
+	return err
+}
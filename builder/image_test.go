@@ -0,0 +1,46 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestImageWriterV1(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	outputDir, err := ioutil.TempDir("", "espore-image")
+	t.Ok(err)
+	defer os.RemoveAll(outputDir)
+
+	manifest := &FirmwareManifest{
+		DeviceInfo: DeviceInfo{Name: "kitchen", ID: "1234"},
+		Files: []*FileEntry{
+			NewVirtualFileEntry([]byte("print(1)"), "main.lua"),
+			NewVirtualFileEntry([]byte("{}"), "config.json"),
+		},
+	}
+	manifest.Files[0].Datafiles = []string{"data.txt"}
+
+	imageWriter, err := GetImageWriter(0)
+	t.Ok(err)
+	t.Ok(writeFirmwareImage(manifest, outputDir, imageWriter))
+
+	data, err := ioutil.ReadFile(filepath.Join(outputDir, "1234.img"))
+	t.Ok(err)
+	t.Equals("Version: 1 -- ESPore Device Image File\n"+
+		"Device Id: 1234\n"+
+		"Device Name: kitchen\n"+
+		"Total files: 3\n"+
+		"\n"+
+		"config.json\n2\n{}"+
+		"main.lua\n8\nprint(1)"+
+		"datafiles.json\n12\n[\"data.txt\"]", string(data))
+
+	_, err = GetImageWriter(99)
+	t.Assert(err != nil, "Expected unsupported image version to fail")
+}
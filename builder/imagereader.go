@@ -0,0 +1,123 @@
+package builder
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ImageHeader is the preamble of a version 1 image
+type ImageHeader struct {
+	Version    int
+	Delta      bool
+	ID         string
+	Name       string
+	TotalFiles int
+	// Deleted lists the files a delta image removes from the device
+	Deleted []string
+}
+
+// ParseImage reads a version 1 image, calling fn with each file it contains.
+// fn must consume the file contents from r before returning.
+func ParseImage(r io.Reader, fn func(path string, size int64, r io.Reader) error) (*ImageHeader, error) {
+	br := bufio.NewReader(r)
+	header := &ImageHeader{}
+	for first := true; ; first = false {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("truncated image header")
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			break
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid image header line %q", line)
+		}
+		switch key, value := parts[0], parts[1]; {
+		case first:
+			if key != "Version" {
+				return nil, fmt.Errorf("not an ESPore image")
+			}
+			if fields := strings.Fields(value); len(fields) > 0 {
+				header.Version, _ = strconv.Atoi(fields[0])
+			}
+			header.Delta = strings.Contains(value, "Delta")
+		case key == "Device Id":
+			header.ID = value
+		case key == "Device Name":
+			header.Name = value
+		case key == "Total files":
+			header.TotalFiles, _ = strconv.Atoi(value)
+		case key == "Delete":
+			header.Deleted = append(header.Deleted, value)
+		}
+	}
+	if header.Version != 1 {
+		return nil, fmt.Errorf("Unsupported image version %d", header.Version)
+	}
+
+	for files := 0; ; files++ {
+		path, err := br.ReadString('\n')
+		if err == io.EOF && path == "" {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("truncated image after %d files", files)
+		}
+		path = strings.TrimSuffix(path, "\n")
+		sizeLine, err := br.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("truncated image entry %s", path)
+		}
+		size, err := strconv.ParseInt(strings.TrimSuffix(sizeLine, "\n"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size for image entry %s", path)
+		}
+		contents := &io.LimitedReader{R: br, N: size}
+		if err := fn(path, size, contents); err != nil {
+			return nil, err
+		}
+		if contents.N > 0 {
+			return nil, fmt.Errorf("truncated image entry %s", path)
+		}
+	}
+	return header, nil
+}
+
+// ExtractImage writes the files of a version 1 image to dstDir. Files with
+// paths leading outside dstDir are refused.
+func ExtractImage(r io.Reader, dstDir string) (*ImageHeader, error) {
+	return ParseImage(r, func(path string, size int64, r io.Reader) error {
+		dst := filepath.Join(dstDir, filepath.FromSlash(path))
+		rel, err := filepath.Rel(dstDir, dst)
+		if err != nil || filepath.IsAbs(path) || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("image entry %s is outside the destination directory", path)
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		f, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(f, r)
+		return err
+	})
+}
+
+// OpenImage opens an image file for reading, or standard input if path is
+// "-", so the image tools can be used in pipelines
+func OpenImage(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
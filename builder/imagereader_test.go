@@ -0,0 +1,102 @@
+package builder
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestExtractImageFromStdin(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	files := map[string]string{
+		"init.lua":        "dofile(\"main.lua\")",
+		"main.lua":        "print('hello')",
+		"www/index.html":  "<html></html>",
+		"empty/file.conf": "",
+	}
+	var paths []string
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var image bytes.Buffer
+	imageWriter := &imageWriterV1{}
+	manifest := &FirmwareManifest{DeviceInfo: DeviceInfo{ID: "1111", Name: "kitchen"}}
+	t.Ok(imageWriter.WriteHeader(&image, manifest, len(files)))
+	for _, path := range paths {
+		t.Ok(imageWriter.WriteFile(&image, path, int64(len(files[path])), strings.NewReader(files[path])))
+	}
+
+	// pipe the image through stdin, as in cat 1111.img | espore -extract -
+	pr, pw, err := os.Pipe()
+	t.Ok(err)
+	defer func(stdin *os.File) { os.Stdin = stdin }(os.Stdin)
+	os.Stdin = pr
+	written := make(chan error, 1)
+	go func() {
+		_, err := pw.Write(image.Bytes())
+		pw.Close()
+		written <- err
+	}()
+
+	dstDir, err := ioutil.TempDir("", "espore-extract")
+	t.Ok(err)
+	defer os.RemoveAll(dstDir)
+	r, err := OpenImage("-")
+	t.Ok(err)
+	header, err := ExtractImage(r, dstDir)
+	t.Ok(err)
+	t.Ok(r.Close())
+	t.Ok(<-written)
+	pr.Close()
+
+	t.Equals(&ImageHeader{Version: 1, ID: "1111", Name: "kitchen", TotalFiles: len(files)}, header)
+	for path, contents := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dstDir, filepath.FromSlash(path)))
+		t.Ok(err)
+		t.Equals(contents, string(data))
+	}
+
+	// entries escaping the destination are refused
+	image.Reset()
+	t.Ok(imageWriter.WriteHeader(&image, manifest, 1))
+	t.Ok(imageWriter.WriteFile(&image, "../evil.lua", 4, strings.NewReader("evil")))
+	_, err = ExtractImage(&image, dstDir)
+	t.Assert(err != nil, "Expected an error extracting a file outside the destination")
+	_, err = os.Stat(filepath.Join(filepath.Dir(dstDir), "evil.lua"))
+	t.Assert(os.IsNotExist(err), "Expected nothing written outside the destination")
+
+	// truncated images are reported
+	image.Reset()
+	t.Ok(imageWriter.WriteHeader(&image, manifest, 1))
+	t.Ok(imageWriter.WriteFile(&image, "main.lua", 100, strings.NewReader("short")))
+	_, err = ExtractImage(&image, dstDir)
+	t.Assert(err != nil, "Expected an error for a truncated image")
+
+	// extracting into a relative destination works as well
+	wd, err := os.Getwd()
+	t.Ok(err)
+	defer os.Chdir(wd)
+	t.Ok(os.Chdir(dstDir))
+	image.Reset()
+	t.Ok(imageWriter.WriteHeader(&image, manifest, 1))
+	t.Ok(imageWriter.WriteFile(&image, "relative.lua", 2, strings.NewReader("ok")))
+	_, err = ExtractImage(&image, ".")
+	t.Ok(err)
+	data, err := ioutil.ReadFile(filepath.Join(dstDir, "relative.lua"))
+	t.Ok(err)
+	t.Equals("ok", string(data))
+
+	// an empty version header is not an image
+	_, err = ParseImage(strings.NewReader("Version: \n\n"), nil)
+	t.Assert(err != nil, "Expected an error for an empty version")
+}
@@ -0,0 +1,204 @@
+package builder
+
+import (
+	"errors"
+	"espore/config"
+	"path/filepath"
+	"sort"
+)
+
+// ErrFullBuildRequired is returned by UpdateManifestForFile when the change
+// cannot be applied incrementally and the manifest must be rebuilt
+var ErrFullBuildRequired = errors.New("The change requires a full build")
+
+// UpdateManifestForFile updates a device manifest after the file at
+// changedPath, one of the library files the device was built from, changed
+// on disk. The file is re-hashed and its manifest entry updated. If it
+// requires new modules or loads new files, they are resolved and added to the
+// manifest. The generated version.lua and files.json are refreshed when
+// present.
+//
+// The changes are found by comparing the file with the manifest's own entry,
+// so the same libraries can be used to update every device built from them.
+// Entries are never modified in place since manifests share them with the
+// libraries; the manifest and the libraries get updated copies instead.
+//
+// It returns ErrFullBuildRequired if the file is packed in the LFS image,
+// belongs to a prefixed library, or stopped requiring or loading a file,
+// since files may no longer be needed.
+func UpdateManifestForFile(config *config.BuildConfig, manifest *FirmwareManifest, libs []*FirmwareLib, changedPath string) error {
+	files, key := findLibraryEntry(libs, changedPath)
+	if files == nil {
+		return ErrFileEntryNotFound
+	}
+	entry := files[key]
+	if entry.Source != "" {
+		return ErrFullBuildRequired
+	}
+
+	hash, info, err := scanFile(entry.SourcePath(), importRegex(config.GetDirectiveKeywords()), nil, "")
+	if err != nil {
+		return err
+	}
+	size, err := fileSize(entry.SourcePath())
+	if err != nil {
+		return err
+	}
+	updated := *entry
+	updated.Hash, updated.Size = hash, size
+	if info != nil {
+		updated.Dependencies, updated.DependencyLines = info.Dependencies, info.DependencyLines
+		updated.OptionalDependencies = info.OptionalDependencies
+		updated.Datafiles, updated.DatafileLines = info.Datafiles, info.DatafileLines
+		updated.Includes, updated.IncludeLines = info.Includes, info.IncludeLines
+	}
+	files[key] = &updated
+
+	fileMap := make(map[string]*FileEntry, len(manifest.Files))
+	shippedIndex := -1
+	for i, fe := range manifest.Files {
+		fileMap[fe.Path] = fe
+		if fe.Path == entry.Path && fe.Content == nil {
+			shippedIndex = i
+		}
+		for _, source := range fe.Sources {
+			if source == entry.Path {
+				return ErrFullBuildRequired
+			}
+		}
+	}
+	if shippedIndex < 0 {
+		// the device does not use this file
+		return nil
+	}
+	shipped := manifest.Files[shippedIndex]
+
+	var added []string
+	var includesAdded []string
+	if info != nil {
+		var removed bool
+		added, removed = diffStrings(shipped.Dependencies, info.Dependencies)
+		if removed {
+			return ErrFullBuildRequired
+		}
+		includesAdded, removed = diffStrings(shipped.Includes, info.Includes)
+		if removed {
+			return ErrFullBuildRequired
+		}
+		// a require that stops being optional may now fail to resolve
+		for dep := range shipped.OptionalDependencies {
+			if !info.OptionalDependencies[dep] {
+				return ErrFullBuildRequired
+			}
+		}
+	}
+
+	deviceEntry := updated
+	if hasDeviceDatafiles(updated.Datafiles) {
+		deviceEntry.Datafiles = deviceDatafiles(updated.Datafiles, manifest.ID)
+	}
+	manifest.Files[shippedIndex] = &deviceEntry
+	fileMap[deviceEntry.Path] = &deviceEntry
+
+	if len(added) > 0 || len(includesAdded) > 0 {
+		newEntry := updated
+		newEntry.Dependencies, newEntry.Includes = added, includesAdded
+		if err := addReferencedFiles(&newEntry, config.GetSearchPath(), libs, fileMap, []string{file2Mod(entry.Path)}); err != nil {
+			return err
+		}
+		expandDatafiles(fileMap, manifest.ID)
+		var newPaths []string
+		for path := range fileMap {
+			if !manifestHasFile(manifest, path) {
+				newPaths = append(newPaths, path)
+			}
+		}
+		sort.Strings(newPaths)
+		for _, path := range newPaths {
+			manifest.Files = append(manifest.Files, fileMap[path])
+		}
+	}
+
+	return refreshGeneratedFiles(manifest)
+}
+
+// findLibraryEntry returns the library file map holding the file whose
+// source is at path, and its key in that map
+func findLibraryEntry(libs []*FirmwareLib, path string) (map[string]*FileEntry, string) {
+	path = filepath.Clean(path)
+	for _, lib := range libs {
+		for _, files := range []map[string]*FileEntry{lib.Files, lib.DeviceFiles} {
+			for key, fe := range files {
+				if filepath.Clean(fe.SourcePath()) == path {
+					return files, key
+				}
+			}
+		}
+	}
+	return nil, ""
+}
+
+// diffStrings returns the strings in b that are not in a, and whether any
+// string in a is missing from b
+func diffStrings(a, b []string) (added []string, removed bool) {
+	inA := make(map[string]bool, len(a))
+	for _, s := range a {
+		inA[s] = true
+	}
+	inB := make(map[string]bool, len(b))
+	for _, s := range b {
+		inB[s] = true
+		if !inA[s] {
+			added = append(added, s)
+		}
+	}
+	for _, s := range a {
+		if !inB[s] {
+			removed = true
+		}
+	}
+	return added, removed
+}
+
+func manifestHasFile(manifest *FirmwareManifest, path string) bool {
+	for _, fe := range manifest.Files {
+		if fe.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshGeneratedFiles regenerates version.lua and files.json if the
+// manifest ships them, since they depend on the hashes of the other files
+func refreshGeneratedFiles(manifest *FirmwareManifest) error {
+	var hasVersion, hasEmbedded bool
+	files := manifest.Files[:0]
+	for _, fe := range manifest.Files {
+		switch fe.Path {
+		case VersionFileName:
+			hasVersion = fe.Content != nil
+			if hasVersion {
+				continue
+			}
+		case EmbeddedManifestName:
+			hasEmbedded = fe.Content != nil
+			if hasEmbedded {
+				continue
+			}
+		}
+		files = append(files, fe)
+	}
+	manifest.Files = files
+	if hasVersion {
+		manifest.Files = append(manifest.Files, versionModule(manifest))
+	}
+	if hasEmbedded {
+		embedded, err := embeddedManifest(manifest)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, embedded)
+	}
+	return nil
+}
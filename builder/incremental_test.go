@@ -0,0 +1,126 @@
+package builder
+
+import (
+	"espore/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestUpdateManifestForFile(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	root, err := ioutil.TempDir("", "espore-incremental")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+	devicePath := filepath.Join(root, "device")
+	libPath := filepath.Join(root, "lib")
+	utilPath := filepath.Join(libPath, "util.lua")
+	write := func(path, code string) {
+		t.Ok(ioutil.WriteFile(path, []byte(code), 0644))
+	}
+	writeFiles(tx, root, map[string]string{
+		"device/library.json": `{"dependencies": [` + strconv.Quote(libPath) + `]}`,
+		"device/main.lua":     `require("util")`,
+		"lib/util.lua":        `return {}`,
+		"lib/extra.lua":       `return 1`,
+	})
+
+	cfg := &config.BuildConfig{Reproducible: true, VersionModule: true, EmbedManifest: true}
+	build := func() (*FirmwareManifest, []*FirmwareLib) {
+		return buildTestManifest(tx, cfg, devicePath, testFirmwareDef("1111", "kitchen"))
+	}
+	manifest, libs := build()
+	_, shipped := fileHashes(manifest)["extra.lua"]
+	t.Assert(!shipped, "Expected extra.lua not to be shipped before it is required")
+
+	// a content change only updates the file and the generated files
+	write(utilPath, `return {version = 2}`)
+	before := fileHashes(manifest)
+	t.Ok(UpdateManifestForFile(cfg, manifest, libs, utilPath))
+	rebuilt, _ := build()
+	t.Equals(fileHashes(rebuilt), fileHashes(manifest))
+	after := fileHashes(manifest)
+	t.Assert(before["util.lua"] != after["util.lua"], "Expected util.lua to be re-hashed")
+	t.Assert(before[VersionFileName] != after[VersionFileName], "Expected version.lua to be refreshed")
+	t.Equals(before["main.lua"], after["main.lua"])
+
+	// a new require pulls in the module, a new datafile is recorded
+	write(utilPath, "-- datafile: util.cfg\nreturn require(\"extra\")")
+	t.Ok(UpdateManifestForFile(cfg, manifest, libs, utilPath))
+	rebuilt, _ = build()
+	t.Equals(fileHashes(rebuilt), fileHashes(manifest))
+	for _, fe := range manifest.Files {
+		if fe.Path == "util.lua" {
+			t.Equals([]string{"util.cfg"}, fe.Datafiles)
+		}
+	}
+
+	// dropping a require may leave files unused, which needs a full build
+	write(utilPath, `return {}`)
+	err = UpdateManifestForFile(cfg, manifest, libs, utilPath)
+	t.Equals(ErrFullBuildRequired, err)
+
+	// files that are not part of any library are reported
+	err = UpdateManifestForFile(cfg, manifest, libs, filepath.Join(libPath, "missing.lua"))
+	t.Equals(ErrFileEntryNotFound, err)
+}
+
+func TestUpdateManifestForFileSharedLibrary(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	root, err := ioutil.TempDir("", "espore-incremental")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+	libPath := filepath.Join(root, "lib")
+	utilPath := filepath.Join(libPath, "util.lua")
+	writeFiles(tx, libPath, map[string]string{
+		"util.lua":  `return {}`,
+		"extra.lua": `return 1`,
+	})
+	var devicePaths []string
+	for _, id := range []string{"1111", "2222"} {
+		devicePath := filepath.Join(root, id)
+		writeFiles(tx, devicePath, map[string]string{
+			"library.json": `{"dependencies": [` + strconv.Quote(libPath) + `]}`,
+			"main.lua":     `require("util")`,
+		})
+		devicePaths = append(devicePaths, devicePath)
+	}
+
+	cfg := &config.BuildConfig{Reproducible: true}
+	build := func(allLibs map[string]*FirmwareLib) ([]*FirmwareManifest, [][]*FirmwareLib) {
+		var manifests []*FirmwareManifest
+		var libs [][]*FirmwareLib
+		for _, devicePath := range devicePaths {
+			lib, err := LoadLibrary(cfg, devicePath, allLibs, 0)
+			t.Ok(err)
+			fwDef := testFirmwareDef(filepath.Base(devicePath), "")
+			manifest, err := buildDeviceFirmwareManifest(cfg, lib, fwDef, newLFSCache(""))
+			t.Ok(err)
+			manifests = append(manifests, manifest)
+			deviceLibs, err := orderLibraries(getLibraryList(lib, nil), lib, nil)
+			t.Ok(err)
+			libs = append(libs, deviceLibs)
+		}
+		return manifests, libs
+	}
+	// both devices are built from the same library entries
+	manifests, libs := build(make(map[string]*FirmwareLib))
+	writeFiles(tx, libPath, map[string]string{"util.lua": `return require("extra")`})
+	for i, manifest := range manifests {
+		t.Ok(UpdateManifestForFile(cfg, manifest, libs[i], utilPath))
+	}
+	rebuilt, _ := build(make(map[string]*FirmwareLib))
+	for i, manifest := range manifests {
+		t.Equals(fileHashes(rebuilt[i]), fileHashes(manifest))
+		_, shipped := fileHashes(manifest)["extra.lua"]
+		t.Assert(shipped, "Expected %s to ship extra.lua", manifest.ID)
+	}
+}
@@ -0,0 +1,92 @@
+package builder
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// orderModules sorts the modules so each one comes after the modules it
+// requires, directly or through other files, and after the modules named in
+// its After list. Modules with no constraint between them are kept in
+// alphabetical order. It returns an error if the constraints form a cycle.
+func orderModules(modules []ModuleDef, searchPath []string, libs []*FirmwareLib) ([]ModuleDef, error) {
+	byName := make(map[string]ModuleDef, len(modules))
+	for _, mod := range modules {
+		byName[mod.Name] = mod
+	}
+
+	// before[m] holds the modules that must start before m
+	before := make(map[string]map[string]bool, len(modules))
+	for _, mod := range modules {
+		before[mod.Name] = make(map[string]bool)
+		for dep := range requiredModules(mod.Name, searchPath, libs) {
+			if _, ok := byName[dep]; ok && dep != mod.Name {
+				before[mod.Name][dep] = true
+			}
+		}
+		for _, after := range mod.After {
+			// constraints on modules this device does not start are moot
+			if _, ok := byName[after]; ok {
+				before[mod.Name][after] = true
+			}
+		}
+	}
+
+	ordered := make([]ModuleDef, 0, len(modules))
+	for len(before) > 0 {
+		var ready []string
+		for name, deps := range before {
+			if len(deps) == 0 {
+				ready = append(ready, name)
+			}
+		}
+		if len(ready) == 0 {
+			var cycle []string
+			for name := range before {
+				cycle = append(cycle, name)
+			}
+			sort.Strings(cycle)
+			return nil, fmt.Errorf("Cannot order modules, there is a cycle between %s", strings.Join(cycle, ", "))
+		}
+		sort.Strings(ready)
+		name := ready[0]
+		ordered = append(ordered, byName[name])
+		delete(before, name)
+		for _, deps := range before {
+			delete(deps, name)
+		}
+	}
+	return ordered, nil
+}
+
+// requiredModules returns the modules reachable through the requires of the
+// given module and the files it loads
+func requiredModules(moduleName string, searchPath []string, libs []*FirmwareLib) map[string]bool {
+	required := make(map[string]bool)
+	visited := make(map[string]bool)
+	var visit func(fileName string)
+	visit = func(fileName string) {
+		if visited[fileName] {
+			return
+		}
+		visited[fileName] = true
+		entry, err := FindInLibraries(fileName, libs)
+		if err != nil {
+			return
+		}
+		for _, dep := range entry.Dependencies {
+			required[dep] = true
+			if depFile, depEntry := findModule(dep, searchPath, libs, nil); depEntry != nil {
+				visit(depFile)
+			}
+		}
+		for _, inc := range entry.Includes {
+			visit(inc)
+		}
+	}
+	if fileName, entry := findModule(moduleName, searchPath, libs, nil); entry != nil {
+		visit(fileName)
+	}
+	return required
+}
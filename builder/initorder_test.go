@@ -0,0 +1,45 @@
+package builder
+
+import (
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestModuleInitOrder(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	lib := &FirmwareLib{
+		Files: map[string]*FileEntry{
+			"app.lua":     {Path: "app.lua", Dependencies: []string{"util"}},
+			"util.lua":    {Path: "util.lua", Dependencies: []string{"log"}},
+			"log.lua":     {Path: "log.lua"},
+			"network.lua": {Path: "network.lua"},
+		},
+	}
+	libs := []*FirmwareLib{lib}
+	names := func(mods []ModuleDef) []string {
+		var n []string
+		for _, mod := range mods {
+			n = append(n, mod.Name)
+		}
+		return n
+	}
+
+	modules := []ModuleDef{{Name: "app"}, {Name: "log"}, {Name: "network"}}
+	ordered, err := orderModules(modules, nil, libs)
+	t.Ok(err)
+	t.Equals([]string{"log", "app", "network"}, names(ordered))
+
+	// app does not require network, but must start after it
+	modules[0].After = []string{"network"}
+	ordered, err = orderModules(modules, nil, libs)
+	t.Ok(err)
+	t.Equals([]string{"log", "network", "app"}, names(ordered))
+
+	modules[1].After = []string{"app"}
+	_, err = orderModules(modules, nil, libs)
+	t.Assert(err != nil, "Expected a cycle between app and log")
+	t.Equals("Cannot order modules, there is a cycle between app, log", err.Error())
+}
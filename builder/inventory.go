@@ -0,0 +1,75 @@
+package builder
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// InventoryRow summarizes the build of a device
+type InventoryRow struct {
+	// ID is the device id, followed by the variant name for device variants
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Files int    `json:"files"`
+	// Size is the total size of the files, in bytes
+	Size int64 `json:"size"`
+	// Checksum is the firmware checksum, the one devices report when built
+	// with versionModule
+	Checksum string `json:"checksum"`
+}
+
+// Inventory returns a row for each device manifest in outputDir, sorted by
+// device id
+func Inventory(outputDir string) ([]InventoryRow, error) {
+	manifests, err := readManifests(outputDir)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]InventoryRow, 0, len(manifests))
+	for _, mf := range manifests {
+		if mf.err != nil {
+			return nil, fmt.Errorf("Error reading manifest %s: %s", mf.path, mf.err)
+		}
+		manifest := mf.manifest
+		row := InventoryRow{
+			ID:       artifactName(manifest),
+			Name:     manifest.Name,
+			Files:    len(manifest.Files),
+			Checksum: FirmwareChecksum(manifest),
+		}
+		for _, fe := range manifest.Files {
+			row.Size += fe.Size
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return strings.Compare(rows[i].ID, rows[j].ID) < 0
+	})
+	return rows, nil
+}
+
+// WriteInventoryJSON writes the inventory as a JSON array
+func WriteInventoryJSON(w io.Writer, rows []InventoryRow) error {
+	data, err := json.MarshalIndent(rows, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// WriteInventoryCSV writes the inventory as CSV with a header row
+func WriteInventoryCSV(w io.Writer, rows []InventoryRow) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "name", "files", "size", "checksum"})
+	for _, row := range rows {
+		cw.Write([]string{row.ID, row.Name, strconv.Itoa(row.Files), strconv.FormatInt(row.Size, 10), row.Checksum})
+	}
+	cw.Flush()
+	return cw.Error()
+}
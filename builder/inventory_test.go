@@ -0,0 +1,69 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"espore/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestInventory(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	output, err := ioutil.TempDir("", "espore-inventory")
+	t.Ok(err)
+	defer os.RemoveAll(output)
+
+	manifests := []*FirmwareManifest{
+		{
+			DeviceInfo:      DeviceInfo{ID: "2222", Name: "garage"},
+			ManifestVersion: ManifestVersion,
+			Files: []*FileEntry{
+				{Path: "main.lua", Hash: "3", Size: 120},
+			},
+		},
+		{
+			DeviceInfo:      DeviceInfo{ID: "1111", Name: "kitchen"},
+			ManifestVersion: ManifestVersion,
+			Files: []*FileEntry{
+				{Path: "index.html", Hash: "1", Size: 300},
+				{Path: "lfs.img", Hash: "2", Size: 4096},
+			},
+		},
+	}
+	for _, manifest := range manifests {
+		t.Ok(utils.WriteJSON(filepath.Join(output, manifest.ID+".json"), manifest))
+	}
+	t.Ok(ioutil.WriteFile(filepath.Join(output, "1111.img"), []byte("image"), 0644))
+
+	rows, err := Inventory(output)
+	t.Ok(err)
+	t.Equals([]InventoryRow{
+		{ID: "1111", Name: "kitchen", Files: 2, Size: 4396, Checksum: FirmwareChecksum(manifests[1])},
+		{ID: "2222", Name: "garage", Files: 1, Size: 120, Checksum: FirmwareChecksum(manifests[0])},
+	}, rows)
+
+	var csvOut bytes.Buffer
+	t.Ok(WriteInventoryCSV(&csvOut, rows))
+	t.Equals("id,name,files,size,checksum\n"+
+		"1111,kitchen,2,4396,"+rows[0].Checksum+"\n"+
+		"2222,garage,1,120,"+rows[1].Checksum+"\n", csvOut.String())
+
+	var jsonOut bytes.Buffer
+	t.Ok(WriteInventoryJSON(&jsonOut, rows))
+	var decoded []InventoryRow
+	t.Ok(json.Unmarshal(jsonOut.Bytes(), &decoded))
+	t.Equals(rows, decoded)
+
+	// an inventory written to the output dir is not taken for a manifest
+	t.Ok(ioutil.WriteFile(filepath.Join(output, "inventory.json"), jsonOut.Bytes(), 0644))
+	again, err := Inventory(output)
+	t.Ok(err)
+	t.Equals(rows, again)
+}
@@ -0,0 +1,126 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// lfsCache keeps compiled LFS images indexed by the content hash of their
+// source files, so the same set is only compiled once per build. If dir is
+// set, images are also persisted there and reused across builds. Images with
+// different hashes can be compiled concurrently.
+type lfsCache struct {
+	dir    string
+	lock   sync.Mutex
+	images map[string]*lfsCacheEntry
+}
+
+// lfsCacheEntry is an image that is being or has been compiled. done is
+// closed once data and err are set.
+type lfsCacheEntry struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func newLFSCache(dir string) *lfsCache {
+	return &lfsCache{
+		dir:    dir,
+		images: make(map[string]*lfsCacheEntry),
+	}
+}
+
+func (c *lfsCache) imagePath(hash string) string {
+	return filepath.Join(c.dir, hash+".lfs")
+}
+
+// getOrCompile returns the cached image for hash, invoking compile and
+// caching its result on a miss. Concurrent requests for the same hash wait
+// for the first one to finish.
+func (c *lfsCache) getOrCompile(hash string, bl *buildLog, compile func() ([]byte, error)) ([]byte, error) {
+	c.lock.Lock()
+	if entry, ok := c.images[hash]; ok {
+		c.lock.Unlock()
+		bl.Debugf("LFS image %s: reusing the image compiled in this build", hash)
+		<-entry.done
+		return entry.data, entry.err
+	}
+	entry := &lfsCacheEntry{done: make(chan struct{})}
+	c.images[hash] = entry
+	c.lock.Unlock()
+
+	entry.data, entry.err = c.load(hash, bl, compile)
+	if entry.err != nil {
+		// let later builds try again
+		c.lock.Lock()
+		delete(c.images, hash)
+		c.lock.Unlock()
+	}
+	close(entry.done)
+	return entry.data, entry.err
+}
+
+// load reads the image from the cache dir, compiling and storing it there if
+// it is not found
+func (c *lfsCache) load(hash string, bl *buildLog, compile func() ([]byte, error)) ([]byte, error) {
+	if c.dir != "" {
+		if data, err := ioutil.ReadFile(c.imagePath(hash)); err == nil {
+			bl.Debugf("LFS image %s: found in %s", hash, c.dir)
+			return data, nil
+		}
+	}
+	bl.Debugf("LFS image %s: compiling", hash)
+
+	data, err := compile()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.dir != "" {
+		if err := os.MkdirAll(c.dir, 0755); err != nil {
+			bl.Infof("Cannot create LFS cache dir %s: %s", c.dir, err)
+		} else if err := c.store(hash, data); err != nil {
+			bl.Infof("Cannot write LFS cache entry %s: %s", hash, err)
+		}
+	}
+	return data, nil
+}
+
+// store writes the image to a temporary file and renames it into place, so
+// other builds never see a partially written image
+func (c *lfsCache) store(hash string, data []byte) error {
+	tmp, err := ioutil.TempFile(c.dir, hash+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.imagePath(hash))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// ClearCache removes all the compiled LFS images stored in cacheDir, so the
+// next build recompiles them. It returns how many images were removed.
+func ClearCache(cacheDir string) (int, error) {
+	images, err := filepath.Glob(filepath.Join(cacheDir, "*.lfs"))
+	if err != nil {
+		return 0, err
+	}
+	var removed int
+	for _, image := range images {
+		if err := os.Remove(image); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
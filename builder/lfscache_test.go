@@ -0,0 +1,81 @@
+package builder
+
+import (
+	"espore/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestSharedLFSCompiledOnce(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	var compilations int
+	defer func(f func([]*FileEntry, string) error) { luac = f }(luac)
+	luac = func(sourceEntries []*FileEntry, dstFile string) error {
+		compilations++
+		return ioutil.WriteFile(dstFile, []byte("lfs"), 0644)
+	}
+
+	root, err := ioutil.TempDir("", "espore-build")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+
+	for _, id := range []string{"1111", "2222"} {
+		devicePath := filepath.Join(root, "devices", id)
+		t.Ok(os.MkdirAll(devicePath, 0755))
+		t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "firmware.json"), []byte(`{"name": "dev`+id+`", "id": "`+id+`"}`), 0644))
+		t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "main.lua"), []byte("return 1\n"), 0644))
+	}
+	output := filepath.Join(root, "dist")
+	t.Ok(os.MkdirAll(output, 0755))
+
+	cfg := &config.BuildConfig{
+		Devices: []string{filepath.Join(root, "devices", "*")},
+		Output:  output,
+	}
+	t.Ok(Build(cfg))
+	t.Equals(1, compilations)
+
+	for _, id := range []string{"1111", "2222"} {
+		manifest, err := ReadManifest(filepath.Join(output, id+".json"))
+		t.Ok(err)
+		var found bool
+		for _, fe := range manifest.Files {
+			found = found || fe.Path == "lfs.img"
+		}
+		t.Assert(found, "Expected lfs.img in manifest of %s", id)
+	}
+
+	// with a disk cache, a second build reuses the persisted image
+	cfg.CacheDir = filepath.Join(root, "cache")
+	t.Ok(Build(cfg))
+	t.Equals(2, compilations)
+	t.Ok(Build(cfg))
+	t.Equals(2, compilations)
+}
+
+func TestClearCache(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	cacheDir, err := ioutil.TempDir("", "espore-cache")
+	t.Ok(err)
+	defer os.RemoveAll(cacheDir)
+
+	for _, name := range []string{"aaaa.lfs", "bbbb.lfs", "README"} {
+		t.Ok(ioutil.WriteFile(filepath.Join(cacheDir, name), []byte("x"), 0644))
+	}
+
+	removed, err := ClearCache(cacheDir)
+	t.Ok(err)
+	t.Equals(2, removed)
+
+	left, err := filepath.Glob(filepath.Join(cacheDir, "*"))
+	t.Ok(err)
+	t.Equals([]string{filepath.Join(cacheDir, "README")}, left)
+}
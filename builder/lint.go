@@ -0,0 +1,146 @@
+package builder
+
+import (
+	"bufio"
+	"espore/config"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+)
+
+// LintFile checks a Lua source file against device constraints, returning a
+// warning for each line longer than maxLineLength and one if the file is
+// larger than maxFileSize. Zero limits disable the corresponding check.
+func LintFile(path string, maxLineLength int, maxFileSize int64) ([]string, error) {
+	var warnings []string
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if maxFileSize > 0 {
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if fi.Size() > maxFileSize {
+			warnings = append(warnings, fmt.Sprintf("%s: file size %d exceeds maximum of %d bytes", path, fi.Size(), maxFileSize))
+		}
+	}
+
+	if maxLineLength > 0 {
+		reader := bufio.NewReader(f)
+		line := 1
+		length := 0
+		for {
+			b, err := reader.ReadByte()
+			if err != nil || b == '\n' {
+				if length > maxLineLength {
+					warnings = append(warnings, fmt.Sprintf("%s:%d: line length %d exceeds maximum of %d", path, line, length, maxLineLength))
+				}
+				if err != nil {
+					break
+				}
+				line++
+				length = 0
+				continue
+			}
+			if b != '\r' {
+				length++
+			}
+		}
+	}
+	return warnings, nil
+}
+
+// lintFiles runs LintFile over all the Lua files with a source on disk
+func lintFiles(files map[string]*FileEntry, maxLineLength int, maxFileSize int64) ([]string, error) {
+	var warnings []string
+	if maxLineLength <= 0 && maxFileSize <= 0 {
+		return nil, nil
+	}
+	for _, fe := range files {
+		if fe.Content != nil || !isLua(fe.Path) {
+			continue
+		}
+		w, err := LintFile(fe.SourcePath(), maxLineLength, maxFileSize)
+		if err != nil {
+			return nil, err
+		}
+		warnings = append(warnings, w...)
+	}
+	return warnings, nil
+}
+
+// largeFileWarnings returns a warning for each file larger than threshold
+// bytes, sorted by path. A threshold of 0 disables the check.
+func largeFileWarnings(files map[string]*FileEntry, threshold int64) []string {
+	if threshold <= 0 {
+		return nil
+	}
+	var warnings []string
+	for _, fe := range files {
+		if fe.Size > threshold {
+			warnings = append(warnings, fmt.Sprintf("%s: file size %d exceeds %d bytes", fe.Path, fe.Size, threshold))
+		}
+	}
+	sort.Strings(warnings)
+	return warnings
+}
+
+// luacParse runs the Lua compiler in parse-only mode over a file, returning
+// its output. Replaced in tests.
+var luacParse = func(path string) ([]byte, error) {
+	return exec.Command("luac.cross", "-p", path).CombinedOutput()
+}
+
+// CheckSyntax parses each Lua file with a source on disk, returning a
+// *BuildError pointing at the syntax error of every file that fails to parse.
+// It returns an error if the compiler cannot be run.
+func CheckSyntax(files []*FileEntry) ([]*BuildError, error) {
+	var paths []string
+	for _, fe := range files {
+		if fe.Content == nil && isLua(fe.Path) {
+			paths = append(paths, fe.SourcePath())
+		}
+	}
+	sort.Strings(paths)
+
+	var syntaxErrors []*BuildError
+	for _, path := range paths {
+		output, err := luacParse(path)
+		if err == nil {
+			continue
+		}
+		if _, ok := err.(*exec.Error); ok {
+			return nil, fmt.Errorf("Cannot run the Lua compiler: %s", err)
+		}
+		match := luacErrorRegex.FindStringSubmatch(string(output))
+		if match == nil {
+			return nil, fmt.Errorf("Error checking %s:\n%s", path, output)
+		}
+		line, _ := strconv.Atoi(match[2])
+		syntaxErrors = append(syntaxErrors, &BuildError{File: path, Line: line, Message: match[3]})
+	}
+	return syntaxErrors, nil
+}
+
+// LintDevice checks the syntax of every Lua file the given device ships,
+// including those that would be packed in LFS
+func LintDevice(config *config.BuildConfig, deviceID string) ([]*BuildError, error) {
+	deviceRootLib, fwDef, err := loadDevice(config, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	// keep every file out of LFS, so all sources stay listed and nothing is
+	// compiled
+	fwDef.LFS = FirmwareLFSConfig{Exclude: []string{"**/*", "*"}}
+	manifest, err := buildDeviceManifest(config, deviceRootLib.BasePath, deviceRootLib, fwDef, newLFSCache(""))
+	if err != nil {
+		return nil, err
+	}
+	return CheckSyntax(manifest.Files)
+}
@@ -0,0 +1,90 @@
+package builder
+
+import (
+	"errors"
+	"espore/config"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestLintFile(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, err := ioutil.TempDir("", "espore-lint")
+	t.Ok(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "long.lua")
+	code := "local a = 1\nlocal s = \"" + strings.Repeat("x", 100) + "\"\r\nreturn a\n"
+	t.Ok(ioutil.WriteFile(path, []byte(code), 0644))
+
+	warnings, err := LintFile(path, 80, 0)
+	t.Ok(err)
+	t.Equals([]string{fmt.Sprintf("%s:2: line length 112 exceeds maximum of 80", path)}, warnings)
+
+	warnings, err = LintFile(path, 0, 50)
+	t.Ok(err)
+	t.Equals(1, len(warnings))
+
+	warnings, err = LintFile(path, 200, 1000)
+	t.Ok(err)
+	t.Equals(0, len(warnings))
+}
+
+func TestLintDevice(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	// emulate the compiler, which reports the first syntax error of a file
+	defer func(f func(string) ([]byte, error)) { luacParse = f }(luacParse)
+	var parsed []string
+	luacParse = func(path string) ([]byte, error) {
+		parsed = append(parsed, filepath.Base(path))
+		code, err := ioutil.ReadFile(path)
+		t.Ok(err)
+		if strings.Count(string(code), "function") > strings.Count(string(code), "end") {
+			return []byte("luac.cross: " + path + ":3: 'end' expected near '<eof>'\n"), errors.New("exit status 1")
+		}
+		return nil, nil
+	}
+
+	root, err := ioutil.TempDir("", "espore-lint")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+	devicePath := filepath.Join(root, "devices", "1111")
+	t.Ok(os.MkdirAll(devicePath, 0755))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "firmware.json"), []byte(`{"name": "kitchen", "id": "1111"}`), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "main.lua"), []byte("require(\"sensor\")\nrequire(\"util\")\n"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "util.lua"), []byte("local function f()\n  return 1\nend\n"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "sensor.lua"), []byte("local function read()\n  return 1\n"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "index.html"), []byte("<html></html>"), 0644))
+
+	cfg := &config.BuildConfig{
+		Devices:      []string{filepath.Join(root, "devices", "*")},
+		Reproducible: true,
+	}
+	syntaxErrors, err := LintDevice(cfg, "1111")
+	t.Ok(err)
+	t.Equals(1, len(syntaxErrors))
+	t.Equals(&BuildError{
+		File:    filepath.Join(devicePath, "sensor.lua"),
+		Line:    3,
+		Message: "'end' expected near '<eof>'",
+	}, syntaxErrors[0])
+	// every device Lua source is checked, generated files are not
+	t.Equals([]string{"main.lua", "sensor.lua", "util.lua"}, parsed)
+
+	// an unexpected compiler failure is reported as an error
+	luacParse = func(path string) ([]byte, error) {
+		return []byte("out of memory"), errors.New("exit status 2")
+	}
+	_, err = LintDevice(cfg, "1111")
+	t.Assert(err != nil, "Expected an error when the compiler fails")
+}
@@ -0,0 +1,106 @@
+package builder
+
+import (
+	"espore/config"
+	"espore/utils"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Lockfile records the files resolved for each device, mapping device ids to
+// file paths to hashes
+type Lockfile map[string]map[string]string
+
+// ReadLockfile reads a lockfile, returning an empty one if it does not exist
+func ReadLockfile(path string) (Lockfile, error) {
+	lock := make(Lockfile)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return lock, nil
+	}
+	if err := utils.ReadJSON(path, &lock); err != nil {
+		return nil, fmt.Errorf("Error reading lockfile %s: %s", path, err)
+	}
+	return lock, nil
+}
+
+// checkLockfile compares the files resolved for the built devices with the
+// lockfile. In frozen mode any difference fails the build, otherwise the
+// lockfile is updated. A full build also accounts for devices that are no
+// longer built.
+func checkLockfile(config *config.BuildConfig, manifests []*FirmwareManifest, full bool) error {
+	lock, err := ReadLockfile(config.Lockfile)
+	if err != nil {
+		return err
+	}
+	resolved := make(Lockfile, len(manifests))
+	for _, manifest := range manifests {
+		resolved[manifest.ID] = manifest.Resolved
+	}
+
+	if config.FrozenLockfile {
+		if diff := lockfileDiff(lock, resolved, full); len(diff) > 0 {
+			return fmt.Errorf("Resolved files differ from lockfile %s:\n%s", config.Lockfile, strings.Join(diff, "\n"))
+		}
+		return nil
+	}
+
+	if full {
+		lock = make(Lockfile, len(resolved))
+	}
+	for id, files := range resolved {
+		lock[id] = files
+	}
+	return utils.WriteJSON(config.Lockfile, lock)
+}
+
+// lockfileDiff returns one line per file added (+), removed (-) or changed
+// (~) in resolved with respect to locked. Devices in locked that were not
+// built are only reported as removed when full is set.
+func lockfileDiff(locked, resolved Lockfile, full bool) []string {
+	ids := make(map[string]bool)
+	for id := range resolved {
+		ids[id] = true
+	}
+	if full {
+		for id := range locked {
+			ids[id] = true
+		}
+	}
+	sortedIDs := make([]string, 0, len(ids))
+	for id := range ids {
+		sortedIDs = append(sortedIDs, id)
+	}
+	sort.Strings(sortedIDs)
+
+	var diff []string
+	for _, id := range sortedIDs {
+		before, after := locked[id], resolved[id]
+		paths := make(map[string]bool)
+		for path := range before {
+			paths[path] = true
+		}
+		for path := range after {
+			paths[path] = true
+		}
+		sortedPaths := make([]string, 0, len(paths))
+		for path := range paths {
+			sortedPaths = append(sortedPaths, path)
+		}
+		sort.Strings(sortedPaths)
+		for _, path := range sortedPaths {
+			oldHash, wasLocked := before[path]
+			newHash, isResolved := after[path]
+			switch {
+			case !wasLocked:
+				diff = append(diff, fmt.Sprintf("%s: + %s", id, path))
+			case !isResolved:
+				diff = append(diff, fmt.Sprintf("%s: - %s", id, path))
+			case oldHash != newHash:
+				diff = append(diff, fmt.Sprintf("%s: ~ %s", id, path))
+			}
+		}
+	}
+	return diff
+}
@@ -0,0 +1,62 @@
+package builder
+
+import (
+	"espore/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestFrozenLockfile(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	root, err := ioutil.TempDir("", "espore-lock")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+
+	libPath := filepath.Join(root, "lib")
+	t.Ok(os.MkdirAll(libPath, 0755))
+	t.Ok(ioutil.WriteFile(filepath.Join(libPath, "extra.lua"), []byte("return {}\n"), 0644))
+	devicePath := filepath.Join(root, "devices", "1111")
+	t.Ok(os.MkdirAll(devicePath, 0755))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "library.json"), []byte(`{"dependencies": [`+strconv.Quote(libPath)+`]}`), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "firmware.json"), []byte(testFirmwareJSON("1111", "kitchen")), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "main.lua"), []byte("return 1\n"), 0644))
+
+	output := filepath.Join(root, "dist")
+	t.Ok(os.MkdirAll(output, 0755))
+	cfg := &config.BuildConfig{
+		Devices:      []string{filepath.Join(root, "devices", "*")},
+		Output:       output,
+		Reproducible: true,
+		Lockfile:     filepath.Join(root, "espore.lock"),
+	}
+	t.Ok(Build(cfg))
+	lock, err := ReadLockfile(cfg.Lockfile)
+	t.Ok(err)
+	t.Equals(NewVirtualFileEntry([]byte("return 1\n"), "main.lua").Hash, lock["1111"]["main.lua"])
+	t.Assert(lock["1111"]["extra.lua"] == "", "Expected extra.lua not to be resolved yet")
+
+	// with nothing changed, a frozen build succeeds
+	cfg.FrozenLockfile = true
+	t.Ok(Build(cfg))
+
+	// requiring a new module changes the resolved set
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "main.lua"), []byte("require(\"extra\")\n"), 0644))
+	err = Build(cfg)
+	t.Assert(err != nil, "Expected the frozen build to fail")
+	t.Assert(strings.Contains(err.Error(), "1111: + extra.lua"), "Expected the new file in the diff, got %s", err)
+	t.Assert(strings.Contains(err.Error(), "1111: ~ main.lua"), "Expected the changed file in the diff, got %s", err)
+
+	// updating the lockfile accepts the change
+	cfg.FrozenLockfile = false
+	t.Ok(Build(cfg))
+	cfg.FrozenLockfile = true
+	t.Ok(Build(cfg))
+}
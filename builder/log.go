@@ -0,0 +1,30 @@
+package builder
+
+import (
+	"espore/config"
+	"log"
+)
+
+// buildLog prints build messages according to the configured verbosity. A
+// nil buildLog prints at the Normal level.
+type buildLog struct {
+	verbosity config.Verbosity
+}
+
+func newBuildLog(config *config.BuildConfig) *buildLog {
+	return &buildLog{verbosity: config.GetVerbosity()}
+}
+
+// Infof prints warnings and notices, unless the build is quiet
+func (bl *buildLog) Infof(format string, a ...interface{}) {
+	if bl == nil || bl.verbosity != config.Quiet {
+		log.Printf(format, a...)
+	}
+}
+
+// Debugf prints details only shown in verbose builds
+func (bl *buildLog) Debugf(format string, a ...interface{}) {
+	if bl != nil && bl.verbosity == config.Verbose {
+		log.Printf(format, a...)
+	}
+}
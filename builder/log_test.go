@@ -0,0 +1,67 @@
+package builder
+
+import (
+	"bytes"
+	"espore/config"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestBuildVerbosity(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+
+	root, err := ioutil.TempDir("", "espore-verbosity")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+	devicePath := filepath.Join(root, "devices", "1111")
+	writeFiles(tx, devicePath, map[string]string{
+		"firmware.json": testFirmwareJSON("1111", "kitchen"),
+		"main.lua":      "print('hello')\n",
+		"notes.txt":     "not shipped",
+	})
+
+	cfg := &config.BuildConfig{
+		Devices:           []string{filepath.Join(root, "devices", "*")},
+		CacheDir:          filepath.Join(root, "cache"),
+		AllowedExtensions: []string{"json"},
+		Reproducible:      true,
+	}
+	build := func(verbosity config.Verbosity) string {
+		output.Reset()
+		cfg.Verbosity = verbosity
+		_, err := BuildManifest(cfg, "1111")
+		t.Ok(err)
+		return output.String()
+	}
+
+	// quiet prints nothing but still reports errors
+	t.Equals("", build(config.Quiet))
+	_, err = BuildManifest(cfg, "9999")
+	t.Assert(err != nil, "Expected an error building an unknown device")
+	t.Equals("", output.String())
+
+	// normal prints notices, without the per-file details
+	normal := build("")
+	t.Assert(strings.Contains(normal, "Skipping "+filepath.Join(devicePath, "notes.txt")), "Expected the skipped file notice, got %q", normal)
+	t.Assert(!strings.Contains(normal, "including"), "Expected no per-file lines, got %q", normal)
+
+	// verbose lists every included file and the cache decisions
+	verbose := build(config.Verbose)
+	t.Assert(strings.Contains(verbose, "Device 1111: including main.lua (from "+filepath.Join(devicePath, "main.lua")+")"), "Expected main.lua to be listed, got %q", verbose)
+	t.Assert(strings.Contains(verbose, "Device 1111: including modules.json (generated)"), "Expected generated files to be listed, got %q", verbose)
+	t.Assert(strings.Contains(verbose, filepath.Join(devicePath, "main.lua")+": unchanged, using the cached scan"), "Expected a cache hit for main.lua, got %q", verbose)
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "main.lua"), []byte("print('hello again')\n"), 0644))
+	verbose = build(config.Verbose)
+	t.Assert(strings.Contains(verbose, filepath.Join(devicePath, "main.lua")+": scanning"), "Expected a cache miss for main.lua, got %q", verbose)
+}
@@ -0,0 +1,227 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ManifestVersion is the manifest schema version written by this builder
+const ManifestVersion = 2
+
+// firmwareManifestV1 is the original manifest format, where files were a map
+// of path to hash. Unversioned manifests may also list files as an array,
+// like the current format.
+type firmwareManifestV1 struct {
+	DeviceInfo
+	NodeMCUFirmware string
+	Files           map[string]string `json:"files"`
+}
+
+// ReadManifest loads a manifest file of any known version and converts it
+// to the current FirmwareManifest format
+func ReadManifest(path string) (*FirmwareManifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseManifest(data)
+}
+
+// manifestFile is a manifest read from a build output directory
+type manifestFile struct {
+	path     string
+	manifest *FirmwareManifest
+	// err is set if the file could not be read as a manifest
+	err error
+}
+
+// readManifests reads the device manifests in dir, sorted by path. JSON files
+// that are not manifests, such as an inventory written next to them, are
+// skipped. Files that cannot be read or decoded are returned with their error.
+func readManifests(dir string) ([]manifestFile, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	manifests := make([]manifestFile, 0, len(paths))
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err == nil && !looksLikeManifest(data) {
+			continue
+		}
+		mf := manifestFile{path: path}
+		if err == nil {
+			mf.manifest, err = ParseManifest(data)
+		}
+		mf.err = err
+		manifests = append(manifests, mf)
+	}
+	return manifests, nil
+}
+
+// looksLikeManifest returns whether data is a JSON object with a device id.
+// Invalid JSON is taken as a damaged manifest.
+func looksLikeManifest(data []byte) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return !json.Valid(data)
+	}
+	_, ok := fields["id"]
+	return ok
+}
+
+// ParseManifest decodes manifest JSON of any known version and converts it
+// to the current FirmwareManifest format
+func ParseManifest(data []byte) (*FirmwareManifest, error) {
+	var header struct {
+		ManifestVersion int             `json:"manifestVersion"`
+		Files           json.RawMessage `json:"files"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, fmt.Errorf("Error decoding manifest: %s", err)
+	}
+
+	switch header.ManifestVersion {
+	case 0, 1:
+		if !bytes.HasPrefix(bytes.TrimSpace(header.Files), []byte("{")) {
+			var manifest FirmwareManifest
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return nil, fmt.Errorf("Error decoding manifest: %s", err)
+			}
+			manifest.ManifestVersion = ManifestVersion
+			return &manifest, nil
+		}
+		var v1 firmwareManifestV1
+		if err := json.Unmarshal(data, &v1); err != nil {
+			return nil, fmt.Errorf("Error decoding v1 manifest: %s", err)
+		}
+		return upgradeManifestV1(&v1), nil
+	case ManifestVersion:
+		var manifest FirmwareManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, fmt.Errorf("Error decoding manifest: %s", err)
+		}
+		return &manifest, nil
+	}
+	return nil, fmt.Errorf("Unsupported manifest version %d", header.ManifestVersion)
+}
+
+func upgradeManifestV1(v1 *firmwareManifestV1) *FirmwareManifest {
+	manifest := &FirmwareManifest{
+		DeviceInfo:      v1.DeviceInfo,
+		ManifestVersion: ManifestVersion,
+		NodeMCUFirmware: v1.NodeMCUFirmware,
+		Files:           make([]*FileEntry, 0, len(v1.Files)),
+	}
+	for path, hash := range v1.Files {
+		manifest.Files = append(manifest.Files, &FileEntry{
+			Path: path,
+			Hash: hash,
+		})
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return strings.Compare(manifest.Files[i].Path, manifest.Files[j].Path) < 0
+	})
+	return manifest
+}
+
+// Includes returns whether the manifest ships the file at path, either
+// directly or packed in a generated file such as the LFS image
+func (manifest *FirmwareManifest) Includes(path string) bool {
+	for _, fe := range manifest.Files {
+		if fe.Path == path {
+			return true
+		}
+		for _, source := range fe.Sources {
+			if source == path {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DevicesIncluding returns the devices whose manifest in outputDir includes
+// the file at path, sorted by id
+func DevicesIncluding(outputDir, path string) ([]DeviceInfo, error) {
+	manifests, err := readManifests(outputDir)
+	if err != nil {
+		return nil, err
+	}
+	var devices []DeviceInfo
+	for _, mf := range manifests {
+		if mf.err != nil {
+			return nil, fmt.Errorf("Error reading manifest %s: %s", mf.path, mf.err)
+		}
+		manifest := mf.manifest
+		// variants are builds of a device already listed
+		if manifest.Includes(path) && manifest.Variant == "" {
+			devices = append(devices, manifest.DeviceInfo)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return strings.Compare(devices[i].ID, devices[j].ID) < 0
+	})
+	return devices, nil
+}
+
+// ManifestDiff lists the file differences between two manifests, each sorted
+// by path
+type ManifestDiff struct {
+	// OnlyA and OnlyB are the files shipped by only one of the manifests
+	OnlyA []string
+	OnlyB []string
+	// Different are the files in both manifests with different hashes
+	Different []string
+}
+
+// CompareManifests returns the files that differ between two manifests,
+// which may belong to different devices
+func CompareManifests(a, b *FirmwareManifest) *ManifestDiff {
+	onlyB, different, onlyA := diffFiles(a.Files, b.Files)
+	return &ManifestDiff{
+		OnlyA:     onlyA,
+		OnlyB:     fileEntryPaths(onlyB),
+		Different: fileEntryPaths(different),
+	}
+}
+
+// diffFiles compares two file lists by path and hash. It returns the entries
+// of b missing from a, the entries of b whose hash is different in a, and the
+// paths of a missing from b, each sorted by path.
+func diffFiles(a, b []*FileEntry) (added, changed []*FileEntry, removed []string) {
+	aFiles := make(map[string]*FileEntry, len(a))
+	for _, fe := range a {
+		aFiles[fe.Path] = fe
+	}
+	for _, fe := range b {
+		other, ok := aFiles[fe.Path]
+		if !ok {
+			added = append(added, fe)
+		} else if other.Hash != fe.Hash {
+			changed = append(changed, fe)
+		}
+		delete(aFiles, fe.Path)
+	}
+	for path := range aFiles {
+		removed = append(removed, path)
+	}
+	sortFileEntries(added)
+	sortFileEntries(changed)
+	sort.Strings(removed)
+	return added, changed, removed
+}
+
+// fileEntryPaths returns the paths of files
+func fileEntryPaths(files []*FileEntry) []string {
+	var paths []string
+	for _, fe := range files {
+		paths = append(paths, fe.Path)
+	}
+	return paths
+}
@@ -0,0 +1,151 @@
+package builder
+
+import (
+	"espore/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestParseManifest(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	v1 := `{
+	"name": "kitchen",
+	"id": "1234",
+	"NodeMCUFirmware": "nodemcu.bin",
+	"files": {
+		"main.lua": "aaaa",
+		"config.json": "bbbb"
+	}
+}`
+	manifest, err := ParseManifest([]byte(v1))
+	t.Ok(err)
+	t.Equals(ManifestVersion, manifest.ManifestVersion)
+	t.Equals("kitchen", manifest.Name)
+	t.Equals("1234", manifest.ID)
+	t.Equals("nodemcu.bin", manifest.NodeMCUFirmware)
+	t.Equals(2, len(manifest.Files))
+	t.Equals("config.json", manifest.Files[0].Path)
+	t.Equals("bbbb", manifest.Files[0].Hash)
+	t.Equals("main.lua", manifest.Files[1].Path)
+	t.Equals("aaaa", manifest.Files[1].Hash)
+
+	v2 := `{
+	"name": "kitchen",
+	"id": "1234",
+	"manifestVersion": 2,
+	"NodeMCUFirmware": "",
+	"files": [
+		{"base": "site/lib", "path": "main.lua", "hash": "aaaa", "datafiles": ["data.json"]}
+	]
+}`
+	manifest, err = ParseManifest([]byte(v2))
+	t.Ok(err)
+	t.Equals(ManifestVersion, manifest.ManifestVersion)
+	t.Equals(1, len(manifest.Files))
+	t.Equals("main.lua", manifest.Files[0].Path)
+	t.Equals([]string{"data.json"}, manifest.Files[0].Datafiles)
+
+	// unversioned manifests written before file maps were replaced keep the
+	// files array
+	unversioned := `{"name":"kitchen","id":"1234","NodeMCUFirmware":"","files":[{"base":"/site/devices/1234","path":"init.lua","hash":"cccc"},{"base":"/site/lib","path":"main.lua","hash":"aaaa","datafiles":["data.json"]}]}`
+	manifest, err = ParseManifest([]byte(unversioned))
+	t.Ok(err)
+	t.Equals(ManifestVersion, manifest.ManifestVersion)
+	t.Equals("1234", manifest.ID)
+	t.Equals(2, len(manifest.Files))
+	t.Equals("init.lua", manifest.Files[0].Path)
+	t.Equals("cccc", manifest.Files[0].Hash)
+	t.Equals([]string{"data.json"}, manifest.Files[1].Datafiles)
+
+	_, err = ParseManifest([]byte(`{"manifestVersion": 99}`))
+	t.Assert(err != nil, "Expected unsupported version to fail")
+}
+
+func TestDevicesIncluding(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	output, err := ioutil.TempDir("", "espore-dist")
+	t.Ok(err)
+	defer os.RemoveAll(output)
+
+	manifests := []*FirmwareManifest{
+		{
+			DeviceInfo:      DeviceInfo{ID: "1111", Name: "kitchen"},
+			ManifestVersion: ManifestVersion,
+			Files: []*FileEntry{
+				{Path: "index.html", Hash: "1"},
+				{Path: "lfs.img", Hash: "2", Sources: []string{"main.lua", "net/wifi.lua"}},
+			},
+		},
+		{
+			DeviceInfo:      DeviceInfo{ID: "2222", Name: "garage"},
+			ManifestVersion: ManifestVersion,
+			Files: []*FileEntry{
+				{Path: "main.lua", Hash: "3"},
+			},
+		},
+	}
+	for _, manifest := range manifests {
+		t.Ok(utils.WriteJSON(filepath.Join(output, manifest.ID+".json"), manifest))
+	}
+
+	devices, err := DevicesIncluding(output, "net/wifi.lua")
+	t.Ok(err)
+	t.Equals([]DeviceInfo{{ID: "1111", Name: "kitchen"}}, devices)
+
+	devices, err = DevicesIncluding(output, "main.lua")
+	t.Ok(err)
+	t.Equals(2, len(devices))
+
+	devices, err = DevicesIncluding(output, "missing.lua")
+	t.Ok(err)
+	t.Equals(0, len(devices))
+
+	// other JSON files are not manifests, unless they are damaged
+	t.Ok(ioutil.WriteFile(filepath.Join(output, "inventory.json"), []byte(`[{"id": "1111"}]`), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(output, "settings.json"), []byte(`{"theme": "dark"}`), 0644))
+	devices, err = DevicesIncluding(output, "main.lua")
+	t.Ok(err)
+	t.Equals(2, len(devices))
+	t.Ok(ioutil.WriteFile(filepath.Join(output, "3333.json"), []byte(`{"id": "3333", "files": [`), 0644))
+	_, err = DevicesIncluding(output, "main.lua")
+	t.Assert(err != nil, "Expected a damaged manifest to be reported")
+}
+
+func TestCompareManifests(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	a := &FirmwareManifest{
+		DeviceInfo: DeviceInfo{ID: "1111"},
+		Files: []*FileEntry{
+			{Path: "main.lua", Hash: "1"},
+			{Path: "config.json", Hash: "2"},
+			{Path: "relay.lua", Hash: "3"},
+			{Path: "index.html", Hash: "4"},
+		},
+	}
+	b := &FirmwareManifest{
+		DeviceInfo: DeviceInfo{ID: "2222"},
+		Files: []*FileEntry{
+			{Path: "sensor.lua", Hash: "5"},
+			{Path: "main.lua", Hash: "1"},
+			{Path: "config.json", Hash: "6"},
+			{Path: "dht.lua", Hash: "7"},
+		},
+	}
+	diff := CompareManifests(a, b)
+	t.Equals([]string{"index.html", "relay.lua"}, diff.OnlyA)
+	t.Equals([]string{"dht.lua", "sensor.lua"}, diff.OnlyB)
+	t.Equals([]string{"config.json"}, diff.Different)
+
+	diff = CompareManifests(a, a)
+	t.Equals(0, len(diff.OnlyA)+len(diff.OnlyB)+len(diff.Different))
+}
@@ -0,0 +1,120 @@
+package builder
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func isRemote(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// FetchRemoteLibrary downloads a .tar.gz library from url and extracts it
+// under cacheDir, returning the local library folder. The download is skipped
+// if the server reports the cached copy is still current, via its ETag.
+// If the tarball contains a single top folder, that folder is the library.
+func FetchRemoteLibrary(url, cacheDir string) (string, error) {
+	if cacheDir == "" {
+		cacheDir = filepath.Join(os.TempDir(), "espore-remote")
+	}
+	hasher := sha1.New()
+	hasher.Write([]byte(url))
+	dir := filepath.Join(cacheDir, "remote", hex.EncodeToString(hasher.Sum(nil)))
+	contentDir := filepath.Join(dir, "content")
+	etagFile := filepath.Join(dir, "etag")
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	if etag, err := ioutil.ReadFile(etagFile); err == nil {
+		if _, err := os.Stat(contentDir); err == nil {
+			req.Header.Set("If-None-Match", string(etag))
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Error downloading library %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+	case http.StatusOK:
+		if err := os.RemoveAll(dir); err != nil {
+			return "", err
+		}
+		if err := extractTarGz(resp.Body, contentDir); err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("Error extracting library %s: %s", url, err)
+		}
+		if etag := resp.Header.Get("Etag"); etag != "" {
+			if err := ioutil.WriteFile(etagFile, []byte(etag), 0644); err != nil {
+				return "", err
+			}
+		}
+	default:
+		return "", fmt.Errorf("Error downloading library %s: %s", url, resp.Status)
+	}
+
+	entries, err := ioutil.ReadDir(contentDir)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		return filepath.Join(contentDir, entries[0].Name()), nil
+	}
+	return contentDir, nil
+}
+
+func extractTarGz(r io.Reader, dst string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, filepath.FromSlash(header.Name))
+		if target != dst && !strings.HasPrefix(target, dst+string(os.PathSeparator)) {
+			return fmt.Errorf("Invalid path %q in archive", header.Name)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.Create(target)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"espore/config"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestRemoteLibrary(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	var tarball bytes.Buffer
+	gz := gzip.NewWriter(&tarball)
+	tw := tar.NewWriter(gz)
+	content := []byte("return {}\n")
+	t.Ok(tw.WriteHeader(&tar.Header{Name: "core/", Typeflag: tar.TypeDir, Mode: 0755}))
+	t.Ok(tw.WriteHeader(&tar.Header{Name: "core/util.lua", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}))
+	_, err := tw.Write(content)
+	t.Ok(err)
+	t.Ok(tw.Close())
+	t.Ok(gz.Close())
+
+	var downloads int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Header().Set("Etag", `"v1"`)
+		w.Write(tarball.Bytes())
+	}))
+	defer server.Close()
+
+	cacheDir, err := ioutil.TempDir("", "espore-cache")
+	t.Ok(err)
+	defer os.RemoveAll(cacheDir)
+
+	cfg := &config.BuildConfig{
+		Libs:     []string{server.URL + "/core.tar.gz"},
+		CacheDir: cacheDir,
+	}
+	for i := 0; i < 2; i++ {
+		libs, err := LoadLibraries(cfg)
+		t.Ok(err)
+		lib := libs[server.URL+"/core.tar.gz"]
+		t.Assert(lib != nil, "Expected remote library to be loaded")
+		t.Assert(lib.Files["util.lua"] != nil, "Expected util.lua in remote library")
+
+		fileMap := make(map[string]*FileEntry)
+		t.Ok(AddFilesFromModule("util", []*FirmwareLib{lib}, fileMap))
+	}
+	t.Equals(1, downloads)
+}
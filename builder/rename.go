@@ -0,0 +1,89 @@
+package builder
+
+import (
+	"encoding/json"
+	"espore/config"
+	"espore/utils"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// firmwareFields reads the firmware.json of a device as raw fields, so it can
+// be rewritten keeping the fields espore does not know about. Devices defined
+// by a firmware template cannot be rewritten.
+func firmwareFields(devicePath string) (string, map[string]json.RawMessage, error) {
+	if _, err := os.Stat(filepath.Join(devicePath, FirmwareTemplateName)); err == nil {
+		return "", nil, fmt.Errorf("%s: device is defined by %s, edit it instead", devicePath, FirmwareTemplateName)
+	}
+	jsonPath := filepath.Join(devicePath, "firmware.json")
+	var fields map[string]json.RawMessage
+	if err := utils.ReadJSON(jsonPath, &fields); err != nil {
+		return "", nil, fmt.Errorf("Error reading %s: %s", jsonPath, err)
+	}
+	return jsonPath, fields, nil
+}
+
+// deviceRename is a rename of a device in the build tree that was checked
+// to be possible
+type deviceRename struct {
+	jsonPath   string
+	fields     map[string]json.RawMessage
+	devicePath string
+	newPath    string
+}
+
+// planRename checks that the device with oldID can be renamed to newID
+func planRename(config *config.BuildConfig, oldID, newID string) (*deviceRename, error) {
+	devicePath, _, err := FindDevice(config, oldID)
+	if err != nil {
+		return nil, err
+	}
+	jsonPath, fields, err := firmwareFields(devicePath)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := FindDevice(config, newID); err == nil {
+		return nil, fmt.Errorf("A device with id %q already exists", newID)
+	}
+	newPath := devicePath
+	if filepath.Base(devicePath) == oldID {
+		newPath = filepath.Join(filepath.Dir(devicePath), newID)
+		if _, err := os.Stat(newPath); err == nil {
+			return nil, fmt.Errorf("Cannot rename %s, %s already exists", devicePath, newPath)
+		}
+	}
+	return &deviceRename{jsonPath: jsonPath, fields: fields, devicePath: devicePath, newPath: newPath}, nil
+}
+
+// CheckRename returns the error RenameDevice would fail with, without
+// changing anything, so the rename can be validated before it is applied
+// elsewhere
+func CheckRename(config *config.BuildConfig, oldID, newID string) error {
+	_, err := planRename(config, oldID, newID)
+	return err
+}
+
+// RenameDevice changes the id and name of a device in its firmware.json. If
+// the device folder is named after the old id, it is renamed after the new
+// one. Devices defined by a firmware template must be renamed by hand. It
+// returns the new device folder.
+func RenameDevice(config *config.BuildConfig, oldID, newID, newName string) (string, error) {
+	rename, err := planRename(config, oldID, newID)
+	if err != nil {
+		return "", err
+	}
+	rename.fields["id"], _ = json.Marshal(newID)
+	if newName != "" {
+		rename.fields["name"], _ = json.Marshal(newName)
+	}
+	if err := utils.WriteJSON(rename.jsonPath, rename.fields); err != nil {
+		return "", err
+	}
+	if rename.newPath != rename.devicePath {
+		if err := os.Rename(rename.devicePath, rename.newPath); err != nil {
+			return "", err
+		}
+	}
+	return rename.newPath, nil
+}
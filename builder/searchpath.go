@@ -0,0 +1,61 @@
+package builder
+
+import (
+	"espore/config"
+	"strings"
+)
+
+// moduleFiles returns the files a module may be loaded from, in the order
+// they are tried. An empty search path uses config.DefaultSearchPath.
+func moduleFiles(moduleName string, searchPath []string) []string {
+	if len(searchPath) == 0 {
+		searchPath = config.DefaultSearchPath
+	}
+	name := strings.ReplaceAll(moduleName, ".", "/")
+	files := make([]string, len(searchPath))
+	for i, template := range searchPath {
+		files[i] = strings.ReplaceAll(template, "?", name)
+	}
+	return files
+}
+
+// fileModule returns the module a file is loaded as through the search path,
+// if any. It is the reverse of moduleFiles.
+func fileModule(fileName string, searchPath []string) (string, bool) {
+	if len(searchPath) == 0 {
+		searchPath = config.DefaultSearchPath
+	}
+	for _, template := range searchPath {
+		i := strings.Index(template, "?")
+		if i < 0 {
+			continue
+		}
+		prefix, suffix := template[:i], template[i+1:]
+		if !strings.HasPrefix(fileName, prefix) || !strings.HasSuffix(fileName, suffix) || len(fileName) <= len(prefix)+len(suffix) {
+			continue
+		}
+		name := fileName[len(prefix) : len(fileName)-len(suffix)]
+		// templates with more than one placeholder must map back to the file
+		if strings.ReplaceAll(template, "?", name) != fileName {
+			continue
+		}
+		return strings.ReplaceAll(name, "/", "."), true
+	}
+	return "", false
+}
+
+// findModule returns the file a module resolves to, trying each file of the
+// search path in order as the device does. Files already in fileMap, which
+// may be nil, take precedence over the libraries. It returns a nil entry if
+// the module cannot be found.
+func findModule(moduleName string, searchPath []string, libs []*FirmwareLib, fileMap map[string]*FileEntry) (string, *FileEntry) {
+	for _, fileName := range moduleFiles(moduleName, searchPath) {
+		if entry, ok := fileMap[fileName]; ok {
+			return fileName, entry
+		}
+		if entry, err := FindInLibraries(fileName, libs); err == nil {
+			return fileName, entry
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,69 @@
+package builder
+
+import (
+	"espore/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestSearchPath(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	root, err := ioutil.TempDir("", "espore-searchpath")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+
+	devicePath := filepath.Join(root, "devices", "1111")
+	files := map[string]string{
+		"firmware.json":   testFirmwareJSON("1111", "kitchen"),
+		"main.lua":        "require(\"util\")\nrequire(\"net\")\n",
+		"lua/util.lua":    "return {}\n",
+		"util.lua":        "-- shadowed by lua/util.lua\n",
+		"net/init.lua":    "require(\"net.dns\")\n",
+		"lua/net/dns.lua": "return {}\n",
+	}
+	for name, content := range files {
+		t.Ok(os.MkdirAll(filepath.Dir(filepath.Join(devicePath, name)), 0755))
+		t.Ok(ioutil.WriteFile(filepath.Join(devicePath, name), []byte(content), 0644))
+	}
+	cfg := &config.BuildConfig{
+		Devices:    []string{filepath.Join(root, "devices", "*")},
+		SearchPath: []string{"lua/?.lua", "?/init.lua", "?.lua"},
+	}
+
+	deviceRootLib, fwDef, err := loadDevice(cfg, "1111")
+	t.Ok(err)
+	fileMap := make(map[string]*FileEntry)
+	t.Ok(addFilesFromModule("main", cfg.GetSearchPath(), []*FirmwareLib{deviceRootLib}, fileMap, nil, nil))
+	var paths []string
+	for path := range fileMap {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	t.Equals([]string{"lua/net/dns.lua", "lua/util.lua", "main.lua", "net/init.lua"}, paths)
+
+	selection, err := DeviceModuleSelection(cfg, fwDef.ID)
+	t.Ok(err)
+	t.Equals([]string{"net", "net.dns", "util"}, selection.Available)
+
+	module, ok := fileModule("lua/net/dns.lua", cfg.SearchPath)
+	t.Assert(ok, "Expected lua/net/dns.lua to map to a module")
+	t.Equals("net.dns", module)
+	_, ok = fileModule("firmware.json", cfg.SearchPath)
+	t.Assert(!ok, "Expected firmware.json not to map to a module")
+
+	// with the default search path, net cannot be found
+	err = addFilesFromModule("main", nil, []*FirmwareLib{deviceRootLib}, make(map[string]*FileEntry), nil, nil)
+	t.Assert(err != nil, "Expected an error resolving net with the default search path")
+	t.Assert(strings.Contains(err.Error(), "file net.lua not found"), "Unexpected error: %s", err)
+
+	err = addFilesFromModule("nope", cfg.GetSearchPath(), []*FirmwareLib{deviceRootLib}, make(map[string]*FileEntry), nil, nil)
+	t.Assert(err != nil && strings.Contains(err.Error(), "lua/nope.lua or nope/init.lua or nope.lua"), "Unexpected error: %v", err)
+}
@@ -0,0 +1,153 @@
+package builder
+
+import (
+	"espore/config"
+	"espore/utils"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// SelectionDir is the folder under the build output where images built from
+// a module selection are written, so they don't replace the device's image
+const SelectionDir = "adhoc"
+
+// ModuleSelection lists the modules a device can start
+type ModuleSelection struct {
+	// Available are the modules found in the device's search libraries,
+	// sorted by name
+	Available []string
+	// Selected are the modules the device starts as currently defined
+	Selected []string
+}
+
+// DeviceModuleSelection returns the modules available to a device along with
+// those it currently starts. The main module is always included, so it is
+// not listed.
+func DeviceModuleSelection(config *config.BuildConfig, deviceID string) (*ModuleSelection, error) {
+	deviceRootLib, fwDef, err := loadDevice(config, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	modules, searchLibs, err := deviceModules(deviceRootLib, getLibraryList(deviceRootLib, nil), fwDef, config.GetSearchPath())
+	if err != nil {
+		return nil, err
+	}
+	selection := &ModuleSelection{Available: availableModules(searchLibs, config.GetSearchPath())}
+	for _, modDef := range modules {
+		if modDef.Name != MainModule.Name {
+			selection.Selected = append(selection.Selected, modDef.Name)
+		}
+	}
+	return selection, nil
+}
+
+// BuildModuleSelection builds an image for a device that starts the given
+// modules instead of the ones it defines, writing it to SelectionDir under the
+// build output. Dependencies of the selected modules are resolved as usual.
+func BuildModuleSelection(config *config.BuildConfig, deviceID string, modules []string) (*FirmwareManifest, error) {
+	imageWriter, err := GetImageWriter(config.ImageVersion)
+	if err != nil {
+		return nil, err
+	}
+	deviceRootLib, fwDef, err := loadDevice(config, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := selectionManifest(config, deviceRootLib, fwDef, modules, newLFSCache(config.CacheDir))
+	if err != nil {
+		return nil, err
+	}
+	outputDir := filepath.Join(config.Output, SelectionDir)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := utils.WriteJSON(filepath.Join(outputDir, manifest.ID+".json"), manifest); err != nil {
+		return nil, err
+	}
+	if err := writeFirmwareImage(manifest, outputDir, imageWriter); err != nil {
+		return nil, fmt.Errorf("Error writing firmware image for %s: %s", deviceID, err)
+	}
+	return manifest, nil
+}
+
+// selectionManifest builds the manifest of a device starting only the given
+// modules. Modules the device already defines keep their settings, the rest
+// are autostarted.
+func selectionManifest(config *config.BuildConfig, deviceRootLib *FirmwareLib, fwDef FirmwareDef, modules []string, cache *lfsCache) (*FirmwareManifest, error) {
+	defined, _, err := deviceModules(deviceRootLib, getLibraryList(deviceRootLib, nil), fwDef, config.GetSearchPath())
+	if err != nil {
+		return nil, err
+	}
+	defs := make(map[string]ModuleDef, len(defined))
+	for _, modDef := range defined {
+		defs[modDef.Name] = modDef
+	}
+
+	fwDef.Modules = make([]ModuleDef, 0, len(modules))
+	for _, module := range modules {
+		modDef, ok := defs[module]
+		if !ok {
+			modDef = ModuleDef{Name: module, Autostart: true}
+		}
+		fwDef.Modules = append(fwDef.Modules, modDef)
+	}
+	// libraries are shared, so the modules they start are dropped on copies
+	return buildDeviceFirmwareManifest(config, withoutModules(deviceRootLib, nil), fwDef, cache)
+}
+
+// withoutModules returns a copy of lib and its dependencies that start no
+// modules
+func withoutModules(lib *FirmwareLib, copied map[*FirmwareLib]*FirmwareLib) *FirmwareLib {
+	if copied == nil {
+		copied = make(map[*FirmwareLib]*FirmwareLib)
+	}
+	if c, ok := copied[lib]; ok {
+		return c
+	}
+	c := *lib
+	c.Modules = nil
+	c.Dependencies = make([]*FirmwareLib, 0, len(lib.Dependencies))
+	copied[lib] = &c
+	for _, dep := range lib.Dependencies {
+		c.Dependencies = append(c.Dependencies, withoutModules(dep, copied))
+	}
+	return &c
+}
+
+// availableModules returns the sorted names of the modules in libs found
+// through the search path, other than the main module
+func availableModules(libs []*FirmwareLib, searchPath []string) []string {
+	seen := make(map[string]bool)
+	var modules []string
+	for _, lib := range libs {
+		for path := range lib.Files {
+			module, ok := fileModule(path, searchPath)
+			if !ok || module == MainModule.Name || seen[module] {
+				continue
+			}
+			seen[module] = true
+			modules = append(modules, module)
+		}
+	}
+	sort.Strings(modules)
+	return modules
+}
+
+// loadDevice loads the root library and firmware definition of a device
+func loadDevice(config *config.BuildConfig, deviceID string) (*FirmwareLib, FirmwareDef, error) {
+	devicePath, fwDef, err := FindDevice(config, deviceID)
+	if err != nil {
+		return nil, FirmwareDef{}, err
+	}
+	allLibs, err := LoadLibraries(config)
+	if err != nil {
+		return nil, FirmwareDef{}, err
+	}
+	deviceRootLib, err := LoadLibrary(config, devicePath, allLibs, 0)
+	if err != nil {
+		return nil, FirmwareDef{}, err
+	}
+	return deviceRootLib, fwDef, nil
+}
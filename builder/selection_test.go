@@ -0,0 +1,77 @@
+package builder
+
+import (
+	"encoding/json"
+	"espore/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestModuleSelection(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	root, err := ioutil.TempDir("", "espore-selection")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+
+	libPath := filepath.Join(root, "lib")
+	t.Ok(os.MkdirAll(libPath, 0755))
+	libFiles := map[string]string{
+		"library.json": `{"modules": [{"name": "wifi", "autostart": true}]}`,
+		"wifi.lua":     "return {}\n",
+		"sensor.lua":   "require(\"dht\")\nreturn {}\n",
+		"dht.lua":      "return {pin = 4}\n",
+		"mqtt.lua":     "return {}\n",
+	}
+	for name, content := range libFiles {
+		t.Ok(ioutil.WriteFile(filepath.Join(libPath, name), []byte(content), 0644))
+	}
+	devicePath := filepath.Join(root, "devices", "1111")
+	t.Ok(os.MkdirAll(devicePath, 0755))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "library.json"), []byte(`{"dependencies": [`+strconv.Quote(libPath)+`]}`), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "firmware.json"), []byte(`{"name": "kitchen", "id": "1111", "modules": [{"name": "mqtt", "autostart": false}], "lfs": {"exclude": ["**/*", "*"]}}`), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(devicePath, "main.lua"), []byte("return 1\n"), 0644))
+	cfg := &config.BuildConfig{Devices: []string{filepath.Join(root, "devices", "*")}}
+
+	selection, err := DeviceModuleSelection(cfg, "1111")
+	t.Ok(err)
+	t.Equals([]string{"dht", "mqtt", "sensor", "wifi"}, selection.Available)
+	t.Equals([]string{"mqtt", "wifi"}, selection.Selected)
+
+	deviceRootLib, fwDef, err := loadDevice(cfg, "1111")
+	t.Ok(err)
+	manifest, err := selectionManifest(cfg, deviceRootLib, fwDef, []string{"sensor", "mqtt"}, newLFSCache(""))
+	t.Ok(err)
+
+	var paths []string
+	var modules []ModuleDef
+	for _, fe := range manifest.Files {
+		if fe.Path == "modules.json" {
+			t.Ok(json.Unmarshal(fe.Content, &modules))
+		}
+		if isLua(fe.Path) {
+			paths = append(paths, fe.Path)
+		}
+	}
+	sort.Strings(paths)
+	// dht is pulled in by sensor, wifi is left out although its library
+	// starts it
+	t.Equals([]string{"__espore.lua", "dht.lua", "init.lua", "main.lua", "mqtt.lua", "sensor.lua"}, paths)
+	t.Equals([]ModuleDef{
+		{Name: "mqtt", Autostart: false},
+		{Name: "sensor", Autostart: true},
+		MainModule,
+	}, modules)
+	// the shared library still starts its module
+	t.Equals(1, len(deviceRootLib.Dependencies[0].Modules))
+
+	_, err = selectionManifest(cfg, deviceRootLib, fwDef, []string{"nope"}, newLFSCache(""))
+	t.Assert(err != nil, "Expected an error for a module that cannot be found")
+}
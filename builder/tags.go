@@ -0,0 +1,79 @@
+package builder
+
+import (
+	"encoding/json"
+	"espore/config"
+	"espore/utils"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ParseTag splits a key=value tag. The value may be empty.
+func ParseTag(tag string) (string, string, error) {
+	parts := strings.SplitN(tag, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("Invalid tag %q, expected key=value", tag)
+	}
+	return parts[0], parts[1], nil
+}
+
+// SetDeviceTag records a tag in the firmware.json of a device, replacing any
+// previous value of the key. An empty value removes the tag.
+func SetDeviceTag(config *config.BuildConfig, deviceID, key, value string) error {
+	devicePath, fwDef, err := FindDevice(config, deviceID)
+	if err != nil {
+		return err
+	}
+	jsonPath, fields, err := firmwareFields(devicePath)
+	if err != nil {
+		return err
+	}
+	tags := fwDef.Tags
+	if tags == nil {
+		tags = make(map[string]string)
+	}
+	if value == "" {
+		delete(tags, key)
+	} else {
+		tags[key] = value
+	}
+	if len(tags) == 0 {
+		delete(fields, "tags")
+	} else {
+		fields["tags"], _ = json.Marshal(tags)
+	}
+	return utils.WriteJSON(jsonPath, fields)
+}
+
+// DevicesWithTags returns the devices having all the given tags, sorted by
+// id. An empty filter matches all devices.
+func DevicesWithTags(config *config.BuildConfig, filter map[string]string) ([]DeviceInfo, error) {
+	devicePaths, err := DevicePaths(config)
+	if err != nil {
+		return nil, err
+	}
+	var devices []DeviceInfo
+	for _, devicePath := range devicePaths {
+		fwDef, err := ReadFirmwareDef(config, devicePath)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read firmware file in %s: %s", devicePath, err)
+		}
+		if hasTags(fwDef.Tags, filter) {
+			devices = append(devices, fwDef.DeviceInfo)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].ID < devices[j].ID
+	})
+	return devices, nil
+}
+
+func hasTags(tags, filter map[string]string) bool {
+	for key, value := range filter {
+		if v, ok := tags[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package builder
+
+import (
+	"encoding/json"
+	"espore/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestDeviceTags(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	root, err := ioutil.TempDir("", "espore-tags")
+	t.Ok(err)
+	defer os.RemoveAll(root)
+	for _, id := range []string{"3333", "1111", "2222"} {
+		writeFiles(tx, filepath.Join(root, "devices", id), map[string]string{
+			"firmware.json": testFirmwareJSON(id, "dev"+id),
+			"main.lua":      "return 1\n",
+		})
+	}
+	cfg := &config.BuildConfig{
+		Devices:      []string{filepath.Join(root, "devices", "*")},
+		Reproducible: true,
+	}
+
+	t.Ok(SetDeviceTag(cfg, "1111", "location", "kitchen"))
+	t.Ok(SetDeviceTag(cfg, "1111", "role", "sensor"))
+	t.Ok(SetDeviceTag(cfg, "2222", "location", "kitchen"))
+	t.Ok(SetDeviceTag(cfg, "3333", "location", "garage"))
+	t.Ok(SetDeviceTag(cfg, "3333", "role", "sensor"))
+
+	// tags persist in firmware.json, keeping the other fields
+	_, fwDef, err := FindDevice(cfg, "1111")
+	t.Ok(err)
+	t.Equals(map[string]string{"location": "kitchen", "role": "sensor"}, fwDef.Tags)
+	t.Equals([]string{"**/*", "*"}, fwDef.LFS.Exclude)
+
+	ids := func(filter map[string]string) []string {
+		devices, err := DevicesWithTags(cfg, filter)
+		t.Ok(err)
+		var ids []string
+		for _, device := range devices {
+			ids = append(ids, device.ID)
+		}
+		return ids
+	}
+	t.Equals([]string{"1111", "2222", "3333"}, ids(nil))
+	t.Equals([]string{"1111", "2222"}, ids(map[string]string{"location": "kitchen"}))
+	t.Equals([]string{"1111"}, ids(map[string]string{"location": "kitchen", "role": "sensor"}))
+	t.Equals(0, len(ids(map[string]string{"location": "attic"})))
+
+	// an empty value removes the tag
+	t.Ok(SetDeviceTag(cfg, "2222", "location", ""))
+	t.Equals([]string{"1111"}, ids(map[string]string{"location": "kitchen"}))
+
+	// tags round-trip through the manifest
+	manifest, err := BuildManifest(cfg, "1111")
+	t.Ok(err)
+	data, err := json.Marshal(manifest)
+	t.Ok(err)
+	var decoded FirmwareManifest
+	t.Ok(json.Unmarshal(data, &decoded))
+	t.Equals(map[string]string{"location": "kitchen", "role": "sensor"}, decoded.Tags)
+
+	key, value, err := ParseTag("location=living room")
+	t.Ok(err)
+	t.Equals("location", key)
+	t.Equals("living room", value)
+	_, _, err = ParseTag("location")
+	t.Assert(err != nil, "Expected an error for a tag without a value")
+}
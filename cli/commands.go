@@ -1,32 +1,87 @@
 package cli
 
 import (
+	"errors"
 	"espore/builder"
+	"espore/cli/history"
 	"espore/cli/syncer"
 	"espore/initializer"
+	"espore/session"
+	"espore/session/fileman"
+	"espore/utils"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rivo/tview"
 )
 
 type commandHandler struct {
 	handler       func(parameters []string) error
 	minParameters int
+	// exactName requires the full command name, so destructive commands
+	// cannot be run by a prefix
+	exactName bool
 }
 
-func (ui *UI) ls() error {
+func (ui *UI) ls(path string) error {
 	list, err := ui.Session.File.List()
 	if err != nil {
 		return err
 	}
-	ui.Printf("Files:\n")
-	for _, entry := range list {
-		ui.Printf("%s\t%d\n", entry.Name, entry.Size)
-	}
+	ui.Printf("%s", tview.Escape(formatListing(list, cleanListingPath(path))))
 	ui.updateFilebrowser(list)
 	return nil
 }
 
+// forget removes the last n entries of the command history, or all of it if n
+// is 0. History is edited from the UI goroutine, after the /forget line itself
+// has been appended.
+func (ui *UI) forget(n int) {
+	ui.app.QueueUpdate(func() {
+		forgetHistory(ui.History, ui.commandHandlers, n)
+	})
+	if n > 0 {
+		ui.Printf("Forgot the last %d history entries\n", n)
+	} else {
+		ui.Printf("History cleared\n")
+	}
+}
+
+// forgetHistory removes the last n entries of h, or all of them if n is 0.
+// The /forget command line is removed as well when it is the last entry,
+// which is not the case if History.Append skipped it as a repeated line.
+func forgetHistory(h *history.History, handlers map[string]*commandHandler, n int) {
+	if n <= 0 {
+		h.Forget(0)
+		return
+	}
+	if match := commandRegex.FindStringSubmatch(h.Last()); len(match) > 0 {
+		if command, _ := resolveCommand(handlers, match[1]); command == "forget" {
+			n++
+		}
+	}
+	h.Forget(n)
+}
+
+// freeSpace returns the bytes available on the device filesystem
+func (ui *UI) freeSpace() (int64, error) {
+	remaining, _, _, err := ui.Session.File.FSInfo()
+	return remaining, err
+}
+
+func (ui *UI) df() error {
+	remaining, used, total, err := ui.Session.File.FSInfo()
+	if err != nil {
+		return err
+	}
+	ui.Printf("Filesystem: %d bytes total, %d used, %d free\n", total, used, remaining)
+	return nil
+}
+
 func (ui *UI) unload(packageName string) error {
 	if packageName == "*" {
 		return ui.Session.RunCode(`
@@ -41,7 +96,7 @@ func (ui *UI) unload(packageName string) error {
 }
 
 func (ui *UI) push(srcPath, dstPath string) error {
-	err := ui.Session.PushFile(srcPath, dstPath)
+	err := ui.Session.PushFile(srcPath, session.JoinRemotePath(ui.remoteDir, dstPath))
 	if err != nil {
 		ui.Printf("Error uploading file: %s\n", err)
 	} else {
@@ -50,47 +105,202 @@ func (ui *UI) push(srcPath, dstPath string) error {
 	return nil
 }
 
+func (ui *UI) get(srcName, dstPath string) error {
+	err := ui.Session.PullFile(session.JoinRemotePath(ui.remoteDir, srcName), dstPath)
+	if err != nil {
+		ui.Printf("Error downloading file: %s\n", err)
+	} else {
+		ui.Printf("Saved %s\n", dstPath)
+	}
+	return nil
+}
+
 func (ui *UI) watch(srcPath, dstPath string) error {
 	currentDir, err := os.Getwd()
 	if err != nil {
 		return err
 	}
 	srcPath = filepath.Join(currentDir, srcPath)
-	sync := ui.syncers[srcPath]
-	if sync != nil {
-		sync.Close()
-		delete(ui.syncers, srcPath)
-	}
+	dstPath = session.JoinRemotePath(ui.remoteDir, dstPath)
+	ui.removeSyncer(srcPath)
 
-	sync, err = syncer.New(&syncer.Config{
+	sync, err := syncer.New(&syncer.Config{
 		SrcPath: srcPath,
-		OnSync: func(path string) {
-			ui.app.QueueUpdate(func() {
-				relFile, err := filepath.Rel(srcPath, path)
+		OnSync: func(path string, closing <-chan struct{}) error {
+			errC := make(chan error, 1)
+			push := func() {
+				dstName, err := pushWatchedFile(ui.Session, srcPath, dstPath, path)
 				if err != nil {
-					ui.Printf("[red]Error pushing file: %s\n", err)
-				} else {
-					dstName := filepath.Join(dstPath, relFile)
-
-					err = ui.Session.PushFile(path, dstName)
-					if err != nil {
-						ui.Printf("[red]Error pushing %s: %s[-:-:-]\n", dstName, err)
-					} else {
-						ui.Printf("Pushed %s\n", dstName)
-					}
+					ui.Printf("[red]%s[-:-:-]\n", err)
+				} else if dstName != "" {
+					ui.Printf("Pushed %s\n", dstName)
 				}
-			})
+				errC <- err
+			}
+			// the command goroutine may be the one closing this syncer
+			select {
+			case ui.commands <- push:
+			case <-closing:
+				return nil
+			}
+			select {
+			case err := <-errC:
+				return err
+			case <-closing:
+				return nil
+			}
 		},
 	})
 	if err != nil {
 		ui.Printf("Error setting up sync for %s->%s: %s\n", srcPath, dstPath, err)
 	} else {
+		ui.setSyncer(srcPath, sync)
 		ui.Printf("Watching %s for changes\n", srcPath)
 	}
 
 	return nil
 }
 
+func (ui *UI) listSyncers() {
+	list := ui.syncerStatusList()
+	if len(list) == 0 {
+		ui.Printf("No active syncers\n")
+		return
+	}
+	ui.Printf("Syncers:\n")
+	for _, status := range list {
+		ui.Printf("%s\t%s\t%s", status.SrcPath, status.State, status.LastActivity.Format("15:04:05"))
+		if status.Err != nil {
+			ui.Printf("\t%s", status.Err)
+		}
+		ui.Printf("\n")
+	}
+}
+
+func (ui *UI) hash(path string) error {
+	hash, err := utils.HashFile(path)
+	if err != nil {
+		return err
+	}
+	ui.Printf("%s\t%s\n", hash, path)
+	return nil
+}
+
+func (ui *UI) autosync(deviceID string) error {
+	buildConfig := ui.Config.EsporeConfig.Build
+	var paths []string
+	for _, pathGlob := range append(buildConfig.Libs, buildConfig.Devices...) {
+		matches, _ := filepath.Glob(pathGlob)
+		paths = append(paths, matches...)
+	}
+
+	key := "device:" + deviceID
+	ui.removeDeviceSyncer(key)
+
+	var ds *syncer.DeviceSyncer
+	ds, err := syncer.NewDevice(&syncer.DeviceConfig{
+		Paths:       paths,
+		Debounce:    500 * time.Millisecond,
+		Pusher:      ui.Session,
+		List:        ui.Session.File.List,
+		FreeSpace:   ui.freeSpace,
+		SpaceMargin: ui.Config.EsporeConfig.GetFreeSpaceMargin(),
+		Build: func() (*builder.FirmwareManifest, error) {
+			return builder.BuildManifest(&buildConfig, deviceID)
+		},
+		OnChange: func() {
+			ui.commands <- func() {
+				ui.syncDevice(deviceID, ds)
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+	ui.setDeviceSyncer(key, ds)
+	ui.Printf("Watching sources of device %s for changes\n", deviceID)
+	ui.syncDevice(deviceID, ds)
+	return nil
+}
+
+// resync retries syncing a device after an error, starting a device syncer
+// if there is none yet
+func (ui *UI) resync(deviceID string) error {
+	ds := ui.getDeviceSyncer("device:" + deviceID)
+	if ds == nil {
+		return ui.autosync(deviceID)
+	}
+	ds.Reset()
+	ui.syncDevice(deviceID, ds)
+	return nil
+}
+
+// pruneDryRun lists the device files that are not part of the device firmware
+// and would be deleted by a prune
+func (ui *UI) pruneDryRun(deviceID string) error {
+	var candidates []string
+	var err error
+	if ds := ui.getDeviceSyncer("device:" + deviceID); ds != nil {
+		candidates, err = ds.PruneCandidates()
+	} else {
+		var manifest *builder.FirmwareManifest
+		if manifest, err = builder.BuildManifest(&ui.Config.EsporeConfig.Build, deviceID); err != nil {
+			return err
+		}
+		var deviceFiles []fileman.FileEntry
+		if deviceFiles, err = ui.Session.File.List(); err != nil {
+			return err
+		}
+		names := make([]string, len(deviceFiles))
+		for i, entry := range deviceFiles {
+			names[i] = entry.Name
+		}
+		candidates = syncer.PruneCandidates(manifest, names)
+	}
+	if err != nil {
+		return err
+	}
+	if len(candidates) == 0 {
+		ui.Printf("Nothing to prune on device %s\n", deviceID)
+		return nil
+	}
+	ui.Printf("Prune would delete %d files from device %s:\n", len(candidates), deviceID)
+	for _, name := range candidates {
+		ui.Printf("%s\n", name)
+	}
+	return nil
+}
+
+func (ui *UI) syncDevice(deviceID string, ds *syncer.DeviceSyncer) {
+	pushed, err := ds.Sync()
+	if err != nil {
+		ui.Printf("[red]Error syncing device %s: %s[-:-:-]\n", deviceID, err)
+		return
+	}
+	if len(pushed) == 0 {
+		ui.Printf("Device %s is up to date\n", deviceID)
+		return
+	}
+	ui.Printf("Synced %d files to %s: %s\n", len(pushed), deviceID, strings.Join(pushed, ", "))
+	if len(pushed) > 1 {
+		ui.Printf("Slowest files:\n")
+		for _, timing := range syncer.SlowestFiles(ds.Timings(), slowestFilesShown) {
+			ui.Printf("  %s\t%s\t%s\n", timing.Path, timing.Duration.Round(time.Millisecond), formatRate(timing.Size, timing.Duration))
+		}
+	}
+}
+
+// slowestFilesShown is how many of the slowest files are listed after a sync
+const slowestFilesShown = 5
+
+// formatRate returns the transfer rate of size bytes over d
+func formatRate(size int64, d time.Duration) string {
+	if d <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f KB/s", float64(size)/d.Seconds()/1024)
+}
+
 func (ui *UI) cat(path string) error {
 	//TODO: encode somehow so as to avoid the newlines in print()
 	return ui.Session.RunCode(fmt.Sprintf(`
@@ -105,6 +315,61 @@ func (ui *UI) cat(path string) error {
 	`, path))
 }
 
+func (ui *UI) cd(dir string) {
+	ui.remoteDir = session.JoinRemotePath(dir, "")
+	ui.pwd()
+}
+
+func (ui *UI) pwd() {
+	ui.Printf("Remote directory: /%s\n", ui.remoteDir)
+}
+
+func (ui *UI) reload() error {
+	libs, err := builder.ReloadLibraries(&ui.Config.EsporeConfig.Build)
+	if err != nil {
+		return err
+	}
+	var files int
+	for _, lib := range libs {
+		files += len(lib.Files)
+	}
+	ui.Printf("Rescanned %d libraries, %d files\n", len(libs), files)
+	return nil
+}
+
+func (ui *UI) clearCache() error {
+	cacheDir := ui.Config.EsporeConfig.Build.CacheDir
+	if cacheDir == "" {
+		ui.Printf("No cache directory configured\n")
+		return nil
+	}
+	removed, err := builder.ClearCache(cacheDir)
+	if err != nil {
+		return err
+	}
+	ui.Printf("Removed %d cached images from %s\n", removed, cacheDir)
+	return nil
+}
+
+func (ui *UI) build(devices []string) error {
+	if len(devices) == 0 {
+		err := builder.Build(&ui.Config.EsporeConfig.Build)
+		if err == nil {
+			ui.Printf("Firmware images built.\n")
+		}
+		return err
+	}
+	ids, err := ui.EsporeConfig.ExpandDevices(devices)
+	if err != nil {
+		return err
+	}
+	if err := builder.BuildDevices(&ui.Config.EsporeConfig.Build, ids); err != nil {
+		return err
+	}
+	ui.Printf("Firmware images built for %s.\n", strings.Join(ids, ", "))
+	return nil
+}
+
 func (ui *UI) install_runtime() error {
 	return ui.Session.InstallRuntime()
 }
@@ -120,16 +385,28 @@ func (ui *UI) buildCommandHandlers() map[string]*commandHandler {
 		"ls": &commandHandler{
 			minParameters: 0,
 			handler: func(p []string) error {
-				return ui.ls()
+				path := ""
+				if len(p) > 0 {
+					path = p[0]
+				}
+				return ui.ls(path)
+			},
+		},
+		"df": &commandHandler{
+			minParameters: 0,
+			handler: func(p []string) error {
+				return ui.df()
 			},
 		},
 		"init": &commandHandler{
+			exactName:     true,
 			minParameters: 0,
 			handler: func(p []string) error {
 				return initializer.Initialize(ui.EsporeConfig.Build.Output, ui.Session)
 			},
 		},
 		"install-runtime": &commandHandler{
+			exactName:     true,
 			minParameters: 0,
 			handler: func(p []string) error {
 				return ui.install_runtime()
@@ -141,15 +418,193 @@ func (ui *UI) buildCommandHandlers() map[string]*commandHandler {
 				return ui.unload(p[0])
 			},
 		},
+		"get": &commandHandler{
+			minParameters: 1,
+			handler: func(p []string) error {
+				dstPath := filepath.Base(p[0])
+				if len(p) > 1 {
+					dstPath = p[1]
+				}
+				return ui.get(p[0], dstPath)
+			},
+		},
 		"push": &commandHandler{
 			minParameters: 2,
 			handler: func(p []string) error {
 				return ui.push(p[0], p[1])
 			},
 		},
+		"exec": &commandHandler{
+			minParameters: 1,
+			handler: func(p []string) error {
+				return ui.exec(p[0])
+			},
+		},
+		"snapshot": &commandHandler{
+			minParameters: 1,
+			handler: func(p []string) error {
+				return ui.snapshot(p[0])
+			},
+		},
+		"restore": &commandHandler{
+			exactName:     true,
+			minParameters: 1,
+			handler: func(p []string) error {
+				return ui.restore(p[0])
+			},
+		},
+		"prune": &commandHandler{
+			minParameters: 2,
+			handler: func(p []string) error {
+				if p[0] != "--dry-run" {
+					return errors.New("Only /prune --dry-run <deviceId> is supported")
+				}
+				return ui.pruneDryRun(p[1])
+			},
+		},
+		"config": &commandHandler{
+			minParameters: 2,
+			handler: func(p []string) error {
+				return ui.deviceConfig(p)
+			},
+		},
+		"rename": &commandHandler{
+			exactName:     true,
+			minParameters: 1,
+			handler: func(p []string) error {
+				return ui.rename(p)
+			},
+		},
+		"hexdump": &commandHandler{
+			minParameters: 1,
+			handler: func(p []string) error {
+				switch p[0] {
+				case "on":
+					ui.dumper.SetHex(true)
+				case "off":
+					ui.dumper.SetHex(false)
+				default:
+					return fmt.Errorf("Expected on or off, got %q", p[0])
+				}
+				ui.Printf("Hex dump is %s\n", p[0])
+				return nil
+			},
+		},
+		"forward": &commandHandler{
+			minParameters: 1,
+			handler: func(p []string) error {
+				ui.forward(p[0])
+				return nil
+			},
+		},
+		"forget": &commandHandler{
+			handler: func(p []string) error {
+				n := 0
+				if len(p) > 0 {
+					var err error
+					if n, err = strconv.Atoi(p[0]); err != nil || n <= 0 {
+						return fmt.Errorf("Expected a number of entries to forget, got %q", p[0])
+					}
+				}
+				ui.forget(n)
+				return nil
+			},
+		},
+		"expect": &commandHandler{
+			minParameters: 1,
+			handler: func(p []string) error {
+				timeout := defaultExpectTimeout
+				if len(p) > 1 {
+					var err error
+					if timeout, err = parseExpectTimeout(p[1]); err != nil {
+						return err
+					}
+				}
+				return ui.expect(p[0], timeout)
+			},
+		},
+		"recover": &commandHandler{
+			handler: func(p []string) error {
+				var deviceID string
+				if len(p) > 0 {
+					deviceID = p[0]
+				}
+				return ui.recover(deviceID)
+			},
+		},
+		"feed": &commandHandler{
+			minParameters: 1,
+			handler: func(p []string) error {
+				return ui.feed(p)
+			},
+		},
 		"clear": &commandHandler{
 			handler: func(p []string) error {
-				ui.output.SetText("")
+				ui.outputWriter.Do(func() {
+					ui.output.SetText("")
+				})
+				return nil
+			},
+		},
+		"format": &commandHandler{
+			exactName: true,
+			handler: func(p []string) error {
+				var deviceID string
+				if len(p) > 0 {
+					deviceID = p[0]
+				}
+				return ui.format(deviceID)
+			},
+		},
+		"echo": &commandHandler{
+			minParameters: 1,
+			handler: func(p []string) error {
+				switch p[0] {
+				case "on":
+					ui.echo = true
+				case "off":
+					ui.echo = false
+				default:
+					return fmt.Errorf("Expected on or off, got %q", p[0])
+				}
+				ui.Printf("Command echo is %s\n", p[0])
+				return nil
+			},
+		},
+		"crlf": &commandHandler{
+			handler: func(p []string) error {
+				if len(p) > 0 {
+					switch p[0] {
+					case "on":
+						ui.Session.SetLineTerminator("\r\n")
+					case "off":
+						ui.Session.SetLineTerminator("\n")
+					default:
+						return fmt.Errorf("Expected on or off, got %q", p[0])
+					}
+				}
+				terminator := ui.Session.LineTerminator()
+				state := "off"
+				if terminator == "\r\n" {
+					state = "on"
+				}
+				ui.Printf("CRLF is %s, lines end with %s\n", state, strconv.Quote(terminator))
+				return nil
+			},
+		},
+		"raw": &commandHandler{
+			handler: func(p []string) error {
+				ui.raw()
+				return nil
+			},
+		},
+		"save": &commandHandler{
+			minParameters: 1,
+			handler: func(p []string) error {
+				if err := ui.transcript.Save(p[0]); err != nil {
+					return err
+				}
+				ui.Printf("Transcript saved to %s\n", p[0])
 				return nil
 			},
 		},
@@ -163,24 +618,166 @@ func (ui *UI) buildCommandHandlers() map[string]*commandHandler {
 				return ui.watch(p[0], dstPath)
 			},
 		},
+		"autosync": &commandHandler{
+			minParameters: 1,
+			handler: func(p []string) error {
+				return ui.autosync(p[0])
+			},
+		},
+		"resync": &commandHandler{
+			minParameters: 1,
+			handler: func(p []string) error {
+				return ui.resync(p[0])
+			},
+		},
+		"device": &commandHandler{
+			minParameters: 1,
+			handler: func(p []string) error {
+				return ui.device(p[0])
+			},
+		},
+		"devices": &commandHandler{
+			handler: func(p []string) error {
+				return ui.devices(p)
+			},
+		},
+		"tag": &commandHandler{
+			minParameters: 2,
+			handler: func(p []string) error {
+				return ui.tag(p[0], p[1])
+			},
+		},
+		"check": &commandHandler{
+			handler: func(p []string) error {
+				var deviceID string
+				if len(p) > 0 {
+					deviceID = p[0]
+				}
+				return ui.checkDist(deviceID)
+			},
+		},
+		"lint": &commandHandler{
+			handler: func(p []string) error {
+				var deviceID string
+				if len(p) > 0 {
+					deviceID = p[0]
+				}
+				return ui.lint(deviceID)
+			},
+		},
+		"identify": &commandHandler{
+			handler: func(p []string) error {
+				return ui.identify()
+			},
+		},
+		"cost": &commandHandler{
+			minParameters: 1,
+			handler: func(p []string) error {
+				var deviceID string
+				if len(p) > 1 {
+					deviceID = p[1]
+				}
+				return ui.cost(p[0], deviceID)
+			},
+		},
+		"modules": &commandHandler{
+			handler: func(p []string) error {
+				var deviceID string
+				if len(p) > 0 {
+					deviceID = p[0]
+				}
+				return ui.modules(deviceID)
+			},
+		},
+		"compare": &commandHandler{
+			minParameters: 2,
+			handler: func(p []string) error {
+				return ui.compare(p[0], p[1])
+			},
+		},
+		"whoincludes": &commandHandler{
+			minParameters: 1,
+			handler: func(p []string) error {
+				return ui.whoIncludes(p[0])
+			},
+		},
+		"deps": &commandHandler{
+			minParameters: 1,
+			handler: func(p []string) error {
+				return ui.deps(p[0])
+			},
+		},
+		"graph": &commandHandler{
+			minParameters: 1,
+			handler: func(p []string) error {
+				var outFile string
+				if len(p) > 1 {
+					outFile = p[1]
+				}
+				return ui.graph(p[0], outFile)
+			},
+		},
+		"inventory": &commandHandler{
+			handler: func(p []string) error {
+				var outFile string
+				if len(p) > 0 {
+					outFile = p[0]
+				}
+				return ui.inventory(outFile)
+			},
+		},
+		"syncers": &commandHandler{
+			handler: func(p []string) error {
+				ui.listSyncers()
+				return nil
+			},
+		},
+		"hash": &commandHandler{
+			minParameters: 1,
+			handler: func(p []string) error {
+				return ui.hash(p[0])
+			},
+		},
 		"cat": &commandHandler{
 			minParameters: 1,
 			handler: func(p []string) error {
 				return ui.cat(p[0])
 			},
 		},
+		"cd": &commandHandler{
+			handler: func(p []string) error {
+				var dir string
+				if len(p) > 0 {
+					dir = p[0]
+				}
+				ui.cd(dir)
+				return nil
+			},
+		},
+		"pwd": &commandHandler{
+			handler: func(p []string) error {
+				ui.pwd()
+				return nil
+			},
+		},
 		"restart": &commandHandler{
 			handler: func(p []string) error {
 				return ui.Session.NodeRestart()
 			},
 		},
+		"reload": &commandHandler{
+			handler: func(p []string) error {
+				return ui.reload()
+			},
+		},
+		"clearcache": &commandHandler{
+			handler: func(p []string) error {
+				return ui.clearCache()
+			},
+		},
 		"build": &commandHandler{
 			handler: func(p []string) error {
-				err := builder.Build(&ui.Config.EsporeConfig.Build)
-				if err == nil {
-					ui.Printf("Firmware images built.\n")
-				}
-				return err
+				return ui.build(p)
 			},
 		},
 	}
@@ -0,0 +1,41 @@
+package cli
+
+import (
+	"bytes"
+	"espore/cli/history"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestForgetHistory(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	ui := &UI{}
+	handlers := ui.buildCommandHandlers()
+	newHistory := func(lines ...string) *history.History {
+		h, err := history.New(bytes.NewBufferString(""), &history.Config{Limit: 10, OnAppend: func(string) {}})
+		t.Ok(err)
+		for _, line := range lines {
+			h.Append(line)
+		}
+		return h
+	}
+
+	// the /forget line is dropped along with the entries before it
+	h := newHistory("line1", "/wifi secret", "/forg 1")
+	forgetHistory(h, handlers, 1)
+	t.Equals(1, h.Len())
+	t.Equals("line1", h.Last())
+
+	// a /forget line that was not appended leaves the other entries alone
+	h = newHistory("line1", "line2")
+	forgetHistory(h, handlers, 1)
+	t.Equals(1, h.Len())
+	t.Equals("line1", h.Last())
+
+	h = newHistory("line1", "line2")
+	forgetHistory(h, handlers, 0)
+	t.Equals(0, h.Len())
+}
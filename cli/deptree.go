@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"espore/builder"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+func (ui *UI) deps(moduleName string) error {
+	allLibs, err := builder.LoadLibraries(&ui.Config.EsporeConfig.Build)
+	if err != nil {
+		return err
+	}
+	tree := builder.DependencyTree(moduleName, ui.Config.EsporeConfig.Build.GetSearchPath(), builder.LibraryList(allLibs))
+	ui.Printf("%s", formatDependencyTree(tree))
+	return nil
+}
+
+// formatDependencyTree renders a dependency tree indented by depth, marking
+// unresolved modules in red
+func formatDependencyTree(node *builder.DependencyNode) string {
+	var sb strings.Builder
+	writeDependencyNode(&sb, node, 0)
+	return sb.String()
+}
+
+func writeDependencyNode(sb *strings.Builder, node *builder.DependencyNode, depth int) {
+	indent := strings.Repeat("  ", depth)
+	switch {
+	case node.Seen:
+		fmt.Fprintf(sb, "%s%s (see above)\n", indent, node.Module)
+	case node.Entry == nil:
+		fmt.Fprintf(sb, "%s[red]%s (not found)[yellow]\n", indent, node.Module)
+	default:
+		fmt.Fprintf(sb, "%s%s\n", indent, node.Module)
+	}
+	for _, dep := range node.Dependencies {
+		writeDependencyNode(sb, dep, depth+1)
+	}
+}
+
+// graph writes the module dependency graph of a device as a Graphviz file
+func (ui *UI) graph(deviceID, outFile string) error {
+	dot, err := builder.DeviceGraphDOT(&ui.Config.EsporeConfig.Build, deviceID)
+	if err != nil {
+		return err
+	}
+	if outFile == "" {
+		outFile = deviceID + ".dot"
+	}
+	if err := ioutil.WriteFile(outFile, []byte(dot), 0644); err != nil {
+		return err
+	}
+	ui.Printf("Dependency graph of %s written to %s\n", deviceID, outFile)
+	return nil
+}
@@ -0,0 +1,30 @@
+package cli
+
+import (
+	"espore/builder"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestFormatDependencyTree(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	libs := []*builder.FirmwareLib{
+		{
+			Files: map[string]*builder.FileEntry{
+				"main.lua":     {Path: "main.lua", Dependencies: []string{"net.wifi", "util"}},
+				"net/wifi.lua": {Path: "net/wifi.lua", Dependencies: []string{"util", "net.dhcp"}},
+				"util.lua":     {Path: "util.lua"},
+			},
+		},
+	}
+
+	tree := builder.DependencyTree("main", nil, libs)
+	t.Equals("main\n"+
+		"  net.wifi\n"+
+		"    [red]net.dhcp (not found)[yellow]\n"+
+		"    util\n"+
+		"  util (see above)\n", formatDependencyTree(tree))
+}
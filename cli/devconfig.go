@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"espore/builder"
+	"espore/config"
+	"strings"
+
+	"github.com/rivo/tview"
+)
+
+// codeRunner runs Lua code on the device
+type codeRunner interface {
+	RunCode(luaCode string) error
+}
+
+// runConfigCommand handles "set <key> <value>" and "get <key>", running the
+// config commands of the given firmware. The value may contain spaces.
+func runConfigCommand(runner codeRunner, fwDef *builder.FirmwareDef, p []string) error {
+	switch {
+	case len(p) >= 3 && p[0] == "set":
+		return runner.RunCode(fwDef.GetConfigSetCommand(p[1], strings.Join(p[2:], " ")))
+	case len(p) == 2 && p[0] == "get":
+		return runner.RunCode(fwDef.GetConfigGetCommand(p[1]))
+	}
+	return errors.New("Usage: /config set <key> <value> | /config get <key> | /config show")
+}
+
+// formatBuildConfig renders the build config as indented JSON
+func formatBuildConfig(buildConfig *config.BuildConfig) (string, error) {
+	data, err := json.MarshalIndent(buildConfig, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data) + "\n", nil
+}
+
+// deviceConfig sets or prints a value of the device config store, using the
+// config commands of the connected device firmware, or the default ones if
+// the device is not part of the build. "show" prints the build config instead.
+func (ui *UI) deviceConfig(p []string) error {
+	if len(p) == 1 && p[0] == "show" {
+		text, err := formatBuildConfig(&ui.Config.EsporeConfig.Build)
+		if err != nil {
+			return err
+		}
+		ui.Printf("%s", tview.Escape(text))
+		return nil
+	}
+	var fwDef builder.FirmwareDef
+	if chipID, err := ui.Session.GetChipID(); err == nil {
+		if _, def, err := builder.FindDevice(&ui.Config.EsporeConfig.Build, chipID); err == nil {
+			fwDef = def
+		}
+	}
+	return runConfigCommand(ui.Session, &fwDef, p)
+}
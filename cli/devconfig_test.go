@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"encoding/json"
+	"espore/builder"
+	"espore/config"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestConfigCommand(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	fwDef := &builder.FirmwareDef{
+		ConfigSetCommand: "cfg.set(${KEY}, ${VALUE})",
+		ConfigGetCommand: "print(cfg.get(${KEY}))",
+	}
+	runner := &recordingRunner{}
+	t.Ok(runConfigCommand(runner, fwDef, []string{"set", "ssid", "My", "\"Home\""}))
+	t.Ok(runConfigCommand(runner, fwDef, []string{"get", "ssid"}))
+	t.Equals([]string{
+		`run cfg.set("ssid", "My \"Home\"")`,
+		`run print(cfg.get("ssid"))`,
+	}, runner.calls)
+
+	// the default commands use the config.json store
+	runner = &recordingRunner{}
+	t.Ok(runConfigCommand(runner, &builder.FirmwareDef{}, []string{"set", "name", "kitchen"}))
+	t.Equals("run "+(&builder.FirmwareDef{}).GetConfigSetCommand("name", "kitchen"), runner.calls[0])
+
+	t.Assert(runConfigCommand(runner, fwDef, []string{"get"}) != nil, "Expected a usage error")
+	t.Assert(runConfigCommand(runner, fwDef, []string{"delete", "ssid"}) != nil, "Expected a usage error")
+}
+
+func TestFormatBuildConfig(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	buildConfig := &config.BuildConfig{
+		Libs:          []string{"lib/*"},
+		Devices:       []string{"devices/*"},
+		Output:        "dist",
+		CacheDir:      ".espore-cache",
+		VersionModule: true,
+		SearchPath:    []string{"lua/?.lua"},
+	}
+	text, err := formatBuildConfig(buildConfig)
+	t.Ok(err)
+	t.Assert(strings.Contains(text, `"output": "dist"`), "Expected the output dir in %s", text)
+	t.Assert(strings.Contains(text, `"cacheDir": ".espore-cache"`), "Expected the cache dir in %s", text)
+	t.Assert(strings.Contains(text, `"versionModule": true`), "Expected the version module flag in %s", text)
+
+	var shown config.BuildConfig
+	t.Ok(json.Unmarshal([]byte(text), &shown))
+	t.Equals(*buildConfig, shown)
+}
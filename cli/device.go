@@ -0,0 +1,210 @@
+package cli
+
+import (
+	"errors"
+	"espore/builder"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func (ui *UI) device(deviceID string) error {
+	manifest, err := builder.ReadManifest(filepath.Join(ui.Config.EsporeConfig.Build.Output, deviceID+".json"))
+	if err != nil {
+		return err
+	}
+	ui.Printf("%s", formatDeviceInfo(manifest))
+	return nil
+}
+
+// tag sets a key=value tag on a device, an empty value removes it
+func (ui *UI) tag(deviceID, tag string) error {
+	key, value, err := builder.ParseTag(tag)
+	if err != nil {
+		return err
+	}
+	if err := builder.SetDeviceTag(&ui.Config.EsporeConfig.Build, deviceID, key, value); err != nil {
+		return err
+	}
+	if value == "" {
+		ui.Printf("Removed tag %s from device %s\n", key, deviceID)
+	} else {
+		ui.Printf("Tagged device %s with %s\n", deviceID, tag)
+	}
+	return nil
+}
+
+// devices lists the devices in the build, only those with all the tags given
+// with --tag key=value if any
+func (ui *UI) devices(p []string) error {
+	filter := make(map[string]string)
+	for i := 0; i < len(p); i++ {
+		if p[i] != "--tag" || i+1 == len(p) {
+			return errors.New("Usage: /devices [--tag key=value]...")
+		}
+		i++
+		key, value, err := builder.ParseTag(p[i])
+		if err != nil {
+			return err
+		}
+		filter[key] = value
+	}
+	devices, err := builder.DevicesWithTags(&ui.Config.EsporeConfig.Build, filter)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		ui.Printf("%s\t%s\t%s\n", device.ID, device.Name, formatTags(device.Tags))
+	}
+	ui.Printf("%d devices\n", len(devices))
+	return nil
+}
+
+// formatTags returns the tags as key=value pairs sorted by key
+func formatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for key, value := range tags {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// formatDeviceInfo summarizes the device described by a manifest
+func formatDeviceInfo(manifest *builder.FirmwareManifest) string {
+	var size int64
+	for _, fe := range manifest.Files {
+		size += fe.Size
+	}
+	info := fmt.Sprintf("Name:\t%s\nId:\t%s\nFiles:\t%d\nSize:\t%d bytes\n", manifest.Name, manifest.ID, len(manifest.Files), size)
+	if len(manifest.Tags) > 0 {
+		info += fmt.Sprintf("Tags:\t%s\n", formatTags(manifest.Tags))
+	}
+	return info
+}
+
+func (ui *UI) whoIncludes(path string) error {
+	devices, err := builder.DevicesIncluding(ui.Config.EsporeConfig.Build.Output, path)
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		ui.Printf("No device includes %s\n", path)
+		return nil
+	}
+	ui.Printf("%s is included by %d devices:\n", path, len(devices))
+	for _, device := range devices {
+		ui.Printf("%s\t%s\n", device.ID, device.Name)
+	}
+	return nil
+}
+
+// checkDist verifies the images in the output directory against their
+// manifests and checksums, for all devices or only the given one
+func (ui *UI) checkDist(deviceID string) error {
+	distDir := ui.Config.EsporeConfig.Build.Output
+	var err error
+	if deviceID == "" {
+		err = builder.CheckDist(distDir)
+	} else {
+		err = builder.CheckDevice(distDir, deviceID)
+	}
+	if checkErr, ok := err.(*builder.DistCheckError); ok {
+		ui.Printf("[red]%d problems found in %s:[-]\n", len(checkErr.Problems), distDir)
+		for _, problem := range checkErr.Problems {
+			ui.Printf("%s\n", problem)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ui.Printf("%s is OK\n", distDir)
+	return nil
+}
+
+// lint checks the syntax of the Lua files shipped to the given device, or to
+// the connected one if deviceID is empty
+func (ui *UI) lint(deviceID string) error {
+	if deviceID == "" {
+		chipID, err := ui.Session.GetChipID()
+		if err != nil {
+			return err
+		}
+		deviceID = chipID
+	}
+	syntaxErrors, err := builder.LintDevice(&ui.Config.EsporeConfig.Build, deviceID)
+	if err != nil {
+		return err
+	}
+	if len(syntaxErrors) == 0 {
+		ui.Printf("No syntax errors found in device %s\n", deviceID)
+		return nil
+	}
+	ui.Printf("[red]%d files of device %s fail to parse:[-]\n", len(syntaxErrors), deviceID)
+	for _, syntaxErr := range syntaxErrors {
+		ui.Printf("%s\n", syntaxErr)
+	}
+	return nil
+}
+
+// cost prints the files, and their size, that a module adds to a device
+// beyond those its other modules already pull in
+func (ui *UI) cost(module, deviceID string) error {
+	if deviceID == "" {
+		chipID, err := ui.Session.GetChipID()
+		if err != nil {
+			return err
+		}
+		deviceID = chipID
+	}
+	cost, err := builder.DeviceModuleCost(&ui.Config.EsporeConfig.Build, deviceID, module)
+	if err != nil {
+		return err
+	}
+	ui.Printf("%s", formatModuleCost(cost, deviceID))
+	return nil
+}
+
+// formatModuleCost lists the files a module adds and their total size
+func formatModuleCost(cost *builder.ModuleCost, deviceID string) string {
+	var sb strings.Builder
+	if len(cost.Files) == 0 {
+		fmt.Fprintf(&sb, "Module %s adds nothing to device %s, its files are already included\n", cost.Module, deviceID)
+		return sb.String()
+	}
+	for _, fe := range cost.Files {
+		fmt.Fprintf(&sb, "%8d  %s\n", fe.Size, fe.Path)
+	}
+	fmt.Fprintf(&sb, "Module %s adds %d bytes in %d files to device %s\n", cost.Module, cost.Size, len(cost.Files), deviceID)
+	return sb.String()
+}
+
+// compare prints the differences between the built manifests of two devices
+func (ui *UI) compare(idA, idB string) error {
+	output := ui.Config.EsporeConfig.Build.Output
+	a, err := builder.ReadManifest(filepath.Join(output, idA+".json"))
+	if err != nil {
+		return fmt.Errorf("Cannot read manifest of device %s: %s", idA, err)
+	}
+	b, err := builder.ReadManifest(filepath.Join(output, idB+".json"))
+	if err != nil {
+		return fmt.Errorf("Cannot read manifest of device %s: %s", idB, err)
+	}
+	diff := builder.CompareManifests(a, b)
+	if len(diff.OnlyA)+len(diff.OnlyB)+len(diff.Different) == 0 {
+		ui.Printf("Devices %s and %s ship the same files\n", idA, idB)
+		return nil
+	}
+	for _, path := range diff.OnlyA {
+		ui.Printf("[red]- %s[-]\tonly in %s\n", path, idA)
+	}
+	for _, path := range diff.OnlyB {
+		ui.Printf("[green]+ %s[-]\tonly in %s\n", path, idB)
+	}
+	for _, path := range diff.Different {
+		ui.Printf("[yellow]* %s[-]\tdiffers\n", path)
+	}
+	return nil
+}
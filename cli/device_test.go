@@ -0,0 +1,26 @@
+package cli
+
+import (
+	"espore/builder"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestFormatDeviceInfo(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	manifest, err := builder.ParseManifest([]byte(`{
+	"name": "kitchen",
+	"id": "1234",
+	"manifestVersion": 2,
+	"files": [
+		{"path": "main.lua", "hash": "aaaa", "size": 100},
+		{"path": "index.html", "hash": "bbbb", "size": 24}
+	]
+}`))
+	t.Ok(err)
+
+	t.Equals("Name:\tkitchen\nId:\t1234\nFiles:\t2\nSize:\t124 bytes\n", formatDeviceInfo(manifest))
+}
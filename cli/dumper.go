@@ -1,8 +1,10 @@
 package cli
 
 import (
+	"encoding/hex"
 	"io"
 	"log"
+	"sync"
 
 	"github.com/rivo/tview"
 )
@@ -12,6 +14,21 @@ type Dumper struct {
 	W       io.Writer
 	dumping bool
 	quitC   chan struct{}
+	taps    []io.Writer
+	hex     io.WriteCloser
+	lock    sync.Mutex
+}
+
+// escapeWriter writes to W escaping tview color tags
+type escapeWriter struct {
+	W io.Writer
+}
+
+func (ew escapeWriter) Write(p []byte) (int, error) {
+	if _, err := ew.W.Write([]byte(tview.Escape(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
 }
 
 func (d *Dumper) Dump() {
@@ -27,7 +44,7 @@ func (d *Dumper) Dump() {
 					log.Fatalf("Error reading socket: %s", err)
 				}
 			} else {
-				d.W.Write([]byte(tview.Escape(string(buffer[:i]))))
+				d.write(buffer[:i])
 			}
 		}
 		close(d.quitC)
@@ -35,6 +52,61 @@ func (d *Dumper) Dump() {
 
 }
 
+// write renders device output as escaped text, or as a hex dump if enabled,
+// and copies it to the taps
+func (d *Dumper) write(p []byte) {
+	d.lock.Lock()
+	if d.hex != nil {
+		d.hex.Write(p)
+	} else {
+		d.W.Write([]byte(tview.Escape(string(p))))
+	}
+	d.lock.Unlock()
+	d.writeTaps(p)
+}
+
+// SetHex switches between showing the device output as text and as a
+// canonical hex dump with offsets and an ASCII gutter. Switching back to
+// text flushes the incomplete last line of the dump.
+func (d *Dumper) SetHex(on bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if on && d.hex == nil {
+		d.hex = hex.Dumper(escapeWriter{W: d.W})
+	} else if !on && d.hex != nil {
+		d.hex.Close()
+		d.hex = nil
+	}
+}
+
+// Tap sends a copy of the raw device output to w. Write errors are ignored,
+// so a failing tap does not stop the output.
+func (d *Dumper) Tap(w io.Writer) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.taps = append(d.taps, w)
+}
+
+// Untap stops sending the device output to w
+func (d *Dumper) Untap(w io.Writer) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for i, tap := range d.taps {
+		if tap == w {
+			d.taps = append(d.taps[:i:i], d.taps[i+1:]...)
+			return
+		}
+	}
+}
+
+func (d *Dumper) writeTaps(p []byte) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, tap := range d.taps {
+		tap.Write(p)
+	}
+}
+
 func (d *Dumper) Close() {
 	d.dumping = false
 	<-d.quitC
@@ -0,0 +1,30 @@
+package cli
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestDumperHex(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	var screen bytes.Buffer
+	d := &Dumper{W: &screen}
+
+	d.write([]byte("> "))
+	d.SetHex(true)
+	d.write([]byte("espore\x00\x01\x02\xff"))
+	d.write([]byte("0123456789"))
+	// switching back to text completes the last line of the dump
+	d.SetHex(false)
+	d.write([]byte("\n> "))
+
+	t.Equals("> "+
+		"00000000  65 73 70 6f 72 65 00 01  02 ff 30 31 32 33 34 35  |espore....012345|\n"+
+		"00000010  36 37 38 39                                       |6789|\n"+
+		"\n> ",
+		screen.String())
+}
@@ -26,13 +26,12 @@ func New(config *Config) *escape {
 }
 
 func (esc *escape) Read(p []byte) (int, error) {
-	i, err := esc.buf.Read(p)
-	if i == len(p) || (err != nil && err != io.EOF) {
-		return i, err
+	// return what is buffered first, rather than wait for more input
+	if esc.buf.Len() > 0 {
+		return esc.buf.Read(p)
 	}
-	p = p[i:]
 
-	i, err = esc.Reader.Read(esc.data)
+	i, err := esc.Reader.Read(esc.data)
 	if err != nil && err != io.EOF {
 		return 0, err
 	}
@@ -31,3 +31,27 @@ func TestEscape(tx *testing.T) {
 	t.Equals([]byte{5, 1, 2, 5, 6, 3, 4, 8, 9, 10, 11}, data)
 	t.Assert(seqCount == 3, "Expected sequence count to be 3")
 }
+
+func TestEscapeSmallReads(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	input := bytes.Repeat([]byte("0123456789"), 10)
+	escape := escape.New(&escape.Config{
+		Reader:   bytes.NewReader(input),
+		Sequence: []byte("5"),
+		Callback: func() {},
+	})
+
+	// reads smaller than what the escape reader buffers must not lose data
+	var data []byte
+	buf := make([]byte, 7)
+	for {
+		n, err := escape.Read(buf)
+		data = append(data, buf[:n]...)
+		if err != nil {
+			break
+		}
+	}
+	t.Equals(bytes.Repeat([]byte("012346789"), 10), data)
+}
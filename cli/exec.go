@@ -0,0 +1,34 @@
+package cli
+
+import "fmt"
+
+// execTmpFile is where /exec uploads the script before running it
+const execTmpFile = "__exec.tmp.lua"
+
+// scriptRunner is the part of the session needed to run a script on the device
+type scriptRunner interface {
+	PushFile(srcPath, dstName string) error
+	RunCode(luaCode string) error
+}
+
+// execScript uploads a local script to a temporary file, runs it with dofile
+// and removes it. The script output shows up in the console as the device
+// prints it.
+func execScript(runner scriptRunner, srcPath string) error {
+	if err := runner.PushFile(srcPath, execTmpFile); err != nil {
+		return fmt.Errorf("Error uploading %s: %s", srcPath, err)
+	}
+	runErr := runner.RunCode(fmt.Sprintf(`
+	local ok, err = pcall(dofile, "%s")
+	if not ok then print("Error running script: " .. tostring(err)) end
+	`, execTmpFile))
+	// remove the script even if it could not be started
+	if err := runner.RunCode(fmt.Sprintf(`file.remove("%s")`, execTmpFile)); err != nil && runErr == nil {
+		runErr = err
+	}
+	return runErr
+}
+
+func (ui *UI) exec(srcPath string) error {
+	return execScript(ui.Session, srcPath)
+}
@@ -0,0 +1,45 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+// recordingRunner logs the calls made to it
+type recordingRunner struct {
+	calls    []string
+	pushFail bool
+}
+
+func (rr *recordingRunner) PushFile(srcPath, dstName string) error {
+	rr.calls = append(rr.calls, fmt.Sprintf("push %s %s", srcPath, dstName))
+	if rr.pushFail {
+		return errors.New("device not responding")
+	}
+	return nil
+}
+
+func (rr *recordingRunner) RunCode(luaCode string) error {
+	rr.calls = append(rr.calls, "run "+strings.TrimSpace(luaCode))
+	return nil
+}
+
+func TestExecScript(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	runner := &recordingRunner{}
+	t.Ok(execScript(runner, "snippet.lua"))
+	t.Equals(3, len(runner.calls))
+	t.Equals("push snippet.lua "+execTmpFile, runner.calls[0])
+	t.Assert(strings.Contains(runner.calls[1], `pcall(dofile, "`+execTmpFile+`")`), "Expected the script to be run, got %q", runner.calls[1])
+	t.Equals(`run file.remove("`+execTmpFile+`")`, runner.calls[2])
+
+	runner = &recordingRunner{pushFail: true}
+	t.Assert(execScript(runner, "snippet.lua") != nil, "Expected an upload error")
+	t.Equals(1, len(runner.calls))
+}
@@ -0,0 +1,93 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultExpectTimeout is how long /expect waits when no timeout is given
+const defaultExpectTimeout = 10 * time.Second
+
+// lineMatcher splits the device output into lines and reports the first one
+// matching a pattern. It is meant to be tapped into the Dumper.
+type lineMatcher struct {
+	pattern *regexp.Regexp
+	partial []byte
+	matched chan string
+	lock    sync.Mutex
+}
+
+func newLineMatcher(pattern *regexp.Regexp) *lineMatcher {
+	return &lineMatcher{
+		pattern: pattern,
+		matched: make(chan string, 1),
+	}
+}
+
+func (lm *lineMatcher) Write(p []byte) (int, error) {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	lm.partial = append(lm.partial, p...)
+	for {
+		i := bytes.IndexByte(lm.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimRight(string(lm.partial[:i]), "\r")
+		lm.partial = lm.partial[i+1:]
+		if lm.pattern.MatchString(line) {
+			select {
+			case lm.matched <- line:
+			default:
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// Wait returns the first matching line, or an error if none arrives within
+// timeout
+func (lm *lineMatcher) Wait(timeout time.Duration) (string, error) {
+	select {
+	case line := <-lm.matched:
+		return line, nil
+	case <-time.After(timeout):
+		return "", fmt.Errorf("Timed out after %s waiting for a line matching %q", timeout, lm.pattern)
+	}
+}
+
+// parseExpectTimeout accepts a duration such as 500ms or 1m, or a number of
+// seconds
+func parseExpectTimeout(s string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(s); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	timeout, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid timeout %q", s)
+	}
+	return timeout, nil
+}
+
+// expect blocks until the device prints a line matching pattern. Only output
+// received after the command starts is considered.
+func (ui *UI) expect(pattern string, timeout time.Duration) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	lm := newLineMatcher(re)
+	ui.dumper.Tap(lm)
+	defer ui.dumper.Untap(lm)
+	line, err := lm.Wait(timeout)
+	if err != nil {
+		return err
+	}
+	ui.Printf("Matched: %s\n", line)
+	return nil
+}
@@ -0,0 +1,43 @@
+package cli
+
+import (
+	"io/ioutil"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestExpectLine(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	// the device prints some boot noise, then "ready" split across reads
+	d := &Dumper{W: ioutil.Discard}
+	lm := newLineMatcher(regexp.MustCompile(`^ready( v\d+)?$`))
+	d.Tap(lm)
+	defer d.Untap(lm)
+	go func() {
+		d.write([]byte("booting\r\nalmost ready\r\n"))
+		time.Sleep(50 * time.Millisecond)
+		d.write([]byte("rea"))
+		d.write([]byte("dy v2\r\n"))
+	}()
+	line, err := lm.Wait(5 * time.Second)
+	t.Ok(err)
+	t.Equals("ready v2", line)
+
+	// nothing else matches, so waiting again times out
+	_, err = lm.Wait(50 * time.Millisecond)
+	t.Assert(err != nil, "Expected a timeout")
+
+	timeout, err := parseExpectTimeout("3")
+	t.Ok(err)
+	t.Equals(3*time.Second, timeout)
+	timeout, err = parseExpectTimeout("250ms")
+	t.Ok(err)
+	t.Equals(250*time.Millisecond, timeout)
+	_, err = parseExpectTimeout("soon")
+	t.Assert(err != nil, "Expected an invalid timeout error")
+}
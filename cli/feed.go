@@ -0,0 +1,118 @@
+package cli
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// feedPollInterval is how often a followed file is checked for appends
+const feedPollInterval = 200 * time.Millisecond
+
+// feeder writes the contents of a local file to the device. When following,
+// it keeps waiting for data appended to the file, like tail -f.
+type feeder struct {
+	file   *os.File
+	device io.Writer
+	follow bool
+	quit   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+// newFeeder starts writing the file at path to device. onDone is called with
+// the number of bytes written once the whole file is sent, or the feeder is
+// closed or fails.
+func newFeeder(path string, device io.Writer, follow bool, onDone func(written int64, err error)) (*feeder, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &feeder{
+		file:   file,
+		device: device,
+		follow: follow,
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(f.done)
+		defer file.Close()
+		onDone(f.run())
+	}()
+	return f, nil
+}
+
+func (f *feeder) run() (int64, error) {
+	var written int64
+	buf := make([]byte, 256)
+	for {
+		select {
+		case <-f.quit:
+			return written, nil
+		default:
+		}
+		n, err := f.file.Read(buf)
+		if n > 0 {
+			if _, err := f.device.Write(buf[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		if err == io.EOF {
+			if !f.follow {
+				return written, nil
+			}
+			select {
+			case <-f.quit:
+				return written, nil
+			case <-time.After(feedPollInterval):
+			}
+			continue
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// Close stops feeding and waits for the feeder to finish
+func (f *feeder) Close() {
+	f.once.Do(func() {
+		close(f.quit)
+	})
+	<-f.done
+}
+
+func (ui *UI) feed(p []string) error {
+	if ui.feeder != nil {
+		ui.feeder.Close()
+		ui.feeder = nil
+	}
+	if p[0] == "off" {
+		ui.Printf("Feeding stopped\n")
+		return nil
+	}
+	path, follow := p[0], false
+	if path == "-f" && len(p) > 1 {
+		path, follow = p[1], true
+	}
+	f, err := newFeeder(path, ui.Session, follow, func(written int64, err error) {
+		if err != nil {
+			ui.Printf("[red]Error feeding %s: %s[-]\n", path, err)
+			return
+		}
+		ui.Printf("Fed %d bytes from %s\n", written, path)
+	})
+	if err != nil {
+		return err
+	}
+	ui.feeder = f
+	if follow {
+		ui.Printf("Feeding %s to the device, following appends. /feed off to stop.\n", path)
+	} else {
+		ui.Printf("Feeding %s to the device\n", path)
+	}
+	return nil
+}
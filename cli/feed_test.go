@@ -0,0 +1,52 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestFeeder(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, err := ioutil.TempDir("", "espore-feed")
+	t.Ok(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sensor.txt")
+	t.Ok(ioutil.WriteFile(path, []byte("t=21.5\nt=21.7\n"), 0644))
+
+	// without follow, the feeder stops at EOF
+	device := &syncBuffer{}
+	finished := make(chan int64, 1)
+	_, err = newFeeder(path, device, false, func(written int64, err error) {
+		t.Ok(err)
+		finished <- written
+	})
+	t.Ok(err)
+	t.Equals(int64(14), <-finished)
+	t.Equals("t=21.5\nt=21.7\n", device.String())
+
+	// following, data appended to the file keeps reaching the device
+	device = &syncBuffer{}
+	f, err := newFeeder(path, device, true, func(written int64, err error) {
+		t.Ok(err)
+		finished <- written
+	})
+	t.Ok(err)
+	t.Assert(waitFor(func() bool { return device.String() == "t=21.5\nt=21.7\n" }), "Expected the file contents, got %q", device.String())
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	t.Ok(err)
+	_, err = file.WriteString("t=22.0\n")
+	t.Ok(err)
+	t.Ok(file.Close())
+	t.Assert(waitFor(func() bool { return device.String() == "t=21.5\nt=21.7\nt=22.0\n" }), "Expected the appended line, got %q", device.String())
+	f.Close()
+	t.Equals(int64(21), <-finished)
+
+	_, err = newFeeder(filepath.Join(dir, "missing.txt"), device, false, nil)
+	t.Assert(err != nil, "Expected an error feeding a missing file")
+}
@@ -0,0 +1,72 @@
+package cli
+
+import (
+	"espore/builder"
+	"fmt"
+
+	"github.com/epiclabs-io/winman"
+	"github.com/rivo/tview"
+)
+
+// format erases the device filesystem after asking for confirmation. If a
+// device id is given, the format command configured in its firmware is used.
+func (ui *UI) format(deviceID string) error {
+	command := builder.DefaultFormatCommand
+	if deviceID != "" {
+		_, fwDef, err := builder.FindDevice(&ui.Config.EsporeConfig.Build, deviceID)
+		if err != nil {
+			return err
+		}
+		command = fwDef.GetFormatCommand()
+	}
+
+	ui.confirm("Erase all files on the device?", func(ok bool) {
+		if !ok {
+			ui.Printf("Format cancelled\n")
+			return
+		}
+		ui.commands <- func() {
+			ui.Printf("Formatting device filesystem ... ")
+			if err := ui.Session.Format(command); err != nil {
+				ui.Printf("ERROR: %s\n", err)
+				return
+			}
+			ui.Printf("OK\n")
+		}
+	})
+	return nil
+}
+
+// confirmWithDialog asks the user a yes/no question in a modal window
+func (ui *UI) confirmWithDialog(message string, callback func(ok bool)) {
+	ui.app.QueueUpdateDraw(func() {
+		var wnd winman.Window
+		wnd = confirmDialog(message, func(ok bool) {
+			ui.wm.RemoveWindow(wnd)
+			ui.app.SetFocus(ui.input)
+			callback(ok)
+		})
+		ui.wm.AddWindow(wnd)
+		ui.wm.Center(wnd)
+		ui.app.SetFocus(wnd)
+	})
+}
+
+func confirmDialog(message string, callback func(ok bool)) winman.Window {
+	form := tview.NewForm().
+		AddButton("Yes", func() {
+			callback(true)
+		}).
+		AddButton("No", func() {
+			callback(false)
+		})
+	wnd := winman.NewWindow().
+		SetRoot(form).
+		SetTitle(fmt.Sprintf(" %s ", message)).
+		SetModal(true).
+		SetDraggable(true).
+		Show()
+
+	wnd.SetRect(0, 0, 40, 5)
+	return wnd
+}
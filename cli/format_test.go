@@ -0,0 +1,84 @@
+package cli
+
+import (
+	"bytes"
+	"espore/config"
+	"espore/session"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+)
+
+// fakeDevice acknowledges the format command like a device would
+type fakeDevice struct {
+	*io.PipeReader
+	reply   *io.PipeWriter
+	written bytes.Buffer
+	lock    sync.Mutex
+}
+
+func newFakeDevice() *fakeDevice {
+	r, w := io.Pipe()
+	return &fakeDevice{PipeReader: r, reply: w}
+}
+
+func (fd *fakeDevice) Write(p []byte) (int, error) {
+	fd.lock.Lock()
+	fd.written.Write(p)
+	fd.lock.Unlock()
+	if bytes.Contains(p, []byte("'_DONE'")) {
+		go fd.reply.Write([]byte("FORMAT_DONE\r\n"))
+	}
+	return len(p), nil
+}
+
+func (fd *fakeDevice) Written() string {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	return fd.written.String()
+}
+
+func TestFormatRequiresConfirmation(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	device := newFakeDevice()
+	s, err := session.New(&session.Config{Socket: device})
+	t.Ok(err)
+
+	var answer bool
+	var asked int
+	ui := &UI{
+		Config: Config{
+			Session:      s,
+			EsporeConfig: &config.EsporeConfig{},
+		},
+		transcript: newTranscript(ioutil.Discard, 100),
+		commands:   make(chan func(), 10),
+		confirm: func(message string, callback func(bool)) {
+			asked++
+			callback(answer)
+		},
+	}
+
+	t.Ok(ui.format(""))
+	t.Equals(1, asked)
+	t.Equals(0, len(ui.commands))
+
+	answer = true
+	t.Ok(ui.format(""))
+	t.Equals(2, asked)
+	t.Equals(1, len(ui.commands))
+	(<-ui.commands)()
+
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(device.Written(), "file.format()") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Assert(strings.Contains(device.Written(), "file.format()"), "Expected format command to be sent, got %q", device.Written())
+}
@@ -0,0 +1,139 @@
+package cli
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// forwardRetryInterval is the pause between attempts to reach the remote
+const forwardRetryInterval = 2 * time.Second
+
+// forwardWriteTimeout bounds how long a stalled remote is waited for before
+// the connection is dropped and dialed again
+const forwardWriteTimeout = time.Second
+
+// forwardQueueSize is the number of writes held for a slow remote before
+// further output is discarded
+const forwardQueueSize = 256
+
+// forwarder writes the device output to a TCP address, reconnecting in the
+// background when the connection drops. Writes are queued and sent from the
+// background, so a slow remote never holds the output: output produced while
+// disconnected or while the queue is full is discarded.
+type forwarder struct {
+	addr  string
+	conn  net.Conn
+	queue chan []byte
+	quit  chan struct{}
+	lock  sync.Mutex
+}
+
+func newForwarder(addr string) *forwarder {
+	f := &forwarder{
+		addr:  addr,
+		queue: make(chan []byte, forwardQueueSize),
+		quit:  make(chan struct{}),
+	}
+	go f.connect()
+	return f
+}
+
+// connect keeps the connection up and sends the queued output until the
+// forwarder is closed
+func (f *forwarder) connect() {
+	for {
+		conn, err := net.DialTimeout("tcp", f.addr, forwardRetryInterval)
+		if err != nil {
+			select {
+			case <-f.quit:
+				return
+			case <-time.After(forwardRetryInterval):
+				continue
+			}
+		}
+		f.lock.Lock()
+		select {
+		case <-f.quit:
+			f.lock.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		f.conn = conn
+		f.lock.Unlock()
+		if !f.send(conn) {
+			return
+		}
+	}
+}
+
+// send writes the queued output to conn until a write fails, returning true,
+// or the forwarder is closed, returning false
+func (f *forwarder) send(conn net.Conn) bool {
+	for {
+		select {
+		case <-f.quit:
+			return false
+		case p := <-f.queue:
+			conn.SetWriteDeadline(time.Now().Add(forwardWriteTimeout))
+			if _, err := conn.Write(p); err == nil {
+				continue
+			}
+		}
+		f.lock.Lock()
+		conn.Close()
+		if f.conn == conn {
+			f.conn = nil
+		}
+		f.lock.Unlock()
+		return true
+	}
+}
+
+// Connected returns whether the remote is currently reachable
+func (f *forwarder) Connected() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.conn != nil
+}
+
+// Write queues a copy of p for the remote without waiting for it to be sent
+func (f *forwarder) Write(p []byte) (int, error) {
+	if !f.Connected() {
+		return len(p), nil
+	}
+	select {
+	case f.queue <- append([]byte(nil), p...):
+	default:
+	}
+	return len(p), nil
+}
+
+// Close stops forwarding and closes the connection
+func (f *forwarder) Close() {
+	close(f.quit)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.conn != nil {
+		f.conn.Close()
+		f.conn = nil
+	}
+}
+
+// forward starts sending the device output to addr, replacing any previous
+// forwarding. "off" stops forwarding.
+func (ui *UI) forward(addr string) {
+	if ui.forwarder != nil {
+		ui.dumper.Untap(ui.forwarder)
+		ui.forwarder.Close()
+		ui.forwarder = nil
+	}
+	if addr == "off" {
+		ui.Printf("Output forwarding stopped\n")
+		return
+	}
+	ui.forwarder = newForwarder(addr)
+	ui.dumper.Tap(ui.forwarder)
+	ui.Printf("Forwarding device output to %s\n", addr)
+}
@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+)
+
+// waitFor polls cond until it returns true or a few seconds pass
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func TestForwardOutput(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	t.Ok(err)
+	defer listener.Close()
+
+	f := newForwarder(listener.Addr().String())
+	defer f.Close()
+	remote, err := listener.Accept()
+	t.Ok(err)
+	t.Assert(waitFor(f.Connected), "Expected the forwarder to connect")
+
+	device, deviceOutput := io.Pipe()
+	d := &Dumper{R: device, W: ioutil.Discard}
+	d.Tap(f)
+	d.Dump()
+
+	deviceOutput.Write([]byte("[boot] hello\n"))
+	buf := make([]byte, 64)
+	n, err := io.ReadAtLeast(remote, buf, len("[boot] hello\n"))
+	t.Ok(err)
+	t.Equals("[boot] hello\n", string(buf[:n]))
+
+	// the remote drops, the forwarder reconnects
+	remote.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	var reconnected net.Conn
+	t.Assert(waitFor(func() bool {
+		deviceOutput.Write([]byte("tick\n"))
+		select {
+		case reconnected = <-accepted:
+			return true
+		default:
+			return false
+		}
+	}), "Expected the forwarder to reconnect")
+	defer reconnected.Close()
+	t.Assert(waitFor(f.Connected), "Expected the forwarder to be connected again")
+
+	deviceOutput.Write([]byte("again\n"))
+	var received string
+	t.Assert(waitFor(func() bool {
+		reconnected.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		n, _ := reconnected.Read(buf)
+		received += string(buf[:n])
+		return len(received) >= len("again\n") && received[len(received)-len("again\n"):] == "again\n"
+	}), "Expected output after reconnecting, got %q", received)
+
+	d.Untap(f)
+}
+
+func TestForwardSlowRemote(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	t.Ok(err)
+	defer listener.Close()
+
+	f := newForwarder(listener.Addr().String())
+	defer f.Close()
+	remote, err := listener.Accept()
+	t.Ok(err)
+	defer remote.Close()
+	t.Assert(waitFor(f.Connected), "Expected the forwarder to connect")
+
+	// the remote never reads: once the socket buffers fill, the output is
+	// discarded instead of waiting for the remote
+	chunk := make([]byte, 64*1024)
+	start := time.Now()
+	for i := 0; i < 2*forwardQueueSize; i++ {
+		n, err := f.Write(chunk)
+		t.Ok(err)
+		t.Equals(len(chunk), n)
+	}
+	t.Assert(time.Since(start) < forwardWriteTimeout, "Expected writes not to wait for the remote, took %s", time.Since(start))
+}
@@ -11,6 +11,10 @@ type Config struct {
 	// OnAppend is called every time a new history line must be persisted
 	OnAppend func(line string)
 
+	// OnRewrite is called with the remaining lines when history is
+	// forgotten, so the persisted copy can be replaced
+	OnRewrite func(lines []string)
+
 	// Limit indicates how many lines of history to keep
 	Limit int
 }
@@ -61,6 +65,27 @@ func (h *History) Append(line string) {
 	h.pos = len(h.lines)
 }
 
+// Forget removes the last n lines of the history, or all of it if n <= 0
+func (h *History) Forget(n int) {
+	if n <= 0 || n > len(h.lines) {
+		n = len(h.lines)
+	}
+	h.lines = h.lines[:len(h.lines)-n]
+	h.pos = len(h.lines)
+	if h.OnRewrite != nil {
+		h.OnRewrite(h.lines)
+	}
+}
+
+// Last returns the most recent line in the history, or an empty string if
+// the history is empty
+func (h *History) Last() string {
+	if len(h.lines) == 0 {
+		return ""
+	}
+	return h.lines[len(h.lines)-1]
+}
+
 // Current returns the currently selected item in the history
 func (h *History) Current() string {
 	if h.pos >= len(h.lines) || h.pos < 0 {
@@ -126,3 +126,42 @@ func TestHistory(tx *testing.T) {
 	t.Ok(err)
 
 }
+
+func TestHistoryForget(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	var persisted []string
+	h, err := history.New(bytes.NewBufferString("line1\nline2\nline3\n"), &history.Config{
+		Limit: 10,
+		OnAppend: func(line string) {
+			persisted = append(persisted, line)
+		},
+		OnRewrite: func(lines []string) {
+			persisted = append([]string{}, lines...)
+		},
+	})
+	t.Ok(err)
+	h.Append("/wifi secret")
+	t.Equals(4, h.Len())
+
+	// forgetting the last entry removes it from memory and from disk
+	h.Forget(1)
+	t.Equals(3, h.Len())
+	t.Equals([]string{"line1", "line2", "line3"}, persisted)
+	t.Equals("line3", h.Up())
+
+	t.Equals("line3", h.Last())
+
+	// forgetting everything leaves an empty history
+	h.Forget(0)
+	t.Equals(0, h.Len())
+	t.Equals([]string{}, persisted)
+	t.Equals("", h.Up())
+	t.Equals("", h.Last())
+
+	// asking for more than what is there clears it too
+	h.Append("line4")
+	h.Forget(5)
+	t.Equals(0, h.Len())
+}
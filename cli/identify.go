@@ -0,0 +1,121 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"espore/builder"
+	"espore/session"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// identifyLua reports the device id along with the generated version module
+// and the embedded manifest, when the firmware ships them
+const identifyLua = `local id = {chipid = ` + session.DeviceIDLua + `}
+local ok, version = pcall(require, "version")
+if ok and type(version) == "table" then id.version = version end
+if file.exists("files.json") then
+	local f, parts = file.open("files.json"), {}
+	while true do
+		local s = f:read()
+		if not s then break end
+		parts[#parts + 1] = s
+	end
+	f:close()
+	id.files = table.concat(parts)
+end
+return id`
+
+// deviceIdentity is what a device reports about itself and its firmware
+type deviceIdentity struct {
+	ChipID  string `json:"chipid"`
+	Version *struct {
+		ID       string `json:"id"`
+		Name     string `json:"name"`
+		Checksum string `json:"checksum"`
+		BuiltAt  string `json:"builtAt"`
+		Revision string `json:"revision"`
+	} `json:"version"`
+	// Files is the content of the embedded manifest
+	Files string `json:"files"`
+}
+
+// compareIdentity checks what a device reports against the local build of
+// that device, which is nil if there is none. It returns a line per finding
+// and whether the device runs the local build.
+func compareIdentity(id *deviceIdentity, manifest *builder.FirmwareManifest) ([]string, bool) {
+	report := []string{fmt.Sprintf("Chip id: %s", id.ChipID)}
+	if id.Version != nil {
+		v := id.Version
+		report = append(report, fmt.Sprintf("Firmware: id %s, name %s, checksum %s, built at %s, revision %s", v.ID, v.Name, v.Checksum, v.BuiltAt, v.Revision))
+		if v.ID != "" && v.ID != id.ChipID {
+			return append(report, fmt.Sprintf("Device runs the firmware of device %s", v.ID)), false
+		}
+	}
+	if manifest == nil {
+		return append(report, fmt.Sprintf("No local build for device %s", id.ChipID)), false
+	}
+	report = append(report, fmt.Sprintf("Local build: name %s, checksum %s", manifest.Name, builder.FirmwareChecksum(manifest)))
+
+	switch {
+	case id.Version != nil:
+		if id.Version.Checksum != builder.FirmwareChecksum(manifest) {
+			return append(report, "Checksum differs from the local build"), false
+		}
+		return report, true
+	case id.Files != "":
+		var hashes map[string]string
+		if err := json.Unmarshal([]byte(id.Files), &hashes); err != nil {
+			return append(report, "Cannot decode the embedded manifest"), false
+		}
+		var differing int
+		local := make(map[string]bool)
+		for _, fe := range manifest.Files {
+			if fe.Path == builder.EmbeddedManifestName {
+				continue
+			}
+			local[fe.Path] = true
+			if hashes[fe.Path] != fe.Hash {
+				differing++
+			}
+		}
+		for path := range hashes {
+			if !local[path] {
+				differing++
+			}
+		}
+		if differing > 0 {
+			return append(report, fmt.Sprintf("%d files differ from the local build", differing)), false
+		}
+		return report, true
+	}
+	return append(report, "Device reports no firmware version, build with versionModule or embedManifest"), false
+}
+
+// identify reads the firmware identity of the connected device and compares
+// it with the local build
+func (ui *UI) identify() error {
+	response, err := ui.Session.Rpc(identifyLua)
+	if err != nil {
+		return err
+	}
+	var id deviceIdentity
+	if err := json.Unmarshal(response, &id); err != nil || id.ChipID == "" {
+		return errors.New("Error decoding device identity")
+	}
+	manifest, err := builder.ReadManifest(filepath.Join(ui.Config.EsporeConfig.Build.Output, id.ChipID+".json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	report, match := compareIdentity(&id, manifest)
+	for _, line := range report {
+		ui.Printf("%s\n", line)
+	}
+	if match {
+		ui.Printf("[green]Device firmware matches the local build[-]\n")
+	} else {
+		ui.Printf("[red]Device firmware does not match the local build[-]\n")
+	}
+	return nil
+}
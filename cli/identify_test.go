@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"encoding/json"
+	"espore/builder"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestCompareIdentity(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	manifest := &builder.FirmwareManifest{
+		DeviceInfo: builder.DeviceInfo{ID: "1111", Name: "kitchen"},
+		Files: []*builder.FileEntry{
+			{Path: "main.lua", Hash: "aaa"},
+			{Path: "data.txt", Hash: "bbb"},
+			{Path: builder.VersionFileName, Hash: "ccc"},
+		},
+	}
+	reported := func(response string) *deviceIdentity {
+		var id deviceIdentity
+		t.Ok(json.Unmarshal([]byte(response), &id))
+		return &id
+	}
+	last := func(report []string) string {
+		return report[len(report)-1]
+	}
+
+	// the device runs the local build
+	checksum := builder.FirmwareChecksum(manifest)
+	report, match := compareIdentity(reported(`{"chipid":"1111","version":{"id":"1111","name":"kitchen","checksum":"`+checksum+`"}}`), manifest)
+	t.Assert(match, "Expected the identities to match, got %v", report)
+	t.Assert(strings.Contains(report[1], "checksum "+checksum), "Expected the reported checksum, got %q", report[1])
+
+	// the device runs an older build
+	report, match = compareIdentity(reported(`{"chipid":"1111","version":{"id":"1111","name":"kitchen","checksum":"old"}}`), manifest)
+	t.Assert(!match, "Expected a checksum mismatch")
+	t.Equals("Checksum differs from the local build", last(report))
+
+	// the device runs the firmware of another board
+	report, match = compareIdentity(reported(`{"chipid":"1111","version":{"id":"2222","name":"garage","checksum":"`+checksum+`"}}`), manifest)
+	t.Assert(!match, "Expected a device id mismatch")
+	t.Equals("Device runs the firmware of device 2222", last(report))
+
+	// without a version module, the embedded manifest is compared
+	report, match = compareIdentity(reported(`{"chipid":"1111","files":"{\"main.lua\":\"aaa\",\"data.txt\":\"bbb\",\"version.lua\":\"ccc\"}"}`), manifest)
+	t.Assert(match, "Expected the embedded manifest to match, got %v", report)
+	report, match = compareIdentity(reported(`{"chipid":"1111","files":"{\"main.lua\":\"zzz\",\"data.txt\":\"bbb\",\"old.lua\":\"ddd\"}"}`), manifest)
+	t.Assert(!match, "Expected the embedded manifest to differ")
+	t.Equals("3 files differ from the local build", last(report))
+
+	report, match = compareIdentity(reported(`{"chipid":"1111"}`), manifest)
+	t.Assert(!match, "Expected a device without version information not to match")
+
+	report, match = compareIdentity(reported(`{"chipid":"3333"}`), nil)
+	t.Assert(!match, "Expected no match without a local build")
+	t.Equals("No local build for device 3333", last(report))
+}
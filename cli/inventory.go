@@ -0,0 +1,35 @@
+package cli
+
+import (
+	"bytes"
+	"espore/builder"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// inventory writes a summary of every device built in the output directory,
+// as CSV if outFile ends in .csv and as JSON otherwise
+func (ui *UI) inventory(outFile string) error {
+	rows, err := builder.Inventory(ui.Config.EsporeConfig.Build.Output)
+	if err != nil {
+		return err
+	}
+	if outFile == "" {
+		outFile = "inventory.json"
+	}
+	var buf bytes.Buffer
+	if strings.EqualFold(filepath.Ext(outFile), ".csv") {
+		err = builder.WriteInventoryCSV(&buf, rows)
+	} else {
+		err = builder.WriteInventoryJSON(&buf, rows)
+	}
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(outFile, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	ui.Printf("Inventory of %d devices written to %s\n", len(rows), outFile)
+	return nil
+}
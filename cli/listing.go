@@ -0,0 +1,100 @@
+package cli
+
+import (
+	"espore/session/fileman"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// listingRow is one line of a directory listing. Directories are
+// collapsed into a single row that adds up the files under them.
+type listingRow struct {
+	Name  string
+	Size  int
+	Files int
+	Dir   bool
+}
+
+// cleanListingPath turns a user-supplied path into the prefix files in it
+// share on the device: no leading slash and, unless it is the root, a
+// trailing one.
+func cleanListingPath(path string) string {
+	path = strings.Trim(path, "/")
+	if path == "" || path == "." {
+		return ""
+	}
+	return path + "/"
+}
+
+// listingRows groups the device files under dir. The device filesystem is
+// flat, so directories are inferred from '/' separators in file names.
+func listingRows(entries []fileman.FileEntry, dir string) []listingRow {
+	var rows []listingRow
+	dirs := make(map[string]int)
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name, dir) {
+			continue
+		}
+		rel := entry.Name[len(dir):]
+		if i := strings.Index(rel, "/"); i >= 0 {
+			name := rel[:i+1]
+			idx, ok := dirs[name]
+			if !ok {
+				idx = len(rows)
+				dirs[name] = idx
+				rows = append(rows, listingRow{Name: name, Dir: true})
+			}
+			rows[idx].Size += entry.Size
+			rows[idx].Files++
+			continue
+		}
+		rows = append(rows, listingRow{Name: rel, Size: entry.Size, Files: 1})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Dir != rows[j].Dir {
+			return rows[i].Dir
+		}
+		return rows[i].Name < rows[j].Name
+	})
+	return rows
+}
+
+// formatListing renders the files under dir as an aligned table with a
+// totals line at the end
+func formatListing(entries []fileman.FileEntry, dir string) string {
+	rows := listingRows(entries, dir)
+	if len(rows) == 0 {
+		if dir == "" {
+			return "No files on device\n"
+		}
+		return fmt.Sprintf("No files under /%s\n", dir)
+	}
+
+	nameWidth := len("Name")
+	sizeWidth := len("Size")
+	sizes := make([]string, len(rows))
+	var totalSize, totalFiles int
+	for i, row := range rows {
+		sizes[i] = fmt.Sprintf("%d", row.Size)
+		if row.Dir {
+			sizes[i] = fmt.Sprintf("%d (%d files)", row.Size, row.Files)
+		}
+		if len(row.Name) > nameWidth {
+			nameWidth = len(row.Name)
+		}
+		if len(sizes[i]) > sizeWidth {
+			sizeWidth = len(sizes[i])
+		}
+		totalSize += row.Size
+		totalFiles += row.Files
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%-*s  %*s\n", nameWidth, "Name", sizeWidth, "Size")
+	for i, row := range rows {
+		fmt.Fprintf(&sb, "%-*s  %*s\n", nameWidth, row.Name, sizeWidth, sizes[i])
+	}
+	fmt.Fprintf(&sb, "%d files, %d bytes in /%s\n", totalFiles, totalSize, dir)
+	return sb.String()
+}
@@ -0,0 +1,41 @@
+package cli
+
+import (
+	"espore/session/fileman"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+// listingRpc answers file.list() with a canned device response
+type listingRpc string
+
+func (r listingRpc) Rpc(luaCode string) ([]byte, error) {
+	return []byte(r), nil
+}
+
+func TestFormatListing(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	fm := fileman.New(listingRpc(`{"init.lua":512,"lib/json.lc":2048,"lib/util/str.lc":100,"www/index.html":1500,"config.json":40}`))
+	list, err := fm.List()
+	t.Ok(err)
+
+	t.Equals(""+
+		"Name                   Size\n"+
+		"lib/         2148 (2 files)\n"+
+		"www/         1500 (1 files)\n"+
+		"config.json              40\n"+
+		"init.lua                512\n"+
+		"5 files, 4200 bytes in /\n", formatListing(list, cleanListingPath("")))
+
+	t.Equals(""+
+		"Name              Size\n"+
+		"util/    100 (1 files)\n"+
+		"json.lc           2048\n"+
+		"2 files, 2148 bytes in /lib/\n", formatListing(list, cleanListingPath("/lib")))
+
+	t.Equals("No files under /nope/\n", formatListing(list, cleanListingPath("nope/")))
+	t.Equals("No files on device\n", formatListing(nil, ""))
+}
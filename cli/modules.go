@@ -0,0 +1,94 @@
+package cli
+
+import (
+	"errors"
+	"espore/builder"
+	"fmt"
+	"path/filepath"
+
+	"github.com/epiclabs-io/winman"
+	"github.com/rivo/tview"
+)
+
+// modules lets the user pick the modules a device starts and builds an
+// ad-hoc image with the selection
+func (ui *UI) modules(deviceID string) error {
+	if deviceID == "" {
+		chipID, err := ui.Session.GetChipID()
+		if err != nil {
+			return err
+		}
+		deviceID = chipID
+	}
+	config := &ui.Config.EsporeConfig.Build
+	selection, err := builder.DeviceModuleSelection(config, deviceID)
+	if err != nil {
+		return err
+	}
+	if len(selection.Available) == 0 {
+		return fmt.Errorf("No modules available for device %s", deviceID)
+	}
+
+	result := make(chan []string, 1)
+	ui.app.QueueUpdateDraw(func() {
+		var wnd winman.Window
+		wnd = modulesDialog(deviceID, selection, func(modules []string) {
+			ui.wm.RemoveWindow(wnd)
+			ui.app.SetFocus(ui.input)
+			result <- modules
+		})
+		ui.wm.AddWindow(wnd)
+		ui.wm.Center(wnd)
+		ui.app.SetFocus(wnd)
+	})
+	modules := <-result
+	if modules == nil {
+		return errors.New("Module selection cancelled")
+	}
+
+	manifest, err := builder.BuildModuleSelection(config, deviceID, modules)
+	if err != nil {
+		return err
+	}
+	ui.Printf("Built %d files for %s starting %d modules into %s\n", len(manifest.Files), deviceID, len(modules),
+		filepath.Join(config.Output, builder.SelectionDir, deviceID+".img"))
+	return nil
+}
+
+// modulesDialog shows a checkbox per available module. callback receives the
+// checked modules, in the order they are listed, or nil if cancelled.
+func modulesDialog(deviceID string, selection *builder.ModuleSelection, callback func(modules []string)) winman.Window {
+	checked := make(map[string]bool, len(selection.Selected))
+	for _, module := range selection.Selected {
+		checked[module] = true
+	}
+	form := tview.NewForm()
+	for _, module := range selection.Available {
+		module := module
+		form.AddCheckbox(module, checked[module], func(on bool) {
+			checked[module] = on
+		})
+	}
+	form.
+		AddButton("Build", func() {
+			modules := []string{}
+			for _, module := range selection.Available {
+				if checked[module] {
+					modules = append(modules, module)
+				}
+			}
+			callback(modules)
+		}).
+		AddButton("Cancel", func() {
+			callback(nil)
+		})
+	wnd := winman.NewWindow().
+		SetRoot(form).
+		SetTitle(fmt.Sprintf(" Modules of %s ", deviceID)).
+		SetModal(true).
+		SetDraggable(true).
+		Show()
+
+	wnd.SetRect(0, 0, 50, len(selection.Available)*2+5)
+	return wnd
+}
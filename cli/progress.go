@@ -0,0 +1,61 @@
+package cli
+
+import (
+	"espore/cli/syncer"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// progressInterval is how often the transfer rate is printed during a push
+const progressInterval = time.Second
+
+// progressDisplay prints the transfer rate and ETA of the files being pushed,
+// averaging the rate across consecutive files
+type progressDisplay struct {
+	printf     func(format string, a ...interface{})
+	throughput *syncer.Throughput
+	file       string
+	received   int64
+	shown      time.Time
+	lock       sync.Mutex
+}
+
+func newProgressDisplay(printf func(format string, a ...interface{})) *progressDisplay {
+	return &progressDisplay{
+		printf:     printf,
+		throughput: syncer.NewThroughput(5 * time.Second),
+	}
+}
+
+// Update records the bytes acknowledged by the device for a file and prints
+// the progress if enough time passed since it was last shown
+func (pd *progressDisplay) Update(dstName string, received, size int64) {
+	pd.lock.Lock()
+	defer pd.lock.Unlock()
+	now := time.Now()
+	if dstName != pd.file || received < pd.received {
+		pd.file = dstName
+		pd.received = 0
+	}
+	pd.throughput.Add(now, received-pd.received)
+	pd.received = received
+	if now.Sub(pd.shown) < progressInterval {
+		return
+	}
+	pd.shown = now
+	rate := pd.throughput.Rate()
+	if rate <= 0 || size <= 0 {
+		return
+	}
+	eta, _ := pd.throughput.ETA(size - received)
+	pd.printf("\n%s: %d%% %.1f KB/s ETA %s ", dstName, received*100/size, rate/1024, formatETA(eta))
+}
+
+func formatETA(eta time.Duration) string {
+	eta = eta.Round(time.Second)
+	if eta < time.Minute {
+		return fmt.Sprintf("%ds", int(eta.Seconds()))
+	}
+	return fmt.Sprintf("%dm%02ds", int(eta.Minutes()), int(eta.Seconds())%60)
+}
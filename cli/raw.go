@@ -0,0 +1,147 @@
+package cli
+
+import (
+	"espore/cli/escape"
+	"io"
+	"sync"
+
+	"github.com/gdamore/tcell"
+)
+
+// rawEscapeSequence leaves raw mode (Ctrl+])
+var rawEscapeSequence = []byte{byte(tcell.KeyCtrlRightSq)}
+
+// rawMode forwards keystrokes verbatim to the device until the escape
+// sequence is typed
+type rawMode struct {
+	device io.Writer
+	onExit func()
+	keys   *io.PipeWriter
+	active bool
+	// pending holds the keystrokes not yet written to keys, so a slow
+	// device never blocks the UI goroutine calling HandleKey
+	pending []byte
+	wake    chan struct{}
+	lock    sync.Mutex
+}
+
+// newRawMode starts forwarding keystrokes to device. onExit is called once
+// the escape sequence is typed.
+func newRawMode(device io.Writer, onExit func()) *rawMode {
+	r, w := io.Pipe()
+	rm := &rawMode{
+		device: device,
+		onExit: onExit,
+		keys:   w,
+		active: true,
+		wake:   make(chan struct{}, 1),
+	}
+	keys := escape.New(&escape.Config{
+		Reader:   r,
+		Sequence: rawEscapeSequence,
+		Callback: rm.exit,
+	})
+
+	go rm.writeKeys()
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := keys.Read(buf)
+			if n > 0 {
+				rm.device.Write(buf[:n])
+			}
+			if err != nil || !rm.Active() {
+				return
+			}
+		}
+	}()
+	return rm
+}
+
+// Active returns whether keystrokes are still being forwarded
+func (rm *rawMode) Active() bool {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+	return rm.active
+}
+
+func (rm *rawMode) exit() {
+	rm.lock.Lock()
+	rm.active = false
+	rm.pending = nil
+	rm.lock.Unlock()
+	rm.keys.Close()
+	rm.notify()
+	rm.onExit()
+}
+
+func (rm *rawMode) notify() {
+	select {
+	case rm.wake <- struct{}{}:
+	default:
+	}
+}
+
+// writeKeys feeds the pending keystrokes to keys until raw mode ends
+func (rm *rawMode) writeKeys() {
+	for range rm.wake {
+		rm.lock.Lock()
+		data, active := rm.pending, rm.active
+		rm.pending = nil
+		rm.lock.Unlock()
+		if !active {
+			return
+		}
+		if len(data) > 0 {
+			rm.keys.Write(data)
+		}
+	}
+}
+
+// HandleKey captures a key event, queueing the bytes it produces for the
+// device
+func (rm *rawMode) HandleKey(event *tcell.EventKey) *tcell.EventKey {
+	data := keyBytes(event)
+	if data == nil {
+		return nil
+	}
+	rm.lock.Lock()
+	active := rm.active
+	if active {
+		rm.pending = append(rm.pending, data...)
+	}
+	rm.lock.Unlock()
+	if active {
+		rm.notify()
+	}
+	return nil
+}
+
+// keyBytes returns what a terminal would send for the given key, or nil for
+// keys with no single-byte encoding such as arrows
+func keyBytes(event *tcell.EventKey) []byte {
+	switch key := event.Key(); {
+	case key == tcell.KeyRune:
+		return []byte(string(event.Rune()))
+	case key == tcell.KeyEnter:
+		return []byte("\n")
+	case key < 128:
+		return []byte{byte(key)}
+	}
+	return nil
+}
+
+// raw switches the input to raw mode, sending every keystroke to the device
+// until Ctrl+] is pressed
+func (ui *UI) raw() {
+	ui.Printf("Entering raw mode. Press Ctrl+] to leave.\n")
+	ui.app.QueueUpdate(func() {
+		rm := newRawMode(ui.Session, func() {
+			ui.app.QueueUpdate(func() {
+				ui.app.SetInputCapture(ui.handleGlobalKeys)
+			})
+			ui.Printf("\nLeft raw mode\n")
+		})
+		ui.app.SetInputCapture(rm.HandleKey)
+	})
+}
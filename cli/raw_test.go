@@ -0,0 +1,106 @@
+package cli
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+	"github.com/gdamore/tcell"
+)
+
+type syncBuffer struct {
+	buf  bytes.Buffer
+	lock sync.Mutex
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	return sb.buf.String()
+}
+
+func TestRawMode(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	device := &syncBuffer{}
+	exited := make(chan struct{})
+	rm := newRawMode(device, func() {
+		close(exited)
+	})
+	t.Assert(rm.Active(), "Expected raw mode to be active")
+
+	keys := []*tcell.EventKey{
+		tcell.NewEventKey(tcell.KeyRune, 'p', tcell.ModNone),
+		tcell.NewEventKey(tcell.KeyRune, '=', tcell.ModNone),
+		tcell.NewEventKey(tcell.KeyRune, '1', tcell.ModNone),
+		tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone),
+		tcell.NewEventKey(tcell.KeyUp, 0, tcell.ModNone),
+		tcell.NewEventKey(tcell.KeyCtrlC, 0, tcell.ModNone),
+	}
+	for _, key := range keys {
+		t.Assert(rm.HandleKey(key) == nil, "Expected keys to be captured")
+	}
+
+	rm.HandleKey(tcell.NewEventKey(tcell.KeyCtrlRightSq, 0, tcell.ModNone))
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Assert(false, "Expected escape sequence to leave raw mode")
+	}
+	t.Assert(!rm.Active(), "Expected raw mode to be inactive")
+	t.Equals("p=1\n\x03", device.String())
+
+	// keys typed after leaving are no longer forwarded
+	rm.HandleKey(tcell.NewEventKey(tcell.KeyRune, 'x', tcell.ModNone))
+	t.Equals("p=1\n\x03", device.String())
+}
+
+// blockedWriter holds every write until released
+type blockedWriter struct {
+	release chan struct{}
+	syncBuffer
+}
+
+func (bw *blockedWriter) Write(p []byte) (int, error) {
+	<-bw.release
+	return bw.syncBuffer.Write(p)
+}
+
+func TestRawModeSlowDevice(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	device := &blockedWriter{release: make(chan struct{})}
+	rm := newRawMode(device, func() {})
+
+	typed := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			rm.HandleKey(tcell.NewEventKey(tcell.KeyRune, rune('a'+i%26), tcell.ModNone))
+		}
+		close(typed)
+	}()
+	select {
+	case <-typed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected keys to be queued while the device is busy")
+	}
+
+	close(device.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(device.String()) < 1000 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	t.Equals(1000, len(device.String()))
+	t.Equals("abcdefghijklmnopqrstuvwxyzabc", device.String()[:29])
+	rm.HandleKey(tcell.NewEventKey(tcell.KeyCtrlRightSq, 0, tcell.ModNone))
+}
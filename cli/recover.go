@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"espore/builder"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// bootLoopRepeats is how many times the boot pattern must show up in a row
+// before the device is considered to be boot-looping
+const bootLoopRepeats = 3
+
+// bootLoopTimeout is how long /recover waits for each boot
+const bootLoopTimeout = 30 * time.Second
+
+// commandSender sends a line of Lua code to the device without waiting for
+// its result, which works while the device is still booting
+type commandSender interface {
+	SendCommand(cmd string) error
+}
+
+// breakBootLoop waits for lm to match repeats times, each within timeout, then
+// sends command right after the last boot banner
+func breakBootLoop(lm *lineMatcher, sender commandSender, command string, repeats int, timeout time.Duration) error {
+	for i := 0; i < repeats; i++ {
+		if _, err := lm.Wait(timeout); err != nil {
+			return fmt.Errorf("No boot loop detected after %d boots: %s", i, err)
+		}
+	}
+	return sender.SendCommand(command)
+}
+
+// recover detects a device boot loop and sends the recover command of its
+// firmware to break it. The device can't be asked for its id while looping,
+// so the firmware is looked up by deviceID, using the defaults if empty.
+func (ui *UI) recover(deviceID string) error {
+	var fwDef builder.FirmwareDef
+	if deviceID != "" {
+		_, def, err := builder.FindDevice(&ui.Config.EsporeConfig.Build, deviceID)
+		if err != nil {
+			return err
+		}
+		fwDef = def
+	}
+	re, err := regexp.Compile(fwDef.GetBootLoopPattern())
+	if err != nil {
+		return fmt.Errorf("Invalid boot loop pattern: %s", err)
+	}
+	lm := newLineMatcher(re)
+	ui.dumper.Tap(lm)
+	defer ui.dumper.Untap(lm)
+	ui.Printf("Waiting for %d boots matching %q\n", bootLoopRepeats, re)
+	if err := breakBootLoop(lm, ui.Session, fwDef.GetRecoverCommand(), bootLoopRepeats, bootLoopTimeout); err != nil {
+		return err
+	}
+	ui.Printf("Boot loop detected, sent the recover command. The device can be synced now.\n")
+	return nil
+}
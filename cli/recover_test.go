@@ -0,0 +1,54 @@
+package cli
+
+import (
+	"espore/builder"
+	"io/ioutil"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+)
+
+type recordingSender struct {
+	commands []string
+	lock     sync.Mutex
+}
+
+func (rs *recordingSender) SendCommand(cmd string) error {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.commands = append(rs.commands, cmd)
+	return nil
+}
+
+func TestBreakBootLoop(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	fwDef := &builder.FirmwareDef{RecoverCommand: "autostart = false"}
+	d := &Dumper{W: ioutil.Discard}
+	lm := newLineMatcher(regexp.MustCompile(fwDef.GetBootLoopPattern()))
+	d.Tap(lm)
+	defer d.Untap(lm)
+	go func() {
+		for i := 0; i < 3; i++ {
+			d.write([]byte("\r\n\r\n\r\nEspore bootloader will launch in 3 seconds.\r\n"))
+			d.write([]byte("Set boot to nil to stop\r\n\r\nPANIC: unprotected error in call to Lua API\r\n"))
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	sender := &recordingSender{}
+	t.Ok(breakBootLoop(lm, sender, fwDef.GetRecoverCommand(), 3, 5*time.Second))
+	t.Equals([]string{"autostart = false"}, sender.commands)
+
+	// a device that boots once is not looping
+	sender = &recordingSender{}
+	go d.write([]byte("Espore bootloader will launch in 3 seconds.\r\n"))
+	err := breakBootLoop(lm, sender, fwDef.GetRecoverCommand(), 3, 100*time.Millisecond)
+	t.Assert(err != nil, "Expected no boot loop to be detected")
+	t.Equals(0, len(sender.commands))
+
+	t.Equals(builder.DefaultRecoverCommand, (&builder.FirmwareDef{}).GetRecoverCommand())
+}
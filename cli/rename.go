@@ -0,0 +1,70 @@
+package cli
+
+import (
+	"errors"
+	"espore/builder"
+	"espore/config"
+)
+
+// renameDevice sends the rename command of the device firmware, then, if
+// local is set, renames the device in the build tree. The local rename is
+// checked before the device is touched. The name is kept if newName is empty.
+func renameDevice(runner codeRunner, buildConfig *config.BuildConfig, oldID, newID, newName string, local bool) error {
+	if local {
+		if err := builder.CheckRename(buildConfig, oldID, newID); err != nil {
+			return err
+		}
+	}
+	// devices missing from the build tree use the default rename command and
+	// keep the name stored on them
+	_, fwDef, _ := builder.FindDevice(buildConfig, oldID)
+	name := newName
+	if name == "" {
+		name = fwDef.Name
+	}
+	if err := runner.RunCode(fwDef.GetRenameCommand(newID, name)); err != nil {
+		return err
+	}
+	if !local {
+		return nil
+	}
+	_, err := builder.RenameDevice(buildConfig, oldID, newID, newName)
+	return err
+}
+
+// rename handles /rename [--local] <newid> [newname]. With --local, the
+// device folder and firmware.json are updated too and the device is rebuilt.
+func (ui *UI) rename(p []string) error {
+	local := false
+	var args []string
+	for _, arg := range p {
+		if arg == "--local" {
+			local = true
+			continue
+		}
+		args = append(args, arg)
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("Usage: /rename [--local] <newid> [newname]")
+	}
+	newID := args[0]
+	var newName string
+	if len(args) == 2 {
+		newName = args[1]
+	}
+
+	oldID, err := ui.Session.GetChipID()
+	if err != nil {
+		return err
+	}
+	buildConfig := &ui.Config.EsporeConfig.Build
+	if err := renameDevice(ui.Session, buildConfig, oldID, newID, newName, local); err != nil {
+		return err
+	}
+	if !local {
+		ui.Printf("Device %s renamed to %s\n", oldID, newID)
+		return nil
+	}
+	ui.Printf("Device %s renamed to %s, rebuilding\n", oldID, newID)
+	return ui.build([]string{newID})
+}
@@ -0,0 +1,72 @@
+package cli
+
+import (
+	"espore/builder"
+	"espore/config"
+	"espore/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestRenameDevice(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, err := ioutil.TempDir("", "espore-rename")
+	t.Ok(err)
+	defer os.RemoveAll(dir)
+	t.Ok(os.Mkdir(filepath.Join(dir, "1234"), 0755))
+	t.Ok(ioutil.WriteFile(filepath.Join(dir, "1234", "firmware.json"),
+		[]byte(`{"id": "1234", "name": "kitchen", "libs": ["lib"]}`), 0644))
+	buildConfig := &config.BuildConfig{Devices: []string{filepath.Join(dir, "*")}}
+
+	// by default only the device is renamed
+	runner := &recordingRunner{}
+	t.Ok(renameDevice(runner, buildConfig, "1234", "5678", "", false))
+	t.Equals(1, len(runner.calls))
+	t.Assert(strings.Contains(runner.calls[0], `cfg.id = "5678"`), "Expected the new id to be sent, got %q", runner.calls[0])
+	t.Assert(strings.Contains(runner.calls[0], `cfg.name = "kitchen"`), "Expected the name to be kept, got %q", runner.calls[0])
+	_, err = os.Stat(filepath.Join(dir, "1234", "firmware.json"))
+	t.Ok(err)
+
+	// with local set, the device folder and firmware.json follow
+	runner = &recordingRunner{}
+	t.Ok(renameDevice(runner, buildConfig, "1234", "5678", "pantry", true))
+	t.Equals(1, len(runner.calls))
+	t.Assert(strings.Contains(runner.calls[0], `cfg.name = "pantry"`), "Expected the new name to be sent, got %q", runner.calls[0])
+	_, err = os.Stat(filepath.Join(dir, "1234"))
+	t.Assert(os.IsNotExist(err), "Expected the old device folder to be gone")
+	var fields map[string]interface{}
+	t.Ok(utils.ReadJSON(filepath.Join(dir, "5678", "firmware.json"), &fields))
+	t.Equals("5678", fields["id"])
+	t.Equals("pantry", fields["name"])
+	t.Equals([]interface{}{"lib"}, fields["libs"])
+
+	// devices missing from the build tree keep the name stored on them
+	runner = &recordingRunner{}
+	t.Ok(renameDevice(runner, buildConfig, "4444", "4445", "", false))
+	t.Equals(1, len(runner.calls))
+	t.Assert(strings.Contains(runner.calls[0], `cfg.name = nil or cfg.name`), "Expected the stored name to be kept, got %q", runner.calls[0])
+
+	// renaming a template-defined device is refused before touching the device
+	runner = &recordingRunner{}
+	t.Ok(os.Mkdir(filepath.Join(dir, "7777"), 0755))
+	t.Ok(ioutil.WriteFile(filepath.Join(dir, "7777", builder.FirmwareTemplateName), []byte(`{"id": "7777"}`), 0644))
+	err = renameDevice(runner, buildConfig, "7777", "7778", "", true)
+	t.Assert(err != nil, "Expected an error renaming a template-defined device")
+	t.Equals(0, len(runner.calls))
+	t.Ok(os.RemoveAll(filepath.Join(dir, "7777")))
+
+	// renaming onto an existing device is refused before touching the device
+	runner = &recordingRunner{}
+	t.Ok(os.Mkdir(filepath.Join(dir, "9999"), 0755))
+	t.Ok(ioutil.WriteFile(filepath.Join(dir, "9999", "firmware.json"), []byte(`{"id": "9999"}`), 0644))
+	err = renameDevice(runner, buildConfig, "5678", "9999", "", true)
+	t.Assert(err != nil, "Expected an error renaming onto an existing device")
+	t.Equals(0, len(runner.calls))
+}
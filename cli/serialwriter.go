@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"io"
+	"sync"
+)
+
+// serialWriter writes to W from a single goroutine, so writers on any
+// goroutine can share a W that is not safe for concurrent use, such as the
+// output TextView. Writes are applied in the order they are made.
+type serialWriter struct {
+	W      io.Writer
+	queue  chan func()
+	done   chan struct{}
+	lock   sync.Mutex
+	closed bool
+}
+
+func newSerialWriter(w io.Writer) *serialWriter {
+	sw := &serialWriter{
+		W:     w,
+		queue: make(chan func(), 256),
+		done:  make(chan struct{}),
+	}
+	go func() {
+		for f := range sw.queue {
+			f()
+		}
+		close(sw.done)
+	}()
+	return sw
+}
+
+// Write queues a copy of p to be written to W. Write errors are not reported.
+func (sw *serialWriter) Write(p []byte) (int, error) {
+	data := append([]byte(nil), p...)
+	sw.Do(func() {
+		sw.W.Write(data)
+	})
+	return len(p), nil
+}
+
+// Do runs f on the writer goroutine, after the writes queued before it.
+// Nothing is run once the writer is closed.
+func (sw *serialWriter) Do(f func()) {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+	if sw.closed {
+		return
+	}
+	sw.queue <- f
+}
+
+// Close waits for the queued writes to complete and stops the writer
+func (sw *serialWriter) Close() error {
+	sw.lock.Lock()
+	if !sw.closed {
+		sw.closed = true
+		close(sw.queue)
+	}
+	sw.lock.Unlock()
+	<-sw.done
+	return nil
+}
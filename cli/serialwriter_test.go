@@ -0,0 +1,60 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestConcurrentOutput(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	// bytes.Buffer is not safe for concurrent use, run with -race to check
+	// every write reaches it from the same goroutine
+	var screen bytes.Buffer
+	sw := newSerialWriter(&screen)
+	ui := &UI{transcript: newTranscript(sw, 1000)}
+	d := &Dumper{W: ui.transcript}
+
+	const writers, lines = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < lines; j++ {
+				ui.Printf("printf %d %d\n", i, j)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < lines; j++ {
+				d.write([]byte(fmt.Sprintf("device %d %d\n", i, j)))
+			}
+		}(i)
+	}
+	wg.Wait()
+	t.Ok(sw.Close())
+
+	// lines are not interleaved and the screen matches the transcript
+	text := colorTagRegex.ReplaceAllString(screen.String(), "")
+	t.Equals(ui.transcript.Text(), text)
+	output := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	t.Equals(2*writers*lines, len(output))
+	for _, line := range output {
+		var kind string
+		var i, j int
+		n, err := fmt.Sscanf(line, "%s %d %d", &kind, &i, &j)
+		t.Ok(err)
+		t.Equals(3, n)
+	}
+
+	// writes after closing are dropped
+	ui.Printf("late\n")
+	t.Assert(!strings.Contains(screen.String(), "late"), "Expected writes after close to be dropped")
+}
@@ -0,0 +1,118 @@
+package cli
+
+import (
+	"espore/session/fileman"
+	"espore/utils"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fileTransfer is the part of the session used to copy files to and from
+// the device
+type fileTransfer interface {
+	PullFile(srcName, dstPath string) error
+	PushFile(srcPath, dstName string) error
+}
+
+// snapshotDir returns where the snapshot with the given name is stored. Names
+// must not contain path separators or "..", so snapshots stay in their folder.
+func (ui *UI) snapshotDir(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") {
+		return "", fmt.Errorf("Invalid snapshot name %q", name)
+	}
+	return filepath.Join(ui.Config.EsporeConfig.GetDataDir(), "snapshots", name), nil
+}
+
+// snapshotFiles downloads the given device files into dir, replacing any
+// previous snapshot stored there only once all of them are downloaded
+func snapshotFiles(device fileTransfer, files []fileman.FileEntry, dir string) error {
+	parent, base := filepath.Split(filepath.Clean(dir))
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(parent, "."+base+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	for _, entry := range files {
+		dstPath := filepath.Join(tmp, filepath.FromSlash(entry.Name))
+		if rel, err := filepath.Rel(tmp, dstPath); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("Invalid device file name %q", entry.Name)
+		}
+		if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+			return err
+		}
+		if err := device.PullFile(entry.Name, dstPath); err != nil {
+			return err
+		}
+	}
+	return replaceDir(tmp, dir)
+}
+
+// replaceDir moves src to dst, replacing dst if it exists. The previous dst
+// is put back if src cannot be moved.
+func replaceDir(src, dst string) error {
+	if _, err := os.Stat(dst); os.IsNotExist(err) {
+		return os.Rename(src, dst)
+	}
+	old := src + ".old"
+	if err := os.Rename(dst, old); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		os.Rename(old, dst)
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// restoreFiles uploads every file in the snapshot at dir back to the device,
+// returning the names of the files restored
+func restoreFiles(device fileTransfer, dir string) ([]string, error) {
+	list, err := utils.EnumerateDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range list {
+		if err := device.PushFile(filepath.Join(dir, filepath.FromSlash(name)), name); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// snapshot saves all the device files under the given snapshot name
+func (ui *UI) snapshot(name string) error {
+	dir, err := ui.snapshotDir(name)
+	if err != nil {
+		return err
+	}
+	files, err := ui.Session.File.List()
+	if err != nil {
+		return err
+	}
+	if err := snapshotFiles(ui.Session, files, dir); err != nil {
+		return err
+	}
+	ui.Printf("Saved %d files to snapshot %s (%s)\n", len(files), name, dir)
+	return nil
+}
+
+// restore uploads the files of a snapshot back to the device. Files created on
+// the device after the snapshot was taken are left in place.
+func (ui *UI) restore(name string) error {
+	dir, err := ui.snapshotDir(name)
+	if err != nil {
+		return err
+	}
+	restored, err := restoreFiles(ui.Session, dir)
+	if err != nil {
+		return err
+	}
+	ui.Printf("Restored %d files from snapshot %s\n", len(restored), name)
+	return nil
+}
@@ -0,0 +1,111 @@
+package cli
+
+import (
+	"espore/config"
+	"espore/session/fileman"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+// memoryDevice keeps the device filesystem in a map
+type memoryDevice struct {
+	files map[string][]byte
+}
+
+func (md *memoryDevice) PullFile(srcName, dstPath string) error {
+	data, ok := md.files[srcName]
+	if !ok {
+		return os.ErrNotExist
+	}
+	return ioutil.WriteFile(dstPath, data, 0644)
+}
+
+func (md *memoryDevice) PushFile(srcPath, dstName string) error {
+	data, err := ioutil.ReadFile(srcPath)
+	if err != nil {
+		return err
+	}
+	md.files[dstName] = data
+	return nil
+}
+
+func (md *memoryDevice) List() []fileman.FileEntry {
+	var list []fileman.FileEntry
+	for name, data := range md.files {
+		list = append(list, fileman.FileEntry{Name: name, Size: len(data)})
+	}
+	return list
+}
+
+func TestSnapshotRestore(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, err := ioutil.TempDir("", "espore-snapshot")
+	t.Ok(err)
+	defer os.RemoveAll(dir)
+	snapshot := filepath.Join(dir, "before-sync")
+
+	device := &memoryDevice{files: map[string][]byte{
+		"init.lua":      []byte("print('init')"),
+		"www/index.htm": []byte("<html></html>"),
+	}}
+	t.Ok(snapshotFiles(device, device.List(), snapshot))
+
+	device.files["init.lua"] = []byte("print('broken')")
+	delete(device.files, "www/index.htm")
+
+	restored, err := restoreFiles(device, snapshot)
+	t.Ok(err)
+	sort.Strings(restored)
+	t.Equals([]string{"init.lua", "www/index.htm"}, restored)
+	t.Equals("print('init')", string(device.files["init.lua"]))
+	t.Equals("<html></html>", string(device.files["www/index.htm"]))
+}
+
+func TestSnapshotFailedPull(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dataDir, err := ioutil.TempDir("", "espore-snapshot")
+	t.Ok(err)
+	defer os.RemoveAll(dataDir)
+	ui := &UI{Config: Config{EsporeConfig: &config.EsporeConfig{DataDir: dataDir}}}
+
+	for _, name := range []string{"", "..", "../outside", "a/b", `a\b`} {
+		_, err := ui.snapshotDir(name)
+		t.Assert(err != nil, "Expected snapshot name %q to be rejected", name)
+	}
+	snapshot, err := ui.snapshotDir("good")
+	t.Ok(err)
+
+	device := &memoryDevice{files: map[string][]byte{"init.lua": []byte("print('init')")}}
+	t.Ok(snapshotFiles(device, device.List(), snapshot))
+
+	// a file vanishing during the pull keeps the previous snapshot intact
+	files := append(device.List(), fileman.FileEntry{Name: "gone.lua"})
+	device.files["init.lua"] = []byte("print('broken')")
+	t.Assert(snapshotFiles(device, files, snapshot) != nil, "Expected the pull to fail")
+	data, err := ioutil.ReadFile(filepath.Join(snapshot, "init.lua"))
+	t.Ok(err)
+	t.Equals("print('init')", string(data))
+
+	err = snapshotFiles(device, []fileman.FileEntry{{Name: "../escape.lua"}}, snapshot)
+	t.Assert(err != nil, "Expected a device file outside the snapshot to be rejected")
+
+	// only the snapshot is left behind
+	entries, err := ioutil.ReadDir(filepath.Dir(snapshot))
+	t.Ok(err)
+	t.Equals(1, len(entries))
+
+	device.files["init.lua"] = []byte("print('fixed')")
+	t.Ok(snapshotFiles(device, device.List(), snapshot))
+	data, err = ioutil.ReadFile(filepath.Join(snapshot, "init.lua"))
+	t.Ok(err)
+	t.Equals("print('fixed')", string(data))
+}
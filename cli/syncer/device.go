@@ -0,0 +1,323 @@
+package syncer
+
+import (
+	"bytes"
+	"errors"
+	"espore/builder"
+	"espore/session/fileman"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/radovskyb/watcher"
+)
+
+// Pusher uploads files to a device
+type Pusher interface {
+	FilePusher
+	PushStream(reader io.Reader, size int64, dstName string) error
+}
+
+// DeviceConfig contains the DeviceSyncer config
+type DeviceConfig struct {
+	// Paths are the source folders to watch for changes
+	Paths []string
+	// Debounce is how long to wait for edits to settle before rebuilding
+	Debounce time.Duration
+	// Build rebuilds the device firmware manifest
+	Build func() (*builder.FirmwareManifest, error)
+	// Pusher is used to upload changed files to the device
+	Pusher Pusher
+	// List returns the files currently on the device
+	List func() ([]fileman.FileEntry, error)
+	// FreeSpace, when set, returns the bytes available on the device
+	// filesystem. Syncs that would leave less than SpaceMargin bytes free
+	// are refused.
+	FreeSpace   func() (int64, error)
+	SpaceMargin int64
+	// OnChange is called once edits have settled. It is expected to invoke
+	// Sync, possibly deferring it to a different goroutine.
+	OnChange func()
+}
+
+// DeviceSyncer watches firmware sources, rebuilding a device and pushing the
+// files that changed since the last sync
+type DeviceSyncer struct {
+	DeviceConfig
+	watcher  *watcher.Watcher
+	manifest *builder.FirmwareManifest
+	timer    *time.Timer
+	status   Status
+	timings  []FileTiming
+	lock     sync.Mutex
+}
+
+// FileTiming is how long uploading a file took
+type FileTiming struct {
+	Path     string
+	Size     int64
+	Duration time.Duration
+}
+
+// NewDevice starts watching the configured paths
+func NewDevice(config *DeviceConfig) (*DeviceSyncer, error) {
+	w := watcher.New()
+	for _, path := range config.Paths {
+		if err := w.AddRecursive(path); err != nil {
+			return nil, err
+		}
+	}
+	ds := &DeviceSyncer{
+		DeviceConfig: *config,
+		watcher:      w,
+		status: Status{
+			SrcPath:      strings.Join(config.Paths, ", "),
+			LastActivity: time.Now(),
+		},
+	}
+
+	go func() {
+		for {
+			select {
+			case <-w.Event:
+				ds.trigger()
+			case err := <-w.Error:
+				log.Fatalln(err)
+			case <-w.Closed:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		if err := w.Start(time.Millisecond * 100); err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	return ds, nil
+}
+
+// trigger schedules OnChange, postponing it while edits keep coming
+func (ds *DeviceSyncer) trigger() {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	if ds.timer != nil {
+		ds.timer.Stop()
+	}
+	ds.timer = time.AfterFunc(ds.Debounce, ds.OnChange)
+}
+
+// Sync rebuilds the device and pushes the files whose hash changed since the
+// previous sync, returning their names. The first sync pushes all files.
+func (ds *DeviceSyncer) Sync() ([]string, error) {
+	ds.setStatus(StateSyncing, nil)
+	pushed, err := ds.sync()
+	if err != nil {
+		ds.setStatus(StateError, err)
+	} else {
+		ds.setStatus(StateIdle, nil)
+	}
+	return pushed, err
+}
+
+func (ds *DeviceSyncer) sync() ([]string, error) {
+	manifest, err := ds.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	ds.lock.Lock()
+	previous := ds.manifest
+	ds.lock.Unlock()
+
+	changed := ChangedFiles(previous, manifest)
+	if err := ds.checkFreeSpace(changed); err != nil {
+		return nil, err
+	}
+
+	var pushed []string
+	var timings []FileTiming
+	defer func() {
+		ds.lock.Lock()
+		ds.timings = timings
+		ds.lock.Unlock()
+	}()
+	for _, fe := range changed {
+		start := time.Now()
+		if fe.Content != nil {
+			err = ds.Pusher.PushStream(bytes.NewReader(fe.Content), int64(len(fe.Content)), fe.Path)
+		} else {
+			err = ds.Pusher.PushFile(fe.SourcePath(), fe.Path)
+		}
+		if err != nil {
+			return pushed, err
+		}
+		timings = append(timings, FileTiming{Path: fe.Path, Size: fe.Size, Duration: time.Since(start)})
+		pushed = append(pushed, fe.Path)
+	}
+
+	ds.lock.Lock()
+	ds.manifest = manifest
+	ds.lock.Unlock()
+	return pushed, nil
+}
+
+// checkFreeSpace returns an error if pushing the given files would leave the
+// device with less than SpaceMargin bytes free. Files replacing existing ones
+// only count for the difference in size.
+func (ds *DeviceSyncer) checkFreeSpace(files []*builder.FileEntry) error {
+	if ds.FreeSpace == nil || len(files) == 0 {
+		return nil
+	}
+	free, err := ds.FreeSpace()
+	if err != nil {
+		return fmt.Errorf("Cannot query device free space: %s", err)
+	}
+	existing := make(map[string]int64)
+	if ds.List != nil {
+		deviceFiles, err := ds.List()
+		if err != nil {
+			return err
+		}
+		for _, entry := range deviceFiles {
+			existing[entry.Name] = int64(entry.Size)
+		}
+	}
+	needed := RequiredSpace(files, existing)
+	if needed > free-ds.SpaceMargin {
+		return fmt.Errorf("Not enough space on device: sync needs %d bytes, %d are free and %d must be kept free", needed, free, ds.SpaceMargin)
+	}
+	return nil
+}
+
+// RequiredSpace returns how many more bytes the device filesystem uses after
+// writing the given files, given the sizes of the files already on it. The
+// result is negative if the files shrink.
+func RequiredSpace(files []*builder.FileEntry, existing map[string]int64) int64 {
+	var needed int64
+	for _, fe := range files {
+		size := fe.Size
+		if fe.Content != nil {
+			size = int64(len(fe.Content))
+		}
+		needed += size - existing[fe.Path]
+	}
+	return needed
+}
+
+// PruneCandidates rebuilds the device and returns the device files a prune
+// would delete, without deleting anything
+func (ds *DeviceSyncer) PruneCandidates() ([]string, error) {
+	if ds.List == nil {
+		return nil, errors.New("Listing device files is not supported")
+	}
+	manifest, err := ds.Build()
+	if err != nil {
+		return nil, err
+	}
+	deviceFiles, err := ds.List()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(deviceFiles))
+	for i, entry := range deviceFiles {
+		names[i] = entry.Name
+	}
+	return PruneCandidates(manifest, names), nil
+}
+
+// PruneCandidates returns the device files that are neither shipped by the
+// manifest nor declared as datafiles, sorted by name
+func PruneCandidates(manifest *builder.FirmwareManifest, deviceFiles []string) []string {
+	keep := map[string]bool{"datafiles.json": true}
+	for _, fe := range manifest.Files {
+		keep[fe.Path] = true
+		for _, datafile := range fe.Datafiles {
+			keep[datafile] = true
+		}
+	}
+	var candidates []string
+	for _, name := range deviceFiles {
+		if !keep[name] {
+			candidates = append(candidates, name)
+		}
+	}
+	sort.Strings(candidates)
+	return candidates
+}
+
+func (ds *DeviceSyncer) setStatus(state State, err error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	ds.status.State = state
+	ds.status.Err = err
+	ds.status.LastActivity = time.Now()
+}
+
+// Status returns a snapshot of the current device syncer status
+func (ds *DeviceSyncer) Status() Status {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	return ds.status
+}
+
+// Timings returns how long each file pushed by the last sync took to upload,
+// in the order they were pushed
+func (ds *DeviceSyncer) Timings() []FileTiming {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	return append([]FileTiming(nil), ds.timings...)
+}
+
+// SlowestFiles returns the n timings with the longest durations, slowest
+// first
+func SlowestFiles(timings []FileTiming, n int) []FileTiming {
+	slowest := append([]FileTiming(nil), timings...)
+	sort.SliceStable(slowest, func(i, j int) bool {
+		return slowest[i].Duration > slowest[j].Duration
+	})
+	if len(slowest) > n {
+		slowest = slowest[:n]
+	}
+	return slowest
+}
+
+// Reset clears a previous sync error, returning the syncer to idle
+func (ds *DeviceSyncer) Reset() {
+	ds.setStatus(StateIdle, nil)
+}
+
+// ChangedFiles returns the files in current that are new or have a different
+// hash than in previous, sorted by path
+func ChangedFiles(previous, current *builder.FirmwareManifest) []*builder.FileEntry {
+	hashes := make(map[string]string)
+	if previous != nil {
+		for _, fe := range previous.Files {
+			hashes[fe.Path] = fe.Hash
+		}
+	}
+	var changed []*builder.FileEntry
+	for _, fe := range current.Files {
+		if hash, ok := hashes[fe.Path]; !ok || hash != fe.Hash {
+			changed = append(changed, fe)
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool {
+		return strings.Compare(changed[i].Path, changed[j].Path) < 0
+	})
+	return changed
+}
+
+func (ds *DeviceSyncer) Close() {
+	ds.lock.Lock()
+	if ds.timer != nil {
+		ds.timer.Stop()
+	}
+	ds.lock.Unlock()
+	ds.watcher.Close()
+}
@@ -0,0 +1,237 @@
+package syncer
+
+import (
+	"espore/builder"
+	"espore/session/fileman"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+)
+
+type stubPusher struct {
+	pushed map[string]string
+}
+
+func (sp *stubPusher) PushFile(srcPath, dstName string) error {
+	sp.pushed[dstName] = srcPath
+	return nil
+}
+
+func (sp *stubPusher) PushStream(reader io.Reader, size int64, dstName string) error {
+	data, err := ioutil.ReadAll(reader)
+	sp.pushed[dstName] = string(data)
+	return err
+}
+
+func TestDeviceSyncer(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	manifests := []*builder.FirmwareManifest{
+		{
+			Files: []*builder.FileEntry{
+				{Base: "lib", Path: "main.lua", Hash: "1"},
+				{Base: "lib", Path: "util.lua", Hash: "2"},
+				builder.NewVirtualFileEntry([]byte("[]"), "modules.json"),
+			},
+		},
+		{
+			Files: []*builder.FileEntry{
+				{Base: "lib", Path: "main.lua", Hash: "1"},
+				{Base: "lib", Path: "util.lua", Hash: "3"},
+				builder.NewVirtualFileEntry([]byte("[]"), "modules.json"),
+			},
+		},
+	}
+
+	pusher := &stubPusher{pushed: make(map[string]string)}
+	var builds int
+	var changes int
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	ds, err := NewDevice(&DeviceConfig{
+		Debounce: 50 * time.Millisecond,
+		Pusher:   pusher,
+		Build: func() (*builder.FirmwareManifest, error) {
+			manifest := manifests[builds]
+			builds++
+			return manifest, nil
+		},
+		OnChange: func() {
+			changes++
+			wg.Done()
+		},
+	})
+	t.Ok(err)
+	defer ds.Close()
+
+	// first sync pushes everything
+	pushed, err := ds.Sync()
+	t.Ok(err)
+	t.Equals([]string{"main.lua", "modules.json", "util.lua"}, pushed)
+	t.Equals("[]", pusher.pushed["modules.json"])
+
+	// rapid edits are debounced into a single change notification
+	for i := 0; i < 5; i++ {
+		ds.trigger()
+	}
+	wg.Wait()
+	time.Sleep(100 * time.Millisecond)
+	t.Equals(1, changes)
+
+	// second sync only pushes the changed file
+	pusher.pushed = make(map[string]string)
+	pushed, err = ds.Sync()
+	t.Ok(err)
+	t.Equals([]string{"util.lua"}, pushed)
+	t.Equals(map[string]string{"util.lua": "lib/util.lua"}, pusher.pushed)
+}
+
+func TestPruneCandidates(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	pusher := &stubPusher{pushed: make(map[string]string)}
+	var listed int
+	ds, err := NewDevice(&DeviceConfig{
+		Pusher: pusher,
+		Build: func() (*builder.FirmwareManifest, error) {
+			return &builder.FirmwareManifest{
+				Files: []*builder.FileEntry{
+					{Path: "main.lua", Hash: "1"},
+					{Path: "wifi.lua", Hash: "2", Datafiles: []string{"wifi.cfg"}},
+				},
+			}, nil
+		},
+		List: func() ([]fileman.FileEntry, error) {
+			listed++
+			var list []fileman.FileEntry
+			for _, name := range []string{"wifi.lua", "old.lua", "main.lua", "wifi.cfg", "datafiles.json", "test.txt"} {
+				list = append(list, fileman.FileEntry{Name: name})
+			}
+			return list, nil
+		},
+	})
+	t.Ok(err)
+	defer ds.Close()
+
+	candidates, err := ds.PruneCandidates()
+	t.Ok(err)
+	t.Equals([]string{"old.lua", "test.txt"}, candidates)
+	t.Equals(1, listed)
+	// nothing is sent to the device
+	t.Equals(0, len(pusher.pushed))
+}
+
+func TestFreeSpaceGuard(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	newSyncer := func(pusher *stubPusher, free int64) *DeviceSyncer {
+		ds, err := NewDevice(&DeviceConfig{
+			Pusher: pusher,
+			Build: func() (*builder.FirmwareManifest, error) {
+				return &builder.FirmwareManifest{
+					Files: []*builder.FileEntry{
+						{Base: "lib", Path: "main.lua", Hash: "1", Size: 100},
+						{Base: "lib", Path: "util.lua", Hash: "2", Size: 50},
+					},
+				}, nil
+			},
+			List: func() ([]fileman.FileEntry, error) {
+				return []fileman.FileEntry{{Name: "main.lua", Size: 40}}, nil
+			},
+			FreeSpace: func() (int64, error) {
+				return free, nil
+			},
+			SpaceMargin: 10,
+		})
+		t.Ok(err)
+		return ds
+	}
+
+	// main.lua grows by 60 bytes and util.lua adds 50, leaving exactly the margin
+	pusher := &stubPusher{pushed: make(map[string]string)}
+	ds := newSyncer(pusher, 120)
+	defer ds.Close()
+	pushed, err := ds.Sync()
+	t.Ok(err)
+	t.Equals([]string{"main.lua", "util.lua"}, pushed)
+
+	// one byte less and nothing is pushed
+	pusher = &stubPusher{pushed: make(map[string]string)}
+	ds = newSyncer(pusher, 119)
+	defer ds.Close()
+	_, err = ds.Sync()
+	t.Assert(err != nil, "expected sync to be refused")
+	t.Equals("Not enough space on device: sync needs 110 bytes, 119 are free and 10 must be kept free", err.Error())
+	t.Equals(0, len(pusher.pushed))
+}
+
+// slowPusher takes the configured delay to push each file
+type slowPusher struct {
+	delays map[string]time.Duration
+}
+
+func (sp *slowPusher) PushFile(srcPath, dstName string) error {
+	time.Sleep(sp.delays[dstName])
+	return nil
+}
+
+func (sp *slowPusher) PushStream(reader io.Reader, size int64, dstName string) error {
+	time.Sleep(sp.delays[dstName])
+	_, err := ioutil.ReadAll(reader)
+	return err
+}
+
+func TestSyncTimings(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	manifest := &builder.FirmwareManifest{
+		Files: []*builder.FileEntry{
+			{Base: "lib", Path: "main.lua", Hash: "1", Size: 100},
+			{Base: "lib", Path: "index.html", Hash: "2", Size: 2048},
+			builder.NewVirtualFileEntry([]byte("[]"), "modules.json"),
+		},
+	}
+	pusher := &slowPusher{delays: map[string]time.Duration{
+		"main.lua":     40 * time.Millisecond,
+		"index.html":   5 * time.Millisecond,
+		"modules.json": 20 * time.Millisecond,
+	}}
+	ds, err := NewDevice(&DeviceConfig{
+		Pusher: pusher,
+		Build: func() (*builder.FirmwareManifest, error) {
+			return manifest, nil
+		},
+	})
+	t.Ok(err)
+	defer ds.Close()
+
+	_, err = ds.Sync()
+	t.Ok(err)
+	timings := ds.Timings()
+	t.Equals(3, len(timings))
+	for _, timing := range timings {
+		t.Assert(timing.Duration >= pusher.delays[timing.Path], "Expected %s to take at least %s, took %s", timing.Path, pusher.delays[timing.Path], timing.Duration)
+	}
+	t.Equals("index.html", timings[0].Path)
+	t.Equals(int64(2048), timings[0].Size)
+	t.Equals(int64(2), timings[2].Size)
+
+	var slowest []string
+	for _, timing := range SlowestFiles(timings, 2) {
+		slowest = append(slowest, timing.Path)
+	}
+	t.Equals([]string{"main.lua", "modules.json"}, slowest)
+
+	// a sync with nothing to push records no timings
+	_, err = ds.Sync()
+	t.Ok(err)
+	t.Equals(0, len(ds.Timings()))
+}
@@ -0,0 +1,27 @@
+package syncer
+
+import (
+	"os"
+	"strings"
+)
+
+const gzipExt = ".gz"
+
+// SelectSource decides which local file to upload for a changed srcPath and
+// under which name. When the device can inflate gzip and a compressed sibling
+// exists, the compressed form is sent instead. Compressed files are never sent
+// to devices without gzip support; in that case an empty srcPath is returned.
+func SelectSource(srcPath, dstName string, gzip bool) (string, string) {
+	if strings.HasSuffix(srcPath, gzipExt) {
+		if !gzip {
+			return "", ""
+		}
+		return srcPath, dstName
+	}
+	if gzip {
+		if _, err := os.Stat(srcPath + gzipExt); err == nil {
+			return srcPath + gzipExt, dstName + gzipExt
+		}
+	}
+	return srcPath, dstName
+}
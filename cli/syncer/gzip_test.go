@@ -0,0 +1,38 @@
+package syncer_test
+
+import (
+	"espore/cli/syncer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestSelectSource(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, err := ioutil.TempDir("", "espore-gzip")
+	t.Ok(err)
+	defer os.RemoveAll(dir)
+
+	plain := filepath.Join(dir, "index.html")
+	t.Ok(ioutil.WriteFile(plain, []byte("<html></html>"), 0644))
+	t.Ok(ioutil.WriteFile(plain+".gz", []byte{0x1f, 0x8b}, 0644))
+
+	// device without gzip support gets plain files
+	src, dst := syncer.SelectSource(plain, "index.html", false)
+	t.Equals(plain, src)
+	t.Equals("index.html", dst)
+
+	// and compressed files are skipped
+	src, dst = syncer.SelectSource(plain+".gz", "index.html.gz", false)
+	t.Equals("", src)
+
+	// device with gzip support gets the compressed form
+	src, dst = syncer.SelectSource(plain, "index.html", true)
+	t.Equals(plain+".gz", src)
+	t.Equals("index.html.gz", dst)
+}
@@ -2,6 +2,7 @@ package syncer
 
 import (
 	"log"
+	"sync"
 	"time"
 
 	"github.com/radovskyb/watcher"
@@ -13,11 +14,47 @@ type FilePusher interface {
 
 type Config struct {
 	SrcPath string
-	OnSync  func(srcPath string)
+	// OnSync is called for every change. closing is closed once the syncer
+	// starts closing, and OnSync must then stop waiting on anything that may
+	// be busy closing it.
+	OnSync func(srcPath string, closing <-chan struct{}) error
+}
+
+// State describes what a Syncer is currently doing
+type State int
+
+const (
+	StateIdle State = iota
+	StateSyncing
+	StateError
+)
+
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateSyncing:
+		return "syncing"
+	case StateError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// Status is a snapshot of a Syncer's state
+type Status struct {
+	SrcPath      string
+	State        State
+	LastActivity time.Time
+	Err          error
 }
 
 type Syncer struct {
-	watcher *watcher.Watcher
+	watcher   *watcher.Watcher
+	status    Status
+	lock      sync.Mutex
+	closing   chan struct{}
+	closeOnce sync.Once
 }
 
 func New(config *Config) (*Syncer, error) {
@@ -28,13 +65,23 @@ func New(config *Config) (*Syncer, error) {
 	}
 	s := &Syncer{
 		watcher: w,
+		status: Status{
+			SrcPath:      config.SrcPath,
+			LastActivity: time.Now(),
+		},
+		closing: make(chan struct{}),
 	}
 
 	go func() {
 		for {
 			select {
 			case event := <-w.Event:
-				config.OnSync(event.Path)
+				s.setStatus(StateSyncing, nil)
+				if err := config.OnSync(event.Path, s.closing); err != nil {
+					s.setStatus(StateError, err)
+				} else {
+					s.setStatus(StateIdle, nil)
+				}
 			case err := <-w.Error:
 				log.Fatalln(err)
 			case <-w.Closed:
@@ -49,10 +96,30 @@ func New(config *Config) (*Syncer, error) {
 			log.Fatalln(err)
 		}
 	}()
+	// Close does nothing until the watcher is running
+	w.Wait()
 
 	return s, nil
 }
 
+func (s *Syncer) setStatus(state State, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status.State = state
+	s.status.Err = err
+	s.status.LastActivity = time.Now()
+}
+
+// Status returns a snapshot of the current syncer status
+func (s *Syncer) Status() Status {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.status
+}
+
 func (s *Syncer) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+	})
 	s.watcher.Close()
 }
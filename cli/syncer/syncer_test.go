@@ -0,0 +1,58 @@
+package syncer_test
+
+import (
+	"espore/cli/syncer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestCloseWhileSyncing(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, err := ioutil.TempDir("", "espore-syncer")
+	t.Ok(err)
+	defer os.RemoveAll(dir)
+
+	syncing := make(chan struct{}, 1)
+	s, err := syncer.New(&syncer.Config{
+		SrcPath: dir,
+		OnSync: func(srcPath string, closing <-chan struct{}) error {
+			select {
+			case syncing <- struct{}{}:
+			default:
+			}
+			// wait for a result that never comes, like a push queued behind
+			// the command closing the syncer
+			<-closing
+			return nil
+		},
+	})
+	t.Ok(err)
+
+	t.Ok(ioutil.WriteFile(filepath.Join(dir, "a.lua"), []byte("return 1"), 0644))
+	select {
+	case <-syncing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the change to be synced")
+	}
+	// a second change blocks the watcher until the first sync returns
+	t.Ok(ioutil.WriteFile(filepath.Join(dir, "b.lua"), []byte("return 2"), 0644))
+	time.Sleep(300 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Close to return while syncing")
+	}
+}
@@ -0,0 +1,66 @@
+package syncer
+
+import (
+	"sync"
+	"time"
+)
+
+type throughputSample struct {
+	at    time.Time
+	total int64
+}
+
+// Throughput estimates a transfer rate as a moving average over a time
+// window, so it follows changes in link speed without jumping on every chunk
+type Throughput struct {
+	window  time.Duration
+	total   int64
+	samples []throughputSample
+	lock    sync.Mutex
+}
+
+// NewThroughput returns a Throughput averaging over the given window
+func NewThroughput(window time.Duration) *Throughput {
+	return &Throughput{window: window}
+}
+
+// Add records that n more bytes were transferred at the given time
+func (t *Throughput) Add(at time.Time, n int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.total += n
+	t.samples = append(t.samples, throughputSample{at: at, total: t.total})
+	// keep the newest sample older than the window as the baseline
+	start := at.Add(-t.window)
+	drop := 0
+	for drop+1 < len(t.samples) && !t.samples[drop+1].at.After(start) {
+		drop++
+	}
+	t.samples = t.samples[drop:]
+}
+
+// Rate returns the average bytes per second over the window, or 0 if there
+// are not enough samples yet
+func (t *Throughput) Rate() float64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.samples) < 2 {
+		return 0
+	}
+	first, last := t.samples[0], t.samples[len(t.samples)-1]
+	elapsed := last.at.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(last.total-first.total) / elapsed
+}
+
+// ETA returns how long transferring the remaining bytes will take at the
+// current rate. ok is false while the rate is unknown.
+func (t *Throughput) ETA(remaining int64) (eta time.Duration, ok bool) {
+	rate := t.Rate()
+	if rate <= 0 {
+		return 0, false
+	}
+	return time.Duration(float64(remaining) / rate * float64(time.Second)), true
+}
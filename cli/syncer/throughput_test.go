@@ -0,0 +1,39 @@
+package syncer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestThroughput(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	tp := NewThroughput(5 * time.Second)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	t.Equals(0.0, tp.Rate())
+	_, ok := tp.ETA(1000)
+	t.Assert(!ok, "Expected no ETA without samples")
+
+	tp.Add(start, 0)
+	for i := 1; i <= 10; i++ {
+		tp.Add(start.Add(time.Duration(i)*time.Second), 1000)
+	}
+	t.Equals(1000.0, tp.Rate())
+
+	// the link speeds up: after a full window only the new rate counts
+	for i := 11; i <= 13; i++ {
+		tp.Add(start.Add(time.Duration(i)*time.Second), 2000)
+	}
+	t.Equals(1600.0, tp.Rate())
+	for i := 14; i <= 15; i++ {
+		tp.Add(start.Add(time.Duration(i)*time.Second), 2000)
+	}
+	t.Equals(2000.0, tp.Rate())
+
+	eta, ok := tp.ETA(4000)
+	t.Assert(ok, "Expected an ETA")
+	t.Equals(2*time.Second, eta)
+}
@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"espore/cli/syncer"
+	"espore/session"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// watchPusher is what /watch needs from the session to push changed files
+type watchPusher interface {
+	HasCapability(name string) (bool, error)
+	PushFile(srcPath, dstName string) error
+}
+
+// pushWatchedFile pushes a changed file under srcPath to the same relative
+// path under dstPath, sending its gzipped sibling instead when the device can
+// inflate it. It returns the name pushed, or "" if the file was skipped.
+func pushWatchedFile(pusher watchPusher, srcPath, dstPath, path string) (string, error) {
+	relFile, err := filepath.Rel(srcPath, path)
+	if err != nil {
+		return "", fmt.Errorf("Error pushing file: %s", err)
+	}
+	dstName := session.JoinRemotePath(dstPath, filepath.ToSlash(relFile))
+
+	gzip, err := pusher.HasCapability("gzip")
+	if err != nil {
+		return "", fmt.Errorf("Error querying device capabilities: %s", err)
+	}
+	path, dstName = syncer.SelectSource(path, dstName, gzip)
+	if path == "" {
+		return "", nil
+	}
+	if err := pusher.PushFile(path, dstName); err != nil {
+		return "", fmt.Errorf("Error pushing %s: %s", dstName, err)
+	}
+	return dstName, nil
+}
+
+func (ui *UI) getSyncer(srcPath string) *syncer.Syncer {
+	ui.syncersLock.Lock()
+	defer ui.syncersLock.Unlock()
+	return ui.syncers[srcPath]
+}
+
+// setSyncer registers a syncer for srcPath, closing any previous one
+func (ui *UI) setSyncer(srcPath string, sync *syncer.Syncer) {
+	ui.syncersLock.Lock()
+	defer ui.syncersLock.Unlock()
+	if old := ui.syncers[srcPath]; old != nil && old != sync {
+		old.Close()
+	}
+	ui.syncers[srcPath] = sync
+}
+
+// removeSyncer closes and unregisters the syncer for srcPath, if any
+func (ui *UI) removeSyncer(srcPath string) {
+	ui.syncersLock.Lock()
+	defer ui.syncersLock.Unlock()
+	if sync := ui.syncers[srcPath]; sync != nil {
+		sync.Close()
+		delete(ui.syncers, srcPath)
+	}
+}
+
+func (ui *UI) getDeviceSyncer(key string) *syncer.DeviceSyncer {
+	ui.syncersLock.Lock()
+	defer ui.syncersLock.Unlock()
+	return ui.deviceSyncers[key]
+}
+
+func (ui *UI) setDeviceSyncer(key string, ds *syncer.DeviceSyncer) {
+	ui.syncersLock.Lock()
+	defer ui.syncersLock.Unlock()
+	ui.deviceSyncers[key] = ds
+}
+
+func (ui *UI) removeDeviceSyncer(key string) {
+	ui.syncersLock.Lock()
+	defer ui.syncersLock.Unlock()
+	if ds := ui.deviceSyncers[key]; ds != nil {
+		ds.Close()
+		delete(ui.deviceSyncers, key)
+	}
+}
+
+// syncerStatusList returns the status of all active syncers, including
+// device syncers listed by their key, sorted by path
+func (ui *UI) syncerStatusList() []syncer.Status {
+	ui.syncersLock.Lock()
+	defer ui.syncersLock.Unlock()
+	list := make([]syncer.Status, 0, len(ui.syncers)+len(ui.deviceSyncers))
+	for _, sync := range ui.syncers {
+		list = append(list, sync.Status())
+	}
+	for key, ds := range ui.deviceSyncers {
+		status := ds.Status()
+		status.SrcPath = key
+		list = append(list, status)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return strings.Compare(list[i].SrcPath, list[j].SrcPath) < 0
+	})
+	return list
+}
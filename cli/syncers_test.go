@@ -0,0 +1,264 @@
+package cli
+
+import (
+	"errors"
+	"espore/builder"
+	"espore/cli/syncer"
+	"espore/session"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+	"github.com/rivo/tview"
+)
+
+func TestSyncersConcurrentAccess(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, err := ioutil.TempDir("", "espore-syncers")
+	t.Ok(err)
+	defer os.RemoveAll(dir)
+
+	ui := &UI{
+		syncers: make(map[string]*syncer.Syncer),
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("path%d", i%3)
+			s, err := syncer.New(&syncer.Config{
+				SrcPath: dir,
+				OnSync:  func(string, <-chan struct{}) error { return nil },
+			})
+			if err != nil {
+				tx.Error(err)
+				return
+			}
+			ui.setSyncer(key, s)
+			ui.getSyncer(key)
+			ui.removeSyncer(key)
+		}(i)
+	}
+	wg.Wait()
+
+	t.Equals(0, len(ui.syncers))
+}
+
+func TestSyncerStatusList(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dirA, err := ioutil.TempDir("", "espore-syncers")
+	t.Ok(err)
+	defer os.RemoveAll(dirA)
+	dirB, err := ioutil.TempDir("", "espore-syncers")
+	t.Ok(err)
+	defer os.RemoveAll(dirB)
+
+	ui := &UI{
+		syncers: make(map[string]*syncer.Syncer),
+	}
+	t.Equals(0, len(ui.syncerStatusList()))
+
+	for _, dir := range []string{dirA, dirB} {
+		s, err := syncer.New(&syncer.Config{
+			SrcPath: dir,
+			OnSync:  func(string, <-chan struct{}) error { return nil },
+		})
+		t.Ok(err)
+		ui.setSyncer(dir, s)
+	}
+	defer ui.removeSyncer(dirB)
+
+	list := ui.syncerStatusList()
+	t.Equals(2, len(list))
+	for _, status := range list {
+		t.Equals(syncer.StateIdle, status.State)
+		t.Assert(!status.LastActivity.IsZero(), "Expected last activity to be set")
+	}
+
+	ui.removeSyncer(dirA)
+	list = ui.syncerStatusList()
+	t.Equals(1, len(list))
+	t.Equals(dirB, list[0].SrcPath)
+}
+
+type failingPusher struct {
+	fail bool
+}
+
+func (fp *failingPusher) PushFile(srcPath, dstName string) error {
+	if fp.fail {
+		return errors.New("device not responding")
+	}
+	return nil
+}
+
+func (fp *failingPusher) PushStream(reader io.Reader, size int64, dstName string) error {
+	return fp.PushFile("", dstName)
+}
+
+func TestResync(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	pusher := &failingPusher{fail: true}
+	var ds *syncer.DeviceSyncer
+	var states []syncer.State
+	ds, err := syncer.NewDevice(&syncer.DeviceConfig{
+		Pusher: pusher,
+		Build: func() (*builder.FirmwareManifest, error) {
+			states = append(states, ds.Status().State)
+			return &builder.FirmwareManifest{
+				Files: []*builder.FileEntry{{Base: "lib", Path: "main.lua", Hash: "1"}},
+			}, nil
+		},
+		OnChange: func() {},
+	})
+	t.Ok(err)
+
+	ui := &UI{
+		output:        tview.NewTextView(),
+		deviceSyncers: make(map[string]*syncer.DeviceSyncer),
+	}
+	ui.setDeviceSyncer("device:1111", ds)
+	defer ui.removeDeviceSyncer("device:1111")
+
+	_, err = ds.Sync()
+	t.Assert(err != nil, "Expected sync to fail")
+	t.Equals(syncer.StateError, ds.Status().State)
+
+	pusher.fail = false
+	t.Ok(ui.resync("1111"))
+	t.Equals([]syncer.State{syncer.StateSyncing, syncer.StateSyncing}, states)
+	t.Equals(syncer.StateIdle, ds.Status().State)
+	t.Ok(ds.Status().Err)
+
+	list := ui.syncerStatusList()
+	t.Equals(1, len(list))
+	t.Equals("device:1111", list[0].SrcPath)
+}
+
+// oldRuntimeDevice answers like a device whose runtime predates the
+// capabilities query
+type oldRuntimeDevice struct {
+	in      *io.PipeReader
+	replies chan string
+	done    chan struct{}
+	pending string
+	queries int
+	lock    sync.Mutex
+}
+
+func newOldRuntimeDevice() *oldRuntimeDevice {
+	in, out := io.Pipe()
+	d := &oldRuntimeDevice{
+		in:      in,
+		replies: make(chan string, 10),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		for {
+			select {
+			case reply := <-d.replies:
+				out.Write([]byte(reply))
+			case <-d.done:
+				out.Close()
+				return
+			}
+		}
+	}()
+	return d
+}
+
+func (d *oldRuntimeDevice) Read(p []byte) (int, error) {
+	return d.in.Read(p)
+}
+
+func (d *oldRuntimeDevice) Write(p []byte) (int, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.pending += string(p)
+	for {
+		runtimeCheck := strings.Index(d.pending, "tostring(__espore ~= nil)")
+		query := strings.Index(d.pending, "__espore.capabilities()")
+		switch {
+		case runtimeCheck >= 0 && (query < 0 || runtimeCheck < query):
+			d.pending = d.pending[runtimeCheck+1:]
+			d.replies <- "espore=true\r\n"
+		case query >= 0:
+			d.pending = d.pending[query+1:]
+			d.queries++
+			d.replies <- "{\r\n\"err\":\"attempt to call field 'capabilities' (a nil value)\"\r\n}\r\n"
+		default:
+			return len(p), nil
+		}
+	}
+}
+
+func (d *oldRuntimeDevice) Close() error {
+	close(d.done)
+	return nil
+}
+
+func (d *oldRuntimeDevice) capabilityQueries() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.queries
+}
+
+// recordingPusher queries the capabilities of a real session but records
+// the files pushed instead of uploading them
+type recordingPusher struct {
+	*session.Session
+	pushed []string
+}
+
+func (rp *recordingPusher) PushFile(srcPath, dstName string) error {
+	rp.pushed = append(rp.pushed, filepath.Base(srcPath)+" -> "+dstName)
+	return nil
+}
+
+func TestPushWatchedFileOldRuntime(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, err := ioutil.TempDir("", "espore-watch")
+	t.Ok(err)
+	defer os.RemoveAll(dir)
+	t.Ok(ioutil.WriteFile(filepath.Join(dir, "app.lua"), []byte("return 1"), 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(dir, "app.lua.gz"), []byte("gzipped"), 0644))
+
+	device := newOldRuntimeDevice()
+	s, err := session.New(&session.Config{Socket: device, LineDelay: time.Millisecond})
+	t.Ok(err)
+	defer s.Close()
+	pusher := &recordingPusher{Session: s}
+
+	// without the capabilities query, gzip is not used
+	dstName, err := pushWatchedFile(pusher, dir, "www", filepath.Join(dir, "app.lua"))
+	t.Ok(err)
+	t.Equals("www/app.lua", dstName)
+	dstName, err = pushWatchedFile(pusher, dir, "www", filepath.Join(dir, "app.lua.gz"))
+	t.Ok(err)
+	t.Equals("", dstName)
+	t.Equals([]string{"app.lua -> www/app.lua"}, pusher.pushed)
+	t.Equals(1, device.capabilityQueries())
+
+	// a restart may bring a different runtime
+	t.Ok(s.NodeRestart())
+	_, err = pushWatchedFile(pusher, dir, "www", filepath.Join(dir, "app.lua"))
+	t.Ok(err)
+	t.Equals(2, device.capabilityQueries())
+}
@@ -0,0 +1,79 @@
+package cli
+
+import (
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// transcript forwards everything written to it to W, keeping the last
+// maxLines lines so the session can be saved later
+type transcript struct {
+	W        io.Writer
+	maxLines int
+	// lines is a ring buffer of the complete lines, the oldest at start once
+	// maxLines are retained
+	lines   []string
+	start   int
+	partial string
+	lock    sync.Mutex
+}
+
+func newTranscript(w io.Writer, maxLines int) *transcript {
+	return &transcript{
+		W:        w,
+		maxLines: maxLines,
+	}
+}
+
+// Write records p and forwards it to W. Concurrent writes reach W in the
+// order they are recorded.
+func (t *transcript) Write(p []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.record(p)
+	return t.W.Write(p)
+}
+
+// Record adds p to the transcript without forwarding it to W
+func (t *transcript) Record(p []byte) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.record(p)
+}
+
+func (t *transcript) record(p []byte) {
+	lines := strings.Split(t.partial+string(p), "\n")
+	t.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		if len(t.lines) < t.maxLines {
+			t.lines = append(t.lines, line)
+			continue
+		}
+		if t.maxLines > 0 {
+			t.lines[t.start] = line
+			t.start = (t.start + 1) % t.maxLines
+		}
+	}
+}
+
+var colorTagRegex = regexp.MustCompile(`\[([a-zA-Z]+|#[0-9a-zA-Z]{6}|\-)?(:([a-zA-Z]+|#[0-9a-zA-Z]{6}|\-)?(:([lbdru]+|\-)?)?)?\]`)
+var escapedTagRegex = regexp.MustCompile(`\[([a-zA-Z0-9_,;: \-\."#]+)\[(\[*)\]`)
+
+// Text returns the retained transcript with the color tags removed
+func (t *transcript) Text() string {
+	t.lock.Lock()
+	lines := make([]string, 0, len(t.lines)+1)
+	lines = append(append(lines, t.lines[t.start:]...), t.lines[:t.start]...)
+	text := strings.Join(append(lines, t.partial), "\n")
+	t.lock.Unlock()
+	text = colorTagRegex.ReplaceAllString(text, "")
+	return escapedTagRegex.ReplaceAllString(text, "[$1$2]")
+}
+
+// Save writes the retained transcript to the given file
+func (t *transcript) Save(path string) error {
+	return ioutil.WriteFile(path, []byte(t.Text()), 0644)
+}
@@ -0,0 +1,82 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestTranscriptSave(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, err := ioutil.TempDir("", "espore-transcript")
+	t.Ok(err)
+	defer os.RemoveAll(dir)
+
+	var screen bytes.Buffer
+	tr := newTranscript(&screen, 100)
+	ui := &UI{transcript: tr}
+
+	fmt.Fprintf(ui.writer(), "> %s\n", "print(node.heap())")
+	tr.Write([]byte("4312"))
+	tr.Write([]byte("8\n> "))
+	ui.Printf("Transcript [red]test[-] %d\n", 1)
+
+	path := filepath.Join(dir, "session.txt")
+	t.Ok(tr.Save(path))
+	saved, err := ioutil.ReadFile(path)
+	t.Ok(err)
+	t.Equals("> print(node.heap())\n43128\n> Transcript test 1\n", string(saved))
+	t.Equals("> print(node.heap())\n43128\n> [yellow]Transcript [red]test[-] 1\n[-]", screen.String())
+}
+
+func TestTranscriptBounded(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	tr := newTranscript(ioutil.Discard, 3)
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(tr, "line %d\n", i)
+	}
+	t.Equals("line 7\nline 8\nline 9\n", tr.Text())
+	t.Equals(3, len(tr.lines))
+
+	// a single write wrapping around the buffer keeps the order
+	fmt.Fprint(tr, "a\nb\npartial")
+	t.Equals("line 9\na\nb\npartial", tr.Text())
+	t.Equals(3, len(tr.lines))
+}
+
+func TestEchoCommands(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	var screen bytes.Buffer
+	ui := &UI{transcript: newTranscript(&screen, 100)}
+	ui.commandHandlers = ui.buildCommandHandlers()
+
+	ui.echoCommand("reboot")
+	t.Equals("", screen.String())
+
+	t.Ok(ui.parseCommandLine("/echo on"))
+	screen.Reset()
+	ui.echoCommand("node.heap()")
+	t.Equals("[aqua]> node.heap()[-]\n", screen.String())
+
+	t.Ok(ui.parseCommandLine("/echo off"))
+	screen.Reset()
+	ui.echoCommand("reboot")
+	t.Equals("", screen.String())
+
+	t.Assert(ui.parseCommandLine("/echo maybe") != nil, "Expected invalid echo mode to fail")
+
+	// the transcript keeps every command regardless of echo
+	t.Equals(3, strings.Count(ui.transcript.Text(), "> "))
+}
@@ -7,6 +7,7 @@ import (
 	"espore/config"
 	"espore/session"
 	"fmt"
+	"io"
 	"regexp"
 	"sync"
 
@@ -28,6 +29,8 @@ type UI struct {
 	app               *tview.Application
 	input             *tview.InputField
 	output            *tview.TextView
+	transcript        *transcript
+	outputWriter      *serialWriter
 	fileBrowser       *tview.Table
 	fileBrowserHidden bool
 	outerFlex         *tview.Flex
@@ -36,7 +39,17 @@ type UI struct {
 	mainWnd           *winman.WindowBase
 	commandHandlers   map[string]*commandHandler
 	syncers           map[string]*syncer.Syncer
+	deviceSyncers     map[string]*syncer.DeviceSyncer
+	syncersLock       sync.Mutex
+	remoteDir         string
+	echo              bool
 	commands          chan func()
+	// confirm asks the user to confirm a destructive action
+	confirm func(message string, callback func(ok bool))
+	// forwarder sends the device output to a TCP address set with /forward
+	forwarder *forwarder
+	// feeder writes a local file to the device, set with /feed
+	feeder *feeder
 }
 
 var commandRegex = regexp.MustCompile(`(?m)^\/([^ ]*) *(.*)$`)
@@ -49,6 +62,7 @@ func New(config *Config) *UI {
 	ui := &UI{
 		Config:            *config,
 		syncers:           make(map[string]*syncer.Syncer),
+		deviceSyncers:     make(map[string]*syncer.DeviceSyncer),
 		commands:          make(chan func(), 10),
 		app:               tview.NewApplication(),
 		outerFlex:         tview.NewFlex(),
@@ -59,11 +73,16 @@ func New(config *Config) *UI {
 		fileBrowser:       tview.NewTable(),
 		fileBrowserHidden: false,
 	}
+	ui.outputWriter = newSerialWriter(ui.output)
+	ui.transcript = newTranscript(ui.outputWriter, MAX_TEXT_BUFFER)
+	ui.confirm = ui.confirmWithDialog
+	ui.echo = ui.EsporeConfig.EchoCommands
 	ui.commandHandlers = ui.buildCommandHandlers()
 	ui.Session.Log = ui
+	ui.Session.Progress = newProgressDisplay(ui.Printf).Update
 	ui.dumper = &Dumper{
 		R: ui.Session,
-		W: ui.output,
+		W: ui.transcript,
 	}
 	ui.mainWnd = ui.wm.NewWindow().
 		Show().
@@ -74,7 +93,31 @@ func New(config *Config) *UI {
 }
 
 func (ui *UI) Printf(format string, a ...interface{}) {
-	fmt.Fprintf(ui.output, "[yellow]"+format+"[-]", a...)
+	fmt.Fprintf(ui.writer(), "[yellow]"+format+"[-]", a...)
+}
+
+// writer returns where output is written to, recording it in the transcript
+// when there is one
+func (ui *UI) writer() io.Writer {
+	if ui.transcript == nil {
+		return ui.output
+	}
+	return ui.transcript
+}
+
+// handleGlobalKeys processes the keys that work anywhere in the UI
+func (ui *UI) handleGlobalKeys(event *tcell.EventKey) *tcell.EventKey {
+	switch event.Key() {
+	case tcell.KeyCtrlB:
+		if ui.fileBrowserHidden {
+			ui.fileBrowserHidden = false
+			ui.innerFlex.ResizeItem(ui.fileBrowser, 20, 0)
+		} else {
+			ui.fileBrowserHidden = true
+			ui.innerFlex.ResizeItem(ui.fileBrowser, 0, 0)
+		}
+	}
+	return event
 }
 
 func (ui *UI) Run() error {
@@ -101,21 +144,10 @@ func (ui *UI) Run() error {
 
 	}()
 
-	ui.app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
-		switch event.Key() {
-		case tcell.KeyCtrlB:
-			if ui.fileBrowserHidden {
-				ui.fileBrowserHidden = false
-				ui.innerFlex.ResizeItem(ui.fileBrowser, 20, 0)
-			} else {
-				ui.fileBrowserHidden = true
-				ui.innerFlex.ResizeItem(ui.fileBrowser, 0, 0)
-			}
-		}
-		return event
-	})
+	ui.app.SetInputCapture(ui.handleGlobalKeys)
 
 	ui.dumper.Dump()
+	defer ui.outputWriter.Close()
 	defer ui.dumper.Close()
 
 	if err := ui.app.SetRoot(ui.wm, true).EnableMouse(true).Run(); err != nil {
@@ -1,12 +1,27 @@
 package cli
 
 import (
+	"errors"
+	"fmt"
 	"sort"
 	"strings"
+	"unicode"
 
 	"github.com/gdamore/tcell"
+	"github.com/rivo/tview"
 )
 
+// echoCommand records a submitted command in the transcript, also showing it
+// in the output pane if echo is on
+func (ui *UI) echoCommand(cmd string) {
+	line := fmt.Sprintf("[aqua]> %s[-]\n", tview.Escape(cmd))
+	if ui.echo {
+		fmt.Fprint(ui.writer(), line)
+	} else if ui.transcript != nil {
+		ui.transcript.Record([]byte(line))
+	}
+}
+
 func (ui *UI) initInput() {
 	input := ui.input
 
@@ -21,6 +36,7 @@ func (ui *UI) initInput() {
 			}
 			ui.input.SetText("")
 			ui.commands <- func() {
+				ui.echoCommand(cmd)
 				err := ui.parseCommandLine(cmd)
 				if err != nil {
 					ui.Printf("Error executing command: %s", err)
@@ -42,14 +58,7 @@ func (ui *UI) initInput() {
 		return event
 	})
 
-	var commands []string
-	for c := range ui.commandHandlers {
-		commands = append(commands, c)
-	}
-	sort.Slice(commands, func(i, j int) bool {
-		return strings.Compare(commands[i], commands[j]) < 0
-	})
-
+	commands := ui.commandNames()
 	input.SetAutocompleteFunc(func(currentText string) []string {
 		if len(currentText) == 0 {
 			return nil
@@ -69,7 +78,20 @@ func (ui *UI) parseCommandLine(cmdline string) error {
 	match := commandRegex.FindStringSubmatch(cmdline)
 	if len(match) > 0 {
 		command := match[1]
-		parameters := strings.Split(match[2], " ")
+		parameters, err := splitParameters(match[2])
+		if err != nil {
+			ui.Printf("Error parsing parameters: %s\n", err)
+			return nil
+		}
+		if command == "" {
+			ui.Printf("Usage: /<command> [parameters]. Commands: %s\n", strings.Join(ui.commandNames(), ", "))
+			return nil
+		}
+		command, candidates := resolveCommand(ui.commandHandlers, command)
+		if len(candidates) > 1 {
+			ui.Printf("Ambiguous command %q, could be: %s\n", match[1], strings.Join(candidates, ", "))
+			return nil
+		}
 		handler := ui.commandHandlers[command]
 		if handler == nil {
 			ui.Printf("Unknown command %q\n", command)
@@ -83,3 +105,90 @@ func (ui *UI) parseCommandLine(cmdline string) error {
 	}
 	return ui.Session.SendCommand(cmdline)
 }
+
+// commandNames returns the names of all the commands, sorted
+func (ui *UI) commandNames() []string {
+	var commands []string
+	for c := range ui.commandHandlers {
+		commands = append(commands, c)
+	}
+	sort.Strings(commands)
+	return commands
+}
+
+// resolveCommand returns the name of the handler matching command, either
+// exactly or as its only prefix. Handlers requiring their exact name are
+// never matched by a prefix. If several handlers share the prefix, it returns
+// their names, sorted. Unknown and empty commands are returned as is.
+func resolveCommand(handlers map[string]*commandHandler, command string) (string, []string) {
+	if _, ok := handlers[command]; ok || command == "" {
+		return command, nil
+	}
+	var candidates []string
+	for name, handler := range handlers {
+		if !handler.exactName && strings.HasPrefix(name, command) {
+			candidates = append(candidates, name)
+		}
+	}
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+	sort.Strings(candidates)
+	return command, candidates
+}
+
+// splitParameters splits a command parameter string into its tokens in a
+// shell-like fashion: whitespace separates tokens, single quotes preserve
+// their contents literally, and backslash escapes the next character both
+// outside quotes and within double quotes
+func splitParameters(st string) ([]string, error) {
+	var params []string
+	var token strings.Builder
+	var inToken, escaped bool
+	var quote rune
+
+	for _, c := range st {
+		switch {
+		case escaped:
+			token.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				token.WriteRune(c)
+			}
+		case c == '\\':
+			escaped = true
+			inToken = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				token.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inToken = true
+		case unicode.IsSpace(c):
+			if inToken {
+				params = append(params, token.String())
+				token.Reset()
+				inToken = false
+			}
+		default:
+			token.WriteRune(c)
+			inToken = true
+		}
+	}
+	if escaped {
+		return nil, errors.New("Unterminated escape sequence")
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("Unterminated %c quote", quote)
+	}
+	if inToken {
+		params = append(params, token.String())
+	}
+	return params, nil
+}
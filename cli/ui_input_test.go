@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestSplitParameters(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	split := func(st string) []string {
+		params, err := splitParameters(st)
+		t.Ok(err)
+		return params
+	}
+
+	t.Equals(0, len(split("")))
+	t.Equals(0, len(split("    ")))
+	t.Equals([]string{"a", "b"}, split("a  b"))
+	t.Equals([]string{"a", "b"}, split("  a\tb  "))
+
+	// quoted paths
+	t.Equals([]string{"my file.lua", "dst.lua"}, split(`"my file.lua" dst.lua`))
+	t.Equals([]string{"my file.lua"}, split(`'my file.lua'`))
+	t.Equals([]string{`say "hi"`}, split(`'say "hi"'`))
+	t.Equals([]string{`a"b`}, split(`"a\"b"`))
+	t.Equals([]string{""}, split(`""`))
+	t.Equals([]string{"pre fix.lua"}, split(`pre" "fix.lua`))
+
+	// escaped spaces
+	t.Equals([]string{"my file.lua"}, split(`my\ file.lua`))
+	t.Equals([]string{`back\slash`}, split(`back\\slash`))
+
+	_, err := splitParameters(`"unterminated`)
+	t.Assert(err != nil, "Expected unterminated quote to fail")
+	_, err = splitParameters(`trailing\`)
+	t.Assert(err != nil, "Expected trailing backslash to fail")
+}
+
+func TestResolveCommand(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	handlers := (&UI{}).buildCommandHandlers()
+
+	// unique prefix
+	command, candidates := resolveCommand(handlers, "who")
+	t.Equals("whoincludes", command)
+	t.Equals(0, len(candidates))
+
+	// ambiguous prefix
+	command, candidates = resolveCommand(handlers, "res")
+	t.Equals("res", command)
+	t.Equals([]string{"restart", "resync"}, candidates)
+
+	// destructive commands need their full name
+	command, candidates = resolveCommand(handlers, "resto")
+	t.Equals("resto", command)
+	t.Equals(0, len(candidates))
+	command, candidates = resolveCommand(handlers, "form")
+	t.Equals("form", command)
+	t.Equals(0, len(candidates))
+	command, candidates = resolveCommand(handlers, "format")
+	t.Equals("format", command)
+	t.Equals(0, len(candidates))
+
+	// an empty name matches nothing
+	command, candidates = resolveCommand(handlers, "")
+	t.Equals("", command)
+	t.Equals(0, len(candidates))
+
+	// an exact match wins over the commands it is a prefix of
+	command, candidates = resolveCommand(handlers, "clear")
+	t.Equals("clear", command)
+	t.Equals(0, len(candidates))
+
+	// unknown command
+	command, candidates = resolveCommand(handlers, "nope")
+	t.Equals("nope", command)
+	t.Equals(0, len(candidates))
+}
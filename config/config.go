@@ -5,12 +5,203 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 )
 
 type BuildConfig struct {
-	Libs    []string `json:"libs"`
-	Devices []string `json:"devices"`
-	Output  string   `json:"output"`
+	Libs         []string `json:"libs"`
+	Devices      []string `json:"devices"`
+	Output       string   `json:"output"`
+	ImageVersion int      `json:"imageVersion"`
+	ControlFiles []string `json:"controlFiles"`
+	// MaxLineLength and MaxFileSize, when set, produce build warnings for Lua
+	// files exceeding them
+	MaxLineLength int   `json:"maxLineLength"`
+	MaxFileSize   int64 `json:"maxFileSize"`
+	// LargeFileWarning, when set, produces a build warning for any shipped
+	// file larger than this many bytes, such as an oversized datafile
+	LargeFileWarning int64 `json:"largeFileWarning"`
+	// DirectiveKeywords are the accepted keywords for dependency directives
+	// such as "-- import: a, b"
+	DirectiveKeywords []string `json:"directiveKeywords"`
+	// CacheDir, when set, persists compiled LFS images and the hashes and
+	// parsed dependencies of source files across builds
+	CacheDir string `json:"cacheDir"`
+	// AllowedExtensions, when not empty, restricts the files shipped to those
+	// with the given extensions. Lua sources are always allowed.
+	AllowedExtensions []string `json:"allowedExtensions"`
+	// BuiltAt and Revision, when set, override the build time and git
+	// revision recorded in the manifests
+	BuiltAt  string `json:"builtAt"`
+	Revision string `json:"revision"`
+	// SearchPath lists the templates, like Lua's package.path, required
+	// modules are looked up with, in order. A "?" stands for the module name
+	// with dots replaced by "/". Defaults to DefaultSearchPath.
+	SearchPath []string `json:"searchPath"`
+	// TestPatterns are globs matching test files, which are left out of
+	// libraries and devices along with their dependencies. Defaults to
+	// DefaultTestPatterns, an empty list keeps test files.
+	TestPatterns []string `json:"testPatterns"`
+	// StrictIncludes fails the build when a library include pattern does
+	// not match any file, instead of ignoring it
+	StrictIncludes bool `json:"strictIncludes"`
+	// CaseInsensitivePaths fails the build when two files shipped to a
+	// device have paths that differ only in case
+	CaseInsensitivePaths bool `json:"caseInsensitivePaths"`
+	// Parallelism bounds how many devices are built at the same time.
+	// Defaults to the number of CPUs.
+	Parallelism int `json:"parallelism"`
+	// LuacRetries is how many times the LFS compilation is attempted before
+	// giving up, waiting longer after each failure since luac.cross fails
+	// under load. Defaults to DefaultLuacRetries.
+	LuacRetries int `json:"luacRetries"`
+	// Reproducible leaves the build time and revision empty unless
+	// explicitly set, so repeated builds produce identical output
+	Reproducible bool `json:"reproducible"`
+	// AuditDeviceFiles warns about files in device folders that no module
+	// requires and no include pattern matches, which may be leftovers
+	AuditDeviceFiles bool `json:"auditDeviceFiles"`
+	// EmbedManifest ships files.json, mapping each file path to its hash, in
+	// the device image so the device can verify its files
+	EmbedManifest bool `json:"embedManifest"`
+	// VersionModule ships a generated version.lua returning the device id
+	// and name, manifest checksum, build time and revision, so device code can
+	// require("version") to report its firmware version
+	VersionModule bool `json:"versionModule"`
+	// NoClean keeps the contents of the output directory on a full build,
+	// overwriting only the artifacts of the devices built, so artifacts of
+	// devices that are not part of the build survive
+	NoClean bool `json:"noClean"`
+	// ChecksumOnly computes only the manifest checksum of each device and
+	// writes it to <id>.sum, skipping LFS compilation, images and JSON
+	// manifests, so CI can cheaply tell which devices changed
+	ChecksumOnly bool `json:"checksumOnly"`
+	// Overrides maps image paths to local files whose content is shipped
+	// instead, to inject environment-specific config or secrets from CI.
+	// Paths a device does not ship are ignored.
+	Overrides map[string]string `json:"overrides"`
+	// Lockfile is the path of a file, such as espore.lock, recording the
+	// files resolved for each device and their hashes. It is updated on
+	// every build unless FrozenLockfile is set. Empty disables it.
+	Lockfile string `json:"lockfile"`
+	// FrozenLockfile fails the build when the resolved files differ from
+	// those recorded in Lockfile, instead of updating it
+	FrozenLockfile bool `json:"frozenLockfile"`
+	// Verbosity controls how much the build prints, Normal by default
+	Verbosity Verbosity `json:"verbosity"`
+	// Site holds site-wide values available to firmware.json.tmpl templates
+	Site map[string]interface{} `json:"site"`
+}
+
+// Verbosity is how much the build prints
+type Verbosity string
+
+const (
+	// Quiet prints errors only
+	Quiet Verbosity = "quiet"
+	// Normal also prints warnings and notices
+	Normal Verbosity = "normal"
+	// Verbose also prints every file included in each device and every
+	// cache hit or miss
+	Verbose Verbosity = "verbose"
+)
+
+// GetVerbosity returns the configured verbosity, Normal if none is set
+func (bc *BuildConfig) GetVerbosity() Verbosity {
+	if bc.Verbosity == "" {
+		return Normal
+	}
+	return bc.Verbosity
+}
+
+// GetParallelism returns how many devices can be built concurrently
+func (bc *BuildConfig) GetParallelism() int {
+	if bc.Parallelism <= 0 {
+		return runtime.NumCPU()
+	}
+	return bc.Parallelism
+}
+
+// DefaultLuacRetries is how many times the LFS compilation is attempted by
+// default
+const DefaultLuacRetries = 3
+
+// GetLuacRetries returns how many times the LFS compilation is attempted
+func (bc *BuildConfig) GetLuacRetries() int {
+	if bc.LuacRetries <= 0 {
+		return DefaultLuacRetries
+	}
+	return bc.LuacRetries
+}
+
+// IsExtensionAllowed returns whether files with the given extension can be
+// shipped to the device
+func (bc *BuildConfig) IsExtensionAllowed(ext string) bool {
+	if len(bc.AllowedExtensions) == 0 {
+		return true
+	}
+	ext = strings.ToLower(strings.TrimPrefix(ext, "."))
+	if ext == "lua" || ext == "lc" {
+		return true
+	}
+	for _, allowed := range bc.AllowedExtensions {
+		if strings.ToLower(strings.TrimPrefix(allowed, ".")) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultDirectiveKeywords are the dependency directive keywords accepted when
+// none are configured
+var DefaultDirectiveKeywords = []string{"import"}
+
+// GetDirectiveKeywords returns the configured dependency directive keywords,
+// or the defaults if none are configured
+func (bc *BuildConfig) GetDirectiveKeywords() []string {
+	if len(bc.DirectiveKeywords) > 0 {
+		return bc.DirectiveKeywords
+	}
+	return DefaultDirectiveKeywords
+}
+
+// DefaultSearchPath maps module a.b to a/b.lua
+var DefaultSearchPath = []string{"?.lua"}
+
+// GetSearchPath returns the configured module search path, or the default if
+// none is configured
+func (bc *BuildConfig) GetSearchPath() []string {
+	if len(bc.SearchPath) > 0 {
+		return bc.SearchPath
+	}
+	return DefaultSearchPath
+}
+
+// DefaultTestPatterns match the test files excluded when no test patterns are
+// configured
+var DefaultTestPatterns = []string{"*_test.lua", "*_spec.lua"}
+
+// GetTestPatterns returns the configured test file patterns, or the defaults
+// if none are configured
+func (bc *BuildConfig) GetTestPatterns() []string {
+	if bc.TestPatterns == nil {
+		return DefaultTestPatterns
+	}
+	return bc.TestPatterns
+}
+
+// DefaultControlFiles lists the build-control files that are never shipped
+// to the device
+var DefaultControlFiles = []string{"firmware.json", "firmware.json.tmpl", "firmware.yaml", "library.json", "lib.json", ".espoignore"}
+
+// GetControlFiles returns the configured build-control files, or the
+// defaults if none are configured
+func (bc *BuildConfig) GetControlFiles() []string {
+	if len(bc.ControlFiles) > 0 {
+		return bc.ControlFiles
+	}
+	return DefaultControlFiles
 }
 
 var DefaultConfig = &EsporeConfig{
@@ -23,6 +214,68 @@ var DefaultConfig = &EsporeConfig{
 type EsporeConfig struct {
 	Build   BuildConfig `json:"build"`
 	DataDir string      `json:"dataDir"`
+	// Groups maps group names to the ids of their member devices
+	Groups map[string][]string `json:"groups"`
+	// EchoCommands shows the typed commands in the output pane on startup
+	EchoCommands bool `json:"echoCommands"`
+	// Serial configures how commands are sent to the device
+	Serial SerialConfig `json:"serial"`
+	// FreeSpaceMargin is the number of bytes that must remain free on the
+	// device after a sync. Defaults to DefaultFreeSpaceMargin, a negative
+	// value disables the margin.
+	FreeSpaceMargin int64 `json:"freeSpaceMargin"`
+}
+
+// DefaultFreeSpaceMargin leaves room on the device for logs and config files
+const DefaultFreeSpaceMargin = 4096
+
+// SerialConfig configures the pacing of commands sent over the serial link
+type SerialConfig struct {
+	// LineTerminator ends each command line, "\n" by default
+	LineTerminator string `json:"lineTerminator"`
+	// LineDelay is the pause after each line, in milliseconds. Defaults to
+	// 100ms when unset, 0 sends lines without pause.
+	LineDelay *int `json:"lineDelay"`
+	// CharDelay, when set, is the pause after each character, in milliseconds
+	CharDelay int `json:"charDelay"`
+}
+
+// ExpandDevices replaces each @group reference in the list by the ids of the
+// group members, returning the resulting device ids without duplicates
+func (ec *EsporeConfig) ExpandDevices(devices []string) ([]string, error) {
+	var ids []string
+	added := make(map[string]bool)
+	add := func(id string) {
+		if !added[id] {
+			added[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for _, device := range devices {
+		if !strings.HasPrefix(device, "@") {
+			add(device)
+			continue
+		}
+		members, ok := ec.Groups[device[1:]]
+		if !ok {
+			return nil, fmt.Errorf("Unknown device group %q", device[1:])
+		}
+		for _, id := range members {
+			add(id)
+		}
+	}
+	return ids, nil
+}
+
+// GetFreeSpaceMargin returns the configured free space margin in bytes
+func (ec *EsporeConfig) GetFreeSpaceMargin() int64 {
+	if ec.FreeSpaceMargin == 0 {
+		return DefaultFreeSpaceMargin
+	}
+	if ec.FreeSpaceMargin < 0 {
+		return 0
+	}
+	return ec.FreeSpaceMargin
 }
 
 func (ec *EsporeConfig) GetDataDir() string {
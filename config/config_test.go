@@ -0,0 +1,27 @@
+package config_test
+
+import (
+	"espore/config"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestExpandDevices(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	ec := &config.EsporeConfig{
+		Groups: map[string][]string{
+			"sensors": {"1111", "2222"},
+			"kitchen": {"2222", "3333"},
+		},
+	}
+
+	ids, err := ec.ExpandDevices([]string{"@sensors", "4444", "@kitchen"})
+	t.Ok(err)
+	t.Equals([]string{"1111", "2222", "4444", "3333"}, ids)
+
+	_, err = ec.ExpandDevices([]string{"@unknown"})
+	t.Assert(err != nil, "Expected unknown group to fail")
+}
@@ -78,14 +78,23 @@ function boot()
         end
 
         local totalFiles = nil
+        -- delta images list the files to delete instead of replacing all
+        local deleted = nil
         -- skip other headers. TODO: check these headers for validity
         repeat
             line = f:readline()
             if line ~= nil then
+                if string.find(line, "Delta Image File", 1, true) then
+                    deleted = {}
+                end
                 if totalFiles == nil then
                     totalFiles = tonumber(
                                      string.match(line, "Total files:%s*(%d*)\n"))
                 end
+                local toDelete = string.match(line, "^Delete: (.+)\n")
+                if toDelete ~= nil and deleted ~= nil then
+                    table.insert(deleted, toDelete)
+                end
             end
         until (line == "\n" or line == nil)
         if line == nil then return nil, "Cannot find image file body" end
@@ -138,7 +147,16 @@ function boot()
             totalFiles = totalFiles - 1
         end
         f:close()
-        return fileList, nil
+        return fileList, nil, deleted
+    end
+
+    M.removeDeleted = function(deleted)
+        for _, name in ipairs(deleted) do
+            if name ~= "init.lua" then
+                M.log_info("Removing %s", name)
+                file.remove(name)
+            end
+        end
     end
 
     M.cleanup = function(fileList)
@@ -174,10 +192,12 @@ function boot()
         file.remove(M.UPDATE_1ST_FILE)
         file.remove(M.UPDATE_FAIL_FILE)
         file.remove(M.UPDATE_NEW_FILE)
-        fileList, err = M.unpackImage(M.UPDATE_OLD_FILE)
+        local fileList, err, deleted = M.unpackImage(M.UPDATE_OLD_FILE)
         if err ~= nil then
             M.log_error("Error restoring previous version. Halt.")
             return
+        elseif deleted ~= nil then
+            M.log_error("Previous version was a delta image, files removed by the update cannot be restored")
         else
             M.cleanup(fileList)
         end
@@ -214,13 +234,17 @@ function boot()
                 if file.exists(M.UPDATE_NEW_FILE) then
                     file.remove(M.UPDATE_1ST_FILE)
                     file.rename(M.UPDATE_NEW_FILE, M.UPDATE_1ST_FILE)
-                    local fileList, err = M.unpackImage(M.UPDATE_1ST_FILE)
+                    local fileList, err, deleted = M.unpackImage(M.UPDATE_1ST_FILE)
                     if err ~= nil then
                         M.log_error("Error unpacking update file: %s", err)
                         M.restorePreviousVersion()
                         return
                     end
-                    M.cleanup(fileList)
+                    if deleted ~= nil then
+                        M.removeDeleted(deleted)
+                    else
+                        M.cleanup(fileList)
+                    end
                     if M.flashLFS() ~= nil then
                         M.log_error("Error flashing LFS: %s", err)
                         M.restorePreviousVersion()
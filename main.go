@@ -12,22 +12,36 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/tarm/serial"
 )
 
-func getSerialSession(port string) (s *session.Session, close func(), err error) {
+func getSerialSession(port string, serialConfig *config.SerialConfig) (s *session.Session, close func(), err error) {
 	socket, err := serial.OpenPort(&serial.Config{Name: port, Baud: 115200, ReadTimeout: time.Second * 1})
 	if err != nil {
 		return nil, nil, err
 	}
 
+	var lineDelay time.Duration
+	if serialConfig.LineDelay != nil {
+		lineDelay = time.Duration(*serialConfig.LineDelay) * time.Millisecond
+		if lineDelay == 0 {
+			// the session takes a zero delay as unset
+			lineDelay = -1
+		}
+	}
+
 	s, err = session.New(&session.Config{
-		Socket: socket,
+		Socket:         socket,
+		LineTerminator: serialConfig.LineTerminator,
+		LineDelay:      lineDelay,
+		CharDelay:      time.Duration(serialConfig.CharDelay) * time.Millisecond,
 	})
 	if err != nil {
 		socket.Close()
@@ -41,8 +55,8 @@ func getSerialSession(port string) (s *session.Session, close func(), err error)
 
 }
 
-func initFirmware(outputDir string, port string) error {
-	s, close, err := getSerialSession(port)
+func initFirmware(outputDir string, port string, serialConfig *config.SerialConfig) error {
+	s, close, err := getSerialSession(port, serialConfig)
 	if err != nil {
 		return err
 	}
@@ -51,6 +65,22 @@ func initFirmware(outputDir string, port string) error {
 	return initializer.Initialize(outputDir, s)
 }
 
+// extractImage writes the files of the image at path, or read from standard
+// input if path is "-", to dstDir
+func extractImage(path, dstDir string) error {
+	r, err := builder.OpenImage(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	header, err := builder.ExtractImage(r, dstDir)
+	if err != nil {
+		return err
+	}
+	log.Printf("Extracted %d files of device %s (%s) to %s", header.TotalFiles, header.ID, header.Name, dstDir)
+	return nil
+}
+
 func buildHistory(fileName string) (*history.History, error) {
 	var r io.Reader
 	f, err := os.Open(fileName)
@@ -73,6 +103,15 @@ func buildHistory(fileName string) (*history.History, error) {
 				fmt.Println(err)
 			}
 		},
+		OnRewrite: func(lines []string) {
+			var b strings.Builder
+			for _, line := range lines {
+				fmt.Fprintln(&b, line)
+			}
+			if err := ioutil.WriteFile(fileName, []byte(b.String()), 0644); err != nil {
+				fmt.Println(err)
+			}
+		},
 	})
 }
 
@@ -82,9 +121,20 @@ func main() {
 	cliFlag := flag.Bool("cli", false, "Run the interactive UI")
 	serverFlag := flag.Bool("server", false, "Run the firmware server")
 	port := flag.String("port", "/dev/ttyUSB0", "Serial port to connect to")
+	jsonErrorsFlag := flag.Bool("json-errors", false, "Print build errors as JSON records")
+	extractFlag := flag.String("extract", "", "Extract the files of an image, - reads it from stdin")
+	extractDirFlag := flag.String("extract-dir", ".", "Directory to extract image files to")
+	checksumOnlyFlag := flag.Bool("checksum-only", false, "Write only a checksum per device instead of building images")
 
 	flag.Parse()
 
+	if *extractFlag != "" {
+		if err := extractImage(*extractFlag, *extractDirFlag); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	config, err := config.Read()
 	if err != nil {
 		log.Printf("Error: %s", err)
@@ -101,7 +151,7 @@ func main() {
 	}
 
 	if *cliFlag {
-		session, close, err := getSerialSession(*port)
+		session, close, err := getSerialSession(*port, &config.Serial)
 		if err != nil {
 			log.Fatalf("Error opening session over serial: %s", err)
 		}
@@ -124,13 +174,21 @@ func main() {
 			log.Fatalf("CLI:%s", err)
 		}
 	}
+	if *checksumOnlyFlag {
+		config.Build.ChecksumOnly = true
+	}
 	err = builder.Build(&config.Build)
 	if err != nil {
+		if *jsonErrorsFlag {
+			errJSON, _ := builder.ErrorJSON(err)
+			fmt.Fprintln(os.Stderr, string(errJSON))
+			os.Exit(1)
+		}
 		log.Fatal(err)
 	}
 
 	if *initFlag {
-		if err := initFirmware(config.Build.Output, *port); err != nil {
+		if err := initFirmware(config.Build.Output, *port, &config.Serial); err != nil {
 			log.Fatal(err)
 		}
 	}
@@ -0,0 +1,41 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Capabilities queries the device for the optional features it supports,
+// such as "gzip". Runtimes that predate the query support none. The result
+// is cached until the device restarts or its runtime changes.
+func (s *Session) Capabilities() (map[string]bool, error) {
+	s.capabilitiesLock.Lock()
+	defer s.capabilitiesLock.Unlock()
+	if s.capabilities != nil {
+		return s.capabilities, nil
+	}
+	capabilities := make(map[string]bool)
+	if r, err := s.Rpc(`return __espore.capabilities()`); err == nil {
+		if err := json.Unmarshal(r, &capabilities); err != nil {
+			return nil, errors.New("Error decoding device capabilities")
+		}
+	}
+	s.capabilities = capabilities
+	return capabilities, nil
+}
+
+// resetCapabilities makes the next Capabilities call query the device again
+func (s *Session) resetCapabilities() {
+	s.capabilitiesLock.Lock()
+	defer s.capabilitiesLock.Unlock()
+	s.capabilities = nil
+}
+
+// HasCapability returns whether the device supports the given feature
+func (s *Session) HasCapability(name string) (bool, error) {
+	capabilities, err := s.Capabilities()
+	if err != nil {
+		return false, err
+	}
+	return capabilities[name], nil
+}
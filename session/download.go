@@ -0,0 +1,96 @@
+package session
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var downloadEndRegex = regexp.MustCompile(`^END ([0-9a-fA-F]{40})$`)
+
+// PullStream downloads a file from the device, writing its contents to w as
+// they arrive. The running hash is checked against the one reported by the
+// device when the transfer finishes.
+func (s *Session) PullStream(srcName string, w io.Writer) error {
+	return s.LockReader.Lock(func(socket io.Reader) error {
+		if err := s.ensureRuntime(socket); err != nil {
+			return err
+		}
+		s.Log.Printf("Pulling %s ", srcName)
+		if err := s.SendCommand(fmt.Sprintf("__espore.download(\"%s\")\n", srcName)); err != nil {
+			return err
+		}
+		if err := receiveStream(socket, w); err != nil {
+			s.Log.Printf("ERROR\n")
+			return err
+		}
+		s.Log.Printf("OK\n")
+		return nil
+	})
+}
+
+// PullFile downloads a file from the device into dstPath. The file is only
+// written if its checksum matches the one reported by the device.
+func (s *Session) PullFile(srcName, dstPath string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(dstPath), ".espore-download")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = s.PullStream(srcName, tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dstPath)
+}
+
+// receiveStream decodes the base64 lines sent by __espore.download, hashing
+// them as they are written to w, until the END line with the expected hash
+func receiveStream(r io.Reader, w io.Writer) error {
+	m, err := awaitRegex(r, `^(BEGIN|ERROR)`)
+	if err != nil {
+		return errors.New("Error waiting for download BEGIN signal")
+	}
+	if m[1] == "ERROR" {
+		return errors.New("Cannot open file in device")
+	}
+
+	hasher := sha1.New()
+	writer := io.MultiWriter(w, hasher)
+	for {
+		line, err := ReadLine(r)
+		if err != nil {
+			return fmt.Errorf("Error receiving file: %s", err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if m := downloadEndRegex.FindStringSubmatch(line); m != nil {
+			hash := hex.EncodeToString(hasher.Sum(nil))
+			if !strings.EqualFold(m[1], hash) {
+				return fmt.Errorf("Checksum hash mismatch. Expected %s, got %s", m[1], hash)
+			}
+			return nil
+		}
+		data, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return fmt.Errorf("Error decoding received data: %s", err)
+		}
+		if _, err := writer.Write(data); err != nil {
+			return err
+		}
+	}
+}
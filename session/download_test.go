@@ -0,0 +1,48 @@
+package session
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestReceiveStream(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	content := []byte(strings.Repeat("espore download test ", 20))
+	hasher := sha1.New()
+	hasher.Write(content)
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	stream := func(expectedHash string) *bytes.Buffer {
+		var sb bytes.Buffer
+		fmt.Fprintf(&sb, "\r\nBEGIN %d\r\n", len(content))
+		for i := 0; i < len(content); i += 96 {
+			end := i + 96
+			if end > len(content) {
+				end = len(content)
+			}
+			fmt.Fprintf(&sb, "%s\r\n", base64.StdEncoding.EncodeToString(content[i:end]))
+		}
+		fmt.Fprintf(&sb, "END %s\r\n", expectedHash)
+		return &sb
+	}
+
+	var out bytes.Buffer
+	t.Ok(receiveStream(stream(hash), &out))
+	t.Equals(content, out.Bytes())
+
+	out.Reset()
+	err := receiveStream(stream(strings.Repeat("0", 40)), &out)
+	t.Assert(err != nil, "Expected checksum mismatch to fail")
+
+	err = receiveStream(bytes.NewBufferString("\nERROR\n"), &out)
+	t.Assert(err != nil, "Expected device error to fail")
+}
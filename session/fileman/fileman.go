@@ -48,6 +48,20 @@ func (fm *Fileman) List() ([]FileEntry, error) {
 	return entries, nil
 }
 
+// FSInfo returns the bytes remaining, used and in total on the device
+// filesystem
+func (fm *Fileman) FSInfo() (remaining, used, total int64, err error) {
+	r, err := fm.s.Rpc(`return {file.fsinfo()}`)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var info []int64
+	if err := json.Unmarshal(r, &info); err != nil || len(info) != 3 {
+		return 0, 0, 0, errors.New("Error decoding filesystem info")
+	}
+	return info[0], info[1], info[2], nil
+}
+
 func (fm *Fileman) Rename(oldName, newName string) error {
 	_, err := fm.s.Rpc(fmt.Sprintf("__espore.renameFile('%s', '%s')", oldName, newName))
 	return err
@@ -7,26 +7,55 @@ import (
 	"time"
 )
 
+// DefaultLineTerminator ends each line sent to the device unless configured
+// otherwise
+const DefaultLineTerminator = "\n"
+
 type LineWriter struct {
 	w io.Writer
 	b bytes.Buffer
+	// Terminator is appended to each line
+	Terminator string
+	// LineDelay, when positive, is the pause after each line
+	LineDelay time.Duration
+	// CharDelay, when set, paces the line one byte at a time
+	CharDelay time.Duration
 }
 
 func NewLineWriter(writer io.Writer) *LineWriter {
 	return &LineWriter{
-		w: writer,
+		w:          writer,
+		Terminator: DefaultLineTerminator,
+		LineDelay:  throttle,
 	}
 }
 
 func (lw *LineWriter) Write(data []byte) (int, error) {
 	scanner := bufio.NewScanner(bytes.NewBuffer(data))
 	for scanner.Scan() {
-		line := append(scanner.Bytes(), 10) // add a LF at the end
-		i, err := lw.w.Write(line)
-		if err != nil {
-			return i, err
+		// copy the line, since appending in place would overwrite the
+		// scanner buffer with terminators longer than the newline
+		line := append(append([]byte(nil), scanner.Bytes()...), lw.Terminator...)
+		if err := lw.writeLine(line); err != nil {
+			return 0, err
+		}
+		if lw.LineDelay > 0 {
+			time.Sleep(lw.LineDelay)
 		}
-		time.Sleep(throttle)
 	}
 	return len(data), nil
 }
+
+func (lw *LineWriter) writeLine(line []byte) error {
+	if lw.CharDelay == 0 {
+		_, err := lw.w.Write(line)
+		return err
+	}
+	for i := range line {
+		if _, err := lw.w.Write(line[i : i+1]); err != nil {
+			return err
+		}
+		time.Sleep(lw.CharDelay)
+	}
+	return nil
+}
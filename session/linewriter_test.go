@@ -0,0 +1,137 @@
+package session
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+)
+
+type timedWrite struct {
+	data []byte
+	at   time.Time
+}
+
+type recordingWriter struct {
+	writes []timedWrite
+	lock   sync.Mutex
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	rw.writes = append(rw.writes, timedWrite{data: append([]byte(nil), p...), at: time.Now()})
+	return len(p), nil
+}
+
+func (rw *recordingWriter) Read(p []byte) (int, error) { return 0, io.EOF }
+func (rw *recordingWriter) Close() error               { return nil }
+
+func (rw *recordingWriter) bytes() []byte {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	var b bytes.Buffer
+	for _, w := range rw.writes {
+		b.Write(w.data)
+	}
+	return b.Bytes()
+}
+
+func TestLineWriterPacing(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	rw := &recordingWriter{}
+	lw := NewLineWriter(rw)
+	lw.Terminator = "\r\n"
+	lw.LineDelay = 0
+	lw.CharDelay = 5 * time.Millisecond
+
+	start := time.Now()
+	n, err := lw.Write([]byte("a=1\nprint(a)"))
+	t.Ok(err)
+	t.Equals(12, n)
+	t.Equals([]byte("a=1\r\nprint(a)\r\n"), rw.bytes())
+	t.Equals(15, len(rw.writes))
+	t.Assert(time.Since(start) >= 15*lw.CharDelay, "Expected writes to be paced")
+	for i := 1; i < len(rw.writes); i++ {
+		t.Assert(rw.writes[i].at.Sub(rw.writes[i-1].at) >= lw.CharDelay, "Expected a pause between characters")
+	}
+}
+
+func TestSendCommandLineConfig(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	rw := &recordingWriter{}
+	s, err := New(&Config{
+		Socket:         rw,
+		LineTerminator: "\r\n",
+		LineDelay:      time.Millisecond,
+	})
+	t.Ok(err)
+	defer s.Close()
+
+	t.Ok(s.SendCommand("node.heap()"))
+	deadline := time.Now().Add(time.Second)
+	for len(rw.bytes()) < len("node.heap()\r\n") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	t.Equals([]byte("node.heap()\r\n"), rw.bytes())
+}
+
+func TestSendCommandWithoutLineDelay(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	rw := &recordingWriter{}
+	s, err := New(&Config{
+		Socket:    rw,
+		LineDelay: -1,
+	})
+	t.Ok(err)
+	defer s.Close()
+
+	// ten lines at the default delay would take a second
+	start := time.Now()
+	t.Ok(s.SendCommand(strings.Repeat("a=1\n", 10)))
+	t.Assert(time.Since(start) < 5*throttle, "Expected no pause between lines, took %s", time.Since(start))
+}
+
+func TestSetLineTerminator(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	rw := &recordingWriter{}
+	s, err := New(&Config{
+		Socket:    rw,
+		LineDelay: time.Millisecond,
+	})
+	t.Ok(err)
+	defer s.Close()
+
+	send := func(cmd, expected string) {
+		t.Ok(s.SendCommand(cmd))
+		deadline := time.Now().Add(time.Second)
+		for !bytes.HasSuffix(rw.bytes(), []byte(expected)) && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		t.Assert(bytes.HasSuffix(rw.bytes(), []byte(expected)), "Expected %q to be sent, got %q", expected, rw.bytes())
+	}
+
+	t.Equals("\n", s.LineTerminator())
+	send("a=1", "a=1\n")
+
+	s.SetLineTerminator("\r\n")
+	t.Equals("\r\n", s.LineTerminator())
+	send("b=2", "b=2\r\n")
+
+	s.SetLineTerminator("")
+	t.Equals("\n", s.LineTerminator())
+	send("c=3", "c=3\n")
+	t.Equals([]byte("a=1\nb=2\r\nc=3\n"), rw.bytes())
+}
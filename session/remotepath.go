@@ -0,0 +1,17 @@
+package session
+
+import (
+	"path"
+	"strings"
+)
+
+// JoinRemotePath prefixes name with the remote directory dir, producing a
+// device file name. An empty dir or "/" leaves name untouched.
+func JoinRemotePath(dir, name string) string {
+	name = strings.TrimPrefix(name, "/")
+	dir = strings.Trim(dir, "/")
+	if dir == "" {
+		return name
+	}
+	return path.Join(dir, name)
+}
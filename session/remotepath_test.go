@@ -0,0 +1,19 @@
+package session_test
+
+import (
+	"espore/session"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestJoinRemotePath(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	t.Equals("init.lua", session.JoinRemotePath("", "init.lua"))
+	t.Equals("init.lua", session.JoinRemotePath("/", "init.lua"))
+	t.Equals("web/index.html", session.JoinRemotePath("web", "index.html"))
+	t.Equals("web/index.html", session.JoinRemotePath("/web/", "/index.html"))
+	t.Equals("web/css/style.css", session.JoinRemotePath("web", "css/style.css"))
+}
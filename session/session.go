@@ -29,13 +29,29 @@ type Logger interface {
 type Config struct {
 	Socket io.ReadWriteCloser
 	Output io.Writer
+	// LineTerminator ends each command line. Defaults to DefaultLineTerminator.
+	LineTerminator string
+	// LineDelay is the pause after sending each command line. Defaults to
+	// 100ms, a negative value sends lines without pause.
+	LineDelay time.Duration
+	// CharDelay, when set, sends commands one byte at a time with this pause,
+	// for devices whose input buffer overruns
+	CharDelay time.Duration
 }
 
 type Session struct {
 	*bufferedwriter.BufferedWriter
 	*lockreader.LockReader
-	Log  Logger
-	File *fileman.Fileman
+	Log          Logger
+	File         *fileman.Fileman
+	capabilities map[string]bool
+	lineConfig   Config
+	lineLock     sync.Mutex
+	// capabilitiesLock guards capabilities
+	capabilitiesLock sync.Mutex
+	// Progress, when set, is called as the device acknowledges the bytes of
+	// a file being pushed
+	Progress func(dstName string, received, size int64)
 }
 
 type defaultLogger struct{}
@@ -46,7 +62,8 @@ func (dl *defaultLogger) Printf(fmt string, item ...interface{}) {
 
 func New(config *Config) (*Session, error) {
 	s := &Session{
-		Log: &defaultLogger{},
+		Log:        &defaultLogger{},
+		lineConfig: *config,
 	}
 	s.BufferedWriter = bufferedwriter.New(config.Socket)
 	s.LockReader = lockreader.New(config.Socket)
@@ -55,8 +72,36 @@ func New(config *Config) (*Session, error) {
 	return s, nil
 }
 
+// LineTerminator returns the terminator SendCommand appends to each line
+func (s *Session) LineTerminator() string {
+	s.lineLock.Lock()
+	defer s.lineLock.Unlock()
+	if s.lineConfig.LineTerminator == "" {
+		return DefaultLineTerminator
+	}
+	return s.lineConfig.LineTerminator
+}
+
+// SetLineTerminator changes the terminator SendCommand appends to each line.
+// An empty terminator restores DefaultLineTerminator.
+func (s *Session) SetLineTerminator(terminator string) {
+	s.lineLock.Lock()
+	defer s.lineLock.Unlock()
+	s.lineConfig.LineTerminator = terminator
+}
+
 func (s *Session) SendCommand(cmd string) error {
+	s.lineLock.Lock()
+	lineConfig := s.lineConfig
+	s.lineLock.Unlock()
 	sw := NewLineWriter(s)
+	if lineConfig.LineTerminator != "" {
+		sw.Terminator = lineConfig.LineTerminator
+	}
+	if lineConfig.LineDelay != 0 {
+		sw.LineDelay = lineConfig.LineDelay
+	}
+	sw.CharDelay = lineConfig.CharDelay
 	_, err := sw.Write([]byte(cmd))
 	if err != nil {
 		return err
@@ -109,6 +154,7 @@ func (s *Session) pushRuntime(socket io.Reader) error {
 }
 
 func (s *Session) InstallRuntime() error {
+	defer s.resetCapabilities()
 	return s.PushStream(bytes.NewBufferString(EsporeLua), int64(len(EsporeLua)), "__espore.lua")
 }
 
@@ -119,7 +165,24 @@ func (s *Session) startUpload(fname string, size int64) error {
 	return nil
 }
 
+// Format runs the given command to erase the device filesystem and waits for
+// it to complete
+func (s *Session) Format(command string) error {
+	// the runtime and its capabilities must be probed again
+	defer s.resetCapabilities()
+	return s.LockReader.Lock(func(socket io.Reader) error {
+		if err := s.SendCommand(fmt.Sprintf("\n%s\nprint('FORMAT'..'_DONE')\n", command)); err != nil {
+			return err
+		}
+		if _, err := awaitRegex(socket, "FORMAT_DONE$"); err != nil {
+			return errors.New("Formatting the device filesystem failed")
+		}
+		return nil
+	})
+}
+
 func (s *Session) NodeRestart() error {
+	defer s.resetCapabilities()
 	return s.RunCode("node.restart()")
 }
 
@@ -201,6 +264,9 @@ func (s *Session) PushStream(reader io.Reader, size int64, dstName string) error
 					recvErr = fmt.Errorf("Error parsing remaining size: %s", err)
 					return
 				}
+				if s.Progress != nil {
+					s.Progress(dstName, received, size)
+				}
 			}
 		}()
 		wg.Wait()
@@ -280,10 +346,16 @@ func (s *Session) Close() error {
 	return s.SendCommand("\n__espore.finish()\n")
 }
 
+// DeviceIDLua is a Lua expression evaluating to the device id: the id stored
+// in config.json when the device was renamed, or its chip id otherwise
+const DeviceIDLua = `(function() local ok, cfg = pcall(function() return sjson.decode(file.getcontents("config.json")) end) if ok and type(cfg) == "table" and cfg.id then return tostring(cfg.id) end return tostring(node.chipid()) end)()`
+
+// GetChipID returns the id of the device, which is its chip id unless the
+// device was renamed
 func (s *Session) GetChipID() (string, error) {
 	var result string
 	err := s.LockReader.Lock(func(reader io.Reader) error {
-		if err := s.SendCommand("\nprint('i' .. 'd=' .. node.chipid())\n"); err != nil {
+		if err := s.SendCommand("\nprint('i' .. 'd=' .. " + DeviceIDLua + ")\n"); err != nil {
 			return err
 		}
 
@@ -0,0 +1,59 @@
+package session
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+)
+
+// renamedDevice answers the id query like a device renamed to id
+type renamedDevice struct {
+	*io.PipeReader
+	out     *io.PipeWriter
+	id      string
+	pending string
+	lock    sync.Mutex
+}
+
+func newRenamedDevice(id string) *renamedDevice {
+	in, out := io.Pipe()
+	return &renamedDevice{PipeReader: in, out: out, id: id}
+}
+
+func (d *renamedDevice) Write(p []byte) (int, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.pending += string(p)
+	if i := strings.Index(d.pending, DeviceIDLua); i >= 0 {
+		d.pending = d.pending[i+len(DeviceIDLua):]
+		go d.out.Write([]byte("id=" + d.id + "\r\n"))
+	}
+	return len(p), nil
+}
+
+func (d *renamedDevice) Close() error {
+	return d.out.Close()
+}
+
+func TestGetChipIDReadsStoredID(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	device := newRenamedDevice("5678")
+	s, err := New(&Config{Socket: device, LineDelay: time.Millisecond})
+	t.Ok(err)
+	defer device.Close()
+
+	// the stored id is read before falling back to the chip id
+	t.Assert(strings.Contains(DeviceIDLua, `file.getcontents("config.json")`), "Expected the stored id to be read")
+	t.Assert(strings.Contains(DeviceIDLua, "node.chipid()"), "Expected the chip id as fallback")
+	t.Assert(!strings.Contains(DeviceIDLua, "\n"), "Expected a single line expression for the REPL")
+
+	id, err := s.GetChipID()
+	t.Ok(err)
+	t.Equals("5678", id)
+}
@@ -169,6 +169,27 @@ const EsporeLua = `
         nextChunk()
     end
 
+    L.download = function(fname)
+        local f = file.open(fname, "r")
+        if not f then
+            rprint("\nERROR")
+            return
+        end
+        local h = crypto.new_hash("sha1")
+        printLock()
+        rprint("\nBEGIN " .. file.stat(fname).size)
+        local chunk = f:read(96)
+        while chunk ~= nil do
+            h:update(chunk)
+            rprint(encoder.toBase64(chunk))
+            tmr.wdclr()
+            chunk = f:read(96)
+        end
+        f:close()
+        rprint("END " .. encoder.toHex(h:finalize()))
+        printUnlock()
+    end
+
     L.unload = function(packageName)
         package.loaded[packageName] = nil
         _G[packageName] = nil
@@ -201,6 +222,10 @@ const EsporeLua = `
         end
     end
 
+    L.capabilities = function()
+        return {gzip = (zlib ~= nil)}
+    end
+
     __espore = L
     L.start()
 end)()
@@ -4,12 +4,15 @@ import (
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+
+	"github.com/gobwas/glob"
 )
 
 func CopyFile(src, dst string, hashFile bool) (h string, err error) {
@@ -50,7 +53,7 @@ func CopyFile(src, dst string, hashFile bool) (h string, err error) {
 	return h, os.Chmod(dst, srcinfo.Mode())
 }
 
-func enumerateDir(basePath, src string, fileList []string) ([]string, error) {
+func enumerateDir(basePath, src string, fileList []string, excludes []glob.Glob) ([]string, error) {
 	var err error
 	var fds []os.FileInfo
 
@@ -63,20 +66,46 @@ func enumerateDir(basePath, src string, fileList []string) ([]string, error) {
 	}
 	for _, fd := range fds {
 		srcfp := path.Join(src, fd.Name())
+		relPath := path.Join(basePath, fd.Name())
+		if isExcluded(relPath, excludes) {
+			continue
+		}
 
 		if fd.IsDir() {
-			if fileList, err = enumerateDir(path.Join(basePath, fd.Name()), srcfp, fileList); err != nil {
+			if fileList, err = enumerateDir(relPath, srcfp, fileList, excludes); err != nil {
 				return fileList, err
 			}
 		} else {
-			fileList = append(fileList, path.Join(basePath, fd.Name()))
+			fileList = append(fileList, relPath)
 		}
 	}
 	return fileList, nil
 }
 
-func EnumerateDir(src string) ([]string, error) {
-	return enumerateDir("", src, nil)
+// isExcluded returns whether a relative path, or its last element, matches
+// any of the exclude globs
+func isExcluded(relPath string, excludes []glob.Glob) bool {
+	for _, g := range excludes {
+		if g.Match(relPath) || g.Match(path.Base(relPath)) {
+			return true
+		}
+	}
+	return false
+}
+
+// EnumerateDir returns the paths of all files under src, relative to it.
+// Files and directories matching any of the exclude globs, either by their
+// relative path or by name, are skipped without being descended into.
+func EnumerateDir(src string, excludes ...string) ([]string, error) {
+	globs := make([]glob.Glob, len(excludes))
+	for i, pattern := range excludes {
+		g, err := glob.Compile(pattern, '/')
+		if err != nil {
+			return nil, fmt.Errorf("Invalid exclude pattern %q: %s", pattern, err)
+		}
+		globs[i] = g
+	}
+	return enumerateDir("", src, nil, globs)
 }
 
 func copyDir(basePath, src, dst string, fileList []string) ([]string, error) {
@@ -135,7 +164,62 @@ func WriteJSON(path string, item interface{}) error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(path, data, 0666)
+	return WriteFileAtomic(path, data)
+}
+
+// AtomicFile is written to a temporary file in the directory of its
+// destination and renamed into place on Commit, so readers see either the
+// previous file or the complete new one
+type AtomicFile struct {
+	*os.File
+	path string
+}
+
+// CreateAtomic starts writing the file at path
+func CreateAtomic(path string) (*AtomicFile, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &AtomicFile{File: f, path: path}, nil
+}
+
+// Commit closes the file and moves it to its destination
+func (af *AtomicFile) Commit() error {
+	if err := af.Chmod(0644); err != nil {
+		af.Abort()
+		return err
+	}
+	if err := af.Close(); err != nil {
+		os.Remove(af.Name())
+		return err
+	}
+	if err := os.Rename(af.Name(), af.path); err != nil {
+		os.Remove(af.Name())
+		return err
+	}
+	return nil
+}
+
+// Abort discards the file, leaving the destination untouched. It does nothing
+// once the file is committed, so it can be deferred.
+func (af *AtomicFile) Abort() {
+	if af.Close() == nil {
+		os.Remove(af.Name())
+	}
+}
+
+// WriteFileAtomic replaces the file at path with data, see AtomicFile
+func WriteFileAtomic(path string, data []byte) error {
+	af, err := CreateAtomic(path)
+	if err != nil {
+		return err
+	}
+	if _, err := af.Write(data); err != nil {
+		af.Abort()
+		return err
+	}
+	return af.Commit()
 }
 
 func RemoveDirContents(dir string) error {
@@ -0,0 +1,97 @@
+package utils_test
+
+import (
+	"espore/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestHashFile(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, err := ioutil.TempDir("", "espore-hash")
+	t.Ok(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hello.txt")
+	t.Ok(ioutil.WriteFile(path, []byte("hello"), 0644))
+
+	hash, err := utils.HashFile(path)
+	t.Ok(err)
+	t.Equals("aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d", hash)
+
+	_, err = utils.HashFile(filepath.Join(dir, "missing.txt"))
+	t.Assert(err != nil, "Expected error hashing a missing file")
+}
+
+func TestEnumerateDirExcludes(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, err := ioutil.TempDir("", "espore-enum")
+	t.Ok(err)
+	defer os.RemoveAll(dir)
+
+	for _, f := range []string{"main.lua", "build.tmp", "lib/util.lua", "lib/cache.tmp", "lib/.git/HEAD", ".git/config"} {
+		p := filepath.Join(dir, filepath.FromSlash(f))
+		t.Ok(os.MkdirAll(filepath.Dir(p), 0755))
+		t.Ok(ioutil.WriteFile(p, []byte("x"), 0644))
+	}
+
+	list, err := utils.EnumerateDir(dir)
+	t.Ok(err)
+	t.Equals(6, len(list))
+
+	list, err = utils.EnumerateDir(dir, "*.tmp", ".git")
+	t.Ok(err)
+	sort.Strings(list)
+	t.Equals([]string{"lib/util.lua", "main.lua"}, list)
+
+	_, err = utils.EnumerateDir(dir, "[")
+	t.Assert(err != nil, "Expected an error for an invalid pattern")
+}
+
+func TestAtomicFile(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, err := ioutil.TempDir("", "espore-atomic")
+	t.Ok(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dev.json")
+	t.Ok(utils.WriteJSON(path, map[string]int{"version": 1}))
+
+	af, err := utils.CreateAtomic(path)
+	t.Ok(err)
+	_, err = af.Write([]byte(`{"version": `))
+	t.Ok(err)
+	// readers still see the previous file while the new one is written
+	var current map[string]int
+	t.Ok(utils.ReadJSON(path, &current))
+	t.Equals(1, current["version"])
+	_, err = af.Write([]byte(`2}`))
+	t.Ok(err)
+	t.Ok(af.Commit())
+	af.Abort()
+	t.Ok(utils.ReadJSON(path, &current))
+	t.Equals(2, current["version"])
+
+	af, err = utils.CreateAtomic(path)
+	t.Ok(err)
+	_, err = af.Write([]byte("{"))
+	t.Ok(err)
+	af.Abort()
+	t.Ok(utils.ReadJSON(path, &current))
+	t.Equals(2, current["version"])
+
+	files, err := ioutil.ReadDir(dir)
+	t.Ok(err)
+	t.Equals(1, len(files))
+}